@@ -0,0 +1,191 @@
+// Package baseline learns the normal host flows of a host, and reports the flows
+// deviating from them, such as unexpected new destinations after a deploy.
+package baseline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// Kinds of Anomaly.
+const (
+	// AnomalyNew is a flow which is not in the baseline.
+	AnomalyNew = "new"
+	// AnomalyConnections is a flow whose connections are out of the range learned
+	// in the baseline beyond the tolerance.
+	AnomalyConnections = "connections"
+	// AnomalyMissing is a flow which was present in every sample of the baseline, but is not now.
+	AnomalyMissing = "missing"
+)
+
+// Baseline is the host flows learned from the samples collected over a period.
+type Baseline struct {
+	Hostname     string    `json:"hostname"`
+	LearnedFrom  time.Time `json:"learned_from"`
+	LearnedUntil time.Time `json:"learned_until"`
+	// Samples is the number of the collections learned.
+	Samples int      `json:"samples"`
+	Flows   []*Entry `json:"flows"`
+
+	entries map[string]*Entry
+}
+
+// Entry is a flow of the baseline, which is keyed on HostFlow.UniqKey().
+type Entry struct {
+	Key            string                `json:"key"`
+	Direction      tcpflow.FlowDirection `json:"direction"`
+	Local          *tcpflow.AddrPort     `json:"local"`
+	Peer           *tcpflow.AddrPort     `json:"peer"`
+	MinConnections int64                 `json:"min_connections"`
+	MaxConnections int64                 `json:"max_connections"`
+	// Seen is the number of the samples containing the flow.
+	Seen int `json:"seen"`
+}
+
+// New returns the empty baseline of the host.
+func New() *Baseline {
+	hostname, _ := os.Hostname()
+	return &Baseline{Hostname: hostname, Flows: []*Entry{}, entries: map[string]*Entry{}}
+}
+
+// Learn adds the flows collected at 'at' as a sample.
+func (b *Baseline) Learn(flows tcpflow.HostFlows, at time.Time) {
+	at = at.UTC()
+	if b.Samples == 0 {
+		b.LearnedFrom = at
+	}
+	b.LearnedUntil = at
+	b.Samples++
+	for _, flow := range flows {
+		key := flow.UniqKey()
+		ent, ok := b.entries[key]
+		if !ok {
+			ent = &Entry{
+				Key:            key,
+				Direction:      flow.Direction,
+				Local:          flow.Local,
+				Peer:           flow.Peer,
+				MinConnections: flow.Connections,
+				MaxConnections: flow.Connections,
+			}
+			b.entries[key] = ent
+			b.Flows = append(b.Flows, ent)
+		}
+		if flow.Connections < ent.MinConnections {
+			ent.MinConnections = flow.Connections
+		}
+		if flow.Connections > ent.MaxConnections {
+			ent.MaxConnections = flow.Connections
+		}
+		ent.Seen++
+	}
+	sort.Slice(b.Flows, func(i, j int) bool {
+		return b.Flows[i].Key < b.Flows[j].Key
+	})
+}
+
+// Load loads the baseline from the JSON file written by Save.
+func Load(path string) (*Baseline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", path, err)
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, xerrors.Errorf("could not parse %s: %w", path, err)
+	}
+	b.entries = make(map[string]*Entry, len(b.Flows))
+	for _, ent := range b.Flows {
+		if ent.Local == nil || ent.Peer == nil {
+			return nil, xerrors.Errorf("flow %q without local or peer address in %s", ent.Key, path)
+		}
+		b.entries[ent.Key] = ent
+	}
+	return &b, nil
+}
+
+// Save writes the baseline into the JSON file.
+func (b *Baseline) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("failed to marshal json: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return xerrors.Errorf("could not write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Anomaly is a flow deviating from the baseline.
+type Anomaly struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Flow is the flow collected now, which is nil for AnomalyMissing.
+	Flow *tcpflow.HostFlow `json:"flow,omitempty"`
+	// Baseline is the flow in the baseline, which is nil for AnomalyNew.
+	Baseline *Entry `json:"baseline,omitempty"`
+}
+
+// String returns the string representation of Anomaly.
+func (a *Anomaly) String() string {
+	return fmt.Sprintf("[%s] %s", a.Kind, a.Message)
+}
+
+// Check returns the flows deviating from the baseline in the order of the flows.
+// The connections of a flow are anomalous if they are out of the range learned in
+// the baseline by more than 'tolerance', such as 0.5 for 50%.
+func (b *Baseline) Check(flows tcpflow.HostFlows, tolerance float64) []*Anomaly {
+	var anomalies []*Anomaly
+	present := make(map[string]bool, len(flows))
+	for _, flow := range flows.Sorted() {
+		present[flow.UniqKey()] = true
+		ent, ok := b.entries[flow.UniqKey()]
+		if !ok {
+			anomalies = append(anomalies, &Anomaly{
+				Kind:    AnomalyNew,
+				Message: fmt.Sprintf("%s is not in the baseline", describe(flow.Local, flow.Direction, flow.Peer, flow.Connections)),
+				Flow:    flow,
+			})
+			continue
+		}
+		lower := float64(ent.MinConnections) * (1 - tolerance)
+		upper := float64(ent.MaxConnections) * (1 + tolerance)
+		if n := float64(flow.Connections); n < lower || n > upper {
+			anomalies = append(anomalies, &Anomaly{
+				Kind: AnomalyConnections,
+				Message: fmt.Sprintf("%s is out of %d-%d connections in the baseline",
+					describe(flow.Local, flow.Direction, flow.Peer, flow.Connections), ent.MinConnections, ent.MaxConnections),
+				Flow:     flow,
+				Baseline: ent,
+			})
+		}
+	}
+	for _, ent := range b.Flows {
+		if ent.Seen < b.Samples {
+			continue
+		}
+		if present[ent.Key] {
+			continue
+		}
+		anomalies = append(anomalies, &Anomaly{
+			Kind: AnomalyMissing,
+			Message: fmt.Sprintf("%s %s %s was present in every sample of the baseline, but is not now",
+				ent.Local, ent.Direction.Arrow(), ent.Peer),
+			Baseline: ent,
+		})
+	}
+	return anomalies
+}
+
+// describe returns the description of the flow such as "10.0.1.9:many --> 8.8.8.8:443 (3 connections)".
+func describe(local *tcpflow.AddrPort, direction tcpflow.FlowDirection, peer *tcpflow.AddrPort, connections int64) string {
+	return fmt.Sprintf("%s %s %s (%d connections)", local, direction.Arrow(), peer, connections)
+}
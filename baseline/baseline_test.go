@@ -0,0 +1,84 @@
+package baseline
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestBaseline(t *testing.T) {
+	local := netip.MustParseAddr("10.0.1.9")
+	mysql := func(n int64) *tcpflow.HostFlow {
+		return &tcpflow.HostFlow{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(local),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: n,
+		}
+	}
+	ssh := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowPassive,
+		Local:       tcpflow.NewAddrPort(local, 22),
+		Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.2.13")),
+		Connections: 1,
+	}
+	public := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowActive,
+		Local:       tcpflow.NewWildcardAddrPort(local),
+		Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("8.8.8.8"), 443),
+		Connections: 3,
+	}
+
+	b := New()
+	at := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	b.Learn(tcpflow.HostFlows{"2-10.0.1.9:many-10.0.1.10:3306": mysql(10), "4-10.0.1.9:22-10.0.2.13:many": ssh}, at)
+	b.Learn(tcpflow.HostFlows{"2-10.0.1.9:many-10.0.1.10:3306": mysql(20)}, at.Add(time.Minute))
+	if b.Samples != 2 || len(b.Flows) != 2 || !b.LearnedUntil.Equal(at.Add(time.Minute)) {
+		t.Fatalf("baseline should have 2 flows in 2 samples, got %+v", b)
+	}
+
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := b.Save(path); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	if anomalies := loaded.Check(tcpflow.HostFlows{"2-10.0.1.9:many-10.0.1.10:3306": mysql(28)}, 0.5); len(anomalies) != 0 {
+		t.Errorf("connections within the tolerance should not be anomalous, got %v", anomalies)
+	}
+
+	anomalies := loaded.Check(tcpflow.HostFlows{"2-10.0.1.9:many-10.0.1.10:3306": mysql(31), "2-10.0.1.9:many-8.8.8.8:443": public}, 0.5)
+	want := []struct {
+		kind    string
+		message string
+	}{
+		{AnomalyNew, "10.0.1.9:many --> 8.8.8.8:443 (3 connections) is not in the baseline"},
+		{AnomalyConnections, "10.0.1.9:many --> 10.0.1.10:3306 (31 connections) is out of 10-20 connections in the baseline"},
+	}
+	if len(anomalies) != len(want) {
+		t.Fatalf("anomalies should be len == %d, got %d: %v", len(want), len(anomalies), anomalies)
+	}
+	for i, w := range want {
+		if a := anomalies[i]; a.Kind != w.kind || a.Message != w.message {
+			t.Errorf("anomaly #%d should be [%s] %s, got %s", i, w.kind, w.message, a)
+		}
+	}
+
+	// the flow seen in every sample is missing.
+	anomalies = loaded.Check(tcpflow.HostFlows{"4-10.0.1.9:22-10.0.2.13:many": ssh}, 0.5)
+	if len(anomalies) != 1 || anomalies[0].Kind != AnomalyMissing {
+		t.Errorf("mysql flow should be missing, got %v", anomalies)
+	}
+}
+
+func TestLoad_error(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "none.json")); err == nil {
+		t.Error("should raise error for the file not found")
+	}
+}
@@ -2,13 +2,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/netip"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -17,6 +22,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/netutil"
 	"github.com/yuuki/lstf/tcpflow"
 )
 
@@ -24,7 +30,7 @@ const (
 	exitCodeOK  = 0
 	exitCodeErr = 10 + iota
 
-	defaultWatchDurationSec = 3
+	defaultWatchInterval = 3 * time.Second
 )
 
 var (
@@ -52,6 +58,21 @@ type CLI struct {
 	// outStream and errStream are the stdout and stderr
 	// to write message from the CLI.
 	outStream, errStream io.Writer
+
+	// flags is the flag set of the command run last, which is read to generate
+	// the shell completion.
+	flags *flag.FlagSet
+}
+
+// newFlagSet returns the flag set of the command, which prints 'help' as the usage.
+func (c *CLI) newFlagSet(cmd string, help string) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	flags.SetOutput(c.errStream)
+	flags.Usage = func() {
+		fmt.Fprint(c.errStream, help)
+	}
+	c.flags = flags
+	return flags
 }
 
 // Run execute the main process.
@@ -59,98 +80,477 @@ type CLI struct {
 func (c *CLI) Run(args []string) int {
 	log.SetOutput(c.errStream)
 
+	// 'lstf [options]' is 'lstf flows [options]'.
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		return c.runFlows("", args)
+	}
+	cmd := lookupCommand(args[1])
+	if cmd == nil {
+		fmt.Fprintf(c.errStream, "unknown command '%s' (see 'lstf help')\n", args[1])
+		return exitCodeErr
+	}
+	return cmd.run(c, args[1:])
+}
+
+// runFlows executes 'lstf flows' and 'lstf watch' subcommands, or lstf without
+// a subcommand if 'cmd' is empty.
+func (c *CLI) runFlows(cmd string, args []string) int {
+	opt, ret := c.parseFlows(cmd, args)
+	if opt == nil {
+		return ret
+	}
+	if opt.interval == 0 { // no watch option
+		return c.run(context.Background(), opt)
+	}
+	return c.watch(cmd, args, opt)
+}
+
+// parseFlows parses the arguments of runFlows into the options to print host flows.
+// It returns nil with the exit code if there are no flows to print, such as --help.
+func (c *CLI) parseFlows(cmd string, args []string) (*listOption, int) {
 	var (
 		numeric   bool
 		processes bool
-		watch     int
+		detail    bool
+		interval  intervalValue
+		count     int
+		seen      bool
 		json      bool
+		envelope  bool
+		ndjson    bool
 		filter    string
+		catalog   string
+		clouds    []string
+		groupBy   string
+		resolver  string
+		profile   string
+		source    string
+		procRoot  string
+		pcapFile  string
+		locals    []string
+		timeout   time.Duration
 
 		ver     bool
 		credits bool
 		debug   bool
 	)
-	flags := flag.NewFlagSet(name, flag.ContinueOnError)
-	flags.SetOutput(c.errStream)
-	flags.Usage = func() {
-		fmt.Fprint(c.errStream, helpText)
+	flagSetName, usage := name, helpText
+	switch cmd {
+	case "flows":
+		flagSetName, usage = name+" flows", flowsHelpText
+	case "watch":
+		flagSetName, usage = name+" watch", watchHelpText
 	}
+	flags := c.newFlagSet(flagSetName, usage)
 	flags.BoolVarP(&numeric, "numeric", "n", false, "")
 	flags.BoolVarP(&processes, "processes", "p", false, "")
-	flags.IntVarP(&watch, "watch", "w", 0, "")
-	flags.Lookup("watch").NoOptDefVal = fmt.Sprint(defaultWatchDurationSec)
+	flags.BoolVar(&detail, "detail", false, "")
+	flags.BoolVar(&detail, "connections", false, "")
+	if cmd == "watch" {
+		interval = intervalValue(defaultWatchInterval)
+		flags.VarP(&interval, "interval", "i", "")
+	} else {
+		flags.VarP(&interval, "watch", "w", "")
+		flags.Lookup("watch").NoOptDefVal = defaultWatchInterval.String()
+	}
+	flags.IntVar(&count, "count", 0, "")
+	flags.BoolVar(&seen, "seen", false, "")
 	flags.BoolVar(&json, "json", false, "")
+	flags.BoolVar(&envelope, "json-envelope", false, "")
+	flags.BoolVar(&ndjson, "ndjson", false, "")
 	flags.StringVarP(&filter, "filter", "f", tcpflow.FilterAll, "")
-	flags.BoolVar(&ver, "version", false, "")
-	flags.BoolVar(&credits, "credits", false, "")
+	flags.StringVar(&catalog, "catalog", "", "")
+	flags.StringSliceVar(&clouds, "cloud-ranges", nil, "")
+	flags.StringVarP(&groupBy, "group-by", "g", "", "")
+	flags.StringVar(&resolver, "resolver", "", "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.StringVar(&procRoot, "proc-root", "", "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	if cmd != "watch" {
+		flags.StringVar(&pcapFile, "pcap", "", "")
+		flags.StringSliceVar(&locals, "local", nil, "")
+	}
+	if cmd == "" {
+		flags.BoolVar(&ver, "version", false, "")
+		flags.BoolVar(&credits, "credits", false, "")
+	}
 	flags.BoolVar(&debug, "debug", false, "")
 	if err := flags.Parse(args[1:]); err != nil {
-		return exitCodeErr
+		return nil, exitCodeErr
 	}
 
 	setDebugOutputLevel(debug)
 
+	watch := time.Duration(interval)
+	if watch < 0 || (cmd == "watch" && watch == 0) {
+		fmt.Fprintf(c.errStream, "invalid interval '%s'\n", watch)
+		return nil, exitCodeErr
+	}
+	if count < 0 {
+		fmt.Fprintf(c.errStream, "invalid count '%d'\n", count)
+		return nil, exitCodeErr
+	}
+	if timeout < 0 {
+		fmt.Fprintf(c.errStream, "invalid timeout '%s'\n", timeout)
+		return nil, exitCodeErr
+	}
+
 	if ver {
-		fmt.Fprintf(c.errStream, "%s version %s, build %s, date %s \n", name, version, commit, date)
-		return exitCodeOK
+		c.printVersion()
+		return nil, exitCodeOK
 	}
 
 	if credits {
 		fmt.Fprintln(c.outStream, creditsText)
-		return exitCodeOK
+		return nil, exitCodeOK
 	}
 
-	if !(filter == tcpflow.FilterAll ||
-		filter == tcpflow.FilterPublic ||
-		filter == tcpflow.FilterPrivate) {
-		fmt.Fprint(c.errStream, helpText)
-		return exitCodeErr
+	p, err := applyProfile(flags, profile)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return nil, exitCodeErr
+	}
+	if resolver != "" {
+		netutil.SetResolver(resolver)
+	}
+
+	// the networks of the profile take precedence over the networks of the catalog file.
+	list, err := p.NetworkList()
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return nil, exitCodeErr
+	}
+	if catalog != "" {
+		cat, err := netutil.LoadCatalog(catalog)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return nil, exitCodeErr
+		}
+		list = append(list, cat.Networks()...)
+	}
+	var networks *netutil.Catalog
+	if len(list) > 0 {
+		networks = netutil.NewCatalog(list)
+	}
+
+	var cloudRanges *netutil.CloudRanges
+	if len(clouds) > 0 {
+		var err error
+		cloudRanges, err = netutil.LoadCloudRanges(clouds...)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return nil, exitCodeErr
+		}
+	}
+
+	if (filter == tcpflow.FilterCloud || strings.HasPrefix(filter, tcpflow.FilterCloud+":")) && cloudRanges == nil {
+		fmt.Fprintln(c.errStream, "--filter cloud requires --cloud-ranges")
+		return nil, exitCodeErr
+	}
+	if !(&tcpflow.GetHostFlowsOption{Filter: filter, Catalog: networks, CloudRanges: cloudRanges}).ValidFilter() {
+		fmt.Fprint(c.errStream, usage)
+		return nil, exitCodeErr
+	}
+
+	if procRoot != "" {
+		// only procfs can read the files under the directory.
+		switch source {
+		case tcpflow.SourceAuto:
+			source = "procfs"
+		case "procfs":
+		default:
+			fmt.Fprintf(c.errStream, "--proc-root cannot be used with %s source\n", source)
+			return nil, exitCodeErr
+		}
+		if seen {
+			fmt.Fprintln(c.errStream, "--seen cannot be used with --proc-root")
+			return nil, exitCodeErr
+		}
+	}
+
+	var grouping *tcpflow.Grouping
+	if groupBy != "" {
+		var err error
+		grouping, err = tcpflow.ParseGrouping(groupBy)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return nil, exitCodeErr
+		}
+		switch {
+		case grouping.Kind == tcpflow.GroupByDomain && numeric:
+			fmt.Fprintln(c.errStream, "--group-by domain cannot be used with --numeric")
+			return nil, exitCodeErr
+		case grouping.Kind == tcpflow.GroupByProcess && !processes:
+			fmt.Fprintln(c.errStream, "--group-by process requires --processes")
+			return nil, exitCodeErr
+		}
+	}
+
+	var src tcpflow.FlowSource
+	if pcapFile != "" {
+		if procRoot != "" || source != tcpflow.SourceAuto {
+			fmt.Fprintln(c.errStream, "--pcap cannot be used with --source or --proc-root")
+			return nil, exitCodeErr
+		}
+		if watch != 0 {
+			fmt.Fprintln(c.errStream, "--pcap cannot be used with --watch")
+			return nil, exitCodeErr
+		}
+		if len(locals) == 0 {
+			fmt.Fprintln(c.errStream, "--pcap requires --local with the addresses of the captured host")
+			return nil, exitCodeErr
+		}
+		ips := make([]netip.Addr, 0, len(locals))
+		for _, local := range locals {
+			ip, err := netip.ParseAddr(local)
+			if err != nil {
+				fmt.Fprintf(c.errStream, "invalid --local address '%s'\n", local)
+				return nil, exitCodeErr
+			}
+			ips = append(ips, ip)
+		}
+		src = tcpflow.NewPcapSource(pcapFile, ips)
+	} else {
+		if len(locals) > 0 {
+			fmt.Fprintln(c.errStream, "--local requires --pcap")
+			return nil, exitCodeErr
+		}
+		var err error
+		src, err = tcpflow.NewFlowSource(source)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return nil, exitCodeErr
+		}
 	}
 
 	if err := setRLimitNoFile(); err != nil {
 		fmt.Fprintf(c.errStream, "%v", err)
-		return exitCodeErr
+		return nil, exitCodeErr
 	}
 
 	if watch == 0 { // no watch option
-		return c.run(processes, numeric, json, filter)
+		if seen {
+			fmt.Fprintln(c.errStream, "--seen requires --watch")
+			return nil, exitCodeErr
+		}
+		if count > 0 {
+			fmt.Fprintln(c.errStream, "--count requires --watch")
+			return nil, exitCodeErr
+		}
+	}
+	if seen {
+		if name := src.Name(); name != tcpflow.SourceAuto && name != "netlink" {
+			fmt.Fprintf(c.errStream, "--seen cannot be used with %s source\n", name)
+			return nil, exitCodeErr
+		}
 	}
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
-	defer signal.Stop(sig)
-
-	tick := time.NewTicker(time.Duration(watch) * time.Second)
-	defer tick.Stop()
+	return &listOption{
+		numeric:   numeric,
+		processes: processes,
+		sockets:   detail,
+		json:      json || envelope || ndjson,
+		envelope:  envelope,
+		ndjson:    ndjson,
+		source:    src.Name(),
+		filter:    filter,
+		catalog:   networks,
+		clouds:    cloudRanges,
+		grouping:  grouping,
+		procRoot:  procRoot,
+		timeout:   timeout,
+		interval:  watch,
+		count:     count,
+		seen:      seen,
+		getFlows:  src.GetHostFlows,
+	}, exitCodeOK
+}
 
-	fmt.Fprintf(c.outStream, "-- %s -- \n", time.Now().Format("15:04:05")) // print timestamp
-	ret := c.run(processes, numeric, json, filter)
-	if ret != exitCodeOK {
-		return ret
+// watch prints host flows every opt.interval until SIGINT or SIGTERM, or opt.count times.
+// The schedule does not drift by the collection time, and the intervals overrun by a
+// slow collection are skipped with a warning. SIGHUP reloads the configuration.
+func (c *CLI) watch(cmd string, args []string, opt *listOption) int {
+	if opt.seen {
+		watcher, err := tcpflow.NewWatcher()
+		if err != nil {
+			log.Printf("failed to watch closed connections: %v\n", err)
+			return exitCodeErr
+		}
+		defer watcher.Close()
+		opt.getFlows = watcher.GetHostFlows
 	}
-	fmt.Fprintln(c.outStream) // print newline
 
-	for {
-		select {
-		case now := <-tick.C:
-			fmt.Fprintf(c.outStream, "-- %s -- \n", now.Format("15:04:05")) // print timestamp
-			ret := c.run(processes, numeric, json, filter)
-			if ret != exitCodeOK {
-				return ret
-			}
+	// the signal also interrupts the collection in progress.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	timestamp := "15:04:05"
+	if opt.interval < time.Second {
+		timestamp = "15:04:05.000"
+	}
+	next := time.Now()
+	for n := 1; ; n++ {
+		start := time.Now()
+		// json output is printed one per line without the timestamp to keep the stream parseable.
+		if !opt.json {
+			fmt.Fprintf(c.outStream, "-- %s -- \n", start.Format(timestamp)) // print timestamp
+		}
+		ret := c.run(ctx, opt)
+		if ret != exitCodeOK || ctx.Err() != nil {
+			return ret
+		}
+		if !opt.json {
 			fmt.Fprintln(c.outStream) // print newline
-		case <-sig:
+		}
+		if opt.count > 0 && n >= opt.count {
 			return exitCodeOK
 		}
+
+		next = c.nextSchedule(next, opt.interval, start, "collection")
+		timer := time.NewTimer(time.Until(next))
+		for waiting := true; waiting; {
+			select {
+			case <-timer.C:
+				waiting = false
+			case <-hup:
+				opt = c.reloadFlows(cmd, args, opt)
+			case <-ctx.Done():
+				timer.Stop()
+				return exitCodeOK
+			}
+		}
+	}
+}
+
+// reloadFlows parses the arguments again with the config files, the catalog and the
+// cloud ranges reloaded. The interval, the count and --seen are kept as they were,
+// and so is 'opt' if the configuration is invalid.
+func (c *CLI) reloadFlows(cmd string, args []string, opt *listOption) *listOption {
+	reloaded, _ := c.parseFlows(cmd, args)
+	if reloaded == nil {
+		fmt.Fprintln(c.errStream, "warning: failed to reload the configuration, so that the previous one is kept")
+		return opt
+	}
+	reloaded.interval, reloaded.count, reloaded.seen = opt.interval, opt.count, opt.seen
+	if opt.seen {
+		reloaded.getFlows = opt.getFlows
+	}
+	log.Println("reloaded the configuration")
+	return reloaded
+}
+
+// nextWatchTime returns the time of the next collection scheduled every interval after
+// 'prev', which is the scheduled time of the last collection, and the number of the
+// collections skipped because the last collection has not finished until 'now'.
+func nextWatchTime(prev time.Time, interval time.Duration, now time.Time) (time.Time, int) {
+	next := prev.Add(interval)
+	if !now.After(next) {
+		return next, 0
+	}
+	skipped := int(now.Sub(next)/interval) + 1
+	return next.Add(time.Duration(skipped) * interval), skipped
+}
+
+// nextSchedule returns the time of the next run of the task by nextWatchTime, and warns
+// the runs skipped because the run started at 'start' has overrun the interval.
+func (c *CLI) nextSchedule(prev time.Time, interval time.Duration, start time.Time, task string) time.Time {
+	next, skipped := nextWatchTime(prev, interval, time.Now())
+	if skipped > 0 {
+		fmt.Fprintf(c.errStream, "warning: the %s took %s, longer than the interval %s, so that %d %ss have been skipped\n",
+			task, time.Since(start).Round(time.Millisecond), interval, skipped, task)
+	}
+	return next
+}
+
+// sleepUntil waits until 't', and reports whether ctx is still not done.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// intervalValue is the flag value of the interval of watch mode, which is a duration
+// such as '500ms', or the seconds as an integer such as '3' for compatibility.
+type intervalValue time.Duration
+
+func (v *intervalValue) Set(s string) error {
+	if sec, err := strconv.Atoi(s); err == nil {
+		*v = intervalValue(time.Duration(sec) * time.Second)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return xerrors.New("should be a duration such as '500ms' or the seconds such as '3'")
 	}
+	*v = intervalValue(d)
+	return nil
+}
+
+func (v *intervalValue) String() string {
+	return time.Duration(*v).String()
 }
 
-func (c *CLI) run(processes, numeric, json bool, filter string) int {
-	flows, err := tcpflow.GetHostFlows(&tcpflow.GetHostFlowsOption{
-		Processes: processes,
-		Filter:    filter,
-		Numeric:   numeric,
+func (v *intervalValue) Type() string {
+	return "duration"
+}
+
+// listOption represents the options to print host flows.
+type listOption struct {
+	numeric   bool
+	processes bool
+	sockets   bool
+	json      bool
+	envelope  bool
+	ndjson    bool
+	source    string
+	filter    string
+	catalog   *netutil.Catalog
+	clouds    *netutil.CloudRanges
+	grouping  *tcpflow.Grouping
+	procRoot  string
+	timeout   time.Duration
+
+	// interval is the interval of watch mode, which is zero without watch.
+	interval time.Duration
+	// count is the number of the collections of watch mode, which is unlimited if zero.
+	count int
+	seen  bool
+
+	getFlows func(context.Context, *tcpflow.GetHostFlowsOption) (tcpflow.HostFlows, error)
+}
+
+// run collects and prints host flows. The collection is limited by opt.timeout,
+// and nothing is printed if 'ctx' is done, such as by the interrupt in watch mode.
+func (c *CLI) run(ctx context.Context, opt *listOption) int {
+	collectCtx, cancel := withTimeout(ctx, opt.timeout)
+	defer cancel()
+	var warnings []*tcpflow.Warning
+	collectedAt := time.Now()
+	flows, err := opt.getFlows(collectCtx, &tcpflow.GetHostFlowsOption{
+		Processes:   opt.processes,
+		Filter:      opt.filter,
+		Catalog:     opt.catalog,
+		CloudRanges: opt.clouds,
+		Numeric:     opt.numeric,
+		Sockets:     opt.sockets,
+		ProcRoot:    opt.procRoot,
+		OnWarning: func(w *tcpflow.Warning) {
+			warnings = append(warnings, w)
+		},
 	})
+	if ctx.Err() != nil {
+		return exitCodeOK
+	}
+	c.printWarnings(warnings)
 	if err != nil {
 		if dlog.Debug {
 			log.Printf("failed to get host flows: %+v\n", err)
@@ -159,20 +559,67 @@ func (c *CLI) run(processes, numeric, json bool, filter string) int {
 		}
 		return exitCodeErr
 	}
+	if opt.grouping != nil {
+		flows = flows.GroupBy(opt.grouping)
+	}
+	if opt.catalog != nil {
+		flows.Annotate(opt.catalog)
+	}
+	if opt.clouds != nil {
+		flows.AnnotateCloud(opt.clouds)
+	}
 
-	if json {
+	if opt.ndjson {
+		if err := c.PrintHostFlowsAsNDJSON(flows, collectedAt); err != nil {
+			log.Printf("failed to print json: %v\n", err)
+			return exitCodeErr
+		}
+	} else if opt.envelope {
+		if err := c.PrintHostFlowsAsEnvelope(flows, opt.source, collectedAt); err != nil {
+			log.Printf("failed to print json: %v\n", err)
+			return exitCodeErr
+		}
+	} else if opt.json {
 		if err := c.PrintHostFlowsAsJSON(flows); err != nil {
 			log.Printf("failed to print json: %v\n", err)
 			return exitCodeErr
 		}
 	} else {
-		c.PrintHostFlows(flows, processes)
+		c.PrintHostFlows(flows, opt.processes)
 	}
 
 	return exitCodeOK
 }
 
-// PrintHostFlows prints the host flows.
+// withTimeout returns the context limited by the timeout, or not limited if the timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// printWarnings prints the warnings into errStream.
+// Each process that could not be inspected is printed only in debug mode.
+func (c *CLI) printWarnings(warnings []*tcpflow.Warning) {
+	var procs int
+	for _, w := range warnings {
+		switch w.Kind {
+		case tcpflow.WarningProcScan:
+			procs++
+			if dlog.Debug {
+				fmt.Fprintf(c.errStream, "warning: %s\n", w)
+			}
+		default:
+			fmt.Fprintf(c.errStream, "warning: %s\n", w)
+		}
+	}
+	if procs > 0 && !dlog.Debug {
+		fmt.Fprintf(c.errStream, "warning: %d processes could not be inspected (use --debug for details)\n", procs)
+	}
+}
+
+// PrintHostFlows prints the host flows. The sockets of each flow are printed as a tree under it.
 func (c *CLI) PrintHostFlows(flows tcpflow.HostFlows, processes bool) {
 	// Format in tab-separated columns with a tab stop of 8.
 	tw := tabwriter.NewWriter(c.outStream, 0, 8, 0, '\t', 0)
@@ -183,6 +630,21 @@ func (c *CLI) PrintHostFlows(flows tcpflow.HostFlows, processes bool) {
 	fmt.Fprintln(tw)
 	for _, flow := range flows {
 		fmt.Fprintln(tw, flow)
+		sockets := make([]*tcpflow.Socket, len(flow.Sockets))
+		copy(sockets, flow.Sockets)
+		sort.Slice(sockets, func(i, j int) bool {
+			if sockets[i].Local != sockets[j].Local {
+				return sockets[i].Local.String() < sockets[j].Local.String()
+			}
+			return sockets[i].Peer.String() < sockets[j].Peer.String()
+		})
+		for i, s := range sockets {
+			branch := "|-"
+			if i == len(sockets)-1 {
+				branch = "`-"
+			}
+			fmt.Fprintf(tw, "  %s %s\n", branch, s)
+		}
 	}
 	tw.Flush()
 }
@@ -193,7 +655,33 @@ func (c *CLI) PrintHostFlowsAsJSON(flows tcpflow.HostFlows) error {
 	if err != nil {
 		return xerrors.Errorf("failed to marshal json: %v", err)
 	}
-	c.outStream.Write(b)
+	fmt.Fprintf(c.outStream, "%s\n", b)
+	return nil
+}
+
+// PrintHostFlowsAsEnvelope prints the host flows as json format wrapped with the metadata.
+// The format is described by schema/envelope.schema.json.
+func (c *CLI) PrintHostFlowsAsEnvelope(flows tcpflow.HostFlows, source string, collectedAt time.Time) error {
+	b, err := json.Marshal(tcpflow.NewEnvelope(flows, source, version, collectedAt))
+	if err != nil {
+		return xerrors.Errorf("failed to marshal json: %v", err)
+	}
+	fmt.Fprintf(c.outStream, "%s\n", b)
+	return nil
+}
+
+// PrintHostFlowsAsNDJSON prints each host flow as a line of json format with the metadata.
+// The format of a line is described by schema/flow-record.schema.json.
+func (c *CLI) PrintHostFlowsAsNDJSON(flows tcpflow.HostFlows, collectedAt time.Time) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range tcpflow.NewFlowRecords(flows, collectedAt) {
+		if err := enc.Encode(record); err != nil {
+			return xerrors.Errorf("failed to marshal json: %v", err)
+		}
+	}
+	// write the lines at once not to interleave a partial snapshot into the stream.
+	c.outStream.Write(buf.Bytes())
 	return nil
 }
 
@@ -218,17 +706,109 @@ func setRLimitNoFile() error {
 }
 
 var helpText = `Usage: lstf [options]
+       lstf COMMAND [options]
+
+  Print TCP flows between localhost and other hosts, which is 'lstf flows'.
+
+Commands:
+  flows       print TCP flows between localhost and other hosts
+  watch       print TCP flows periodically
+  listen      print the local listening ports
+  top         show TCP flows in the interactive terminal UI
+  trace       trace short-lived connections by eBPF
+  snapshot    archive the procfs files of the host to analyze it after the fact
+  agent       push TCP flows to remote collectors periodically
+  daemon      serve TCP flows over HTTP
+  check       check TCP flows against the rules for monitoring
+  baseline    learn the normal TCP flows and report the deviating flows
+  export      print the firewall rules allowing the observed TCP flows
+  config      print the effective configuration
+  completion  print the shell completion script for bash, zsh or fish
+  version     print version
+  help        print help of a command
+
+  Run 'lstf help COMMAND' for the options of the command.
 
-  Print TCP flows between localhost and other hosts
+Options:
+` + listOptionsText + pcapOptionsText + watchOptionsText + `
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+
+  --version                 	print version
+  --help, -h                	print help
+  --credits                 	print CREDITS
+`
+
+var flowsHelpText = `Usage: lstf flows [options]
+
+  Print TCP flows between localhost and other hosts.
+
+Options:
+` + listOptionsText + pcapOptionsText + watchOptionsText + `
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
+
+var watchHelpText = `Usage: lstf watch [options]
+
+  Print TCP flows periodically until interrupted, which is 'lstf flows --watch'.
+  json output is printed one per line without the timestamp headers.
+  SIGINT and SIGTERM stop it after interrupting the collection in progress, and SIGHUP
+  reloads the config files and the files of --catalog and --cloud-ranges.
 
 Options:
-  --numeric, -n             	show numerical addresses instead of trying to determine symbolic host names.
+  --interval INTERVAL, -i INTERVAL	print every INTERVAL such as '500ms', '1m' or '3' in seconds (default: 3s).
+                            	The collections overrunning the interval are skipped with a warning.
+  --count N                 	exit after printing N times
+  --seen                    	count connections seen during each interval including closed ones
+                            	instead of connections present (requires CAP_NET_ADMIN)
+` + listOptionsText + `
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
+
+// listOptionsText is the help of the options common to 'lstf flows' and 'lstf watch'.
+var listOptionsText = `  --numeric, -n             	show numerical addresses instead of trying to determine symbolic host names.
+  --resolver ADDR           	resolve host names by the DNS server ADDR such as '10.0.0.2:53' instead of the system resolver
   --processes, -p          	 	show process using socket
+  --detail, --connections   	show the individual sockets of each flow with the state, the owner, the inode and
+                            	the timer (netlink, procfs and gopsutil sources)
   --json                    	print results as json format
-  --filter FILTER, -f FILTER	filter results by "all", "public" or "private" (default: "all")
-  --watch=SECONDS, -w=SECONDS	print periodically (SECONDS should be an interger like '3s')
+  --json-envelope           	print results as json format with the hostname, the collection time and the source
+                            	(see schema/envelope.schema.json)
+  --ndjson                  	print each flow as a line of json format with the hostname and the collection time
+                            	(see schema/flow-record.schema.json). With --watch, the lines are streamed.
+  --filter FILTER, -f FILTER	filter results by "all", "public", "private", a network label of --catalog or
+                            	"cloud[:PROVIDER[/REGION[/SERVICE]]]" of --cloud-ranges (default: "all")
+                            	"private" is any IANA special-purpose block not globally reachable, such as
+                            	RFC1918, CGNAT (100.64.0.0/10), link-local and documentation addresses.
+  --catalog FILE            	annotate peers with the labels of the networks in FILE, whose lines are like
+                            	'10.0.2.0/24 prod-db'. The most specific network wins.
+  --cloud-ranges FILE       	annotate peers with the provider, the region and the service of the ip-ranges
+                            	json FILE published by AWS, Google Cloud, Azure or Cloudflare. It can be repeated.
+  --group-by GROUP, -g GROUP	aggregate flows more coarsely by GROUP instead of each peer address
+                            	"subnet[/BITS4[,BITS6]]": peer subnets (default: /24 for IPv4, /64 for IPv6)
+                            	"cidr:FILE": peer networks labeled by FILE in the format of --catalog
+                            	"domain": peer host name domains such as 'example.com' for 'www.example.com'
+                            	"process": processes (requires --processes)
+                            	"port": service ports only
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+                            	"auto": netlink, or procfs if netlink is unavailable (Linux) / gopsutil (others)
+                            	"netlink", "procfs", "gopsutil": force the backend
+                            	"conntrack": also show flows forwarded by the host (==>) and NAT translation
+                            	"file:PATH": read flows printed by --json from PATH
+  --proc-root DIR           	read procfs files under DIR, such as a snapshot extracted from 'lstf snapshot',
+                            	instead of /proc (implies "--source procfs")
+  --timeout DURATION        	give up the collection after DURATION such as '5s', and print the partial flows
+                            	without the processes or the host names not yet looked up (default: no timeout)
+`
 
-  --version, -v	            	print version
-  --help, -h                	print help
-  --credits                 	print CREDITS
+var pcapOptionsText = `  --pcap FILE --local IP    	read flows from the pcap or pcapng FILE captured on the host whose address is IP.
+                            	Each connection is classified by its handshake. --local can be repeated.
+`
+
+var watchOptionsText = `  --watch=INTERVAL, -w=INTERVAL	print every INTERVAL such as '500ms', '1m' or '3' in seconds (default: 3s)
+                            	like 'lstf watch'. json output is printed one per line without the timestamp headers.
+  --count N                 	with --watch, exit after printing N times
+  --seen                    	with --watch, count connections seen during each interval including closed ones
+                            	instead of connections present (requires CAP_NET_ADMIN)
 `
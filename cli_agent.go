@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/exporter"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const defaultAgentInterval = 60 * time.Second
+
+// runAgent executes 'lstf agent' subcommand.
+func (c *CLI) runAgent(args []string) int {
+	var (
+		configFile   string
+		interval     time.Duration
+		otlpEndpoint string
+		statsd       string
+		dogStatsD    bool
+		webhook      string
+		source       string
+		numeric      bool
+		processes    bool
+		filter       string
+		timeout      time.Duration
+		once         bool
+		profile      string
+		debug        bool
+	)
+	flags := c.newFlagSet(name+" agent", agentHelpText)
+	flags.StringVarP(&configFile, "config", "c", "", "")
+	flags.DurationVarP(&interval, "interval", "i", defaultAgentInterval, "")
+	flags.StringVar(&otlpEndpoint, "otlp-endpoint", "", "")
+	flags.StringVar(&statsd, "statsd", "", "")
+	flags.BoolVar(&dogStatsD, "dogstatsd", false, "")
+	flags.StringVar(&webhook, "webhook", "", "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.BoolVarP(&numeric, "numeric", "n", false, "")
+	flags.BoolVarP(&processes, "processes", "p", false, "")
+	flags.StringVarP(&filter, "filter", "f", tcpflow.FilterAll, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.BoolVar(&once, "once", false, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	p, err := applyProfile(flags, profile)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if !(filter == tcpflow.FilterAll ||
+		filter == tcpflow.FilterPublic ||
+		filter == tcpflow.FilterPrivate) {
+		fmt.Fprint(c.errStream, agentHelpText)
+		return exitCodeErr
+	}
+
+	cfg := &exporter.Config{}
+	if p.Agent != nil {
+		// copy not to append the exporters of the flags into the profile.
+		agent := *p.Agent
+		agent.Exporters = append([]exporter.ExporterConfig(nil), p.Agent.Exporters...)
+		cfg = &agent
+	}
+	if configFile != "" {
+		var err error
+		cfg, err = exporter.LoadConfig(configFile)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return exitCodeErr
+		}
+	}
+	// the flags take precedence over the config file.
+	if flags.Changed("interval") || cfg.Interval == 0 {
+		cfg.Interval = interval
+	}
+	if otlpEndpoint != "" {
+		cfg.Exporters = append(cfg.Exporters, exporter.ExporterConfig{Type: "otlp", Endpoint: otlpEndpoint})
+	}
+	if statsd != "" {
+		cfg.Exporters = append(cfg.Exporters, exporter.ExporterConfig{Type: "statsd", Endpoint: statsd, DogStatsD: dogStatsD})
+	} else if dogStatsD {
+		fmt.Fprintln(c.errStream, "--dogstatsd requires --statsd")
+		return exitCodeErr
+	}
+	if webhook != "" {
+		cfg.Exporters = append(cfg.Exporters, exporter.ExporterConfig{Type: "webhook", Endpoint: webhook})
+	}
+	if len(cfg.Exporters) == 0 {
+		fmt.Fprintln(c.errStream, "no exporter is configured (use --otlp-endpoint, --statsd, --webhook or --config)")
+		return exitCodeErr
+	}
+	if cfg.Interval <= 0 {
+		fmt.Fprintf(c.errStream, "invalid interval '%s'\n", cfg.Interval)
+		return exitCodeErr
+	}
+	if timeout < 0 {
+		fmt.Fprintf(c.errStream, "invalid timeout '%s'\n", timeout)
+		return exitCodeErr
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	exporters := make([]exporter.Exporter, 0, len(cfg.Exporters))
+	for i := range cfg.Exporters {
+		e, err := exporter.New(&cfg.Exporters[i], cfg.Retry)
+		if err != nil {
+			fmt.Fprintf(c.errStream, "%v\n", err)
+			return exitCodeErr
+		}
+		defer e.Close()
+		exporters = append(exporters, e)
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		fmt.Fprintf(c.errStream, "%v", err)
+		return exitCodeErr
+	}
+
+	opt := &tcpflow.GetHostFlowsOption{
+		Processes: processes,
+		Filter:    filter,
+		Numeric:   numeric,
+	}
+	export := func(ctx context.Context) bool {
+		collectCtx, cancel := withTimeout(ctx, timeout)
+		defer cancel()
+		collectedAt := time.Now()
+		var warnings []*tcpflow.Warning
+		opt.OnWarning = func(w *tcpflow.Warning) {
+			warnings = append(warnings, w)
+		}
+		flows, err := src.GetHostFlows(collectCtx, opt)
+		if ctx.Err() != nil {
+			return false
+		}
+		c.printWarnings(warnings)
+		if err != nil {
+			log.Printf("failed to get host flows: %v\n", err)
+			return false
+		}
+		env := tcpflow.NewEnvelope(flows, src.Name(), version, collectedAt)
+		ok := true
+		for _, e := range exporters {
+			if err := e.Export(ctx, env); err != nil {
+				if ctx.Err() != nil {
+					return false
+				}
+				log.Printf("%v\n", err)
+				ok = false
+				continue
+			}
+			dlog.Debugf("exported %d host flows to %s", len(env.Flows), e.Name())
+		}
+		return ok
+	}
+
+	if once {
+		if !export(context.Background()) {
+			return exitCodeErr
+		}
+		return exitCodeOK
+	}
+
+	// the signal also interrupts the collection in progress.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the failures are retried at the next interval to keep running as an agent.
+	// The schedule does not drift, and an overrunning export skips the next ones.
+	for next := time.Now(); ; {
+		start := time.Now()
+		export(ctx)
+		if ctx.Err() != nil {
+			return exitCodeOK
+		}
+		next = c.nextSchedule(next, cfg.Interval, start, "export")
+		if !sleepUntil(ctx, next) {
+			return exitCodeOK
+		}
+	}
+}
+
+var agentHelpText = `Usage: lstf agent [options]
+
+  Collect host flows periodically, and push them to remote collectors.
+  A failed export is retried with exponential backoff, and then at the next interval.
+
+Options:
+  --config FILE, -c FILE    	read the YAML configuration of the interval, the retry policy and the exporters
+                            	(see README) instead of the agent section of the profile. The flags below are
+                            	added to the configuration.
+  --interval DURATION, -i DURATION	collect and export every DURATION such as '30s' (default: 60s)
+  --otlp-endpoint URL       	push the metric 'lstf.flow.connections' by OTLP/HTTP JSON to URL such as
+                            	'http://localhost:4318'
+  --statsd ADDR             	send the gauges by StatsD over UDP to ADDR such as '127.0.0.1:8125'
+  --dogstatsd               	with --statsd, describe the flows by DogStatsD tags
+  --webhook URL             	POST the flows as the JSON printed by '--json-envelope' to URL
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+  --numeric, -n             	show numerical addresses instead of trying to determine symbolic host names.
+  --processes, -p          	 	export process using socket
+  --filter FILTER, -f FILTER	filter results by "all", "public" or "private" (default: "all")
+  --timeout DURATION        	give up each collection after DURATION such as '5s', and export the partial flows
+                            	if the connections have been read (default: no timeout)
+  --once                    	export once and exit, for testing the configuration
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
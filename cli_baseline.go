@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yuuki/lstf/baseline"
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const (
+	defaultBaselineFile      = "baseline.json"
+	defaultBaselineDuration  = time.Hour
+	defaultBaselineInterval  = time.Minute
+	defaultBaselineTolerance = 0.5
+)
+
+// baselineActions are the actions of 'lstf baseline'.
+var baselineActions = []string{"learn", "check"}
+
+// baselineReport is the result of 'lstf baseline check --json'.
+type baselineReport struct {
+	Status    string              `json:"status"`
+	Flows     int                 `json:"flows"`
+	Anomalies []*baseline.Anomaly `json:"anomalies"`
+	// Error is the reason why the flows could not be checked.
+	Error string `json:"error,omitempty"`
+}
+
+// runBaseline executes 'lstf baseline' subcommand.
+func (c *CLI) runBaseline(args []string) int {
+	var (
+		out        string
+		duration   time.Duration
+		interval   time.Duration
+		file       string
+		tolerance  float64
+		jsonFormat bool
+		source     string
+		timeout    time.Duration
+		profile    string
+		debug      bool
+	)
+	flags := c.newFlagSet(name+" baseline", baselineHelpText)
+	flags.StringVarP(&out, "out", "o", defaultBaselineFile, "")
+	flags.DurationVarP(&duration, "duration", "d", defaultBaselineDuration, "")
+	flags.DurationVarP(&interval, "interval", "i", defaultBaselineInterval, "")
+	flags.StringVarP(&file, "baseline", "b", defaultBaselineFile, "")
+	flags.Float64Var(&tolerance, "tolerance", defaultBaselineTolerance, "")
+	flags.BoolVar(&jsonFormat, "json", false, "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if flags.NArg() != 1 || (flags.Arg(0) != baselineActions[0] && flags.Arg(0) != baselineActions[1]) {
+		fmt.Fprint(c.errStream, baselineHelpText)
+		return exitCodeErr
+	}
+	action := flags.Arg(0)
+	// the options of the other action are rejected not to be ignored silently.
+	actionFlags := map[string][]string{
+		"learn": {"out", "duration", "interval"},
+		"check": {"baseline", "tolerance", "json"},
+	}
+	for other, names := range actionFlags {
+		if other == action {
+			continue
+		}
+		for _, f := range names {
+			if flags.Changed(f) {
+				fmt.Fprintf(c.errStream, "--%s is an option of 'lstf baseline %s'\n", f, other)
+				return exitCodeErr
+			}
+		}
+	}
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if timeout < 0 {
+		fmt.Fprintf(c.errStream, "invalid timeout '%s'\n", timeout)
+		return exitCodeErr
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		fmt.Fprintf(c.errStream, "%v", err)
+		return exitCodeErr
+	}
+
+	// the flows are keyed on the addresses, so that the host names are not resolved.
+	// It reports whether the flows are partial by the timeout.
+	collect := func(ctx context.Context) (tcpflow.HostFlows, bool, error) {
+		ctx, cancel := withTimeout(ctx, timeout)
+		defer cancel()
+		var warnings []*tcpflow.Warning
+		partial := false
+		flows, err := src.GetHostFlows(ctx, &tcpflow.GetHostFlowsOption{
+			Numeric: true,
+			Filter:  tcpflow.FilterAll,
+			OnWarning: func(w *tcpflow.Warning) {
+				warnings = append(warnings, w)
+				if w.Kind == tcpflow.WarningPartial {
+					partial = true
+				}
+			},
+		})
+		c.printWarnings(warnings)
+		return flows, partial, err
+	}
+
+	if action == "learn" {
+		if duration <= 0 {
+			fmt.Fprintf(c.errStream, "invalid duration '%s'\n", duration)
+			return exitCodeErr
+		}
+		if interval <= 0 {
+			fmt.Fprintf(c.errStream, "invalid interval '%s'\n", interval)
+			return exitCodeErr
+		}
+		return c.learnBaseline(collect, out, duration, interval)
+	}
+
+	if tolerance < 0 {
+		fmt.Fprintf(c.errStream, "invalid tolerance '%g'\n", tolerance)
+		return exitCodeErr
+	}
+	b, err := baseline.Load(file)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	flows, partial, err := collect(context.Background())
+	if err != nil {
+		log.Printf("failed to get host flows: %v\n", err)
+		return exitCodeErr
+	}
+	return c.reportBaseline(b, flows, partial, tolerance, jsonFormat)
+}
+
+// reportBaseline checks the flows against the baseline, and prints the status and
+// the anomalies. The partial flows are not checked for the missing flows, which
+// may be just not collected, and they are UNKNOWN unless any other anomaly is found.
+func (c *CLI) reportBaseline(b *baseline.Baseline, flows tcpflow.HostFlows, partial bool,
+	tolerance float64, jsonFormat bool) int {
+	anomalies := b.Check(flows, tolerance)
+	if partial {
+		checked := anomalies[:0]
+		for _, a := range anomalies {
+			if a.Kind != baseline.AnomalyMissing {
+				checked = append(checked, a)
+			}
+		}
+		anomalies = checked
+	}
+
+	// new flows are critical, and the others are warnings like 'lstf check'.
+	status := "ok"
+	for _, a := range anomalies {
+		if a.Kind == baseline.AnomalyNew {
+			status = "critical"
+			break
+		}
+		status = "warning"
+	}
+	var reason string
+	if partial && status == "ok" {
+		status = checkStatusUnknown
+		reason = "the collection has timed out, so that some flows have not been checked"
+	}
+	if jsonFormat {
+		report := &baselineReport{Status: status, Flows: len(flows), Anomalies: anomalies, Error: reason}
+		if len(report.Anomalies) == 0 {
+			report.Anomalies = []*baseline.Anomaly{}
+		}
+		b, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("failed to marshal json: %v\n", err)
+			return exitCodeErr
+		}
+		fmt.Fprintf(c.outStream, "%s\n", b)
+	} else {
+		flowsLabel := "flows"
+		if partial {
+			flowsLabel = "partial flows"
+		}
+		fmt.Fprintf(c.outStream, "%s - %d anomalies in %d %s (baseline: %d flows in %d samples from %s to %s)\n",
+			checkStatusLabel(status), len(anomalies), len(flows), flowsLabel, len(b.Flows), b.Samples,
+			b.LearnedFrom.Format(time.RFC3339), b.LearnedUntil.Format(time.RFC3339))
+		if reason != "" {
+			fmt.Fprintln(c.outStream, reason)
+		}
+		for _, a := range anomalies {
+			fmt.Fprintln(c.outStream, a)
+		}
+	}
+
+	switch status {
+	case "critical":
+		return exitCodeCheckCritical
+	case "warning":
+		return exitCodeCheckWarning
+	case checkStatusUnknown:
+		return exitCodeCheckUnknown
+	}
+	return exitCodeOK
+}
+
+// learnBaseline learns the flows collected every interval over the duration, and
+// writes the baseline into 'out'. The failed or partial collections are skipped,
+// and SIGINT and SIGTERM finish learning early.
+func (c *CLI) learnBaseline(collect func(context.Context) (tcpflow.HostFlows, bool, error),
+	out string, duration, interval time.Duration) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	deadline := time.Now().Add(duration)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	b := baseline.New()
+	// the schedule does not drift, and an overrunning collection skips the next ones.
+	for next := time.Now(); ; {
+		start := time.Now()
+		flows, partial, err := collect(ctx)
+		switch {
+		case ctx.Err() != nil:
+			// the collection interrupted at the end of learning is not a sample,
+			// even if it returns the partial flows.
+		case err != nil:
+			// a failed collection is not a sample, and learning goes on.
+			log.Printf("failed to get host flows: %v\n", err)
+		case partial:
+			// the partial flows would be learned as the missing flows of the sample.
+			dlog.Debugf("discarded the partial %d host flows at %s", len(flows), start.Format(time.RFC3339))
+		default:
+			b.Learn(flows, start)
+			dlog.Debugf("learned %d host flows at %s", len(flows), start.Format(time.RFC3339))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		next = c.nextSchedule(next, interval, start, "collection")
+		if !sleepUntil(ctx, next) {
+			break
+		}
+	}
+
+	if b.Samples == 0 {
+		fmt.Fprintln(c.errStream, "no flows have been learned")
+		return exitCodeErr
+	}
+	if err := b.Save(out); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	fmt.Fprintf(c.errStream, "learned %d flows in %d samples, and wrote %s\n", len(b.Flows), b.Samples, out)
+	return exitCodeOK
+}
+
+var baselineHelpText = `Usage: lstf baseline learn [options]
+       lstf baseline check [options]
+
+  learn collects host flows every interval over the duration, and writes the flows
+  with the range of their connections as the baseline of the host. The failed collections
+  are skipped, and SIGINT and SIGTERM finish learning early.
+
+  check collects host flows, and reports the flows deviating from the baseline, which are
+  keyed on the direction, the local and the peer addresses:
+    new          the flow is not in the baseline, such as a new destination after a deploy
+    connections  the connections are out of the range in the baseline beyond the tolerance
+    missing      the flow was present in every sample of the baseline, but is not now
+  It exits with 2 if any flow is new, 1 if the others deviate, 3 if the partial flows do not
+  deviate, and 0 otherwise like 'lstf check'.
+
+Options of learn:
+  --out FILE, -o FILE       	write the baseline into FILE (default: "baseline.json")
+  --duration DURATION, -d DURATION	learn over DURATION such as '1h' (default: 1h)
+  --interval DURATION, -i DURATION	collect every DURATION such as '30s' (default: 1m)
+
+Options of check:
+  --baseline FILE, -b FILE  	read the baseline from FILE (default: "baseline.json")
+  --tolerance RATIO         	allow the connections out of the range in the baseline by RATIO
+                            	such as 0.5 for 50% (default: 0.5)
+  --json                    	print the status and the anomalies as json format
+
+Options:
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+  --timeout DURATION        	give up each collection after DURATION such as '5s'. The partial flows are
+                            	not learned, and not checked for the missing flows
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
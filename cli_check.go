@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/rules"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// The exit codes of 'lstf check' are the codes of the Nagios plugins.
+const (
+	exitCodeCheckWarning  = 1
+	exitCodeCheckCritical = 2
+	// exitCodeCheckUnknown means that the flows could not be checked.
+	exitCodeCheckUnknown = 3
+)
+
+// checkStatusUnknown is the status of the check which could not be done.
+const checkStatusUnknown = "unknown"
+
+// checkReport is the result of 'lstf check --json'.
+type checkReport struct {
+	Status     string             `json:"status"`
+	Rules      int                `json:"rules"`
+	Flows      int                `json:"flows"`
+	Violations []*rules.Violation `json:"violations"`
+	// Error is the reason why the flows could not be checked.
+	Error string `json:"error,omitempty"`
+}
+
+// runCheck executes 'lstf check' subcommand.
+func (c *CLI) runCheck(args []string) int {
+	var (
+		rulesFile  string
+		source     string
+		timeout    time.Duration
+		jsonFormat bool
+		profile    string
+		debug      bool
+	)
+	flags := c.newFlagSet(name+" check", checkHelpText)
+	flags.StringVarP(&rulesFile, "rules", "r", "", "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.BoolVar(&jsonFormat, "json", false, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitCodeErr
+		}
+		return c.checkUnknown(jsonFormat, err)
+	}
+
+	setDebugOutputLevel(debug)
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		return c.checkUnknown(jsonFormat, err)
+	}
+
+	if rulesFile == "" {
+		return c.checkUnknown(jsonFormat, xerrors.New("--rules is required"))
+	}
+	if timeout < 0 {
+		return c.checkUnknown(jsonFormat, xerrors.Errorf("invalid timeout '%s'", timeout))
+	}
+	rs, err := rules.Load(rulesFile)
+	if err != nil {
+		return c.checkUnknown(jsonFormat, err)
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		return c.checkUnknown(jsonFormat, err)
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		return c.checkUnknown(jsonFormat, err)
+	}
+
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	var warnings []*tcpflow.Warning
+	partial := false
+	// the rules match the addresses, so that the host names are not resolved.
+	flows, err := src.GetHostFlows(ctx, &tcpflow.GetHostFlowsOption{
+		Numeric:   true,
+		Processes: rules.NeedsProcesses(rs),
+		Filter:    tcpflow.FilterAll,
+		OnWarning: func(w *tcpflow.Warning) {
+			warnings = append(warnings, w)
+			if w.Kind == tcpflow.WarningPartial {
+				partial = true
+			}
+		},
+	})
+	c.printWarnings(warnings)
+	if err != nil {
+		return c.checkUnknown(jsonFormat, xerrors.Errorf("failed to get host flows: %w", err))
+	}
+	return c.reportCheck(rs, flows, partial, jsonFormat)
+}
+
+// reportCheck checks the flows against the rules, and prints the status and the
+// violations. The partial flows without violations are UNKNOWN rather than OK,
+// because the flows not collected have not been checked.
+func (c *CLI) reportCheck(rs []*rules.Rule, flows tcpflow.HostFlows, partial, jsonFormat bool) int {
+	violations := rules.Check(rs, flows)
+	status := rules.Summarize(violations).Status()
+	var reason string
+	if partial && status != rules.SeverityCritical && status != rules.SeverityWarning {
+		status = checkStatusUnknown
+		reason = "the collection has timed out, so that some flows have not been checked"
+	}
+	if jsonFormat {
+		report := &checkReport{
+			Status:     status,
+			Rules:      len(rs),
+			Flows:      len(flows),
+			Violations: violations,
+			Error:      reason,
+		}
+		if report.Violations == nil {
+			report.Violations = []*rules.Violation{}
+		}
+		b, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("failed to marshal json: %v\n", err)
+			return exitCodeErr
+		}
+		fmt.Fprintf(c.outStream, "%s\n", b)
+	} else {
+		// the first line is the status line of the Nagios plugins.
+		switch status {
+		case rules.SeverityCritical, rules.SeverityWarning:
+			fmt.Fprintf(c.outStream, "%s - %d violations of %d rules in %d flows\n",
+				checkStatusLabel(status), len(violations), len(rs), len(flows))
+		case checkStatusUnknown:
+			fmt.Fprintf(c.outStream, "%s - %d rules passed in %d partial flows, but %s\n",
+				checkStatusLabel(status), len(rs), len(flows), reason)
+		default:
+			fmt.Fprintf(c.outStream, "%s - %d rules passed in %d flows\n",
+				checkStatusLabel(status), len(rs), len(flows))
+		}
+		for _, v := range violations {
+			fmt.Fprintln(c.outStream, v)
+		}
+	}
+
+	switch status {
+	case rules.SeverityCritical:
+		return exitCodeCheckCritical
+	case rules.SeverityWarning:
+		return exitCodeCheckWarning
+	case checkStatusUnknown:
+		return exitCodeCheckUnknown
+	}
+	return exitCodeOK
+}
+
+// checkUnknown prints the status line of the check which could not be done by
+// the error, and returns the exit code of UNKNOWN like the Nagios plugins.
+func (c *CLI) checkUnknown(jsonFormat bool, err error) int {
+	if jsonFormat {
+		b, _ := json.Marshal(&checkReport{Status: checkStatusUnknown, Violations: []*rules.Violation{}, Error: err.Error()})
+		fmt.Fprintf(c.outStream, "%s\n", b)
+	} else {
+		fmt.Fprintf(c.outStream, "%s - %v\n", checkStatusLabel(checkStatusUnknown), err)
+	}
+	return exitCodeCheckUnknown
+}
+
+// checkStatusLabel returns the label of the status in the status line, such as "CRITICAL".
+func checkStatusLabel(status string) string {
+	switch status {
+	case rules.SeverityCritical:
+		return "CRITICAL"
+	case rules.SeverityWarning:
+		return "WARNING"
+	case checkStatusUnknown:
+		return "UNKNOWN"
+	}
+	return "OK"
+}
+
+var checkHelpText = `Usage: lstf check --rules FILE [options]
+
+  Check host flows against the rules in FILE, and print the violations.
+  It exits with 0 if no rule is violated, 1 if only the rules of "warning" severity are
+  violated, 2 if any rule of "critical" severity is violated, and 3 if the flows could not
+  be checked, such as an invalid rules file or the partial flows, like the Nagios plugins.
+
+  rules:
+  - name: app-no-public            # "no active flows to public networks from process app"
+    match: {direction: active, process: app}
+    deny: [public]
+  - name: mysql-connections        # "connections to 10.0.1.10:3306 must be < 500"
+    severity: warning
+    match: {peer: "10.0.1.10:3306"}
+    connections: "< 500"
+  - name: ssh-internal             # "port 22 must only be reached from 10.0.0.0/8"
+    match: {direction: passive, port: 22}
+    allow: [10.0.0.0/8]
+
+  match selects the flows by 'direction', 'process', 'local', 'peer' and 'port' (the service port).
+  deny and allow are "public", "private", addresses or CIDRs. connections is a condition of
+  the total connections of the selected flows by '<', '<=', '>', '>=' or '=='.
+
+Options:
+  --rules FILE, -r FILE     	read the rules from the YAML FILE
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+  --timeout DURATION        	give up the collection after DURATION such as '5s', and check the partial flows,
+                            	which are UNKNOWN unless they violate the rules
+  --json                    	print the status and the violations as json format
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+)
+
+// command is a subcommand of lstf.
+type command struct {
+	name string
+	// summary is the line of the command in the help and the shell completion.
+	summary string
+	// args are the candidates of the arguments in the shell completion.
+	args []string
+	// run executes the command. args[0] is the name of the command.
+	run func(c *CLI, args []string) int
+}
+
+// commands are the subcommands of lstf in the order of the help.
+// They are initialized in init() because 'lstf help' refers to them.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "flows",
+			summary: "print TCP flows between localhost and other hosts",
+			run:     func(c *CLI, args []string) int { return c.runFlows("flows", args) },
+		},
+		{
+			name:    "watch",
+			summary: "print TCP flows periodically",
+			run:     func(c *CLI, args []string) int { return c.runFlows("watch", args) },
+		},
+		{
+			name:    "listen",
+			summary: "print the local listening ports",
+			run:     (*CLI).runListen,
+		},
+		{
+			name:    "top",
+			summary: "show TCP flows in the interactive terminal UI",
+			run:     (*CLI).runTop,
+		},
+		{
+			name:    "trace",
+			summary: "trace short-lived connections by eBPF",
+			run:     (*CLI).runTrace,
+		},
+		{
+			name:    "snapshot",
+			summary: "archive the procfs files of the host to analyze it after the fact",
+			run:     (*CLI).runSnapshot,
+		},
+		{
+			name:    "agent",
+			summary: "push TCP flows to remote collectors periodically",
+			run:     (*CLI).runAgent,
+		},
+		{
+			name:    "daemon",
+			summary: "serve TCP flows over HTTP",
+			run:     (*CLI).runDaemon,
+		},
+		{
+			name:    "check",
+			summary: "check TCP flows against the rules for monitoring",
+			run:     (*CLI).runCheck,
+		},
+		{
+			name:    "baseline",
+			summary: "learn the normal TCP flows and report the deviating flows",
+			args:    baselineActions,
+			run:     (*CLI).runBaseline,
+		},
+		{
+			name:    "export",
+			summary: "print the firewall rules allowing the observed TCP flows",
+			run:     (*CLI).runExport,
+		},
+		{
+			name:    "config",
+			summary: "print the effective configuration",
+			args:    []string{"show"},
+			run:     (*CLI).runConfig,
+		},
+		{
+			name:    "completion",
+			summary: "print the shell completion script for bash, zsh or fish",
+			args:    completionShells,
+			run:     (*CLI).runCompletion,
+		},
+		{
+			name:    "version",
+			summary: "print version",
+			run:     (*CLI).runVersion,
+		},
+		{
+			name:    "help",
+			summary: "print help of a command",
+			run:     (*CLI).runHelp,
+		},
+	}
+	// 'lstf help' completes the names of the commands.
+	lookupCommand("help").args = commandNames()
+}
+
+// lookupCommand returns the command of the name, or nil if not found.
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// runHelp executes 'lstf help' subcommand.
+func (c *CLI) runHelp(args []string) int {
+	flags := c.newFlagSet(name+" help", helpHelpText)
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+	switch flags.NArg() {
+	case 0:
+		fmt.Fprint(c.errStream, helpText)
+		return exitCodeOK
+	case 1:
+	default:
+		fmt.Fprint(c.errStream, helpHelpText)
+		return exitCodeErr
+	}
+	cmd := lookupCommand(flags.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(c.errStream, "unknown command '%s' (see 'lstf help')\n", flags.Arg(0))
+		return exitCodeErr
+	}
+	// the commands print their help by --help, which is not an error here.
+	cmd.run(c, []string{cmd.name, "--help"})
+	return exitCodeOK
+}
+
+var helpHelpText = `Usage: lstf help [COMMAND]
+
+  Print help of COMMAND, or the commands of lstf.
+
+Options:
+  --help, -h                	print help
+`
+
+// runVersion executes 'lstf version' subcommand.
+func (c *CLI) runVersion(args []string) int {
+	flags := c.newFlagSet(name+" version", versionHelpText)
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+	c.printVersion()
+	return exitCodeOK
+}
+
+func (c *CLI) printVersion() {
+	fmt.Fprintf(c.errStream, "%s version %s, build %s, date %s \n", name, version, commit, date)
+}
+
+var versionHelpText = `Usage: lstf version
+
+  Print version, which is 'lstf --version'.
+
+Options:
+  --help, -h                	print help
+`
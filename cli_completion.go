@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// completionShells are the shells whose completion script 'lstf completion' prints.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// runCompletion executes 'lstf completion' subcommand.
+func (c *CLI) runCompletion(args []string) int {
+	flags := c.newFlagSet(name+" completion", completionHelpText)
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(c.errStream, completionHelpText)
+		return exitCodeErr
+	}
+	switch flags.Arg(0) {
+	case "bash":
+		writeBashCompletion(c.outStream)
+	case "zsh":
+		writeZshCompletion(c.outStream)
+	case "fish":
+		writeFishCompletion(c.outStream)
+	default:
+		fmt.Fprintf(c.errStream, "unknown shell '%s' (available: %s)\n",
+			flags.Arg(0), strings.Join(completionShells, ", "))
+		return exitCodeErr
+	}
+	return exitCodeOK
+}
+
+// completionFlag is a flag of a command in the shell completion.
+type completionFlag struct {
+	long, short string
+	// value is whether the flag takes the next argument as its value.
+	value bool
+}
+
+// completionFlags returns the flags of the command, or of lstf without a
+// subcommand if 'cmd' is nil. They are read from the flag set of the command
+// run with --help, which returns after defining the flags.
+func completionFlags(cmd *command) []*completionFlag {
+	c := &CLI{outStream: io.Discard, errStream: io.Discard}
+	if cmd == nil {
+		c.runFlows("", []string{name, "--help"})
+	} else {
+		cmd.run(c, []string{cmd.name, "--help"})
+	}
+	var flags []*completionFlag
+	if c.flags != nil {
+		c.flags.VisitAll(func(f *flag.Flag) {
+			flags = append(flags, &completionFlag{
+				long:  f.Name,
+				short: f.Shorthand,
+				value: f.Value.Type() != "bool" && f.NoOptDefVal == "",
+			})
+		})
+	}
+	return append(flags, &completionFlag{long: "help", short: "h"})
+}
+
+// completionWords returns the words of the flags, and the words of the flags taking a value.
+func completionWords(flags []*completionFlag) (words []string, values []string) {
+	for _, f := range flags {
+		ws := []string{"--" + f.long}
+		if f.short != "" {
+			ws = append(ws, "-"+f.short)
+		}
+		words = append(words, ws...)
+		if f.value {
+			values = append(values, ws...)
+		}
+	}
+	return words, values
+}
+
+// shellQuote quotes 's' by the single quotes for sh, zsh and fish.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeBashCompletion(w io.Writer) {
+	var b strings.Builder
+	b.WriteString(`# bash completion for lstf, generated by 'lstf completion bash'.
+# Load it by: source <(lstf completion bash)
+
+_lstf() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local cmd=""
+    if [[ ${COMP_CWORD} -gt 1 && "${COMP_WORDS[1]}" != -* ]]; then
+        cmd="${COMP_WORDS[1]}"
+    fi
+
+    local flags="" values="" args=""
+    case "${cmd}" in
+`)
+	words, values := completionWords(completionFlags(nil))
+	fmt.Fprintf(&b, "    \"\")\n")
+	fmt.Fprintf(&b, "        flags=%s\n", shellQuote(strings.Join(words, " ")))
+	fmt.Fprintf(&b, "        values=%s\n", shellQuote(strings.Join(values, " ")))
+	fmt.Fprintf(&b, "        if [[ ${COMP_CWORD} -eq 1 ]]; then\n")
+	fmt.Fprintf(&b, "            args=%s\n", shellQuote(strings.Join(commandNames(), " ")))
+	fmt.Fprintf(&b, "        fi\n")
+	fmt.Fprintf(&b, "        ;;\n")
+	for _, cmd := range commands {
+		words, values := completionWords(completionFlags(cmd))
+		fmt.Fprintf(&b, "    %s)\n", cmd.name)
+		fmt.Fprintf(&b, "        flags=%s\n", shellQuote(strings.Join(words, " ")))
+		if len(values) > 0 {
+			fmt.Fprintf(&b, "        values=%s\n", shellQuote(strings.Join(values, " ")))
+		}
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(&b, "        args=%s\n", shellQuote(strings.Join(cmd.args, " ")))
+		}
+		fmt.Fprintf(&b, "        ;;\n")
+	}
+	b.WriteString(`    esac
+
+    # the values of the flags are completed by the file names.
+    if [[ " ${values} " == *" ${prev} "* ]]; then
+        COMPREPLY=($(compgen -f -- "${cur}"))
+    elif [[ "${cur}" == -* ]]; then
+        COMPREPLY=($(compgen -W "${flags}" -- "${cur}"))
+    elif [[ -n "${args}" ]]; then
+        COMPREPLY=($(compgen -W "${args}" -- "${cur}"))
+    else
+        COMPREPLY=($(compgen -f -- "${cur}"))
+    fi
+}
+
+complete -F _lstf lstf
+`)
+	io.WriteString(w, b.String())
+}
+
+func writeZshCompletion(w io.Writer) {
+	var b strings.Builder
+	b.WriteString(`#compdef lstf
+# zsh completion for lstf, generated by 'lstf completion zsh'.
+# Load it by: source <(lstf completion zsh), or save it as _lstf into a directory of $fpath.
+
+_lstf() {
+  local cmd=""
+  local -a flags values args commands
+  if (( CURRENT > 2 )) && [[ ${words[2]} != -* ]]; then
+    cmd=${words[2]}
+  fi
+  commands=(
+`)
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "    %s\n", shellQuote(cmd.name+":"+cmd.summary))
+	}
+	b.WriteString("  )\n\n  case $cmd in\n")
+	words, values := completionWords(completionFlags(nil))
+	fmt.Fprintf(&b, "  \"\")\n")
+	fmt.Fprintf(&b, "    flags=(%s)\n", strings.Join(words, " "))
+	fmt.Fprintf(&b, "    values=(%s)\n", strings.Join(values, " "))
+	fmt.Fprintf(&b, "    ;;\n")
+	for _, cmd := range commands {
+		words, values := completionWords(completionFlags(cmd))
+		fmt.Fprintf(&b, "  %s)\n", cmd.name)
+		fmt.Fprintf(&b, "    flags=(%s)\n", strings.Join(words, " "))
+		if len(values) > 0 {
+			fmt.Fprintf(&b, "    values=(%s)\n", strings.Join(values, " "))
+		}
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(&b, "    args=(%s)\n", strings.Join(cmd.args, " "))
+		}
+		fmt.Fprintf(&b, "    ;;\n")
+	}
+	b.WriteString(`  esac
+
+  # the values of the flags are completed by the file names.
+  if (( ${values[(Ie)${words[CURRENT-1]}]} )); then
+    _files
+  elif [[ ${words[CURRENT]} == -* ]]; then
+    compadd -- $flags
+  elif (( CURRENT == 2 )); then
+    _describe 'command' commands
+  elif (( ${#args} )); then
+    compadd -- $args
+  else
+    _files
+  fi
+}
+
+if [[ ${funcstack[1]} == _lstf ]]; then
+  _lstf "$@"
+else
+  compdef _lstf lstf
+fi
+`)
+	io.WriteString(w, b.String())
+}
+
+func writeFishCompletion(w io.Writer) {
+	var b strings.Builder
+	b.WriteString(`# fish completion for lstf, generated by 'lstf completion fish'.
+# Load it by: lstf completion fish | source
+
+# __lstf_command returns whether the command line is 'lstf CMD', or lstf without
+# a subcommand if CMD is not given.
+function __lstf_command
+    set -l words (commandline -opc)
+    if test -z "$argv[1]"
+        test (count $words) -eq 1; or string match -q -- '-*' $words[2]
+    else
+        test (count $words) -gt 1; and test "$words[2]" = "$argv[1]"
+    end
+end
+
+complete -c lstf -f
+`)
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "complete -c lstf -n '__fish_is_first_arg' -a %s -d %s\n",
+			cmd.name, shellQuote(cmd.summary))
+	}
+	writeFishFlags := func(condition string, flags []*completionFlag) {
+		for _, f := range flags {
+			fmt.Fprintf(&b, "complete -c lstf -n %s -l %s", shellQuote(condition), f.long)
+			if f.short != "" {
+				fmt.Fprintf(&b, " -s %s", f.short)
+			}
+			if f.value {
+				// the values of the flags are completed by the file names.
+				b.WriteString(" -r -F")
+			}
+			b.WriteString("\n")
+		}
+	}
+	writeFishFlags("__lstf_command", completionFlags(nil))
+	for _, cmd := range commands {
+		writeFishFlags("__lstf_command "+cmd.name, completionFlags(cmd))
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(&b, "complete -c lstf -n '__lstf_command %s' -a %s\n",
+				cmd.name, shellQuote(strings.Join(cmd.args, " ")))
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+var completionHelpText = `Usage: lstf completion bash|zsh|fish
+
+  Print the shell completion script of the commands and the options of lstf.
+
+    bash: source <(lstf completion bash)
+    zsh:  source <(lstf completion zsh)
+    fish: lstf completion fish | source
+
+Options:
+  --help, -h                	print help
+`
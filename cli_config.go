@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/yuuki/lstf/config"
+	"github.com/yuuki/lstf/netutil"
+)
+
+// formatFlags are the flags of the output format, which are set by the format of the profile.
+var formatFlags = []string{config.FormatJSON, config.FormatJSONEnvelope, config.FormatNDJSON}
+
+// loadProfile returns the profile of the name merged with the environment variables.
+func loadProfile(name string) (*config.Profile, error) {
+	cfg, _, err := config.LoadDefault()
+	if err != nil {
+		return nil, err
+	}
+	_, p, err := cfg.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	env, _, err := config.FromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	p.Merge(env)
+	return p, nil
+}
+
+// applyProfile sets the flags not given on the command line to the values of the
+// profile, so that the precedence is the flags, the environment variables and the
+// config files. The flags which the command does not have are ignored.
+func applyProfile(flags *flag.FlagSet, name string) (*config.Profile, error) {
+	p, err := loadProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	// a format given on the command line overrides the format of the profile.
+	formatChanged := false
+	for _, f := range formatFlags {
+		formatChanged = formatChanged || flags.Changed(f)
+	}
+	for name, v := range p.FlagValues() {
+		f := flags.Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+		if formatChanged && isFormatFlag(name) {
+			continue
+		}
+		// set the value without marking the flag as changed on the command line.
+		if err := f.Value.Set(v); err != nil {
+			return nil, xerrors.Errorf("invalid %s %q of the profile: %v", name, v, err)
+		}
+	}
+	if p.Resolver != "" && flags.Lookup("resolver") == nil {
+		netutil.SetResolver(p.Resolver)
+	}
+	return p, nil
+}
+
+func isFormatFlag(name string) bool {
+	for _, f := range formatFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runConfig executes 'lstf config' subcommand.
+func (c *CLI) runConfig(args []string) int {
+	var profile string
+	flags := c.newFlagSet(name+" config", configHelpText)
+	flags.StringVar(&profile, "profile", "", "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+	if flags.NArg() != 1 || flags.Arg(0) != "show" {
+		fmt.Fprint(c.errStream, configHelpText)
+		return exitCodeErr
+	}
+
+	cfg, files, err := config.LoadDefault()
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	profileName, p, err := cfg.Lookup(profile)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	env, envSet, err := config.FromEnv(os.Getenv)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	p.Merge(env)
+
+	b, err := yaml.Marshal(p.Redacted())
+	if err != nil {
+		fmt.Fprintf(c.errStream, "failed to marshal yaml: %v\n", err)
+		return exitCodeErr
+	}
+	fmt.Fprintf(c.outStream, "# config files: %s\n", joinOrNone(files))
+	fmt.Fprintf(c.outStream, "# profile: %s\n", profileName)
+	fmt.Fprintf(c.outStream, "# environment: %s\n", joinOrNone(envSet))
+	fmt.Fprintf(c.outStream, "%s", b)
+	return exitCodeOK
+}
+
+func joinOrNone(s []string) string {
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, ", ")
+}
+
+var configHelpText = `Usage: lstf config show [options]
+
+  Print the effective configuration, which is the profile of the config files
+  overridden by the environment variables. The command line flags override it.
+
+  The config files are /etc/lstf/config.yaml and ~/.config/lstf/config.yaml
+  ($XDG_CONFIG_HOME/lstf/config.yaml), or $LSTF_CONFIG. The latter file overrides
+  the profiles of the former by field.
+
+  profile: default                 # the profile used without --profile or $LSTF_PROFILE
+  profiles:
+    default:
+      format: text                 # text, json, json-envelope or ndjson ($LSTF_FORMAT)
+      numeric: false               # $LSTF_NUMERIC
+      processes: false             # $LSTF_PROCESSES
+      filter: all                  # $LSTF_FILTER
+      group_by: subnet/24          # $LSTF_GROUP_BY
+      source: auto                 # $LSTF_SOURCE
+      resolver: 10.0.0.2:53        # DNS server to resolve host names ($LSTF_RESOLVER)
+      catalog: /etc/lstf/networks  # $LSTF_CATALOG
+      networks:                    # named networks added to the catalog
+        10.0.1.0/24: prod-db
+      cloud_ranges:                # $LSTF_CLOUD_RANGES (comma-separated)
+        - /var/lib/lstf/ip-ranges.json
+      agent:                       # the config of 'lstf agent --config'
+        exporters:
+          - type: otlp
+            endpoint: http://127.0.0.1:4318
+
+Options:
+  --profile NAME            	show the profile NAME instead of the default profile
+
+  --help, -h                	print help
+`
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yuuki/lstf/daemon"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const (
+	defaultDaemonListen   = "127.0.0.1:7180"
+	defaultDaemonInterval = 10 * time.Second
+)
+
+// runDaemon executes 'lstf daemon' subcommand.
+func (c *CLI) runDaemon(args []string) int {
+	var (
+		listen   string
+		interval time.Duration
+		history  int
+		source   string
+		numeric  bool
+		timeout  time.Duration
+		profile  string
+		debug    bool
+	)
+	flags := c.newFlagSet(name+" daemon", daemonHelpText)
+	flags.StringVarP(&listen, "listen", "l", defaultDaemonListen, "")
+	flags.DurationVarP(&interval, "interval", "i", defaultDaemonInterval, "")
+	flags.IntVar(&history, "history", daemon.DefaultHistory, "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.BoolVarP(&numeric, "numeric", "n", false, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if interval <= 0 {
+		fmt.Fprintf(c.errStream, "invalid interval '%s'\n", interval)
+		return exitCodeErr
+	}
+	if history <= 0 {
+		fmt.Fprintf(c.errStream, "invalid history '%d'\n", history)
+		return exitCodeErr
+	}
+	if timeout < 0 {
+		fmt.Fprintf(c.errStream, "invalid timeout '%s'\n", timeout)
+		return exitCodeErr
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		fmt.Fprintf(c.errStream, "%v", err)
+		return exitCodeErr
+	}
+
+	d := daemon.New(daemon.Options{
+		Source:      src,
+		Numeric:     numeric,
+		Timeout:     timeout,
+		History:     history,
+		LstfVersion: version,
+	})
+	// the signal also interrupts the collection in progress.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the failures are reported, but the daemon keeps running to retry at the next interval
+	// with the previous flows served.
+	refresh := func() {
+		if err := d.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	first := time.Now()
+	refresh()
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Printf("failed to listen: %v\n", err)
+		return exitCodeErr
+	}
+	srv := &http.Server{Handler: d.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	// the schedule does not drift, and an overrunning collection skips the next ones.
+	go func() {
+		start := first
+		for next := first; ; {
+			next = c.nextSchedule(next, interval, start, "collection")
+			if !sleepUntil(ctx, next) {
+				return
+			}
+			start = time.Now()
+			refresh()
+		}
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+	log.Printf("serving the API on http://%s\n", ln.Addr())
+
+	select {
+	case err := <-served:
+		log.Printf("failed to serve: %v\n", err)
+		return exitCodeErr
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shutdown: %v\n", err)
+		return exitCodeErr
+	}
+	return exitCodeOK
+}
+
+var daemonHelpText = `Usage: lstf daemon [options]
+
+  Collect host flows periodically, and serve them by HTTP JSON API.
+
+  GET /flows       the latest host flows in the format of 'lstf --json-envelope'
+  GET /history     the recent snapshots of host flows, oldest first
+  GET /listeners   the latest listening ports of the host, which are not available from
+                   the sources not reading the sockets of the host such as 'file' and 'conntrack'
+  GET /healthz     the status of the last collection
+
+  /flows and /history take the query parameters 'filter=all|public|private',
+  'numeric=true' and 'processes=true' like the options of lstf.
+
+Options:
+  --listen ADDR, -l ADDR    	listen on ADDR (default: "127.0.0.1:7180")
+  --interval DURATION, -i DURATION	collect every DURATION such as '30s' (default: 10s)
+  --history N               	keep the N recent snapshots (default: 10)
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+  --numeric, -n             	do not resolve host names at each collection
+  --timeout DURATION        	give up each collection after DURATION such as '5s', and serve the partial flows
+                            	if the connections have been read (default: no timeout)
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
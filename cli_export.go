@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuuki/lstf/firewall"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// defaultFirewallAggregate is the prefix lengths which the peers of the firewall rules are aggregated into.
+const defaultFirewallAggregate = "24,64"
+
+// runExport executes 'lstf export' subcommand.
+func (c *CLI) runExport(args []string) int {
+	var (
+		format    string
+		aggregate string
+		source    string
+		timeout   time.Duration
+		profile   string
+		debug     bool
+	)
+	flags := c.newFlagSet(name+" export", exportHelpText)
+	flags.StringVarP(&format, "firewall", "f", "", "")
+	flags.StringVar(&aggregate, "aggregate", defaultFirewallAggregate, "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	switch format {
+	case firewall.FormatNftables, firewall.FormatIptables:
+	case "":
+		fmt.Fprintf(c.errStream, "--firewall is required (available: %s)\n", strings.Join(firewall.Formats, ", "))
+		return exitCodeErr
+	default:
+		fmt.Fprintf(c.errStream, "unknown firewall format '%s' (available: %s)\n",
+			format, strings.Join(firewall.Formats, ", "))
+		return exitCodeErr
+	}
+	// the prefix lengths are parsed as the subnet grouping such as 'subnet/24,64'.
+	g, err := tcpflow.ParseGrouping(tcpflow.GroupBySubnet + "/" + aggregate)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "invalid aggregate '%s'\n", aggregate)
+		return exitCodeErr
+	}
+	if timeout < 0 {
+		fmt.Fprintf(c.errStream, "invalid timeout '%s'\n", timeout)
+		return exitCodeErr
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		fmt.Fprintf(c.errStream, "%v", err)
+		return exitCodeErr
+	}
+
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	collectedAt := time.Now()
+	var warnings []*tcpflow.Warning
+	// the rules need the addresses, and the processes for their comments.
+	flows, err := src.GetHostFlows(ctx, &tcpflow.GetHostFlowsOption{
+		Numeric:   true,
+		Processes: true,
+		Filter:    tcpflow.FilterAll,
+		OnWarning: func(w *tcpflow.Warning) {
+			warnings = append(warnings, w)
+		},
+	})
+	c.printWarnings(warnings)
+	if err != nil {
+		log.Printf("failed to get host flows: %v\n", err)
+		return exitCodeErr
+	}
+
+	rules := firewall.Generate(flows, g.Bits4, g.Bits6)
+	hostname, _ := os.Hostname()
+	header := fmt.Sprintf("Generated by lstf %s from %d flows of %s (source: %s) at %s.",
+		version, len(flows), hostname, src.Name(), collectedAt.Format(time.RFC3339))
+	if err := firewall.Write(c.outStream, format, rules, header); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+	return exitCodeOK
+}
+
+var exportHelpText = `Usage: lstf export --firewall FORMAT [options]
+
+  Print the firewall rules allowing the observed host flows, which are the inbound rules
+  of the passive flows for the listening ports and the outbound rules of the active flows
+  for the peer ports. The peers are aggregated into CIDRs, and the comments of the rules
+  name the processes owning the flows.
+  The rules keep the default policies, so review them and then change the policies to drop.
+
+  FORMAT:
+    nftables  the nft script of the table 'inet lstf'
+    iptables  the shell script of iptables and ip6tables commands
+
+Options:
+  --firewall FORMAT, -f FORMAT	print the rules in FORMAT, which is 'nftables' or 'iptables'
+  --aggregate BITS4[,BITS6] 	aggregate the peers into the networks of the prefix lengths (default: 24,64)
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+  --timeout DURATION        	give up the collection after DURATION such as '5s', and print the rules of the partial flows
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+// runListen executes 'lstf listen' subcommand.
+func (c *CLI) runListen(args []string) int {
+	var (
+		jsonFormat bool
+		debug      bool
+	)
+	flags := c.newFlagSet(name+" listen", listenHelpText)
+	flags.BoolVar(&jsonFormat, "json", false, "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	portSet, err := netutil.LocalListeningPorts()
+	if err != nil {
+		log.Printf("failed to get listening ports: %v\n", err)
+		return exitCodeErr
+	}
+	ports := portSet.Sorted()
+
+	if jsonFormat {
+		b, err := json.Marshal(ports)
+		if err != nil {
+			log.Printf("failed to marshal json: %v\n", err)
+			return exitCodeErr
+		}
+		fmt.Fprintf(c.outStream, "%s\n", b)
+		return exitCodeOK
+	}
+	fmt.Fprintln(c.outStream, "Port")
+	for _, port := range ports {
+		fmt.Fprintln(c.outStream, port)
+	}
+	return exitCodeOK
+}
+
+var listenHelpText = `Usage: lstf listen [options]
+
+  Print the local ports listening on all the addresses or the loopback address,
+  which are the ports of the passive open flows ('<--').
+
+Options:
+  --json                    	print results as json format
+  --help, -h                	print help
+`
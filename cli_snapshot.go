@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/netutil"
+)
+
+// runSnapshot executes 'lstf snapshot' subcommand.
+func (c *CLI) runSnapshot(args []string) int {
+	var (
+		output string
+		debug  bool
+	)
+	flags := c.newFlagSet(name+" snapshot", snapshotHelpText)
+	flags.StringVarP(&output, "output", "o", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if output == "" {
+		output = defaultSnapshotName(time.Now()) + ".tar.gz"
+	}
+
+	var (
+		w   io.Writer = c.outStream
+		dir           = snapshotDirName(output)
+	)
+	if output == "-" {
+		dir = defaultSnapshotName(time.Now())
+	} else {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Printf("failed to create snapshot: %v\n", err)
+			return exitCodeErr
+		}
+		defer f.Close()
+		w = f
+	}
+
+	warnings, err := netutil.WriteSnapshot(w, dir)
+	for _, warning := range warnings {
+		if dlog.Debug {
+			fmt.Fprintf(c.errStream, "warning: %s\n", warning)
+		}
+	}
+	if len(warnings) > 0 && !dlog.Debug {
+		fmt.Fprintf(c.errStream, "warning: %d processes could not be inspected (use --debug for details)\n", len(warnings))
+	}
+	if err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		log.Printf("failed to create snapshot: %v\n", err)
+		return exitCodeErr
+	}
+
+	if output != "-" {
+		fmt.Fprintf(c.errStream, "wrote %s (extract it and run 'lstf --proc-root %s')\n", output, dir)
+	}
+	return exitCodeOK
+}
+
+// defaultSnapshotName returns the name such as 'lstf-snapshot-web01-20200102-150405'.
+func defaultSnapshotName(now time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("lstf-snapshot-%s-%s", host, now.Format("20060102-150405"))
+}
+
+// snapshotDirName returns the top directory in the tarball from the file name.
+func snapshotDirName(output string) string {
+	base := filepath.Base(output)
+	for _, ext := range []string{".tar.gz", ".tgz"} {
+		if strings.HasSuffix(base, ext) {
+			return strings.TrimSuffix(base, ext)
+		}
+	}
+	return base
+}
+
+var snapshotHelpText = `Usage: lstf snapshot [options]
+
+  Collect the procfs files that lstf reads into a gzipped tarball, so that
+  the host can be analyzed after the fact by 'lstf --proc-root DIR'.
+  The tarball contains the TCP socket tables, the stat files of the processes
+  which open sockets, and the manifest of their socket fds.
+
+Options:
+  --output FILE, -o FILE    	write the tarball to FILE, or stdout if FILE is '-'
+                            	(default: lstf-snapshot-<hostname>-<time>.tar.gz)
+  --debug                   	print each process that could not be inspected
+
+  --help, -h                	print help
+`
@@ -2,8 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/baseline"
+	"github.com/yuuki/lstf/rules"
+	"github.com/yuuki/lstf/tcpflow"
 )
 
 func TestRun_global(t *testing.T) {
@@ -26,6 +40,12 @@ func TestRun_global(t *testing.T) {
 			expectedStatus: exitCodeErr,
 			expectedSubErr: "Usage: lstf",
 		},
+		{
+			desc:           "trace help",
+			arg:            "lstf trace --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf trace",
+		},
 		{
 			desc:           "version",
 			arg:            "lstf --version",
@@ -56,6 +76,324 @@ func TestRun_global(t *testing.T) {
 			expectedStatus: exitCodeOK,
 			expectedSubOut: "{\"direction\":",
 		},
+		{
+			desc:           "--source file",
+			arg:            "lstf -n --json --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\"source\":\"file\"",
+		},
+		{
+			desc:           "--json-envelope",
+			arg:            "lstf -n --json-envelope --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\"schema_version\":1,",
+		},
+		{
+			desc:           "--ndjson",
+			arg:            "lstf -n --ndjson --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "{\"schema_version\":1,\"hostname\":",
+		},
+		{
+			desc:           "--catalog",
+			arg:            "lstf -n --catalog testdata/catalog.txt --filter db --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\t(network=db)\n",
+		},
+		{
+			desc:           "--filter with unknown label",
+			arg:            "lstf -n --catalog testdata/catalog.txt --filter unknown --source file:testdata/flows.json",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf",
+		},
+		{
+			desc:           "--cloud-ranges",
+			arg:            "lstf -n --cloud-ranges testdata/cloud/aws-ip-ranges.json,testdata/cloud/cloudflare-ips.json --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "Local Address:Port",
+		},
+		{
+			desc:           "--filter cloud without --cloud-ranges",
+			arg:            "lstf -n --filter cloud:aws --source file:testdata/flows.json",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--filter cloud requires --cloud-ranges",
+		},
+		{
+			desc:           "invalid --cloud-ranges",
+			arg:            "lstf -n --cloud-ranges testdata/catalog.txt",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "testdata/catalog.txt: failed to parse cloud ranges",
+		},
+		{
+			desc:           "--group-by subnet",
+			arg:            "lstf -n --group-by subnet/16 --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\t10.0.0.0/16:3306\t",
+		},
+		{
+			desc:           "--group-by process without --processes",
+			arg:            "lstf -g process --source file:testdata/flows.json",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--group-by process requires --processes",
+		},
+		{
+			desc:           "unknown --group-by",
+			arg:            "lstf -g unknown",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown grouping",
+		},
+		{
+			desc:           "--proc-root",
+			arg:            "lstf -n -p --proc-root testdata/procsnapshot",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "(\"app server\",pgid=200)",
+		},
+		{
+			desc:           "--proc-root --detail",
+			arg:            "lstf -n --detail --proc-root testdata/procsnapshot",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\tTIME-WAIT uid=0 inode=0 timer=(timewait,30s,0)\n",
+		},
+		{
+			desc:           "--proc-root with netlink source",
+			arg:            "lstf --proc-root testdata/procsnapshot --source netlink",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--proc-root cannot be used with netlink source",
+		},
+		{
+			desc:           "--pcap without --local",
+			arg:            "lstf --pcap capture.pcap",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--pcap requires --local",
+		},
+		{
+			desc:           "snapshot help",
+			arg:            "lstf snapshot --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf snapshot",
+		},
+		{
+			desc:           "agent help",
+			arg:            "lstf agent --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf agent",
+		},
+		{
+			desc:           "agent without exporter",
+			arg:            "lstf agent",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "no exporter is configured",
+		},
+		{
+			desc:           "agent --dogstatsd without --statsd",
+			arg:            "lstf agent --dogstatsd --webhook http://127.0.0.1:8080",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--dogstatsd requires --statsd",
+		},
+		{
+			desc:           "daemon help",
+			arg:            "lstf daemon --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf daemon",
+		},
+		{
+			desc:           "daemon invalid history",
+			arg:            "lstf daemon --history 0",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "invalid history",
+		},
+		{
+			desc:           "top help",
+			arg:            "lstf top --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf top",
+		},
+		{
+			desc:           "top without terminal",
+			arg:            "lstf top",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "lstf top requires a terminal",
+		},
+		{
+			desc:           "unknown --source",
+			arg:            "lstf --source unknown",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown flow source",
+		},
+		{
+			desc:           "unknown command",
+			arg:            "lstf unknown",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown command 'unknown'",
+		},
+		{
+			desc:           "flows",
+			arg:            "lstf flows -n --json --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\"source\":\"file\"",
+		},
+		{
+			desc:           "flows --timeout",
+			arg:            "lstf flows -n --json --timeout 10s --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "\"source\":\"file\"",
+		},
+		{
+			desc:           "flows invalid timeout",
+			arg:            "lstf flows --timeout -1s",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "invalid timeout '-1s'",
+		},
+		{
+			desc:           "flows help",
+			arg:            "lstf flows --help",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf flows",
+		},
+		{
+			desc:           "watch invalid interval",
+			arg:            "lstf watch --interval 0",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "invalid interval",
+		},
+		{
+			desc:           "watch --count",
+			arg:            "lstf watch -n --count 2 --interval 10ms --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "Local Address:Port",
+		},
+		{
+			desc:           "watch invalid count",
+			arg:            "lstf watch --count -1",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "invalid count",
+		},
+		{
+			desc:           "--count without --watch",
+			arg:            "lstf -n --count 2 --source file:testdata/flows.json",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--count requires --watch",
+		},
+		{
+			desc:           "check violations",
+			arg:            "lstf check --rules testdata/rules.yaml --source file:testdata/flows.json",
+			expectedStatus: exitCodeCheckCritical,
+			expectedSubOut: "CRITICAL - 2 violations of 3 rules in 3 flows",
+		},
+		{
+			desc:           "check --json",
+			arg:            "lstf check --json -r testdata/rules.yaml --source file:testdata/flows.json",
+			expectedStatus: exitCodeCheckCritical,
+			expectedSubOut: "\"status\":\"critical\"",
+		},
+		{
+			desc:           "check without rules",
+			arg:            "lstf check",
+			expectedStatus: exitCodeCheckUnknown,
+			expectedSubOut: "UNKNOWN - --rules is required",
+		},
+		{
+			desc:           "check rules not found",
+			arg:            "lstf check --json -r testdata/none.yaml --source file:testdata/flows.json",
+			expectedStatus: exitCodeCheckUnknown,
+			expectedSubOut: "\"status\":\"unknown\"",
+		},
+		{
+			desc:           "check failed to get flows",
+			arg:            "lstf check -r testdata/rules.yaml --source file:testdata/none.json",
+			expectedStatus: exitCodeCheckUnknown,
+			expectedSubOut: "UNKNOWN - failed to get host flows",
+		},
+		{
+			desc:           "baseline without action",
+			arg:            "lstf baseline",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "Usage: lstf baseline learn",
+		},
+		{
+			desc:           "baseline check with an option of learn",
+			arg:            "lstf baseline check --duration 1m",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--duration is an option of 'lstf baseline learn'",
+		},
+		{
+			desc:           "export --firewall nftables",
+			arg:            "lstf export --firewall nftables --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "ip saddr 10.0.2.0/24 tcp dport 80 accept comment \"nginx (120 connections)\"",
+		},
+		{
+			desc:           "export --firewall iptables",
+			arg:            "lstf export -f iptables --aggregate 32 --source file:testdata/flows.json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "iptables -A OUTPUT -p tcp -d 10.0.1.10/32 --dport 3306 -m comment --comment 'app (22 connections)' -j ACCEPT",
+		},
+		{
+			desc:           "export without firewall",
+			arg:            "lstf export",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "--firewall is required",
+		},
+		{
+			desc:           "export unknown firewall",
+			arg:            "lstf export --firewall pf",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown firewall format 'pf'",
+		},
+		{
+			desc:           "listen --json",
+			arg:            "lstf listen --json",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "[",
+		},
+		{
+			desc:           "version",
+			arg:            "lstf version",
+			expectedStatus: exitCodeOK,
+			expectedSubErr: "lstf version",
+		},
+		{
+			desc:           "help",
+			arg:            "lstf help",
+			expectedStatus: exitCodeOK,
+			expectedSubErr: "Commands:",
+		},
+		{
+			desc:           "help of command",
+			arg:            "lstf help watch",
+			expectedStatus: exitCodeOK,
+			expectedSubErr: "Usage: lstf watch",
+		},
+		{
+			desc:           "help of unknown command",
+			arg:            "lstf help unknown",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown command 'unknown'",
+		},
+		{
+			desc:           "completion bash",
+			arg:            "lstf completion bash",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "    watch)\n        flags='--catalog",
+		},
+		{
+			desc:           "completion zsh",
+			arg:            "lstf completion zsh",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "#compdef lstf\n",
+		},
+		{
+			desc:           "completion fish",
+			arg:            "lstf completion fish",
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "complete -c lstf -n '__lstf_command listen' -l json\n",
+		},
+		{
+			desc:           "completion of unknown shell",
+			arg:            "lstf completion tcsh",
+			expectedStatus: exitCodeErr,
+			expectedSubErr: "unknown shell 'tcsh'",
+		},
 	}
 	for _, tc := range tests {
 		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
@@ -75,3 +413,346 @@ func TestRun_global(t *testing.T) {
 		}
 	}
 }
+
+func TestHelpText_commands(t *testing.T) {
+	for _, cmd := range commands {
+		want := fmt.Sprintf("\n  %-10s  %s\n", cmd.name, cmd.summary)
+		if !strings.Contains(helpText, want) {
+			t.Errorf("help should contain %q", want)
+		}
+	}
+}
+
+func TestRun_watchCount(t *testing.T) {
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream}
+	args := strings.Split("lstf -n --json --watch=10ms --count 3 --source file:testdata/flows.json", " ")
+	if status := cli.Run(args); status != exitCodeOK {
+		t.Fatalf("status should be %d, got %d: %s", exitCodeOK, status, errStream)
+	}
+	if lines := strings.Count(outStream.String(), "\n"); lines != 3 {
+		t.Errorf("json should be printed 3 times, got %d lines: %s", lines, outStream)
+	}
+}
+
+func TestNextWatchTime(t *testing.T) {
+	prev := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc    string
+		now     time.Duration
+		next    time.Duration
+		skipped int
+	}{
+		{"in time", 1 * time.Second, 3 * time.Second, 0},
+		{"just in time", 3 * time.Second, 3 * time.Second, 0},
+		{"overrun", 4 * time.Second, 6 * time.Second, 1},
+		{"overrun twice", 7 * time.Second, 9 * time.Second, 2},
+	}
+	for _, tc := range tests {
+		next, skipped := nextWatchTime(prev, 3*time.Second, prev.Add(tc.now))
+		if want := prev.Add(tc.next); !next.Equal(want) || skipped != tc.skipped {
+			t.Errorf("desc: %q, next should be %s with %d skipped, got %s with %d skipped",
+				tc.desc, want, tc.skipped, next, skipped)
+		}
+	}
+}
+
+func TestIntervalValue(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+		err  bool
+	}{
+		{"3", 3 * time.Second, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"1m", time.Minute, false},
+		{"3x", 0, true},
+	}
+	for _, tc := range tests {
+		var v intervalValue
+		err := v.Set(tc.arg)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q should raise error", tc.arg)
+			}
+			continue
+		}
+		if err != nil || time.Duration(v) != tc.want {
+			t.Errorf("%q should be %s, got %s (%v)", tc.arg, tc.want, time.Duration(v), err)
+		}
+	}
+}
+
+func TestRunBaseline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "baseline.json")
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream}
+	args := strings.Split("lstf baseline learn --duration 50ms --interval 10ms --source file:testdata/flows.json --out "+file, " ")
+	if status := cli.Run(args); status != exitCodeOK {
+		t.Fatalf("status should be %v, not %v: %s", exitCodeOK, status, errStream)
+	}
+	if !strings.Contains(errStream.String(), "learned 3 flows") {
+		t.Errorf("learn should report 3 flows, got %q", errStream)
+	}
+
+	outStream.Reset()
+	errStream.Reset()
+	args = strings.Split("lstf baseline check --source file:testdata/flows.json -b "+file, " ")
+	if status := cli.Run(args); status != exitCodeOK {
+		t.Fatalf("status should be %v, not %v: %s%s", exitCodeOK, status, outStream, errStream)
+	}
+	if !strings.HasPrefix(outStream.String(), "OK - 0 anomalies in 3 flows") {
+		t.Errorf("check should print the OK status line, got %q", outStream)
+	}
+}
+
+func TestReportCheck_partial(t *testing.T) {
+	rs, err := rules.Load("testdata/rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := netip.MustParseAddr("10.0.1.9")
+	tests := []struct {
+		desc           string
+		flow           *tcpflow.HostFlow
+		partial        bool
+		expectedStatus int
+		expectedSubOut string
+	}{
+		{
+			desc: "complete flows",
+			flow: &tcpflow.HostFlow{
+				Direction:   tcpflow.FlowActive,
+				Local:       tcpflow.NewWildcardAddrPort(local),
+				Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+				Connections: 10,
+			},
+			expectedStatus: exitCodeOK,
+			expectedSubOut: "OK - 3 rules passed in 1 flows",
+		},
+		{
+			desc: "partial flows without violations",
+			flow: &tcpflow.HostFlow{
+				Direction:   tcpflow.FlowActive,
+				Local:       tcpflow.NewWildcardAddrPort(local),
+				Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+				Connections: 10,
+			},
+			partial:        true,
+			expectedStatus: exitCodeCheckUnknown,
+			expectedSubOut: "UNKNOWN - 3 rules passed in 1 partial flows, but the collection has timed out",
+		},
+		{
+			desc: "partial flows with violations",
+			flow: &tcpflow.HostFlow{
+				Direction:   tcpflow.FlowActive,
+				Local:       tcpflow.NewWildcardAddrPort(local),
+				Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("8.8.8.8"), 443),
+				Connections: 3,
+				Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+			},
+			partial:        true,
+			expectedStatus: exitCodeCheckCritical,
+			expectedSubOut: "CRITICAL - 1 violations of 3 rules in 1 flows",
+		},
+	}
+	for _, tc := range tests {
+		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+		cli := &CLI{outStream: outStream, errStream: errStream}
+		flows := tcpflow.HostFlows{tc.flow.UniqKey(): tc.flow}
+		if status := cli.reportCheck(rs, flows, tc.partial, false); status != tc.expectedStatus {
+			t.Errorf("desc: %q, status should be %v, not %v", tc.desc, tc.expectedStatus, status)
+		}
+		if !strings.Contains(outStream.String(), tc.expectedSubOut) {
+			t.Errorf("desc: %q, subout should contain %q, got %q", tc.desc, tc.expectedSubOut, outStream.String())
+		}
+	}
+}
+
+func TestLearnBaseline_skipped(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "baseline.json")
+	flow := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowActive,
+		Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+		Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+		Connections: 1,
+	}
+	flows := tcpflow.HostFlows{flow.UniqKey(): flow}
+	// the collections cycle through the full flows, the partial flows and a failure.
+	calls, full := 0, 0
+	collect := func(ctx context.Context) (tcpflow.HostFlows, bool, error) {
+		calls++
+		switch calls % 3 {
+		case 1:
+			full++
+			return flows, false, nil
+		case 2:
+			return flows, true, nil
+		}
+		return nil, false, xerrors.New("netlink failed")
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream}
+	if status := cli.learnBaseline(collect, file, 85*time.Millisecond, 10*time.Millisecond); status != exitCodeOK {
+		t.Fatalf("status should be %v, not %v: %s", exitCodeOK, status, errStream)
+	}
+	b, err := baseline.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last full collection may be interrupted by the end of learning.
+	if calls < 3 || b.Samples > full || b.Samples < full-1 {
+		t.Errorf("samples should be the %d full collections of the %d collections, not %d", full, calls, b.Samples)
+	}
+}
+
+func TestReportBaseline_partial(t *testing.T) {
+	local := netip.MustParseAddr("10.0.1.9")
+	mysql := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowActive,
+		Local:       tcpflow.NewWildcardAddrPort(local),
+		Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+		Connections: 10,
+	}
+	ssh := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowPassive,
+		Local:       tcpflow.NewAddrPort(local, 22),
+		Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.2.13")),
+		Connections: 1,
+	}
+	public := &tcpflow.HostFlow{
+		Direction:   tcpflow.FlowActive,
+		Local:       tcpflow.NewWildcardAddrPort(local),
+		Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("8.8.8.8"), 443),
+		Connections: 3,
+	}
+	b := baseline.New()
+	b.Learn(tcpflow.HostFlows{mysql.UniqKey(): mysql, ssh.UniqKey(): ssh}, time.Now())
+
+	tests := []struct {
+		desc           string
+		flows          tcpflow.HostFlows
+		partial        bool
+		expectedStatus int
+		expectedSubOut string
+	}{
+		{
+			desc:           "complete flows missing ssh",
+			flows:          tcpflow.HostFlows{mysql.UniqKey(): mysql},
+			expectedStatus: exitCodeCheckWarning,
+			expectedSubOut: "[missing]",
+		},
+		{
+			desc:           "partial flows missing ssh",
+			flows:          tcpflow.HostFlows{mysql.UniqKey(): mysql},
+			partial:        true,
+			expectedStatus: exitCodeCheckUnknown,
+			expectedSubOut: "UNKNOWN - 0 anomalies in 1 partial flows",
+		},
+		{
+			desc:           "partial flows with a new flow",
+			flows:          tcpflow.HostFlows{mysql.UniqKey(): mysql, public.UniqKey(): public},
+			partial:        true,
+			expectedStatus: exitCodeCheckCritical,
+			expectedSubOut: "CRITICAL - 1 anomalies in 2 partial flows",
+		},
+	}
+	for _, tc := range tests {
+		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+		cli := &CLI{outStream: outStream, errStream: errStream}
+		if status := cli.reportBaseline(b, tc.flows, tc.partial, 0.5, false); status != tc.expectedStatus {
+			t.Errorf("desc: %q, status should be %v, not %v", tc.desc, tc.expectedStatus, status)
+		}
+		if !strings.Contains(outStream.String(), tc.expectedSubOut) {
+			t.Errorf("desc: %q, subout should contain %q, got %q", tc.desc, tc.expectedSubOut, outStream.String())
+		}
+		if tc.partial && strings.Contains(outStream.String(), "[missing]") {
+			t.Errorf("desc: %q, the partial flows should not be checked for the missing flows, got %q", tc.desc, outStream.String())
+		}
+	}
+}
+
+func TestRunAgent_once(t *testing.T) {
+	var got tcpflow.Envelope
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("body should be an envelope: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream}
+	args := strings.Split("lstf agent --once -n --source file:testdata/flows.json --webhook "+ts.URL, " ")
+
+	if status := cli.Run(args); status != exitCodeOK {
+		t.Fatalf("status should be %v, not %v: %s", exitCodeOK, status, errStream)
+	}
+	if got.SchemaVersion != tcpflow.SchemaVersion || got.Source != "file" || len(got.Flows) != 3 {
+		t.Errorf("envelope of testdata/flows.json should be pushed, but %+v", got)
+	}
+}
+
+func TestRunConfigShow(t *testing.T) {
+	t.Setenv("LSTF_CONFIG", "testdata/config/system.yaml")
+	t.Setenv("LSTF_FILTER", "private")
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream}
+	if status := cli.Run(strings.Split("lstf config show", " ")); status != exitCodeOK {
+		t.Fatalf("status should be %v, not %v: %s", exitCodeOK, status, errStream)
+	}
+	for _, want := range []string{
+		"# config files: testdata/config/system.yaml\n",
+		"# profile: default\n",
+		"# environment: LSTF_FILTER\n",
+		"numeric: true\n",
+		"filter: private\n",
+	} {
+		if !strings.Contains(outStream.String(), want) {
+			t.Errorf("output should contain %q, got %q", want, outStream.String())
+		}
+	}
+}
+
+func TestRun_profile(t *testing.T) {
+	t.Setenv("LSTF_CONFIG", "testdata/config/system.yaml")
+
+	tests := []struct {
+		desc           string
+		env            string
+		arg            string
+		expectedSubOut string
+	}{
+		{
+			desc:           "profile",
+			arg:            "lstf --profile prod",
+			expectedSubOut: "[{\"direction\":",
+		},
+		{
+			desc:           "environment overrides profile",
+			env:            "ndjson",
+			arg:            "lstf --profile prod",
+			expectedSubOut: "Z\",\"direction\":",
+		},
+		{
+			desc:           "flag overrides environment",
+			env:            "ndjson",
+			arg:            "lstf --profile prod --json-envelope",
+			expectedSubOut: "\"lstf_version\":",
+		},
+	}
+	for _, tc := range tests {
+		t.Setenv("LSTF_FORMAT", tc.env)
+		outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+		cli := &CLI{outStream: outStream, errStream: errStream}
+		if status := cli.Run(strings.Split(tc.arg, " ")); status != exitCodeOK {
+			t.Errorf("desc: %q, status should be %v, not %v: %s", tc.desc, exitCodeOK, status, errStream)
+		}
+		if !strings.Contains(outStream.String(), tc.expectedSubOut) {
+			t.Errorf("desc: %q, output should contain %q, got %q", tc.desc, tc.expectedSubOut, outStream.String())
+		}
+	}
+}
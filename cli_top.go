@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/yuuki/lstf/tcpflow"
+	"github.com/yuuki/lstf/top"
+)
+
+const defaultTopInterval = 2 * time.Second
+
+// runTop executes 'lstf top' subcommand.
+func (c *CLI) runTop(args []string) int {
+	var (
+		numeric   bool
+		processes bool
+		filter    string
+		source    string
+		interval  time.Duration
+		profile   string
+		debug     bool
+	)
+	flags := c.newFlagSet(name+" top", topHelpText)
+	flags.BoolVarP(&numeric, "numeric", "n", false, "")
+	flags.BoolVarP(&processes, "processes", "p", false, "")
+	flags.StringVarP(&filter, "filter", "f", tcpflow.FilterAll, "")
+	flags.StringVar(&source, "source", tcpflow.SourceAuto, "")
+	flags.DurationVarP(&interval, "interval", "i", defaultTopInterval, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if !(filter == tcpflow.FilterAll ||
+		filter == tcpflow.FilterPublic ||
+		filter == tcpflow.FilterPrivate) {
+		fmt.Fprint(c.errStream, topHelpText)
+		return exitCodeErr
+	}
+	if interval <= 0 {
+		fmt.Fprintf(c.errStream, "invalid interval '%s'\n", interval)
+		return exitCodeErr
+	}
+
+	src, err := tcpflow.NewFlowSource(source)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		fmt.Fprintln(c.errStream, "lstf top requires a terminal (use --watch instead)")
+		return exitCodeErr
+	}
+
+	if err := setRLimitNoFile(); err != nil {
+		fmt.Fprintf(c.errStream, "%v", err)
+		return exitCodeErr
+	}
+
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		fmt.Fprintf(c.errStream, "failed to set the terminal raw mode: %v\n", err)
+		return exitCodeErr
+	}
+	defer term.Restore(in, state)
+	// use the alternate screen without the cursor, and restore them on exit.
+	fmt.Fprint(c.outStream, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(c.outStream, "\x1b[?25h\x1b[?1049l")
+
+	m := top.NewModel(numeric, processes)
+
+	type result struct {
+		flows tcpflow.HostFlows
+		at    time.Time
+		err   error
+	}
+	results := make(chan *result, 1)
+	collecting := false
+	collect := func() {
+		if collecting {
+			return
+		}
+		collecting = true
+		opt := &tcpflow.GetHostFlowsOption{
+			Numeric:   m.Numeric,
+			Processes: m.Processes,
+			Filter:    filter,
+			Sockets:   true,
+		}
+		go func() {
+			at := time.Now()
+			flows, err := src.GetHostFlows(context.Background(), opt)
+			results <- &result{flows: flows, at: at, err: err}
+		}()
+	}
+
+	keys := make(chan []top.Key)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- top.ParseKeys(buf[:n])
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGWINCH, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	render := func() {
+		width, height, err := term.GetSize(out)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		m.Render(c.outStream, width, height)
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	collect()
+	render()
+	for {
+		select {
+		case r := <-results:
+			collecting = false
+			m.Update(r.flows, r.at, r.err)
+		case <-tick.C:
+			collect()
+			continue
+		case ks, ok := <-keys:
+			if !ok {
+				return exitCodeOK
+			}
+			for _, k := range ks {
+				switch m.HandleKey(k) {
+				case top.ActionQuit:
+					return exitCodeOK
+				case top.ActionRefresh:
+					collect()
+				}
+			}
+		case s := <-sig:
+			if s == syscall.SIGTERM {
+				return exitCodeOK
+			}
+		}
+		render()
+	}
+}
+
+var topHelpText = `Usage: lstf top [options]
+
+  Show host flows in a full-screen terminal UI refreshed in place.
+  The flows whose numbers of connections changed since the last refresh are highlighted.
+
+Keys:
+  up/down, j/k, PgUp/PgDn	move the cursor
+  enter, space              	expand or collapse the flow into its sockets
+  s, 1-4                    	sort by the next column, or by local, peer, connections or process
+  r                         	reverse the order
+  /                         	filter the flows by a text (esc clears the filter)
+  n                         	toggle numeric addresses
+  p                         	toggle processes
+  q, Ctrl-C                 	quit
+
+Options:
+  --interval DURATION, -i DURATION	refresh every DURATION such as '5s' (default: 2s)
+  --numeric, -n             	show numerical addresses instead of trying to determine symbolic host names.
+  --processes, -p          	 	show process using socket
+  --filter FILTER, -f FILTER	filter results by "all", "public" or "private" (default: "all")
+  --source SOURCE           	get connections from SOURCE (default: "auto")
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
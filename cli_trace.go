@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const defaultTraceDuration = 10 * time.Second
+
+// runTrace executes 'lstf trace' subcommand.
+func (c *CLI) runTrace(args []string) int {
+	var (
+		numeric   bool
+		processes bool
+		json      bool
+		envelope  bool
+		ndjson    bool
+		filter    string
+		duration  time.Duration
+		profile   string
+		debug     bool
+	)
+	flags := c.newFlagSet(name+" trace", traceHelpText)
+	flags.BoolVarP(&numeric, "numeric", "n", false, "")
+	flags.BoolVarP(&processes, "processes", "p", false, "")
+	flags.BoolVar(&json, "json", false, "")
+	flags.BoolVar(&envelope, "json-envelope", false, "")
+	flags.BoolVar(&ndjson, "ndjson", false, "")
+	flags.StringVarP(&filter, "filter", "f", tcpflow.FilterAll, "")
+	flags.DurationVarP(&duration, "duration", "d", defaultTraceDuration, "")
+	flags.StringVar(&profile, "profile", "", "")
+	flags.BoolVar(&debug, "debug", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeErr
+	}
+
+	setDebugOutputLevel(debug)
+
+	if _, err := applyProfile(flags, profile); err != nil {
+		fmt.Fprintf(c.errStream, "%v\n", err)
+		return exitCodeErr
+	}
+
+	if !(filter == tcpflow.FilterAll ||
+		filter == tcpflow.FilterPublic ||
+		filter == tcpflow.FilterPrivate) {
+		fmt.Fprint(c.errStream, traceHelpText)
+		return exitCodeErr
+	}
+
+	// stop tracing when the duration has elapsed or interrupted.
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C:
+		case <-sig:
+		}
+		close(done)
+	}()
+
+	var warnings []*tcpflow.Warning
+	collectedAt := time.Now()
+	flows, err := tcpflow.TraceHostFlows(&tcpflow.GetHostFlowsOption{
+		Processes: processes,
+		Filter:    filter,
+		Numeric:   numeric,
+		OnWarning: func(w *tcpflow.Warning) {
+			warnings = append(warnings, w)
+		},
+	}, done)
+	c.printWarnings(warnings)
+	if err != nil {
+		if dlog.Debug {
+			log.Printf("failed to trace host flows: %+v\n", err)
+		} else {
+			log.Printf("failed to trace host flows: %v\n", err)
+		}
+		return exitCodeErr
+	}
+
+	if ndjson {
+		if err := c.PrintHostFlowsAsNDJSON(flows, collectedAt); err != nil {
+			log.Printf("failed to print json: %v\n", err)
+			return exitCodeErr
+		}
+	} else if envelope {
+		if err := c.PrintHostFlowsAsEnvelope(flows, "ebpf", collectedAt); err != nil {
+			log.Printf("failed to print json: %v\n", err)
+			return exitCodeErr
+		}
+	} else if json {
+		if err := c.PrintHostFlowsAsJSON(flows); err != nil {
+			log.Printf("failed to print json: %v\n", err)
+			return exitCodeErr
+		}
+	} else {
+		c.PrintHostFlows(flows, processes)
+	}
+
+	return exitCodeOK
+}
+
+var traceHelpText = `Usage: lstf trace [options]
+
+  Trace TCP connections opened or closed for a while by eBPF, and print them as host flows.
+  It catches short-lived connections that snapshots miss. It requires root privileges.
+
+Options:
+  --duration DURATION, -d DURATION	trace for DURATION such as '30s' or '5m' (default: 10s). Ctrl-C stops tracing early.
+  --numeric, -n             	show numerical addresses instead of trying to determine symbolic host names.
+  --processes, -p          	 	show process using socket
+  --json                    	print results as json format
+  --json-envelope           	print results as json format with the hostname, the collection time and the source
+  --ndjson                  	print each flow as a line of json format with the hostname and the collection time
+  --filter FILTER, -f FILTER	filter results by "all", "public" or "private" (default: "all")
+
+  --profile NAME            	use the profile NAME of the config files (see 'lstf config show --help')
+  --help, -h                	print help
+`
@@ -0,0 +1,349 @@
+// Package config loads the configuration files and the environment variables of lstf.
+package config
+
+import (
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/yuuki/lstf/exporter"
+	"github.com/yuuki/lstf/netutil"
+)
+
+// DefaultProfile is the name of the profile used if no profile is specified.
+const DefaultProfile = "default"
+
+// Formats of Profile.Format.
+const (
+	FormatText         = "text"
+	FormatJSON         = "json"
+	FormatJSONEnvelope = "json-envelope"
+	FormatNDJSON       = "ndjson"
+)
+
+// SystemPath is the path of the configuration file for all users.
+const SystemPath = "/etc/lstf/config.yaml"
+
+// UserPath returns the path of the configuration file for the user,
+// which is $XDG_CONFIG_HOME/lstf/config.yaml or ~/.config/lstf/config.yaml.
+func UserPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "lstf", "config.yaml")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "lstf", "config.yaml")
+}
+
+// Config is the configuration file.
+type Config struct {
+	// Profile is the name of the profile used if no profile is specified (default: "default").
+	Profile  string              `yaml:"profile,omitempty"`
+	Profiles map[string]*Profile `yaml:"profiles,omitempty"`
+}
+
+// Profile is a set of the default options. The empty fields are not set.
+type Profile struct {
+	// Format is one of "text", "json", "json-envelope" and "ndjson".
+	Format    string `yaml:"format,omitempty"`
+	Numeric   *bool  `yaml:"numeric,omitempty"`
+	Processes *bool  `yaml:"processes,omitempty"`
+	Filter    string `yaml:"filter,omitempty"`
+	GroupBy   string `yaml:"group_by,omitempty"`
+	Source    string `yaml:"source,omitempty"`
+	// Resolver is the address of the DNS server to resolve host names such as "10.0.0.2:53".
+	Resolver string `yaml:"resolver,omitempty"`
+	// Catalog is the path of the catalog of the named networks.
+	Catalog string `yaml:"catalog,omitempty"`
+	// Networks are the named networks added to the catalog, such as "10.0.1.0/24: prod-db".
+	Networks    map[string]string `yaml:"networks,omitempty"`
+	CloudRanges []string          `yaml:"cloud_ranges,omitempty"`
+	// Agent is the configuration of 'lstf agent' such as the exporters.
+	Agent *exporter.Config `yaml:"agent,omitempty"`
+}
+
+// Load reads the configuration files in order. The latter file overrides the
+// profiles of the former by field. The files not found are skipped, and the
+// paths of the files read are returned.
+func Load(paths ...string) (*Config, []string, error) {
+	cfg := &Config{Profiles: map[string]*Profile{}}
+	var loaded []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, xerrors.Errorf("could not read %s: %w", path, err)
+		}
+		var c Config
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return nil, nil, xerrors.Errorf("could not parse %s: %w", path, err)
+		}
+		for name, p := range c.Profiles {
+			if p == nil {
+				p = &Profile{}
+			}
+			if err := p.validate(); err != nil {
+				return nil, nil, xerrors.Errorf("%s: profile %q: %w", path, name, err)
+			}
+			if cfg.Profiles[name] == nil {
+				cfg.Profiles[name] = &Profile{}
+			}
+			cfg.Profiles[name].Merge(p)
+		}
+		if c.Profile != "" {
+			cfg.Profile = c.Profile
+		}
+		loaded = append(loaded, path)
+	}
+	return cfg, loaded, nil
+}
+
+// LoadDefault reads the file of $LSTF_CONFIG, or the system file and the user file.
+func LoadDefault() (*Config, []string, error) {
+	if path := os.Getenv("LSTF_CONFIG"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil, xerrors.Errorf("LSTF_CONFIG: %w", err)
+		}
+		return Load(path)
+	}
+	return Load(SystemPath, UserPath())
+}
+
+// Lookup returns the profile of the name. The empty name is the profile of
+// $LSTF_PROFILE, Config.Profile or "default" in order. It is an error if the
+// profile is specified but not found, while the default profile may be absent.
+func (c *Config) Lookup(name string) (string, *Profile, error) {
+	explicit := name != ""
+	if name == "" {
+		name = os.Getenv("LSTF_PROFILE")
+		explicit = name != ""
+	}
+	if name == "" {
+		name = c.Profile
+		explicit = name != ""
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		if explicit {
+			return "", nil, xerrors.Errorf("profile %q is not found (available: %s)",
+				name, strings.Join(c.profileNames(), ", "))
+		}
+		p = &Profile{}
+	}
+	// copy not to modify the loaded profile by merging the environment variables.
+	merged := &Profile{}
+	merged.Merge(p)
+	return name, merged, nil
+}
+
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Env are the environment variables overriding the profile, by the field of Profile.
+var Env = []string{
+	"LSTF_FORMAT",
+	"LSTF_NUMERIC",
+	"LSTF_PROCESSES",
+	"LSTF_FILTER",
+	"LSTF_GROUP_BY",
+	"LSTF_SOURCE",
+	"LSTF_RESOLVER",
+	"LSTF_CATALOG",
+	"LSTF_CLOUD_RANGES",
+}
+
+// FromEnv returns the profile of the environment variables in Env and the names of the variables set.
+// LSTF_CLOUD_RANGES is a comma-separated list.
+func FromEnv(getenv func(string) string) (*Profile, []string, error) {
+	p := &Profile{}
+	var set []string
+	for _, key := range Env {
+		v := getenv(key)
+		if v == "" {
+			continue
+		}
+		set = append(set, key)
+		switch key {
+		case "LSTF_FORMAT":
+			p.Format = v
+		case "LSTF_NUMERIC", "LSTF_PROCESSES":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("could not parse boolean value from %s: %q", key, v)
+			}
+			if key == "LSTF_NUMERIC" {
+				p.Numeric = &b
+			} else {
+				p.Processes = &b
+			}
+		case "LSTF_FILTER":
+			p.Filter = v
+		case "LSTF_GROUP_BY":
+			p.GroupBy = v
+		case "LSTF_SOURCE":
+			p.Source = v
+		case "LSTF_RESOLVER":
+			p.Resolver = v
+		case "LSTF_CATALOG":
+			p.Catalog = v
+		case "LSTF_CLOUD_RANGES":
+			p.CloudRanges = strings.Split(v, ",")
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, nil, err
+	}
+	return p, set, nil
+}
+
+// Merge overrides the fields of the profile with the fields set in 'o'.
+// The networks are merged by prefix.
+func (p *Profile) Merge(o *Profile) {
+	if o.Format != "" {
+		p.Format = o.Format
+	}
+	if o.Numeric != nil {
+		p.Numeric = o.Numeric
+	}
+	if o.Processes != nil {
+		p.Processes = o.Processes
+	}
+	if o.Filter != "" {
+		p.Filter = o.Filter
+	}
+	if o.GroupBy != "" {
+		p.GroupBy = o.GroupBy
+	}
+	if o.Source != "" {
+		p.Source = o.Source
+	}
+	if o.Resolver != "" {
+		p.Resolver = o.Resolver
+	}
+	if o.Catalog != "" {
+		p.Catalog = o.Catalog
+	}
+	if len(o.Networks) > 0 {
+		networks := make(map[string]string, len(p.Networks)+len(o.Networks))
+		for k, v := range p.Networks {
+			networks[k] = v
+		}
+		for k, v := range o.Networks {
+			networks[k] = v
+		}
+		p.Networks = networks
+	}
+	if len(o.CloudRanges) > 0 {
+		p.CloudRanges = o.CloudRanges
+	}
+	if o.Agent != nil {
+		p.Agent = o.Agent
+	}
+}
+
+func (p *Profile) validate() error {
+	switch p.Format {
+	case "", FormatText, FormatJSON, FormatJSONEnvelope, FormatNDJSON:
+	default:
+		return xerrors.Errorf("unknown format %q (available: %s, %s, %s, %s)",
+			p.Format, FormatText, FormatJSON, FormatJSONEnvelope, FormatNDJSON)
+	}
+	if _, err := p.NetworkList(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NetworkList returns the networks sorted by prefix.
+func (p *Profile) NetworkList() ([]*netutil.Network, error) {
+	networks := make([]*netutil.Network, 0, len(p.Networks))
+	for s, label := range p.Networks {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid network: %v", err)
+		}
+		networks = append(networks, &netutil.Network{Prefix: prefix, Label: label})
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Prefix.String() < networks[j].Prefix.String()
+	})
+	return networks, nil
+}
+
+// FlagValues returns the values of the command line flags set by the profile, by the flag name.
+// The format is converted into the flag of the format such as "json".
+func (p *Profile) FlagValues() map[string]string {
+	values := map[string]string{}
+	switch p.Format {
+	case FormatJSON, FormatJSONEnvelope, FormatNDJSON:
+		values[p.Format] = "true"
+	}
+	if p.Numeric != nil {
+		values["numeric"] = strconv.FormatBool(*p.Numeric)
+	}
+	if p.Processes != nil {
+		values["processes"] = strconv.FormatBool(*p.Processes)
+	}
+	for name, v := range map[string]string{
+		"filter":   p.Filter,
+		"group-by": p.GroupBy,
+		"source":   p.Source,
+		"resolver": p.Resolver,
+		"catalog":  p.Catalog,
+	} {
+		if v != "" {
+			values[name] = v
+		}
+	}
+	if len(p.CloudRanges) > 0 {
+		values["cloud-ranges"] = strings.Join(p.CloudRanges, ",")
+	}
+	return values
+}
+
+// redacted replaces the values of the HTTP headers of the exporters, which may be credentials.
+const redacted = "<redacted>"
+
+// Redacted returns the copy of the profile whose secrets are redacted to print it.
+func (p *Profile) Redacted() *Profile {
+	r := *p
+	if p.Agent != nil {
+		agent := *p.Agent
+		agent.Exporters = make([]exporter.ExporterConfig, len(p.Agent.Exporters))
+		for i, e := range p.Agent.Exporters {
+			if len(e.Headers) > 0 {
+				headers := make(map[string]string, len(e.Headers))
+				for k := range e.Headers {
+					headers[k] = redacted
+				}
+				e.Headers = headers
+			}
+			agent.Exporters[i] = e
+		}
+		r.Agent = &agent
+	}
+	return &r
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, loaded, err := Load("../testdata/config/system.yaml", "../testdata/config/user.yaml", "../testdata/config/notfound.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("the files not found should be skipped, but %v", loaded)
+	}
+	_, p, err := cfg.Lookup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Numeric == nil || !*p.Numeric {
+		t.Errorf("numeric of the system file should be kept, but %v", p.Numeric)
+	}
+	if p.Filter != "all" || p.GroupBy != "subnet/16" {
+		t.Errorf("the user file should override the system file, but %+v", p)
+	}
+	want := map[string]string{"10.0.1.0/24": "prod-db", "10.0.2.0/24": "web"}
+	if !reflect.DeepEqual(p.Networks, want) {
+		t.Errorf("networks should be merged into %v, but %v", want, p.Networks)
+	}
+	_, prod, err := cfg.Lookup("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prod.Format != FormatJSON || prod.Agent == nil || len(prod.Agent.Exporters) != 1 {
+		t.Errorf("the prod profile of the system file should be kept, but %+v", prod)
+	}
+}
+
+func TestLoad_invalid(t *testing.T) {
+	tests := []struct {
+		yaml string
+		err  string
+	}{
+		{"profiles:\n  default:\n    unknown: true\n", "field unknown not found"},
+		{"profiles:\n  default:\n    format: xml\n", `unknown format "xml"`},
+		{"profiles:\n  default:\n    networks:\n      10.0.1.0: db\n", "invalid network"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%q) should raise error %q, but %v", tt.yaml, tt.err, err)
+		}
+	}
+}
+
+func TestConfig_Lookup(t *testing.T) {
+	cfg := &Config{Profiles: map[string]*Profile{"prod": {Filter: "public"}}}
+
+	name, p, err := cfg.Lookup("")
+	if err != nil || name != DefaultProfile || p.Filter != "" {
+		t.Errorf("the absent default profile should be empty, but %q %+v %v", name, p, err)
+	}
+	if _, _, err := cfg.Lookup("staging"); err == nil {
+		t.Error("the profile not found should raise error")
+	}
+
+	t.Setenv("LSTF_PROFILE", "prod")
+	name, p, err = cfg.Lookup("")
+	if err != nil || name != "prod" || p.Filter != "public" {
+		t.Errorf("LSTF_PROFILE should select the profile, but %q %+v %v", name, p, err)
+	}
+	p.Filter = "private"
+	if cfg.Profiles["prod"].Filter != "public" {
+		t.Error("Lookup should return the copy of the profile")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"LSTF_FORMAT":       "ndjson",
+		"LSTF_NUMERIC":      "1",
+		"LSTF_FILTER":       "private",
+		"LSTF_CLOUD_RANGES": "aws.json,gcp.json",
+	}
+	p, set, err := FromEnv(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != len(env) {
+		t.Errorf("the variables set should be %d, but %v", len(env), set)
+	}
+	want := map[string]string{
+		"ndjson":       "true",
+		"numeric":      "true",
+		"filter":       "private",
+		"cloud-ranges": "aws.json,gcp.json",
+	}
+	if got := p.FlagValues(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flag values should be %v, but %v", want, got)
+	}
+
+	for key, v := range map[string]string{"LSTF_NUMERIC": "yes", "LSTF_FORMAT": "xml"} {
+		if _, _, err := FromEnv(func(k string) string {
+			if k == key {
+				return v
+			}
+			return ""
+		}); err == nil {
+			t.Errorf("%s=%s should raise error", key, v)
+		}
+	}
+}
+
+func TestProfile_Redacted(t *testing.T) {
+	cfg, _, err := Load("../testdata/config/system.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.Profiles["prod"]
+	r := p.Redacted()
+	if got := r.Agent.Exporters[0].Headers["Authorization"]; got != redacted {
+		t.Errorf("the headers should be redacted, but %q", got)
+	}
+	if got := p.Agent.Exporters[0].Headers["Authorization"]; got != "Bearer secret" {
+		t.Errorf("the profile should not be modified, but %q", got)
+	}
+}
@@ -0,0 +1,299 @@
+// Package daemon serves host flows collected periodically by HTTP JSON API.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/netutil"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// DefaultHistory is the default number of the snapshots kept in the history.
+const DefaultHistory = 10
+
+// Options represents the options of Daemon.
+type Options struct {
+	// Source is the source of host flows.
+	Source tcpflow.FlowSource
+	// Numeric disables the resolution of the host names at each collection.
+	Numeric bool
+	// Timeout limits each collection, which keeps the partial flows if it times out.
+	// No limit if it is zero.
+	Timeout time.Duration
+	// History is the number of recent snapshots kept in the history (default: DefaultHistory).
+	History int
+	// ListeningPorts gets the listening ports of the host whose flows are served.
+	// It is the listening ports of Source by default if it is a tcpflow.ListenerSource,
+	// or nil otherwise, for which /listeners is not implemented.
+	ListeningPorts func(ctx context.Context) (netutil.PortSet, error)
+	// LstfVersion is recorded in the responses.
+	LstfVersion string
+}
+
+// snapshot is the host flows and the listening ports collected at a time.
+type snapshot struct {
+	collectedAt time.Time
+	flows       tcpflow.HostFlows
+	ports       []uint16
+}
+
+// Daemon caches host flows refreshed periodically, and serves them by HTTP.
+type Daemon struct {
+	opts Options
+
+	mu          sync.RWMutex
+	history     []*snapshot // oldest first
+	lastRefresh time.Time
+	lastErr     error
+}
+
+// New creates Daemon. It serves no flows until Refresh is called, which the caller
+// schedules every interval.
+func New(opts Options) *Daemon {
+	if opts.History <= 0 {
+		opts.History = DefaultHistory
+	}
+	if ls, ok := opts.Source.(tcpflow.ListenerSource); ok && opts.ListeningPorts == nil {
+		opts.ListeningPorts = func(ctx context.Context) (netutil.PortSet, error) {
+			return ls.GetListeningPorts(ctx, &tcpflow.GetHostFlowsOption{})
+		}
+	}
+	return &Daemon{opts: opts}
+}
+
+// Refresh collects host flows and the listening ports, and appends them to the history.
+// The previous snapshot is kept served if it fails.
+func (d *Daemon) Refresh(ctx context.Context) error {
+	if d.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.opts.Timeout)
+		defer cancel()
+	}
+	now := time.Now()
+	err := d.refresh(ctx, now)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastRefresh = now
+	d.lastErr = err
+	return err
+}
+
+func (d *Daemon) refresh(ctx context.Context, now time.Time) error {
+	// collect processes to answer the queries with and without them.
+	flows, err := d.opts.Source.GetHostFlows(ctx, &tcpflow.GetHostFlowsOption{
+		Numeric:   d.opts.Numeric,
+		Processes: true,
+		Filter:    tcpflow.FilterAll,
+		OnWarning: func(w *tcpflow.Warning) {
+			dlog.Debugf("warning: %s", w)
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to get host flows: %w", err)
+	}
+	var ports []uint16
+	if d.opts.ListeningPorts != nil {
+		portSet, err := d.opts.ListeningPorts(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed to get listening ports: %w", err)
+		}
+		ports = portSet.Sorted()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.history = append(d.history, &snapshot{collectedAt: now, flows: flows, ports: ports})
+	if len(d.history) > d.opts.History {
+		d.history = d.history[len(d.history)-d.opts.History:]
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler of the API.
+//
+//	GET /flows      the latest host flows in the format of 'lstf --json-envelope'
+//	GET /history    the recent snapshots of host flows, oldest first
+//	GET /listeners  the latest listening ports, unless the source does not tell them
+//	GET /healthz    the status of the last refresh
+//
+// /flows and /history take the query parameters mirroring the options of lstf:
+// filter=all|public|private, numeric=true and processes=true.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flows", getOnly(d.handleFlows))
+	mux.HandleFunc("/history", getOnly(d.handleHistory))
+	mux.HandleFunc("/listeners", getOnly(d.handleListeners))
+	mux.HandleFunc("/healthz", getOnly(d.handleHealthz))
+	return mux
+}
+
+func getOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, xerrors.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// query represents the query parameters of /flows and /history.
+type query struct {
+	filter    string
+	numeric   bool
+	processes bool
+}
+
+func parseQuery(r *http.Request) (*query, error) {
+	v := r.URL.Query()
+	q := &query{filter: tcpflow.FilterAll}
+	if f := v.Get("filter"); f != "" {
+		if f != tcpflow.FilterAll && f != tcpflow.FilterPublic && f != tcpflow.FilterPrivate {
+			return nil, xerrors.Errorf("filter should be %q, %q or %q, but %q",
+				tcpflow.FilterAll, tcpflow.FilterPublic, tcpflow.FilterPrivate, f)
+		}
+		q.filter = f
+	}
+	for name, p := range map[string]*bool{"numeric": &q.numeric, "processes": &q.processes} {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, xerrors.Errorf("%s should be a boolean, but %q", name, s)
+		}
+		*p = b
+	}
+	return q, nil
+}
+
+// apply returns the copy of the flows to which the query is applied, not to modify the cache.
+func (q *query) apply(flows tcpflow.HostFlows) tcpflow.HostFlows {
+	flows = flows.Filter(q.filter)
+	for key, flow := range flows {
+		f := *flow
+		if !q.processes {
+			f.Process = nil
+		}
+		if q.numeric {
+			local, peer := *f.Local, *f.Peer
+			local.Name, peer.Name = "", ""
+			f.Local, f.Peer = &local, &peer
+		}
+		flows[key] = &f
+	}
+	return flows
+}
+
+func (d *Daemon) envelope(s *snapshot, q *query) *tcpflow.Envelope {
+	return tcpflow.NewEnvelope(q.apply(s.flows), d.opts.Source.Name(), d.opts.LstfVersion, s.collectedAt)
+}
+
+func (d *Daemon) snapshots() []*snapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.history
+}
+
+var errNotCollected = xerrors.New("host flows have not been collected yet")
+
+func (d *Daemon) handleFlows(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	history := d.snapshots()
+	if len(history) == 0 {
+		writeError(w, http.StatusServiceUnavailable, errNotCollected)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.envelope(history[len(history)-1], q))
+}
+
+func (d *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	history := d.snapshots()
+	envelopes := make([]*tcpflow.Envelope, 0, len(history))
+	for _, s := range history {
+		envelopes = append(envelopes, d.envelope(s, q))
+	}
+	writeJSON(w, http.StatusOK, envelopes)
+}
+
+// listenersResponse is the response of /listeners.
+type listenersResponse struct {
+	CollectedAt time.Time `json:"collected_at"`
+	Ports       []uint16  `json:"ports"`
+}
+
+func (d *Daemon) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if d.opts.ListeningPorts == nil {
+		writeError(w, http.StatusNotImplemented,
+			xerrors.Errorf("listening ports are not available from %s source", d.opts.Source.Name()))
+		return
+	}
+	history := d.snapshots()
+	if len(history) == 0 {
+		writeError(w, http.StatusServiceUnavailable, errNotCollected)
+		return
+	}
+	s := history[len(history)-1]
+	writeJSON(w, http.StatusOK, &listenersResponse{CollectedAt: s.collectedAt.UTC(), Ports: s.ports})
+}
+
+// healthzResponse is the response of /healthz.
+type healthzResponse struct {
+	Status      string    `json:"status"`
+	LastRefresh time.Time `json:"last_refresh"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func (d *Daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	resp := &healthzResponse{Status: "ok", LastRefresh: d.lastRefresh.UTC()}
+	status := http.StatusOK
+	switch {
+	case d.lastErr != nil:
+		resp.Status, resp.Error = "error", d.lastErr.Error()
+		status = http.StatusServiceUnavailable
+	case d.lastRefresh.IsZero():
+		resp.Status, resp.Error = "starting", errNotCollected.Error()
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
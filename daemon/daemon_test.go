@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func newTestDaemon(t *testing.T, history int) *Daemon {
+	t.Helper()
+	cur, _ := os.Getwd()
+	return New(Options{
+		Source:  tcpflow.NewFileSource(filepath.Join(cur, "../testdata/flows.json")),
+		History: history,
+		ListeningPorts: func(ctx context.Context) (netutil.PortSet, error) {
+			return netutil.PortSet{80: {}, 22: {}}, nil
+		},
+		LstfVersion: "0.7.2",
+	})
+}
+
+func get(t *testing.T, h http.Handler, target string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s should respond json: %v: %s", target, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+func TestDaemon_beforeRefresh(t *testing.T) {
+	h := newTestDaemon(t, 0).Handler()
+	for _, target := range []string{"/flows", "/listeners", "/healthz"} {
+		if code := get(t, h, target, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("%s should respond %d, but %d", target, http.StatusServiceUnavailable, code)
+		}
+	}
+}
+
+func TestDaemon_flows(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	h := d.Handler()
+
+	tests := []struct {
+		target    string
+		status    int
+		flows     int
+		processes bool
+		names     bool
+	}{
+		{target: "/flows", status: http.StatusOK, flows: 3, names: true},
+		{target: "/flows?filter=public", status: http.StatusOK, flows: 1, names: true},
+		{target: "/flows?filter=private&processes=true&numeric=1", status: http.StatusOK, flows: 2, processes: true},
+		{target: "/flows?filter=unknown", status: http.StatusBadRequest},
+		{target: "/flows?numeric=yes", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		var env tcpflow.Envelope
+		code := get(t, h, tc.target, &env)
+		if code != tc.status {
+			t.Errorf("%s should respond %d, but %d", tc.target, tc.status, code)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		if env.SchemaVersion != tcpflow.SchemaVersion || env.Source != tcpflow.SourceFile {
+			t.Errorf("%s should respond an envelope, but %+v", tc.target, env)
+		}
+		if len(env.Flows) != tc.flows {
+			t.Errorf("%s should respond %d flows, but %d", tc.target, tc.flows, len(env.Flows))
+		}
+		for _, flow := range env.Flows {
+			if (flow.Process != nil) != tc.processes {
+				t.Errorf("%s should respond processes: %v, but %+v", tc.target, tc.processes, flow.Process)
+			}
+			if (flow.Local.Name != "") != tc.names {
+				t.Errorf("%s should respond names: %v, but %q", tc.target, tc.names, flow.Local.Name)
+			}
+		}
+	}
+
+	// the queries should not modify the cache.
+	var env tcpflow.Envelope
+	get(t, h, "/flows?processes=true", &env)
+	for _, flow := range env.Flows {
+		if flow.Process == nil || flow.Local.Name == "" {
+			t.Errorf("cached flow should keep the process and the names, but %+v", flow)
+		}
+	}
+}
+
+func TestDaemon_history(t *testing.T) {
+	d := newTestDaemon(t, 2)
+	for i := 0; i < 3; i++ {
+		if err := d.Refresh(context.Background()); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+	}
+	var envs []*tcpflow.Envelope
+	if code := get(t, d.Handler(), "/history?filter=public", &envs); code != http.StatusOK {
+		t.Fatalf("/history should respond 200, but %d", code)
+	}
+	if len(envs) != 2 {
+		t.Fatalf("history should be len == 2, but %d", len(envs))
+	}
+	if envs[0].CollectedAt.After(envs[1].CollectedAt) {
+		t.Errorf("history should be oldest first, but %v, %v", envs[0].CollectedAt, envs[1].CollectedAt)
+	}
+	if len(envs[1].Flows) != 1 {
+		t.Errorf("history should be filtered, but %d flows", len(envs[1].Flows))
+	}
+}
+
+func TestDaemon_listeners(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	var resp listenersResponse
+	if code := get(t, d.Handler(), "/listeners", &resp); code != http.StatusOK {
+		t.Fatalf("/listeners should respond 200, but %d", code)
+	}
+	if len(resp.Ports) != 2 || resp.Ports[0] != 22 || resp.Ports[1] != 80 {
+		t.Errorf("ports should be [22 80], but %v", resp.Ports)
+	}
+}
+
+func TestDaemon_listenersNotImplemented(t *testing.T) {
+	cur, _ := os.Getwd()
+	// the flows in a file do not tell the listening ports of the host.
+	d := New(Options{Source: tcpflow.NewFileSource(filepath.Join(cur, "../testdata/flows.json"))})
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if code := get(t, d.Handler(), "/listeners", nil); code != http.StatusNotImplemented {
+		t.Errorf("/listeners should respond 501, but %d", code)
+	}
+}
+
+func TestDaemon_healthz(t *testing.T) {
+	d := newTestDaemon(t, 0)
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	h := d.Handler()
+	var resp healthzResponse
+	if code := get(t, h, "/healthz", &resp); code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("/healthz should respond 200 ok, but %d %+v", code, resp)
+	}
+
+	// a failed refresh makes it unhealthy, but keeps the last flows served.
+	d.opts.ListeningPorts = func(ctx context.Context) (netutil.PortSet, error) {
+		return nil, xerrors.New("permission denied")
+	}
+	if err := d.Refresh(context.Background()); err == nil {
+		t.Fatal("err should be raised")
+	}
+	if code := get(t, h, "/healthz", &resp); code != http.StatusServiceUnavailable || resp.Status != "error" {
+		t.Errorf("/healthz should respond 503 error, but %d %+v", code, resp)
+	}
+	if code := get(t, h, "/flows", nil); code != http.StatusOK {
+		t.Errorf("/flows should respond 200, but %d", code)
+	}
+}
+
+func TestDaemon_methodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newTestDaemon(t, 0).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/flows", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST should respond %d, but %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
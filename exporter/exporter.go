@@ -0,0 +1,181 @@
+// Package exporter pushes host flows to remote collectors.
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// Exporter pushes host flows to a remote collector.
+type Exporter interface {
+	// Name returns the name of the exporter, such as "otlp".
+	Name() string
+	// Export pushes the host flows wrapped with the metadata of the collection.
+	// It should give up soon after ctx is done.
+	Export(ctx context.Context, env *tcpflow.Envelope) error
+	// Close releases the resources of the exporter.
+	Close() error
+}
+
+// Config is the configuration of 'lstf agent'.
+type Config struct {
+	// Interval is the interval to collect and export host flows.
+	Interval  time.Duration    `yaml:"interval,omitempty"`
+	Retry     RetryConfig      `yaml:"retry,omitempty"`
+	Exporters []ExporterConfig `yaml:"exporters"`
+}
+
+// ExporterConfig is the configuration of an exporter.
+type ExporterConfig struct {
+	// Type is one of "otlp", "statsd" and "webhook".
+	Type string `yaml:"type"`
+	// Endpoint is the base URL of the OTLP/HTTP receiver, the address of the StatsD server
+	// such as "127.0.0.1:8125", or the URL of the webhook.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are added to the HTTP requests of otlp and webhook.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Timeout is the timeout of a HTTP request (default: 10s).
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Prefix is the prefix of the StatsD metric names (default: "lstf").
+	Prefix string `yaml:"prefix,omitempty"`
+	// DogStatsD enables the tags of DogStatsD instead of encoding them into the metric names.
+	DogStatsD bool `yaml:"dogstatsd,omitempty"`
+}
+
+// LoadConfig loads the YAML configuration file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, xerrors.Errorf("could not parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// exporterFactory creates an exporter from the configuration.
+type exporterFactory func(cfg *ExporterConfig) (Exporter, error)
+
+var exporters = map[string]exporterFactory{
+	"otlp":    newOTLPExporter,
+	"statsd":  newStatsDExporter,
+	"webhook": newWebhookExporter,
+}
+
+// Types returns the sorted types of the exporters.
+func Types() []string {
+	types := make([]string, 0, len(exporters))
+	for t := range exporters {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates the exporter configured by 'cfg', which retries to export by 'retry'.
+func New(cfg *ExporterConfig, retry RetryConfig) (Exporter, error) {
+	factory, ok := exporters[cfg.Type]
+	if !ok {
+		return nil, xerrors.Errorf("unknown exporter type '%s' (available: %s)",
+			cfg.Type, strings.Join(Types(), ", "))
+	}
+	if cfg.Endpoint == "" {
+		return nil, xerrors.Errorf("%s exporter requires endpoint", cfg.Type)
+	}
+	e, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &retryExporter{Exporter: e, retry: retry.withDefaults(), sleep: sleepContext}, nil
+}
+
+// RetryConfig is the policy to retry a failed export with exponential backoff.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts including the first one (default: 3).
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// InitialInterval is the interval before the first retry (default: 1s).
+	InitialInterval time.Duration `yaml:"initial_interval,omitempty"`
+	// MaxInterval caps the interval, which is doubled at each retry (default: 30s).
+	MaxInterval time.Duration `yaml:"max_interval,omitempty"`
+}
+
+func (r RetryConfig) withDefaults() RetryConfig {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = 3
+	}
+	if r.InitialInterval <= 0 {
+		r.InitialInterval = time.Second
+	}
+	if r.MaxInterval <= 0 {
+		r.MaxInterval = 30 * time.Second
+	}
+	return r
+}
+
+// permanentError is an error that does not succeed by retrying, such as 400 Bad Request.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// sleepContext sleeps for the duration, or returns the error of ctx if it is done before.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryExporter retries the export of the wrapped exporter with exponential backoff
+// until ctx is done.
+type retryExporter struct {
+	Exporter
+	retry RetryConfig
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func (e *retryExporter) Export(ctx context.Context, env *tcpflow.Envelope) error {
+	interval := e.retry.InitialInterval
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = e.Exporter.Export(ctx, env)
+		if err == nil {
+			return nil
+		}
+		var perr *permanentError
+		if xerrors.As(err, &perr) || attempt >= e.retry.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		dlog.Debugf("failed to export to %s (attempt %d), retry after %s: %v", e.Name(), attempt, interval, err)
+		if serr := e.sleep(ctx, interval); serr != nil {
+			return xerrors.Errorf("failed to export to %s: %v, and gave up retrying: %w", e.Name(), err, serr)
+		}
+		interval *= 2
+		if interval > e.retry.MaxInterval {
+			interval = e.retry.MaxInterval
+		}
+	}
+	return xerrors.Errorf("failed to export to %s: %w", e.Name(), err)
+}
@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cur, _ := os.Getwd()
+	cfg, err := LoadConfig(filepath.Join(cur, "../testdata/agent/config.yaml"))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	want := &Config{
+		Interval: 30 * time.Second,
+		Retry:    RetryConfig{MaxAttempts: 5, InitialInterval: 500 * time.Millisecond},
+		Exporters: []ExporterConfig{
+			{Type: "otlp", Endpoint: "http://127.0.0.1:4318", Headers: map[string]string{"Authorization": "Bearer secret"}},
+			{Type: "statsd", Endpoint: "127.0.0.1:8125", Prefix: "myhost.lstf", DogStatsD: true},
+			{Type: "webhook", Endpoint: "http://127.0.0.1:8080/flows", Timeout: 3 * time.Second},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config should be %+v, but %+v", want, cfg)
+	}
+}
+
+func TestLoadConfig_unknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("exporters:\n  - type: otlp\n    endpiont: http://127.0.0.1:4318\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "endpiont") {
+		t.Errorf("err should report the unknown field, but %v", err)
+	}
+}
+
+func TestNew_error(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  ExporterConfig
+		err  string
+	}{
+		{desc: "unknown type", cfg: ExporterConfig{Type: "kafka", Endpoint: "127.0.0.1:9092"}, err: "unknown exporter type 'kafka'"},
+		{desc: "no endpoint", cfg: ExporterConfig{Type: "webhook"}, err: "webhook exporter requires endpoint"},
+	}
+	for _, tc := range tests {
+		_, err := New(&tc.cfg, RetryConfig{})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("desc: %q, err should contain %q, but %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+// fakeExporter fails until the number of the calls reaches 'succeedAt'.
+type fakeExporter struct {
+	calls     int
+	succeedAt int
+	err       error
+}
+
+func (e *fakeExporter) Name() string { return "fake" }
+func (e *fakeExporter) Close() error { return nil }
+
+func (e *fakeExporter) Export(ctx context.Context, env *tcpflow.Envelope) error {
+	e.calls++
+	if e.calls >= e.succeedAt {
+		return nil
+	}
+	return e.err
+}
+
+func TestRetryExporter(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 4, InitialInterval: time.Second, MaxInterval: 3 * time.Second}
+	tests := []struct {
+		desc      string
+		fake      *fakeExporter
+		wantErr   bool
+		wantCalls int
+		wantSleep []time.Duration
+	}{
+		{
+			desc:      "success after retries",
+			fake:      &fakeExporter{succeedAt: 4, err: xerrors.New("connection refused")},
+			wantCalls: 4,
+			wantSleep: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			desc:      "give up",
+			fake:      &fakeExporter{succeedAt: 10, err: xerrors.New("connection refused")},
+			wantErr:   true,
+			wantCalls: 4,
+			wantSleep: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			desc:      "permanent error",
+			fake:      &fakeExporter{succeedAt: 10, err: &permanentError{xerrors.New("400 Bad Request")}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+	}
+	for _, tc := range tests {
+		var slept []time.Duration
+		e := &retryExporter{Exporter: tc.fake, retry: retry, sleep: func(ctx context.Context, d time.Duration) error {
+			slept = append(slept, d)
+			return nil
+		}}
+		err := e.Export(context.Background(), &tcpflow.Envelope{})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("desc: %q, err should be raised: %v, but %v", tc.desc, tc.wantErr, err)
+		}
+		if tc.fake.calls != tc.wantCalls {
+			t.Errorf("desc: %q, calls should be %d, but %d", tc.desc, tc.wantCalls, tc.fake.calls)
+		}
+		if !reflect.DeepEqual(slept, tc.wantSleep) {
+			t.Errorf("desc: %q, backoff should be %v, but %v", tc.desc, tc.wantSleep, slept)
+		}
+	}
+}
+
+func TestRetryExporter_canceled(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 3, InitialInterval: time.Minute, MaxInterval: time.Minute}
+	fake := &fakeExporter{succeedAt: 10, err: xerrors.New("connection refused")}
+	e := &retryExporter{Exporter: fake, retry: retry, sleep: sleepContext}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := e.Export(ctx, &tcpflow.Envelope{})
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err should be context.DeadlineExceeded, but %v", err)
+	}
+	if fake.calls != 1 {
+		t.Errorf("calls should be 1, but %d", fake.calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("backoff should be interrupted by the context, but took %s", elapsed)
+	}
+}
@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultHTTPTimeout = 10 * time.Second
+
+// httpClient posts JSON to an endpoint.
+type httpClient struct {
+	client  *http.Client
+	headers map[string]string
+}
+
+func newHTTPClient(cfg *ExporterConfig) *httpClient {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	return &httpClient{
+		client:  &http.Client{Timeout: timeout},
+		headers: cfg.Headers,
+	}
+}
+
+// postJSON posts the JSON body to the URL. The error is permanent if the response status
+// is a client error except for 408 Request Timeout and 429 Too Many Requests.
+func (c *httpClient) postJSON(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{xerrors.Errorf("could not create request: %w", err)}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return xerrors.Errorf("could not post to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = xerrors.Errorf("%s responded %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &permanentError{err}
+	}
+	return err
+}
+
+func (c *httpClient) close() {
+	c.client.CloseIdleConnections()
+}
@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const otlpMetricsPath = "/v1/metrics"
+
+// otlpExporter pushes the number of connections of each host flow as a gauge
+// by OTLP/HTTP with the JSON encoding.
+// see https://opentelemetry.io/docs/specs/otlp/#otlphttp.
+type otlpExporter struct {
+	url    string
+	client *httpClient
+}
+
+func newOTLPExporter(cfg *ExporterConfig) (Exporter, error) {
+	url := cfg.Endpoint
+	if !strings.HasSuffix(url, otlpMetricsPath) {
+		url = strings.TrimSuffix(url, "/") + otlpMetricsPath
+	}
+	return &otlpExporter{url: url, client: newHTTPClient(cfg)}, nil
+}
+
+func (e *otlpExporter) Name() string {
+	return "otlp"
+}
+
+func (e *otlpExporter) Export(ctx context.Context, env *tcpflow.Envelope) error {
+	b, err := json.Marshal(newOTLPRequest(env))
+	if err != nil {
+		return &permanentError{xerrors.Errorf("failed to marshal json: %w", err)}
+	}
+	return e.client.postJSON(ctx, e.url, b)
+}
+
+func (e *otlpExporter) Close() error {
+	e.client.close()
+	return nil
+}
+
+// The types below are the JSON mapping of ExportMetricsServiceRequest in the OTLP protobuf.
+// The 64 bit integers are encoded as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource        `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsInt        string          `json:"asInt"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpAttr(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// newOTLPRequest converts the host flows into the metric 'lstf.flow.connections'.
+// The ports are string attributes because the port of the ephemeral side is "many".
+func newOTLPRequest(env *tcpflow.Envelope) *otlpRequest {
+	ts := strconv.FormatInt(env.CollectedAt.UnixNano(), 10)
+	points := make([]*otlpNumberDataPoint, 0, len(env.Flows))
+	for _, flow := range env.Flows {
+		attrs := []*otlpKeyValue{
+			otlpAttr("lstf.direction", flow.Direction.String()),
+			otlpAttr("network.local.address", flow.Local.Addr.String()),
+			otlpAttr("network.local.port", flow.Local.PortString()),
+			otlpAttr("network.peer.address", flow.Peer.Addr.String()),
+			otlpAttr("network.peer.port", flow.Peer.PortString()),
+		}
+		if flow.Peer.Name != "" {
+			attrs = append(attrs, otlpAttr("lstf.peer.name", flow.Peer.Name))
+		}
+		if flow.Process != nil {
+			attrs = append(attrs, otlpAttr("process.executable.name", flow.Process.Name))
+		}
+		if flow.Source != "" {
+			attrs = append(attrs, otlpAttr("lstf.source", flow.Source))
+		}
+		points = append(points, &otlpNumberDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: ts,
+			AsInt:        strconv.FormatInt(flow.Connections, 10),
+		})
+	}
+	return &otlpRequest{
+		ResourceMetrics: []*otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: []*otlpKeyValue{
+				otlpAttr("service.name", "lstf"),
+				otlpAttr("service.version", env.LstfVersion),
+				otlpAttr("host.name", env.Hostname),
+			}},
+			ScopeMetrics: []*otlpScopeMetrics{{
+				Scope: otlpScope{Name: "github.com/yuuki/lstf", Version: env.LstfVersion},
+				Metrics: []*otlpMetric{{
+					Name:        "lstf.flow.connections",
+					Description: "The number of connections of the host flow.",
+					Unit:        "{connection}",
+					Gauge:       otlpGauge{DataPoints: points},
+				}},
+			}},
+		}},
+	}
+}
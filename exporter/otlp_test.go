@@ -0,0 +1,99 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("path should be /v1/metrics, but %s", r.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("body should be OTLP JSON: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	e, err := New(&ExporterConfig{Type: "otlp", Endpoint: ts.URL + "/"}, RetryConfig{})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer e.Close()
+	flows := tcpflow.HostFlows{}
+	for _, f := range []*tcpflow.HostFlow{
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: 22,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+			Source:      "netlink",
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.9"), 80),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("2001:db8::1")),
+			Connections: 3,
+			Source:      "netlink",
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+	env := tcpflow.NewEnvelope(flows, tcpflow.SourceAuto, "0.7.2", time.Unix(1600000000, 0))
+	if err := e.Export(context.Background(), env); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	if len(got.ResourceMetrics) != 1 || len(got.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("request should have a resource and a scope, but %+v", got)
+	}
+	rm := got.ResourceMetrics[0]
+	if attrs := attrMap(rm.Resource.Attributes); attrs["host.name"] != env.Hostname || attrs["service.name"] != "lstf" {
+		t.Errorf("resource attributes should have host.name and service.name, but %v", attrs)
+	}
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 1 || metrics[0].Name != "lstf.flow.connections" {
+		t.Fatalf("metrics should be lstf.flow.connections, but %+v", metrics)
+	}
+
+	var points []string
+	for _, p := range metrics[0].Gauge.DataPoints {
+		if p.TimeUnixNano != "1600000000000000000" {
+			t.Errorf("timeUnixNano should be the collected time, but %s", p.TimeUnixNano)
+		}
+		attrs := attrMap(p.Attributes)
+		points = append(points, attrs["lstf.direction"]+" "+attrs["network.local.address"]+":"+attrs["network.local.port"]+
+			" "+attrs["network.peer.address"]+":"+attrs["network.peer.port"]+" "+attrs["process.executable.name"]+" "+p.AsInt)
+	}
+	sort.Strings(points)
+	want := []string{
+		"active 10.0.1.9:many 10.0.1.10:3306 app 22",
+		"passive 10.0.1.9:80 2001:db8::1:many  3",
+	}
+	if len(points) != len(want) || points[0] != want[0] || points[1] != want[1] {
+		t.Errorf("data points should be %q, but %q", want, points)
+	}
+}
+
+func attrMap(attrs []*otlpKeyValue) map[string]string {
+	m := map[string]string{}
+	for _, kv := range attrs {
+		m[kv.Key] = kv.Value.StringValue
+	}
+	return m
+}
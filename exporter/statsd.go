@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+const (
+	defaultStatsDPrefix = "lstf"
+	// maxStatsDPacketSize keeps a datagram within the MTU of Ethernet.
+	maxStatsDPacketSize = 1432
+)
+
+// statsDExporter sends the number of connections of each host flow as a gauge by StatsD over UDP.
+// With DogStatsD, the flow is described by tags. Otherwise, it is encoded into the metric name
+// such as 'lstf.flow.active.10_0_1_9_many.10_0_1_10_3306.connections'.
+type statsDExporter struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+}
+
+func newStatsDExporter(cfg *ExporterConfig) (Exporter, error) {
+	conn, err := net.Dial("udp", cfg.Endpoint)
+	if err != nil {
+		return nil, xerrors.Errorf("could not dial statsd %s: %w", cfg.Endpoint, err)
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultStatsDPrefix
+	}
+	return &statsDExporter{conn: conn, prefix: prefix, dogStatsD: cfg.DogStatsD}, nil
+}
+
+func (e *statsDExporter) Name() string {
+	if e.dogStatsD {
+		return "dogstatsd"
+	}
+	return "statsd"
+}
+
+func (e *statsDExporter) Export(ctx context.Context, env *tcpflow.Envelope) error {
+	lines := make([]string, 0, len(env.Flows)+1)
+	lines = append(lines, fmt.Sprintf("%s.flows:%d|g", e.prefix, len(env.Flows)))
+	for _, flow := range env.Flows {
+		lines = append(lines, e.line(flow))
+	}
+	// the write to a full socket buffer is given up at the deadline of ctx.
+	deadline, _ := ctx.Deadline()
+	if err := e.conn.SetWriteDeadline(deadline); err != nil {
+		return xerrors.Errorf("could not set the deadline of statsd %s: %w", e.conn.RemoteAddr(), err)
+	}
+	for _, packet := range statsDPackets(lines) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := e.conn.Write(packet); err != nil {
+			return xerrors.Errorf("could not send to statsd %s: %w", e.conn.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+func (e *statsDExporter) Close() error {
+	return e.conn.Close()
+}
+
+func (e *statsDExporter) line(flow *tcpflow.HostFlow) string {
+	if !e.dogStatsD {
+		return fmt.Sprintf("%s.flow.%s.%s_%s.%s_%s.connections:%d|g", e.prefix, flow.Direction,
+			statsDName(flow.Local.Addr.String()), flow.Local.PortString(),
+			statsDName(flow.Peer.Addr.String()), flow.Peer.PortString(),
+			flow.Connections)
+	}
+	tags := []string{
+		"direction:" + flow.Direction.String(),
+		"local_addr:" + flow.Local.Addr.String(),
+		"local_port:" + flow.Local.PortString(),
+		"peer_addr:" + flow.Peer.Addr.String(),
+		"peer_port:" + flow.Peer.PortString(),
+	}
+	if flow.Process != nil {
+		tags = append(tags, "process:"+statsDTag(flow.Process.Name))
+	}
+	if flow.Source != "" {
+		tags = append(tags, "source:"+flow.Source)
+	}
+	return fmt.Sprintf("%s.flow.connections:%d|g|#%s", e.prefix, flow.Connections, strings.Join(tags, ","))
+}
+
+// statsDName replaces the characters other than alphanumerics, '-' and '_' in a part of metric name.
+func statsDName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// statsDTag replaces the characters delimiting the DogStatsD datagram in a tag value.
+func statsDTag(s string) string {
+	return strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_", " ", "_").Replace(s)
+}
+
+// statsDPackets packs the lines into datagrams separated by newline.
+func statsDPackets(lines []string) [][]byte {
+	var (
+		packets [][]byte
+		buf     bytes.Buffer
+	)
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxStatsDPacketSize {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
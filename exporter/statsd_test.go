@@ -0,0 +1,105 @@
+package exporter
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestStatsDExporter(t *testing.T) {
+	flows := tcpflow.HostFlows{}
+	for _, f := range []*tcpflow.HostFlow{
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: 22,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+			Source:      "netlink",
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.9"), 80),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("2001:db8::1")),
+			Connections: 3,
+			Source:      "netlink",
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+	env := tcpflow.NewEnvelope(flows, tcpflow.SourceAuto, "0.7.2", time.Unix(1600000000, 0))
+
+	tests := []struct {
+		desc      string
+		dogStatsD bool
+		want      []string
+	}{
+		{
+			desc: "statsd",
+			want: []string{
+				"lstf.flow.active.10_0_1_9_many.10_0_1_10_3306.connections:22|g",
+				"lstf.flow.passive.10_0_1_9_80.2001_db8__1_many.connections:3|g",
+				"lstf.flows:2|g",
+			},
+		},
+		{
+			desc:      "dogstatsd",
+			dogStatsD: true,
+			want: []string{
+				"lstf.flow.connections:22|g|#direction:active,local_addr:10.0.1.9,local_port:many,peer_addr:10.0.1.10,peer_port:3306,process:app,source:netlink",
+				"lstf.flow.connections:3|g|#direction:passive,local_addr:10.0.1.9,local_port:80,peer_addr:2001:db8::1,peer_port:many,source:netlink",
+				"lstf.flows:2|g",
+			},
+		},
+	}
+	for _, tc := range tests {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer pc.Close()
+
+		e, err := New(&ExporterConfig{Type: "statsd", Endpoint: pc.LocalAddr().String(), DogStatsD: tc.dogStatsD}, RetryConfig{})
+		if err != nil {
+			t.Fatalf("desc: %q, should not raise error: %v", tc.desc, err)
+		}
+		defer e.Close()
+		if err := e.Export(context.Background(), env); err != nil {
+			t.Fatalf("desc: %q, should not raise error: %v", tc.desc, err)
+		}
+
+		buf := make([]byte, maxStatsDPacketSize)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("desc: %q, should not raise error: %v", tc.desc, err)
+		}
+		got := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("desc: %q, lines should be\n%s\nbut\n%s", tc.desc, strings.Join(tc.want, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestStatsDPackets(t *testing.T) {
+	line := strings.Repeat("x", 500)
+	packets := statsDPackets([]string{line, line, line, line})
+	if len(packets) != 2 {
+		t.Fatalf("packets should be len == 2, but %d", len(packets))
+	}
+	for _, p := range packets {
+		if len(p) > maxStatsDPacketSize {
+			t.Errorf("packet should be within %d bytes, but %d", maxStatsDPacketSize, len(p))
+		}
+		if got := strings.Count(string(p), "\n"); got != 1 {
+			t.Errorf("packet should have 2 lines, but %d", got+1)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// webhookExporter posts the host flows to a URL as the JSON printed by 'lstf --json-envelope'.
+type webhookExporter struct {
+	url    string
+	client *httpClient
+}
+
+func newWebhookExporter(cfg *ExporterConfig) (Exporter, error) {
+	return &webhookExporter{url: cfg.Endpoint, client: newHTTPClient(cfg)}, nil
+}
+
+func (e *webhookExporter) Name() string {
+	return "webhook"
+}
+
+func (e *webhookExporter) Export(ctx context.Context, env *tcpflow.Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return &permanentError{xerrors.Errorf("failed to marshal json: %w", err)}
+	}
+	return e.client.postJSON(ctx, e.url, b)
+}
+
+func (e *webhookExporter) Close() error {
+	e.client.close()
+	return nil
+}
@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestWebhookExporter(t *testing.T) {
+	var (
+		requests int
+		got      tcpflow.Envelope
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request should be POST application/json, but %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("X-Token header should be set, but %q", r.Header.Get("X-Token"))
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("body should be an envelope: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	e, err := New(&ExporterConfig{
+		Type:     "webhook",
+		Endpoint: ts.URL,
+		Headers:  map[string]string{"X-Token": "secret"},
+	}, RetryConfig{InitialInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer e.Close()
+
+	flows := tcpflow.HostFlows{}
+	for _, f := range []*tcpflow.HostFlow{
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: 22,
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+	env := tcpflow.NewEnvelope(flows, "netlink", "0.7.2", time.Unix(1600000000, 0))
+	if err := e.Export(context.Background(), env); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("requests should be 2 with a retry, but %d", requests)
+	}
+	if got.Hostname != env.Hostname || len(got.Flows) != len(env.Flows) {
+		t.Errorf("envelope should be %+v, but %+v", env, got)
+	}
+}
+
+func TestWebhookExporter_permanentError(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	e, err := New(&ExporterConfig{Type: "webhook", Endpoint: ts.URL}, RetryConfig{InitialInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer e.Close()
+
+	if err := e.Export(context.Background(), &tcpflow.Envelope{}); err == nil {
+		t.Error("err should be raised")
+	}
+	if requests != 1 {
+		t.Errorf("requests should be 1 without retry, but %d", requests)
+	}
+}
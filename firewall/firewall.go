@@ -0,0 +1,304 @@
+// Package firewall generates the allow-list rules of a host firewall from the
+// observed host flows, such as the rules of nftables or iptables.
+package firewall
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// Formats of Write.
+const (
+	FormatNftables = "nftables"
+	FormatIptables = "iptables"
+)
+
+// Formats are the formats of Write.
+var Formats = []string{FormatNftables, FormatIptables}
+
+// maxCommentLen is the maximum length of the comment of nftables.
+const maxCommentLen = 128
+
+// Rule allows the TCP connections on a port from or to the networks.
+type Rule struct {
+	// Direction is FlowPassive for the inbound connections to the local Port,
+	// or FlowActive for the outbound connections to the peer Port.
+	Direction tcpflow.FlowDirection
+	Port      uint16
+	// Networks are the peer networks of either IPv4 or IPv6.
+	Networks []netip.Prefix
+	// Processes are the names of the processes owning the connections.
+	Processes []string
+	// Connections is the total connections of the flows.
+	Connections int64
+}
+
+// Is6 reports whether the networks of the rule are IPv6.
+func (r *Rule) Is6() bool {
+	return len(r.Networks) > 0 && r.Networks[0].Addr().Is6()
+}
+
+// Comment returns the comment of the rule naming the processes, such as "nginx (120 connections)".
+func (r *Rule) Comment() string {
+	procs := "unknown process"
+	if len(r.Processes) > 0 {
+		procs = strings.Join(r.Processes, ",")
+	}
+	comment := fmt.Sprintf("%s (%d connections)", procs, r.Connections)
+	// the process names are controlled by the users. The double quotes are replaced,
+	// and the backslashes and the control characters such as newlines are dropped,
+	// which would break the quoted comment or the line of the rule.
+	comment = strings.Map(func(c rune) rune {
+		switch {
+		case c == '"':
+			return '\''
+		case c == '\\' || unicode.IsControl(c):
+			return -1
+		}
+		return c
+	}, strings.ToValidUTF8(comment, ""))
+	if len(comment) > maxCommentLen {
+		n := maxCommentLen
+		for n > 0 && !utf8.RuneStart(comment[n]) {
+			n--
+		}
+		comment = comment[:n]
+	}
+	return comment
+}
+
+// Generate returns the rules allowing the flows: the inbound rules of the passive
+// flows for the listening ports, and the outbound rules of the active flows for
+// the peer ports. The peers are aggregated into the networks of the prefix lengths
+// bits4 and bits6. The other flows, the flows on the loopback and the peers without
+// address are ignored.
+func Generate(flows tcpflow.HostFlows, bits4, bits6 int) []*Rule {
+	type key struct {
+		direction tcpflow.FlowDirection
+		port      uint16
+		is6       bool
+	}
+	rules := map[key]*Rule{}
+	addrs := map[key][]netip.Addr{}
+	procs := map[key]map[string]bool{}
+	for _, flow := range flows {
+		var port *tcpflow.AddrPort
+		switch flow.Direction {
+		case tcpflow.FlowPassive:
+			port = flow.Local
+		case tcpflow.FlowActive:
+			port = flow.Peer
+		default:
+			continue
+		}
+		peer := flow.Peer.Addr
+		if port.Wildcard || !peer.IsValid() || peer.IsLoopback() || flow.Local.Addr.IsLoopback() {
+			continue
+		}
+		k := key{direction: flow.Direction, port: port.Port, is6: peer.Is6()}
+		r, ok := rules[k]
+		if !ok {
+			r = &Rule{Direction: flow.Direction, Port: port.Port}
+			rules[k] = r
+			procs[k] = map[string]bool{}
+		}
+		r.Connections += flow.Connections
+		addrs[k] = append(addrs[k], peer)
+		if flow.Process != nil && flow.Process.Name != "" {
+			procs[k][flow.Process.Name] = true
+		}
+	}
+
+	result := make([]*Rule, 0, len(rules))
+	for k, r := range rules {
+		bits := bits4
+		if k.is6 {
+			bits = bits6
+		}
+		prefixes := make([]netip.Prefix, 0, len(addrs[k]))
+		for _, addr := range addrs[k] {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, bits).Masked())
+		}
+		r.Networks = Aggregate(prefixes)
+		for name := range procs[k] {
+			r.Processes = append(r.Processes, name)
+		}
+		sort.Strings(r.Processes)
+		result = append(result, r)
+	}
+	// the inbound rules precede the outbound rules, and IPv4 precedes IPv6 on a port.
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Direction != b.Direction {
+			return a.Direction == tcpflow.FlowPassive
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return !a.Is6() && b.Is6()
+	})
+	return result
+}
+
+// Aggregate returns the minimum sorted networks covering the prefixes, which
+// drops the prefixes contained in the others and merges the adjacent prefixes.
+func Aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	ps := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		ps = append(ps, p.Masked())
+	}
+	for {
+		sort.Slice(ps, func(i, j int) bool {
+			if c := ps[i].Addr().Compare(ps[j].Addr()); c != 0 {
+				return c < 0
+			}
+			return ps[i].Bits() < ps[j].Bits()
+		})
+		merged := ps[:0]
+		changed := false
+		for _, p := range ps {
+			if n := len(merged); n > 0 {
+				last := merged[n-1]
+				if last.Bits() <= p.Bits() && last.Contains(p.Addr()) {
+					continue
+				}
+				// the halves of a network are merged into the network.
+				if last.Bits() == p.Bits() && p.Bits() > 0 {
+					parent := netip.PrefixFrom(last.Addr(), last.Bits()-1).Masked()
+					if parent.Contains(p.Addr()) {
+						merged[n-1] = parent
+						changed = true
+						continue
+					}
+				}
+			}
+			merged = append(merged, p)
+		}
+		ps = merged
+		if !changed {
+			return ps
+		}
+	}
+}
+
+// Write writes the rules in the format with the header comment. The rules allow
+// the loopback and the established connections in addition to the rules, but
+// keep the default policies, so that the rules should be reviewed before dropping
+// the other connections.
+func Write(w io.Writer, format string, rules []*Rule, header string) error {
+	switch format {
+	case FormatNftables:
+		writeNftables(w, rules, header)
+	case FormatIptables:
+		writeIptables(w, rules, header)
+	default:
+		return xerrors.Errorf("unknown firewall format %q (available: %s)", format, strings.Join(Formats, ", "))
+	}
+	return nil
+}
+
+func writeComments(w io.Writer, header string) {
+	for _, line := range strings.Split(header, "\n") {
+		fmt.Fprintf(w, "# %s\n", line)
+	}
+}
+
+func writeNftables(w io.Writer, rules []*Rule, header string) {
+	fmt.Fprintln(w, "#!/usr/sbin/nft -f")
+	writeComments(w, header)
+	fmt.Fprintln(w, "# Review the rules, and then change the policies to drop.")
+	fmt.Fprintln(w, "table inet lstf {")
+	for i, chain := range []struct {
+		name      string
+		direction tcpflow.FlowDirection
+		iface     string
+		addr      string
+	}{
+		{"input", tcpflow.FlowPassive, "iifname", "saddr"},
+		{"output", tcpflow.FlowActive, "oifname", "daddr"},
+	} {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "\tchain %s {\n", chain.name)
+		fmt.Fprintf(w, "\t\ttype filter hook %s priority 0; policy accept;\n", chain.name)
+		fmt.Fprintf(w, "\t\t%s \"lo\" accept\n", chain.iface)
+		fmt.Fprintln(w, "\t\tct state established,related accept")
+		for _, r := range rules {
+			if r.Direction != chain.direction {
+				continue
+			}
+			family := "ip"
+			if r.Is6() {
+				family = "ip6"
+			}
+			networks := make([]string, 0, len(r.Networks))
+			for _, p := range r.Networks {
+				networks = append(networks, prefixString(p))
+			}
+			set := networks[0]
+			if len(networks) > 1 {
+				set = "{ " + strings.Join(networks, ", ") + " }"
+			}
+			fmt.Fprintf(w, "\t\t%s %s %s tcp dport %d accept comment \"%s\"\n",
+				family, chain.addr, set, r.Port, r.Comment())
+		}
+		fmt.Fprintln(w, "\t}")
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func writeIptables(w io.Writer, rules []*Rule, header string) {
+	fmt.Fprintln(w, "#!/bin/sh")
+	writeComments(w, header)
+	fmt.Fprintln(w, "# Review the rules, and then change the policies to DROP such as 'iptables -P INPUT DROP'.")
+	fmt.Fprintln(w, "set -e")
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		for _, chain := range []struct {
+			name      string
+			direction tcpflow.FlowDirection
+			iface     string
+			addr      string
+		}{
+			{"INPUT", tcpflow.FlowPassive, "-i", "-s"},
+			{"OUTPUT", tcpflow.FlowActive, "-o", "-d"},
+		} {
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "%s -A %s %s lo -j ACCEPT\n", cmd, chain.name, chain.iface)
+			fmt.Fprintf(w, "%s -A %s -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT\n", cmd, chain.name)
+			for _, r := range rules {
+				if r.Direction != chain.direction || r.Is6() != (cmd == "ip6tables") {
+					continue
+				}
+				networks := make([]string, 0, len(r.Networks))
+				for _, p := range r.Networks {
+					networks = append(networks, p.String())
+				}
+				fmt.Fprintf(w, "%s -A %s -p tcp %s %s --dport %d -m comment --comment %s -j ACCEPT\n",
+					cmd, chain.name, chain.addr, strings.Join(networks, ","), r.Port, shellQuote(r.Comment()))
+			}
+		}
+	}
+}
+
+// shellQuote returns s single-quoted for the shell, so that the shell expands nothing in s.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// prefixString returns the address for the single address prefix, or the CIDR.
+func prefixString(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
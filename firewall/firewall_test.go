@@ -0,0 +1,195 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		desc     string
+		prefixes []string
+		want     []string
+	}{
+		{"empty", []string{}, []string{}},
+		{"duplicated", []string{"10.0.0.1/32", "10.0.0.1/32"}, []string{"10.0.0.1/32"}},
+		{"contained", []string{"10.0.1.0/24", "10.0.0.0/16", "10.0.2.3/32"}, []string{"10.0.0.0/16"}},
+		{"halves", []string{"10.0.1.0/24", "10.0.0.0/24", "10.0.2.0/24", "10.0.3.0/24"}, []string{"10.0.0.0/22"}},
+		{"not halves", []string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{"unmasked", []string{"10.0.1.9/24"}, []string{"10.0.1.0/24"}},
+		{"ipv6", []string{"2001:db8::/64", "2001:db8:0:1::/64", "10.0.0.0/8"}, []string{"10.0.0.0/8", "2001:db8::/63"}},
+	}
+	for _, tc := range tests {
+		prefixes := make([]netip.Prefix, 0, len(tc.prefixes))
+		for _, s := range tc.prefixes {
+			prefixes = append(prefixes, netip.MustParsePrefix(s))
+		}
+		got := []string{}
+		for _, p := range Aggregate(prefixes) {
+			got = append(got, p.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("desc: %q, Aggregate(%v) should be %v, got %v", tc.desc, tc.prefixes, tc.want, got)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	local := netip.MustParseAddr("10.0.1.9")
+	flows := tcpflow.HostFlows{}
+	for _, f := range []*tcpflow.HostFlow{
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(local, 80),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.2.13")),
+			Connections: 100,
+			Process:     &tcpflow.Process{Name: "nginx", Pgid: 1100},
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(local, 80),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.3.14")),
+			Connections: 20,
+			Process:     &tcpflow.Process{Name: "nginx", Pgid: 1100},
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(netip.MustParseAddr("2001:db8::9"), 80),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("2001:db8:1::13")),
+			Connections: 5,
+		},
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(local),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: 22,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+		},
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("127.0.0.1")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("127.0.0.1"), 6379),
+			Connections: 4,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+
+	// the loopback flow is ignored.
+	rules := Generate(flows, 16, 48)
+	want := []struct {
+		direction tcpflow.FlowDirection
+		port      uint16
+		networks  string
+		comment   string
+	}{
+		{tcpflow.FlowPassive, 80, "[10.0.0.0/16]", "nginx (120 connections)"},
+		{tcpflow.FlowPassive, 80, "[2001:db8:1::/48]", "unknown process (5 connections)"},
+		{tcpflow.FlowActive, 3306, "[10.0.0.0/16]", "app (22 connections)"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules should be len == %d, got %d: %+v", len(want), len(rules), rules)
+	}
+	for i, w := range want {
+		r := rules[i]
+		if r.Direction != w.direction || r.Port != w.port || fmt.Sprint(r.Networks) != w.networks || r.Comment() != w.comment {
+			t.Errorf("rule #%d should be %v %d %s %q, got %v %d %v %q",
+				i, w.direction, w.port, w.networks, w.comment, r.Direction, r.Port, r.Networks, r.Comment())
+		}
+	}
+}
+
+func TestRule_Comment(t *testing.T) {
+	tests := []struct {
+		desc      string
+		processes []string
+		want      string
+	}{
+		{"unknown", nil, "unknown process (1 connections)"},
+		{"processes", []string{"app", "nginx"}, "app,nginx (1 connections)"},
+		{"quotes", []string{`a"b'c`}, "a'b'c (1 connections)"},
+		{"hostile", []string{"$(id)\n\"x\\"}, "$(id)'x (1 connections)"},
+		{"invalid utf-8", []string{"a\xffb"}, "ab (1 connections)"},
+		{"truncated", []string{strings.Repeat("a", 127) + "あ"}, strings.Repeat("a", 127)},
+	}
+	for _, tc := range tests {
+		r := &Rule{Processes: tc.processes, Connections: 1}
+		if got := r.Comment(); got != tc.want {
+			t.Errorf("desc: %q, Comment() should be %q, got %q", tc.desc, tc.want, got)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rules := []*Rule{
+		{
+			Direction:   tcpflow.FlowPassive,
+			Port:        80,
+			Networks:    []netip.Prefix{netip.MustParsePrefix("10.0.2.13/32"), netip.MustParsePrefix("10.0.3.0/24")},
+			Processes:   []string{"nginx"},
+			Connections: 120,
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Port:        80,
+			Networks:    []netip.Prefix{netip.MustParsePrefix("2001:db8:1::13/128")},
+			Connections: 5,
+		},
+		{
+			Direction:   tcpflow.FlowActive,
+			Port:        3306,
+			Networks:    []netip.Prefix{netip.MustParsePrefix("10.0.1.10/32")},
+			Processes:   []string{"app"},
+			Connections: 22,
+		},
+		{
+			Direction:   tcpflow.FlowActive,
+			Port:        443,
+			Networks:    []netip.Prefix{netip.MustParsePrefix("10.0.4.0/24")},
+			Processes:   []string{"$(id)\n\"x", "o'`id`"},
+			Connections: 3,
+		},
+	}
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{FormatNftables, []string{
+			"# generated\n",
+			"\t\tip saddr { 10.0.2.13, 10.0.3.0/24 } tcp dport 80 accept comment \"nginx (120 connections)\"\n",
+			"\t\tip6 saddr 2001:db8:1::13 tcp dport 80 accept comment \"unknown process (5 connections)\"\n",
+			"\t\tip daddr 10.0.1.10 tcp dport 3306 accept comment \"app (22 connections)\"\n",
+			"\t\tip daddr 10.0.4.0/24 tcp dport 443 accept comment \"$(id)'x,o'`id` (3 connections)\"\n",
+		}},
+		{FormatIptables, []string{
+			"# generated\n",
+			"iptables -A INPUT -p tcp -s 10.0.2.13/32,10.0.3.0/24 --dport 80 -m comment --comment 'nginx (120 connections)' -j ACCEPT\n",
+			"ip6tables -A INPUT -p tcp -s 2001:db8:1::13/128 --dport 80 -m comment --comment 'unknown process (5 connections)' -j ACCEPT\n",
+			"iptables -A OUTPUT -p tcp -d 10.0.1.10/32 --dport 3306 -m comment --comment 'app (22 connections)' -j ACCEPT\n",
+			// the single quotes of the process names are closed, escaped and reopened.
+			"iptables -A OUTPUT -p tcp -d 10.0.4.0/24 --dport 443 -m comment --comment '$(id)'\\''x,o'\\''`id` (3 connections)' -j ACCEPT\n",
+		}},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := Write(&buf, tc.format, rules, "generated"); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(buf.String(), w) {
+				t.Errorf("%s should contain %q, got\n%s", tc.format, w, buf.String())
+			}
+		}
+	}
+
+	if err := Write(&bytes.Buffer{}, "pf", rules, ""); err == nil {
+		t.Error("should raise error for the unknown format")
+	}
+}
@@ -1,16 +1,22 @@
 module github.com/yuuki/lstf
 
-go 1.15
+go 1.18
 
 require (
 	github.com/EricLagergren/go-gnulib v0.0.0-20191129172535-039a51fc60f4
-	github.com/StackExchange/wmi v0.0.0-20180116203802-5d049714c4a6 // indirect
+	github.com/cilium/ebpf v0.9.1
 	github.com/elastic/gosigar v0.10.5
-	github.com/go-ole/go-ole v1.2.1 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
 	github.com/shirou/gopsutil v2.19.9+incompatible
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.0.0-20210906170528-6f6e22806c34
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/StackExchange/wmi v0.0.0-20180116203802-5d049714c4a6 // indirect
+	github.com/go-ole/go-ole v1.2.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c
-	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898
 )
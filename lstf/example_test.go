@@ -0,0 +1,53 @@
+package lstf_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/yuuki/lstf/lstf"
+)
+
+func ExampleCollector_Collect() {
+	c, err := lstf.NewCollector(
+		lstf.WithSource("file:../testdata/flows.json"),
+		lstf.WithNumeric(),
+		lstf.WithProcesses(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flows, err := c.Collect(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, flow := range flows {
+		fmt.Println(flow.Local, flow.Direction.Arrow(), flow.Peer, flow.Connections, flow.Process.Name)
+	}
+	// Output:
+	// 10.0.1.9:many --> 8.8.8.8:443 3 app
+	// 10.0.1.9:many --> 10.0.1.10:3306 22 app
+	// 10.0.1.9:80 <-- 10.0.2.13:many 120 nginx
+}
+
+func ExampleWithFilter() {
+	c, err := lstf.NewCollector(
+		lstf.WithSource("file:../testdata/flows.json"),
+		lstf.WithNumeric(),
+		lstf.WithFilter(lstf.FilterPrivate),
+		lstf.WithGroupBy("subnet/16"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flows, err := c.Collect(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, flow := range flows {
+		fmt.Println(flow.Local, flow.Direction, flow.Peer, flow.Connections)
+	}
+	// Output:
+	// 10.0.1.9:many active 10.0.0.0/16:3306 22
+	// 10.0.1.9:80 passive 10.0.0.0/16:many 120
+}
@@ -0,0 +1,263 @@
+// Package lstf collects the host flows, which are the TCP connections between
+// localhost and other hosts aggregated by the service ports, to embed lstf in
+// Go programs such as monitoring agents.
+//
+//	c, err := lstf.NewCollector(lstf.WithNumeric(), lstf.WithFilter(lstf.FilterPublic))
+//	if err != nil {
+//		return err
+//	}
+//	flows, err := c.Collect(ctx)
+//
+// The types are the same as the types of the JSON printed by 'lstf --json',
+// whose envelope is described by schema/envelope.schema.json.
+package lstf
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// HostFlow is a host flow, which aggregates the connections between the local
+// and the peer addresses whose ephemeral ports are "many".
+type HostFlow = tcpflow.HostFlow
+
+// AddrPort is the address and the port of either end of a host flow.
+type AddrPort = tcpflow.AddrPort
+
+// Process is the process owning the sockets of a host flow.
+type Process = tcpflow.Process
+
+// Socket is a socket aggregated into a host flow, collected by WithSockets.
+type Socket = tcpflow.Socket
+
+// NAT is the translated addresses of a flow forwarded by the host.
+type NAT = tcpflow.NAT
+
+// Direction is the direction of a host flow, such as FlowActive.
+type Direction = tcpflow.FlowDirection
+
+// Warning is a non-fatal problem that occurred while collecting host flows.
+type Warning = tcpflow.Warning
+
+// FlowSource is a backend to get host flows, which can be registered by
+// tcpflow.RegisterFlowSource to be specified by name.
+type FlowSource = tcpflow.FlowSource
+
+// Catalog classifies the peers into the named networks. See netutil.LoadCatalog.
+type Catalog = netutil.Catalog
+
+// CloudRanges classifies the peers into the clouds. See netutil.LoadCloudRanges.
+type CloudRanges = netutil.CloudRanges
+
+// Directions of HostFlow.
+const (
+	// FlowActive is the flow connected from the host, which is 'active open'.
+	FlowActive = tcpflow.FlowActive
+	// FlowPassive is the flow accepted by the host, which is 'passive open'.
+	FlowPassive = tcpflow.FlowPassive
+	// FlowForwarded is the flow forwarded by the host, such as a router or NAT gateway.
+	FlowForwarded = tcpflow.FlowForwarded
+	// FlowUnknown is the flow whose direction could not be determined.
+	FlowUnknown = tcpflow.FlowUnknown
+)
+
+// Filters of WithFilter in addition to the labels of the catalog and the cloud filters.
+const (
+	FilterAll     = tcpflow.FilterAll
+	FilterPublic  = tcpflow.FilterPublic
+	FilterPrivate = tcpflow.FilterPrivate
+	// FilterCloud keeps the peers in any cloud ranges. "cloud:PROVIDER[/REGION[/SERVICE]]"
+	// keeps the peers in the specific clouds.
+	FilterCloud = tcpflow.FilterCloud
+)
+
+// Collector collects host flows. It is safe to call Collect concurrently.
+type Collector struct {
+	source   FlowSource
+	opt      tcpflow.GetHostFlowsOption
+	grouping *tcpflow.Grouping
+}
+
+// Option configures the Collector.
+type Option func(*Collector) error
+
+// WithSource gets connections from the flow source specified as "<name>" or
+// "<name>:<arg>", such as "netlink", "procfs", "conntrack" and "file:flows.json".
+// The default is "auto", which uses the best available source on the platform.
+func WithSource(spec string) Option {
+	return func(c *Collector) error {
+		src, err := tcpflow.NewFlowSource(spec)
+		if err != nil {
+			return err
+		}
+		c.source = src
+		return nil
+	}
+}
+
+// WithFlowSource gets connections from the flow source.
+func WithFlowSource(src FlowSource) Option {
+	return func(c *Collector) error {
+		if src == nil {
+			return xerrors.New("flow source is nil")
+		}
+		c.source = src
+		return nil
+	}
+}
+
+// WithNumeric keeps the addresses numerical instead of resolving the host names.
+func WithNumeric() Option {
+	return func(c *Collector) error {
+		c.opt.Numeric = true
+		return nil
+	}
+}
+
+// WithProcesses sets the processes owning the sockets of the flows.
+func WithProcesses() Option {
+	return func(c *Collector) error {
+		c.opt.Processes = true
+		return nil
+	}
+}
+
+// WithSockets keeps the individual sockets aggregated into each flow.
+// It is supported by netlink, procfs and gopsutil sources.
+func WithSockets() Option {
+	return func(c *Collector) error {
+		c.opt.Sockets = true
+		return nil
+	}
+}
+
+// WithFilter keeps the flows whose peers pass the filter, which is FilterAll,
+// FilterPublic, FilterPrivate, a label of WithCatalog or a cloud filter of WithCloudRanges.
+func WithFilter(filter string) Option {
+	return func(c *Collector) error {
+		c.opt.Filter = filter
+		return nil
+	}
+}
+
+// WithCatalog sets the labels of the networks containing the peers into AddrPort.Network.
+func WithCatalog(catalog *Catalog) Option {
+	return func(c *Collector) error {
+		c.opt.Catalog = catalog
+		return nil
+	}
+}
+
+// WithCloudRanges sets the clouds of the ranges containing the peers into AddrPort.Cloud.
+func WithCloudRanges(ranges *CloudRanges) Option {
+	return func(c *Collector) error {
+		c.opt.CloudRanges = ranges
+		return nil
+	}
+}
+
+// WithGroupBy aggregates the flows more coarsely by the grouping such as
+// "subnet/16", "cidr:FILE", "domain", "process" and "port", like 'lstf --group-by'.
+func WithGroupBy(spec string) Option {
+	return func(c *Collector) error {
+		g, err := tcpflow.ParseGrouping(spec)
+		if err != nil {
+			return err
+		}
+		c.grouping = g
+		return nil
+	}
+}
+
+// WithProcRoot reads the procfs files under the directory, such as a snapshot
+// extracted from 'lstf snapshot', by the procfs source.
+func WithProcRoot(dir string) Option {
+	return func(c *Collector) error {
+		c.opt.ProcRoot = dir
+		return nil
+	}
+}
+
+// WithWarningHandler calls the handler for each non-fatal problem, such as a
+// process which could not be inspected. The warnings are ignored by default.
+func WithWarningHandler(handler func(*Warning)) Option {
+	return func(c *Collector) error {
+		c.opt.OnWarning = handler
+		return nil
+	}
+}
+
+// NewCollector returns the collector configured by the options.
+func NewCollector(opts ...Option) (*Collector, error) {
+	c := &Collector{opt: tcpflow.GetHostFlowsOption{Filter: FilterAll}}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.source == nil {
+		if c.opt.ProcRoot != "" {
+			src, err := tcpflow.NewFlowSource("procfs")
+			if err != nil {
+				return nil, xerrors.Errorf("proc root requires procfs source: %w", err)
+			}
+			c.source = src
+		} else {
+			src, err := tcpflow.NewFlowSource(tcpflow.SourceAuto)
+			if err != nil {
+				return nil, err
+			}
+			c.source = src
+		}
+	}
+	if !c.opt.ValidFilter() {
+		return nil, xerrors.Errorf("unknown filter %q", c.opt.Filter)
+	}
+	if c.grouping != nil {
+		switch {
+		case c.grouping.Kind == tcpflow.GroupByDomain && c.opt.Numeric:
+			return nil, xerrors.New("grouping by domain cannot be used with numeric")
+		case c.grouping.Kind == tcpflow.GroupByProcess && !c.opt.Processes:
+			return nil, xerrors.New("grouping by process requires processes")
+		}
+	}
+	return c, nil
+}
+
+// Source returns the name of the flow source, such as "auto".
+func (c *Collector) Source() string {
+	return c.source.Name()
+}
+
+// Collect collects host flows, which are sorted by the direction, the local and
+// the peer addresses. If the context is done after the connections have been read,
+// it returns the partial flows with a warning of WarningPartial, such as the flows
+// without the processes or the host names. Otherwise it returns the error of the context.
+func (c *Collector) Collect(ctx context.Context) ([]*HostFlow, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the option is copied per collection not to share it between goroutines.
+	opt := c.opt
+	flows, err := c.source.GetHostFlows(ctx, &opt)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && xerrors.Is(err, ctxErr) {
+			return nil, ctxErr
+		}
+		return nil, xerrors.Errorf("failed to get host flows: %w", err)
+	}
+	if c.grouping != nil {
+		flows = flows.GroupBy(c.grouping)
+	}
+	if c.opt.Catalog != nil {
+		flows.Annotate(c.opt.Catalog)
+	}
+	if c.opt.CloudRanges != nil {
+		flows.AnnotateCloud(c.opt.CloudRanges)
+	}
+	return flows.Sorted(), nil
+}
@@ -0,0 +1,58 @@
+package lstf
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestNewCollector_error(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts []Option
+		want string
+	}{
+		{"unknown source", []Option{WithSource("unknown")}, "unknown flow source 'unknown'"},
+		{"nil source", []Option{WithFlowSource(nil)}, "flow source is nil"},
+		{"unknown filter", []Option{WithFilter("unknown")}, "unknown filter \"unknown\""},
+		{"cloud filter without ranges", []Option{WithFilter("cloud:aws")}, "unknown filter"},
+		{"unknown grouping", []Option{WithGroupBy("unknown")}, "unknown grouping"},
+		{"process grouping", []Option{WithGroupBy("process")}, "grouping by process requires processes"},
+		{"domain grouping", []Option{WithNumeric(), WithGroupBy("domain")}, "cannot be used with numeric"},
+	}
+	for _, tc := range tests {
+		_, err := NewCollector(tc.opts...)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("desc: %q, error should contain %q, got %v", tc.desc, tc.want, err)
+		}
+	}
+}
+
+// blockingSource blocks until the context is done.
+type blockingSource struct{}
+
+func (s *blockingSource) Name() string { return "blocking" }
+
+func (s *blockingSource) GetHostFlows(ctx context.Context, opt *tcpflow.GetHostFlowsOption) (tcpflow.HostFlows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCollector_Collect_canceled(t *testing.T) {
+	src := &blockingSource{}
+	c, err := NewCollector(WithFlowSource(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Source(); got != "blocking" {
+		t.Errorf("source should be %q, got %q", "blocking", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	if _, err := c.Collect(ctx); err != context.Canceled {
+		t.Errorf("error should be %v, got %v", context.Canceled, err)
+	}
+}
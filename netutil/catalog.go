@@ -0,0 +1,127 @@
+package netutil
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Network is a named network of a Catalog, such as "10.0.2.0/24 prod-db".
+type Network struct {
+	Prefix netip.Prefix
+	Label  string
+}
+
+// Catalog classifies addresses into the named networks by the most specific prefix.
+type Catalog struct {
+	networks []*Network
+}
+
+// NewCatalog returns the catalog of the networks.
+func NewCatalog(networks []*Network) *Catalog {
+	c := &Catalog{networks: make([]*Network, 0, len(networks))}
+	for _, n := range networks {
+		c.networks = append(c.networks, &Network{Prefix: n.Prefix.Masked(), Label: n.Label})
+	}
+	sort.SliceStable(c.networks, func(i, j int) bool {
+		return c.networks[i].Prefix.Bits() > c.networks[j].Prefix.Bits()
+	})
+	return c
+}
+
+// LoadCatalog reads the catalog from the file whose lines are a prefix and its label
+// such as "10.0.2.0/24 prod-db". Empty lines and lines starting with '#' are ignored.
+func LoadCatalog(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open catalog: %v", err)
+	}
+	defer f.Close()
+	c, err := ParseCatalog(f)
+	if err != nil {
+		return nil, xerrors.Errorf("%s:%v", path, err)
+	}
+	return c, nil
+}
+
+// ParseCatalog parses the catalog in the format of LoadCatalog.
+func ParseCatalog(r io.Reader) (*Catalog, error) {
+	var networks []*Network
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, xerrors.Errorf("%d: a prefix and a label are required: %q", n, line)
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, xerrors.Errorf("%d: %v", n, err)
+		}
+		networks = append(networks, &Network{Prefix: prefix, Label: strings.Join(fields[1:], " ")})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("failed to read catalog: %v", err)
+	}
+	return NewCatalog(networks), nil
+}
+
+// Lookup returns the most specific network containing 'ip', or nil if no network contains it.
+// It is nil for the nil catalog.
+func (c *Catalog) Lookup(ip netip.Addr) *Network {
+	if c == nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	for _, n := range c.networks {
+		if n.Prefix.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// Label returns the label of the network containing 'ip', or empty if no network contains it.
+func (c *Catalog) Label(ip netip.Addr) string {
+	if n := c.Lookup(ip); n != nil {
+		return n.Label
+	}
+	return ""
+}
+
+// HasLabel returns whether the catalog has a network labeled 'label'.
+func (c *Catalog) HasLabel(label string) bool {
+	if c == nil {
+		return false
+	}
+	for _, n := range c.networks {
+		if n.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Networks returns the networks from the most specific.
+func (c *Catalog) Networks() []*Network {
+	if c == nil {
+		return nil
+	}
+	return c.networks
+}
+
+// Len returns the number of the networks.
+func (c *Catalog) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.networks)
+}
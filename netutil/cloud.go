@@ -0,0 +1,255 @@
+package netutil
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// Cloud providers of the ip-ranges files read by LoadCloudRanges.
+const (
+	CloudAWS        = "aws"
+	CloudGCP        = "gcp"
+	CloudGoogle     = "google"
+	CloudAzure      = "azure"
+	CloudCloudflare = "cloudflare"
+)
+
+// Cloud represents where an address belongs to in a cloud provider.
+type Cloud struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region,omitempty"`
+	Service  string `json:"service,omitempty"`
+}
+
+// String returns "<provider>/<region>/<service>" without the empty elements at the end.
+func (c *Cloud) String() string {
+	s := c.Provider
+	switch {
+	case c.Service != "":
+		s += "/" + c.Region + "/" + c.Service
+	case c.Region != "":
+		s += "/" + c.Region
+	}
+	return s
+}
+
+// specificity ranks the clouds of the same prefix, so that a cloud with the
+// service wins over the one only with the region, such as the Azure service tag
+// "Storage.EastUS" over "AzureCloud.eastus".
+func (c *Cloud) specificity() int {
+	n := 0
+	if c.Service != "" {
+		n += 2
+	}
+	if c.Region != "" {
+		n++
+	}
+	return n
+}
+
+// CloudRanges classifies addresses into the clouds by the most specific prefix.
+type CloudRanges struct {
+	v4, v6 cloudTable
+	len    int
+}
+
+// cloudTable is the clouds by prefix, indexed by the prefix length.
+type cloudTable struct {
+	// bits are the prefix lengths of the table from the most specific.
+	bits     []int
+	prefixes map[int]map[netip.Prefix]*Cloud
+}
+
+// NewCloudRanges returns the empty ranges.
+func NewCloudRanges() *CloudRanges {
+	return &CloudRanges{}
+}
+
+// Add adds the range of the cloud. If the prefix is already added, the more specific cloud wins.
+func (r *CloudRanges) Add(prefix netip.Prefix, cloud *Cloud) {
+	prefix = prefix.Masked()
+	t := &r.v4
+	if prefix.Addr().Is6() {
+		t = &r.v6
+	}
+	if t.prefixes == nil {
+		t.prefixes = map[int]map[netip.Prefix]*Cloud{}
+	}
+	m, ok := t.prefixes[prefix.Bits()]
+	if !ok {
+		m = map[netip.Prefix]*Cloud{}
+		t.prefixes[prefix.Bits()] = m
+		t.bits = append(t.bits, prefix.Bits())
+		sort.Sort(sort.Reverse(sort.IntSlice(t.bits)))
+	}
+	if c, ok := m[prefix]; ok {
+		if c.specificity() >= cloud.specificity() {
+			return
+		}
+	} else {
+		r.len++
+	}
+	m[prefix] = cloud
+}
+
+// Lookup returns the cloud of the most specific range containing 'ip', or nil if no range contains it.
+// It is nil for the nil ranges.
+func (r *CloudRanges) Lookup(ip netip.Addr) *Cloud {
+	if r == nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	t := &r.v4
+	if ip.Is6() {
+		t = &r.v6
+	}
+	for _, bits := range t.bits {
+		prefix, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if c, ok := t.prefixes[bits][prefix]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// Len returns the number of the ranges.
+func (r *CloudRanges) Len() int {
+	if r == nil {
+		return 0
+	}
+	return r.len
+}
+
+// cloudRangesJSON is the union of the ip-ranges files published by the cloud providers.
+type cloudRangesJSON struct {
+	// AWS (https://ip-ranges.amazonaws.com/ip-ranges.json) and
+	// Google (https://www.gstatic.com/ipranges/cloud.json and goog.json)
+	Prefixes []struct {
+		IPPrefix   string `json:"ip_prefix"`
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+		Region     string `json:"region"`
+		Scope      string `json:"scope"`
+		Service    string `json:"service"`
+	} `json:"prefixes"`
+	IPv6Prefixes []struct {
+		IPv6Prefix string `json:"ipv6_prefix"`
+		Region     string `json:"region"`
+		Service    string `json:"service"`
+	} `json:"ipv6_prefixes"`
+
+	// Azure (ServiceTags_Public_<date>.json of the Azure IP Ranges and Service Tags)
+	Values []struct {
+		Properties struct {
+			Region          string   `json:"region"`
+			SystemService   string   `json:"systemService"`
+			AddressPrefixes []string `json:"addressPrefixes"`
+		} `json:"properties"`
+	} `json:"values"`
+
+	// Cloudflare (https://api.cloudflare.com/client/v4/ips)
+	Result *struct {
+		IPv4CIDRs []string `json:"ipv4_cidrs"`
+		IPv6CIDRs []string `json:"ipv6_cidrs"`
+	} `json:"result"`
+}
+
+// awsGenericService is the service of AWS, which includes the prefixes of the other services.
+const awsGenericService = "AMAZON"
+
+// LoadCloudRanges reads the ip-ranges files published by AWS, Google Cloud, Azure
+// and Cloudflare. The provider of each file is detected by its format.
+func LoadCloudRanges(paths ...string) (*CloudRanges, error) {
+	r := NewCloudRanges()
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read cloud ranges: %v", err)
+		}
+		if err := r.parse(b); err != nil {
+			return nil, xerrors.Errorf("%s: %v", path, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *CloudRanges) parse(b []byte) error {
+	var v cloudRangesJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return xerrors.Errorf("failed to parse cloud ranges: %v", err)
+	}
+	n := 0
+	add := func(s string, cloud *Cloud) error {
+		if s == "" {
+			return nil
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return xerrors.Errorf("invalid %s range: %v", cloud.Provider, err)
+		}
+		r.Add(prefix, cloud)
+		n++
+		return nil
+	}
+	switch {
+	case v.Result != nil:
+		cloud := &Cloud{Provider: CloudCloudflare}
+		for _, s := range append(v.Result.IPv4CIDRs, v.Result.IPv6CIDRs...) {
+			if err := add(s, cloud); err != nil {
+				return err
+			}
+		}
+	case len(v.Values) > 0:
+		for _, tag := range v.Values {
+			cloud := &Cloud{
+				Provider: CloudAzure,
+				Region:   tag.Properties.Region,
+				Service:  tag.Properties.SystemService,
+			}
+			for _, s := range tag.Properties.AddressPrefixes {
+				if err := add(s, cloud); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		for _, p := range v.Prefixes {
+			var cloud *Cloud
+			if p.IPPrefix != "" {
+				cloud = &Cloud{Provider: CloudAWS, Region: p.Region, Service: p.Service}
+			} else if p.Scope != "" || p.Service != "" {
+				cloud = &Cloud{Provider: CloudGCP, Region: p.Scope, Service: p.Service}
+			} else {
+				cloud = &Cloud{Provider: CloudGoogle}
+			}
+			if cloud.Service == awsGenericService {
+				cloud.Service = ""
+			}
+			for _, s := range []string{p.IPPrefix, p.IPv4Prefix, p.IPv6Prefix} {
+				if err := add(s, cloud); err != nil {
+					return err
+				}
+			}
+		}
+		for _, p := range v.IPv6Prefixes {
+			cloud := &Cloud{Provider: CloudAWS, Region: p.Region, Service: p.Service}
+			if cloud.Service == awsGenericService {
+				cloud.Service = ""
+			}
+			if err := add(p.IPv6Prefix, cloud); err != nil {
+				return err
+			}
+		}
+	}
+	if n == 0 {
+		return xerrors.New("no ranges of AWS, Google Cloud, Azure or Cloudflare are found")
+	}
+	return nil
+}
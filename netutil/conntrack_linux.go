@@ -0,0 +1,122 @@
+// +build linux
+
+package netutil
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var conntrackProcFilenames = []string{"net/nf_conntrack", "net/ip_conntrack"}
+
+// ConntrackTuple is a tuple of a connection tracked by conntrack.
+type ConntrackTuple struct {
+	Src   netip.Addr
+	Dst   netip.Addr
+	Sport uint16
+	Dport uint16
+}
+
+// ConntrackEntry represents a TCP connection tracked by conntrack.
+type ConntrackEntry struct {
+	State    string // TCP state such as "ESTABLISHED"
+	Original ConntrackTuple
+	Reply    ConntrackTuple
+}
+
+// Translated returns whether the connection is translated by NAT.
+func (e *ConntrackEntry) Translated() bool {
+	return e.Original.Src != e.Reply.Dst || e.Original.Sport != e.Reply.Dport ||
+		e.Original.Dst != e.Reply.Src || e.Original.Dport != e.Reply.Sport
+}
+
+// ConntrackConnections returns the TCP connections tracked by conntrack
+// from /proc/net/nf_conntrack. It requires the nf_conntrack module to be loaded.
+func ConntrackConnections() ([]*ConntrackEntry, error) {
+	for _, name := range conntrackProcFilenames {
+		path := filepath.Join(procRoot(), name)
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, xerrors.Errorf("could not open %s: %w", path, err)
+		}
+		defer f.Close()
+		return parseConntrack(f)
+	}
+	return nil, xerrors.Errorf("conntrack table not found in %s (is nf_conntrack loaded?)", procRoot())
+}
+
+// parseConntrack parses the conntrack table.
+// ex:
+// "ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.96.0.10 sport=51234 dport=53 src=10.244.2.7 dst=10.0.0.1 sport=53 dport=51234 [ASSURED] mark=0 zone=0 use=2"
+// The first tuple is the original direction and the second one is the reply direction.
+func parseConntrack(r io.Reader) ([]*ConntrackEntry, error) {
+	entries := []*ConntrackEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[2] != "tcp" {
+			continue
+		}
+		ent := &ConntrackEntry{State: fields[5]}
+		var (
+			tuple = &ent.Original
+			seen  = map[string]bool{}
+		)
+		for _, field := range fields[6:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if seen[kv[0]] {
+				// the keys appear again in the reply tuple.
+				if tuple == &ent.Reply {
+					break
+				}
+				tuple = &ent.Reply
+				seen = map[string]bool{}
+			}
+			seen[kv[0]] = true
+
+			switch kv[0] {
+			case "src", "dst":
+				ip, err := netip.ParseAddr(kv[1])
+				if err != nil {
+					return nil, xerrors.Errorf("invalid address '%s' in conntrack entry: %w", field, err)
+				}
+				if kv[0] == "src" {
+					tuple.Src = ip
+				} else {
+					tuple.Dst = ip
+				}
+			case "sport", "dport":
+				port, err := strconv.ParseUint(kv[1], 10, 16)
+				if err != nil {
+					return nil, xerrors.Errorf("invalid port '%s' in conntrack entry: %w", field, err)
+				}
+				if kv[0] == "sport" {
+					tuple.Sport = uint16(port)
+				} else {
+					tuple.Dport = uint16(port)
+				}
+			}
+		}
+		if !ent.Original.Src.IsValid() || !ent.Reply.Src.IsValid() {
+			continue
+		}
+		entries = append(entries, ent)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("could not read conntrack table: %w", err)
+	}
+	return entries, nil
+}
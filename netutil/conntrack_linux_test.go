@@ -0,0 +1,46 @@
+// +build linux
+
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConntrackConnections(t *testing.T) {
+	cur, _ := os.Getwd()
+	os.Setenv("PROC_ROOT", filepath.Join(cur, "../testdata/conntrack"))
+	defer os.Unsetenv("PROC_ROOT")
+
+	entries, err := ConntrackConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("entries should be len == 6 excluding udp, but %d", len(entries))
+	}
+
+	ent := entries[1]
+	if ent.State != "ESTABLISHED" {
+		t.Errorf("state should be ESTABLISHED, but %s", ent.State)
+	}
+	if ent.Original.Src.String() != "10.0.2.13" || ent.Original.Sport != 40001 ||
+		ent.Original.Dst.String() != "10.0.1.9" || ent.Original.Dport != 80 {
+		t.Errorf("unexpected original tuple %+v", ent.Original)
+	}
+	if ent.Reply.Src.String() != "10.0.1.9" || ent.Reply.Sport != 80 ||
+		ent.Reply.Dst.String() != "10.0.2.13" || ent.Reply.Dport != 40001 {
+		t.Errorf("unexpected reply tuple %+v", ent.Reply)
+	}
+	if ent.Translated() {
+		t.Error("entry should not be translated")
+	}
+
+	if !entries[2].Translated() {
+		t.Error("entry to the service address should be translated")
+	}
+	if entries[5].Original.Dst.String() != "2001:db8::2" {
+		t.Errorf("ipv6 dst should be 2001:db8::2, but %s", entries[5].Original.Dst)
+	}
+}
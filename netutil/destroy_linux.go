@@ -0,0 +1,118 @@
+// +build linux
+
+package netutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/elastic/gosigar/sys/linux"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// multicast groups of NETLINK_SOCK_DIAG.
+// see https://github.com/torvalds/linux/blob/v4.9/include/uapi/linux/sock_diag.h#L27.
+const (
+	sknlgrpInetTCPDestroy  = 1
+	sknlgrpInet6TCPDestroy = 3
+)
+
+const destroyMonitorRcvBuf = 4 << 20
+
+var (
+	// ErrMonitorClosed is returned by SockDestroyMonitor.Read after the monitor is closed.
+	ErrMonitorClosed = xerrors.New("socket destroy monitor closed")
+	// ErrNotificationsLost is returned by SockDestroyMonitor.Read when the
+	// kernel has dropped notifications because the receive buffer was full.
+	ErrNotificationsLost = xerrors.New("socket destroy notifications lost")
+)
+
+// SockDestroyMonitor receives notifications of destroyed TCP sockets from the
+// SKNLGRP_INET_TCP_DESTROY and SKNLGRP_INET6_TCP_DESTROY netlink groups.
+type SockDestroyMonitor struct {
+	file *os.File
+	conn syscall.RawConn
+	buf  []byte
+}
+
+// NewSockDestroyMonitor subscribes to the socket destroy notifications.
+// It requires CAP_NET_ADMIN.
+func NewSockDestroyMonitor() (*SockDestroyMonitor, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, xerrors.Errorf("socket: %w", err)
+	}
+	// ignore the error because the default buffer still works.
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, destroyMonitorRcvBuf)
+
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1<<(sknlgrpInetTCPDestroy-1) | 1<<(sknlgrpInet6TCPDestroy-1),
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, xerrors.Errorf("could not subscribe to socket destroy notifications: %w", err)
+	}
+
+	// os.File registers the non-blocking fd to the runtime poller,
+	// so that Close wakes up the blocking Read.
+	file := os.NewFile(uintptr(fd), "sock_diag")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, xerrors.Errorf("could not get raw connection: %w", err)
+	}
+	return &SockDestroyMonitor{
+		file: file,
+		conn: conn,
+		buf:  make([]byte, os.Getpagesize()*8),
+	}, nil
+}
+
+// Read blocks until sockets are destroyed, and returns them.
+func (m *SockDestroyMonitor) Read() ([]*linux.InetDiagMsg, error) {
+	var (
+		n    int
+		rerr error
+	)
+	err := m.conn.Read(func(fd uintptr) bool {
+		n, _, rerr = unix.Recvfrom(int(fd), m.buf, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err != nil {
+		if xerrors.Is(err, os.ErrClosed) {
+			return nil, ErrMonitorClosed
+		}
+		return nil, xerrors.Errorf("could not read notifications: %w", err)
+	}
+	if rerr != nil {
+		if rerr == unix.ENOBUFS {
+			return nil, ErrNotificationsLost
+		}
+		return nil, xerrors.Errorf("recvfrom: %w", rerr)
+	}
+
+	nlmsgs, err := syscall.ParseNetlinkMessage(m.buf[:n])
+	if err != nil {
+		return nil, xerrors.Errorf("could not parse netlink message: %w", err)
+	}
+	msgs := make([]*linux.InetDiagMsg, 0, len(nlmsgs))
+	for _, nlmsg := range nlmsgs {
+		if nlmsg.Header.Type == syscall.NLMSG_ERROR {
+			return nil, linux.ParseNetlinkError(nlmsg.Data)
+		}
+		msg, err := linux.ParseInetDiagMsg(nlmsg.Data)
+		if err != nil {
+			return nil, xerrors.Errorf("could not parse inet_diag_msg: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Close unsubscribes the notifications.
+// It is safe to call Close concurrently with Read.
+func (m *SockDestroyMonitor) Close() error {
+	return m.file.Close()
+}
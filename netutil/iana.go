@@ -0,0 +1,91 @@
+package netutil
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// SpecialPurposeBlock is an address block of the IANA IPv4 and IPv6 Special-Purpose Address Registries.
+// see https://www.iana.org/assignments/iana-ipv4-special-registry/ and
+// https://www.iana.org/assignments/iana-ipv6-special-registry/.
+type SpecialPurposeBlock struct {
+	Prefix netip.Prefix
+	Name   string
+	// Global is whether the addresses are globally reachable. The blocks whose
+	// reachability is "N/A" in the registries, such as 6to4 and Teredo, are
+	// regarded as globally reachable because they embed public IPv4 addresses.
+	Global bool
+}
+
+// specialPurposeBlocks are sorted from the most specific by init(), so that the
+// globally reachable exceptions such as 192.0.0.9/32 are found before their enclosing blocks.
+var specialPurposeBlocks = []*SpecialPurposeBlock{
+	// IPv4
+	{netip.MustParsePrefix("0.0.0.0/8"), "this-network", false},                    // RFC791
+	{netip.MustParsePrefix("0.0.0.0/32"), "this-host", false},                      // RFC1122
+	{netip.MustParsePrefix("10.0.0.0/8"), "private-use", false},                    // RFC1918
+	{netip.MustParsePrefix("100.64.0.0/10"), "shared-address-space", false},        // RFC6598
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback", false},                      // RFC1122
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local", false},                 // RFC3927
+	{netip.MustParsePrefix("172.16.0.0/12"), "private-use", false},                 // RFC1918
+	{netip.MustParsePrefix("192.0.0.0/24"), "ietf-protocol-assignments", false},    // RFC6890
+	{netip.MustParsePrefix("192.0.0.0/29"), "ipv4-service-continuity", false},      // RFC7335
+	{netip.MustParsePrefix("192.0.0.8/32"), "ipv4-dummy-address", false},           // RFC7600
+	{netip.MustParsePrefix("192.0.0.9/32"), "port-control-protocol-anycast", true}, // RFC7723
+	{netip.MustParsePrefix("192.0.0.10/32"), "turn-anycast", true},                 // RFC8155
+	{netip.MustParsePrefix("192.0.0.170/32"), "nat64-discovery", false},            // RFC8880
+	{netip.MustParsePrefix("192.0.0.171/32"), "nat64-discovery", false},            // RFC8880
+	{netip.MustParsePrefix("192.0.2.0/24"), "documentation", false},                // RFC5737
+	{netip.MustParsePrefix("192.31.196.0/24"), "as112-v4", true},                   // RFC7535
+	{netip.MustParsePrefix("192.52.193.0/24"), "amt", true},                        // RFC7450
+	{netip.MustParsePrefix("192.88.99.0/24"), "6to4-relay-anycast", true},          // RFC7526
+	{netip.MustParsePrefix("192.168.0.0/16"), "private-use", false},                // RFC1918
+	{netip.MustParsePrefix("192.175.48.0/24"), "as112-direct-delegation", true},    // RFC7534
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking", false},                // RFC2544
+	{netip.MustParsePrefix("198.51.100.0/24"), "documentation", false},             // RFC5737
+	{netip.MustParsePrefix("203.0.113.0/24"), "documentation", false},              // RFC5737
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved", false},                      // RFC1112
+	{netip.MustParsePrefix("255.255.255.255/32"), "limited-broadcast", false},      // RFC919
+
+	// IPv6
+	{netip.MustParsePrefix("::1/128"), "loopback", false},                           // RFC4291
+	{netip.MustParsePrefix("::/128"), "unspecified", false},                         // RFC4291
+	{netip.MustParsePrefix("::ffff:0:0/96"), "ipv4-mapped", false},                  // RFC4291
+	{netip.MustParsePrefix("64:ff9b::/96"), "ipv4-ipv6-translation", true},          // RFC6052
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "ipv4-ipv6-translation", false},       // RFC8215
+	{netip.MustParsePrefix("100::/64"), "discard-only", false},                      // RFC6666
+	{netip.MustParsePrefix("2001::/23"), "ietf-protocol-assignments", false},        // RFC2928
+	{netip.MustParsePrefix("2001::/32"), "teredo", true},                            // RFC4380
+	{netip.MustParsePrefix("2001:1::1/128"), "port-control-protocol-anycast", true}, // RFC7723
+	{netip.MustParsePrefix("2001:1::2/128"), "turn-anycast", true},                  // RFC8155
+	{netip.MustParsePrefix("2001:2::/48"), "benchmarking", false},                   // RFC5180
+	{netip.MustParsePrefix("2001:3::/32"), "amt", true},                             // RFC7450
+	{netip.MustParsePrefix("2001:4:112::/48"), "as112-v6", true},                    // RFC7535
+	{netip.MustParsePrefix("2001:20::/28"), "orchidv2", true},                       // RFC7343
+	{netip.MustParsePrefix("2001:30::/28"), "drone-remote-id-protocol", true},       // RFC9374
+	{netip.MustParsePrefix("2001:db8::/32"), "documentation", false},                // RFC3849
+	{netip.MustParsePrefix("2002::/16"), "6to4", true},                              // RFC3056
+	{netip.MustParsePrefix("2620:4f:8000::/48"), "as112-direct-delegation", true},   // RFC7534
+	{netip.MustParsePrefix("3fff::/20"), "documentation", false},                    // RFC9637
+	{netip.MustParsePrefix("5f00::/16"), "segment-routing-sids", false},             // RFC9602
+	{netip.MustParsePrefix("fc00::/7"), "unique-local", false},                      // RFC4193
+	{netip.MustParsePrefix("fe80::/10"), "link-local", false},                       // RFC4291
+}
+
+func init() {
+	sort.SliceStable(specialPurposeBlocks, func(i, j int) bool {
+		return specialPurposeBlocks[i].Prefix.Bits() > specialPurposeBlocks[j].Prefix.Bits()
+	})
+}
+
+// LookupSpecialPurpose returns the most specific special-purpose block containing 'ip',
+// or nil if 'ip' is an ordinary unicast address.
+func LookupSpecialPurpose(ip netip.Addr) *SpecialPurposeBlock {
+	ip = ip.Unmap()
+	for _, block := range specialPurposeBlocks {
+		if block.Prefix.Contains(ip) {
+			return block
+		}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package netutil
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"sort"
 	"strings"
 
 	"golang.org/x/xerrors"
@@ -19,23 +23,13 @@ type UserEnt struct {
 	pgrp  int    // process group id
 }
 
-var privateIPBlocks []*net.IPNet
-
-func init() {
-	for _, cidr := range []string{
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-		"::1/128",        // IPv6 loopback
-		"fe80::/10",      // IPv6 link-local
-		"fc00::/7",       // IPv6 unique local addr
-	} {
-		_, block, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(fmt.Errorf("parse error on %q: %v", cidr, err))
-		}
-		privateIPBlocks = append(privateIPBlocks, block)
-	}
+// NetlinkError represents netlink error.
+type NetlinkError struct {
+	msg string
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("Netlink error: %s", e.msg)
 }
 
 // Inode returns inode.
@@ -76,41 +70,142 @@ func (u *UserEnt) SetInode(inode uint32) {
 // UserEnts represents a hashmap of UserEnt as key is the inode.
 type UserEnts map[uint32]*UserEnt
 
-// ResolveAddr lookup first hostname from IP Address.
-func ResolveAddr(addr string) string {
-	hostnames, _ := net.LookupAddr(addr)
+// timerNames are the names of the kinds of the socket timers, which are
+// the 'tr' field of /proc/net/tcp and idiag_timer of netlink.
+var timerNames = map[uint8]string{
+	1: "retransmit",
+	2: "keepalive",
+	3: "timewait",
+	4: "probe", // zero window probe
+}
+
+// TimerName returns the name of the kind of the socket timer, or empty if no timer is pending.
+func TimerName(timer uint8) string {
+	if name, ok := timerNames[timer]; ok {
+		return name
+	}
+	if timer == 0 {
+		return ""
+	}
+	return "unknown"
+}
+
+// ScanWarning represents a process that could not be inspected while scanning
+// sockets owned by processes, such as permission denied on /proc/<pid>/fd.
+type ScanWarning struct {
+	Pid  int
+	Path string
+	Err  error
+}
+
+func newScanWarning(pid int, err error) *ScanWarning {
+	w := &ScanWarning{Pid: pid, Err: err}
+	var pathErr *os.PathError
+	if xerrors.As(err, &pathErr) {
+		w.Path = pathErr.Path
+	}
+	return w
+}
+
+func (w *ScanWarning) Error() string {
+	return fmt.Sprintf("pid %d: %v", w.Pid, w.Err)
+}
+
+// Unwrap returns the underlying error.
+func (w *ScanWarning) Unwrap() error {
+	return w.Err
+}
+
+// IsPermission returns whether the warning is caused by lack of permission.
+func (w *ScanWarning) IsPermission() bool {
+	return xerrors.Is(w.Err, os.ErrPermission)
+}
+
+// resolver resolves the host names of ResolveAddr.
+var resolver = net.DefaultResolver
+
+// SetResolver makes ResolveAddr query the DNS server at 'addr' such as "10.0.0.2:53"
+// instead of the resolver of the system. The port is 53 if omitted.
+func SetResolver(addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// ResolveAddr lookup first hostname from IP Address. It returns the address
+// itself if the lookup fails, or the context is done.
+func ResolveAddr(ctx context.Context, addr netip.Addr) string {
+	hostnames, _ := resolver.LookupAddr(ctx, addr.String())
 	if len(hostnames) > 0 {
 		return strings.TrimSuffix(hostnames[0], ".")
 	}
-	return addr
+	return addr.String()
+}
+
+// AddrFromIP converts net.IP into netip.Addr. An IPv4-mapped IPv6 address is
+// converted into the IPv4 address. It returns the zero Addr if 'ip' is invalid.
+func AddrFromIP(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
 }
 
-// LocalIPAddrs gets the string slice of localhost IPaddrs.
-func LocalIPAddrs() ([]string, error) {
+// LocalIPAddrs gets the IPv4 addresses of localhost except loopback.
+func LocalIPAddrs() ([]netip.Addr, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get local addresses: %v", err)
 	}
-	addrStrings := make([]string, 0, len(addrs))
+	ips := make([]netip.Addr, 0, len(addrs))
 	for _, a := range addrs {
 		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				addrStrings = append(addrStrings, ipnet.IP.String())
+			if ip := AddrFromIP(ipnet.IP); ip.Is4() {
+				ips = append(ips, ip)
 			}
 		}
 	}
-	return addrStrings, nil
+	return ips, nil
 }
 
-// IsPrivateIP returns whether 'ip' is in private network space.
-func IsPrivateIP(ip net.IP) bool {
-	if ip.IsLoopback() {
-		return true
-	}
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true
-		}
+// IsPrivateIP returns whether 'ip' is in private network space, which is any
+// special-purpose block not globally reachable such as RFC1918, CGNAT and link-local.
+func IsPrivateIP(ip netip.Addr) bool {
+	block := LookupSpecialPurpose(ip)
+	return block != nil && !block.Global
+}
+
+// PortSet is a set of ports, such as the local listening ports.
+type PortSet map[uint16]struct{}
+
+// Add adds the port into the set.
+func (s PortSet) Add(port uint16) {
+	s[port] = struct{}{}
+}
+
+// Has returns whether the set contains the port.
+func (s PortSet) Has(port uint16) bool {
+	_, ok := s[port]
+	return ok
+}
+
+// Sorted returns the ports in ascending order.
+func (s PortSet) Sorted() []uint16 {
+	ports := make([]uint16, 0, len(s))
+	for port := range s {
+		ports = append(ports, port)
 	}
-	return false
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// isListenerAddr returns whether the listening address accepts connections from
+// other hosts or the host itself, such as '0.0.0.0', '::' and '127.0.0.1'.
+func isListenerAddr(ip netip.Addr) bool {
+	return ip.IsUnspecified() || ip == netip.AddrFrom4([4]byte{127, 0, 0, 1})
 }
@@ -5,12 +5,13 @@ package netutil
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -22,19 +23,16 @@ import (
 	gnet "github.com/shirou/gopsutil/net"
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
-)
-
-// NetlinkError represents netlink error.
-type NetlinkError struct {
-	msg string
-}
 
-func (e *NetlinkError) Error() string {
-	return fmt.Sprintf("Netlink error: %s", e.msg)
-}
+	"github.com/yuuki/lstf/dlog"
+)
 
-// NetlinkConnections returns connection stats.
-func NetlinkConnections() ([]*linux.InetDiagMsg, error) {
+// NetlinkConnections returns connection stats. The dump is not interrupted
+// once it has started, so the context is checked only before it.
+func NetlinkConnections(ctx context.Context) ([]*linux.InetDiagMsg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	req := linux.NewInetDiagReq()
 	msgs, err := linux.NetlinkInetDiag(req)
 	if err != nil {
@@ -44,7 +42,7 @@ func NetlinkConnections() ([]*linux.InetDiagMsg, error) {
 }
 
 // UserEntByLport is a map that key is listening port, value is UserEnt structure.
-type UserEntByLport map[string]*UserEnt
+type UserEntByLport map[uint16]*UserEnt
 
 // NetlinkFilterByLocalListeningPorts filters ConnectionStat slice by the local listening ports.
 func NetlinkFilterByLocalListeningPorts(conns []*linux.InetDiagMsg) ([]*linux.InetDiagMsg, error) {
@@ -53,8 +51,7 @@ func NetlinkFilterByLocalListeningPorts(conns []*linux.InetDiagMsg) ([]*linux.In
 		if linux.TCPState(conn.State) != linux.TCP_LISTEN {
 			continue
 		}
-		sip := conn.SrcIP().String()
-		if sip == "0.0.0.0" || sip == "127.0.0.1" || sip == "::" {
+		if isListenerAddr(AddrFromIP(conn.SrcIP())) {
 			lconns = append(lconns, conn)
 		}
 	}
@@ -62,46 +59,68 @@ func NetlinkFilterByLocalListeningPorts(conns []*linux.InetDiagMsg) ([]*linux.In
 }
 
 // NetlinkLocalListeningPorts returns the local listening ports.
-func NetlinkLocalListeningPorts() ([]string, error) {
-	msgs, err := NetlinkConnections()
+func NetlinkLocalListeningPorts() (PortSet, error) {
+	msgs, err := NetlinkConnections(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	ports := make([]string, 0, len(msgs))
+	ports := make(PortSet, len(msgs))
 	for _, diag := range msgs {
 		if linux.TCPState(diag.State) != linux.TCP_LISTEN {
 			continue
 		}
-		ports = append(ports, fmt.Sprintf("%v", diag.SrcPort()))
+		ports.Add(uint16(diag.SrcPort()))
 	}
 	return ports, nil
 }
 
-const (
-	tcpProcFilename = "/proc/net/tcp"
-)
-
-// Addr is <addr>:<port>.
-type Addr struct {
-	IP   string `json:"ip"`
-	Port uint32 `json:"port"`
-}
+// tcpProcFilenames are the TCP socket tables under procfs.
+var tcpProcFilenames = []string{"net/tcp", "net/tcp6"}
 
 // ConnectionStat represents statistics for a connection.
 type ConnectionStat struct {
-	Laddr  Addr
-	Raddr  Addr
+	Laddr  netip.AddrPort
+	Raddr  netip.AddrPort
 	Status linux.TCPState
+	UID    uint32
+	Inode  uint32 // 0 if the socket is not owned by any process, such as TIME-WAIT
+
+	Timer        uint8  // the kind of the pending timer, see TimerName
+	TimerExpires uint32 // milliseconds until the timer expires
+	Retransmits  uint8
 }
 
 // ProcfsConnections returns connection stats.
-// ref. https://github.com/shirou/gopsutil/blob/c23bcca55e77b8389d84b09db8c5ac2b472070ef/net/net_linux.go#L656
 func ProcfsConnections() ([]*ConnectionStat, error) {
-	body, err := ioutil.ReadFile(tcpProcFilename)
-	if err != nil {
-		return nil, err
+	return ProcfsConnectionsAt("")
+}
+
+// ProcfsConnectionsAt returns connection stats from net/tcp and net/tcp6
+// under the procfs 'root', such as an extracted snapshot.
+// An empty root means the procfs of the host.
+func ProcfsConnectionsAt(root string) ([]*ConnectionStat, error) {
+	if root == "" {
+		root = procRoot()
+	}
+	var conns []*ConnectionStat
+	for _, name := range tcpProcFilenames {
+		path := filepath.Join(root, name)
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			if name == "net/tcp6" && os.IsNotExist(err) {
+				// IPv6 is disabled.
+				continue
+			}
+			return nil, err
+		}
+		conns = append(conns, parseProcNetTCP(body)...)
 	}
+	return conns, nil
+}
 
+// parseProcNetTCP parses /proc/net/tcp or /proc/net/tcp6.
+// ref. https://github.com/shirou/gopsutil/blob/c23bcca55e77b8389d84b09db8c5ac2b472070ef/net/net_linux.go#L656
+func parseProcNetTCP(body []byte) []*ConnectionStat {
 	lines := bytes.Split(body, []byte("\n"))
 	conns := make([]*ConnectionStat, 0, len(lines)-1)
 	for _, line := range lines[1:] {
@@ -123,15 +142,35 @@ func ProcfsConnections() ([]*ConnectionStat, error) {
 		if err != nil {
 			continue
 		}
+		uid, err := strconv.ParseUint(l[7], 10, 32)
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(l[9], 10, 32)
+		if err != nil {
+			continue
+		}
+		// "tr:tm->when", where tm->when is in clock ticks of USER_HZ (100).
+		var timer, when uint64
+		if t := strings.SplitN(l[5], ":", 2); len(t) == 2 {
+			timer, _ = strconv.ParseUint(t[0], 16, 8)
+			when, _ = strconv.ParseUint(t[1], 16, 32)
+		}
+		retrans, _ := strconv.ParseUint(l[6], 16, 8)
 
 		conns = append(conns, &ConnectionStat{
 			Laddr:  la,
 			Raddr:  ra,
 			Status: linux.TCPState(status),
+			UID:    uint32(uid),
+			Inode:  uint32(inode),
+
+			Timer:        uint8(timer),
+			TimerExpires: uint32(when * 10),
+			Retransmits:  uint8(retrans),
 		})
 	}
-
-	return conns, nil
+	return conns
 }
 
 // decodeAddress decode addresse represents addr in proc/net/*
@@ -139,45 +178,56 @@ func ProcfsConnections() ([]*ConnectionStat, error) {
 // "0500000A:0016" -> "10.0.0.5", 22
 // "0085002452100113070057A13F025401:0035" -> "2400:8500:1301:1052:a157:7:154:23f", 53
 // ref. https://github.com/shirou/gopsutil/blob/c23bcca55e77b8389d84b09db8c5ac2b472070ef/net/net_linux.go#L600
-func decodeAddress(src string) (Addr, error) {
+func decodeAddress(src string) (netip.AddrPort, error) {
 	t := strings.Split(src, ":")
 	if len(t) != 2 {
-		return Addr{}, xerrors.Errorf("does not contain port, %s", src)
+		return netip.AddrPort{}, xerrors.Errorf("does not contain port, %s", src)
 	}
 	addr := t[0]
-	port, err := strconv.ParseInt("0x"+t[1], 0, 64)
+	port, err := strconv.ParseUint(t[1], 16, 16)
 	if err != nil {
-		return Addr{}, xerrors.Errorf("invalid port, %s", src)
+		return netip.AddrPort{}, xerrors.Errorf("invalid port, %s", src)
 	}
 	decoded, err := hex.DecodeString(addr)
 	if err != nil {
-		return Addr{}, xerrors.Errorf("decode error, %s", err)
+		return netip.AddrPort{}, xerrors.Errorf("decode error, %s", err)
 	}
-	// Assumes this is little_endian
-	ip := net.IP(gnet.Reverse(decoded))
-	return Addr{
-		IP:   ip.String(),
-		Port: uint32(port),
-	}, nil
+	// Assumes this is little_endian.
+	// An IPv6 address consists of four 32-bit words in host byte order.
+	ip := make([]byte, 0, len(decoded))
+	for i := 0; i+4 <= len(decoded); i += 4 {
+		ip = append(ip, gnet.Reverse(decoded[i:i+4])...)
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok || len(ip) != len(decoded) {
+		return netip.AddrPort{}, xerrors.Errorf("invalid address length, %s", src)
+	}
+	return netip.AddrPortFrom(a.Unmap(), uint16(port)), nil
 }
 
 // FilterByLocalListeningPorts filters ConnectionStat slice by the local listening ports.
-func FilterByLocalListeningPorts(conns []*ConnectionStat) ([]string, error) {
-	ports := []string{}
+func FilterByLocalListeningPorts(conns []*ConnectionStat) (PortSet, error) {
+	ports := PortSet{}
 	for _, conn := range conns {
 		if conn.Status != linux.TCP_LISTEN {
 			continue
 		}
-		if conn.Laddr.IP == "0.0.0.0" || conn.Laddr.IP == "127.0.0.1" || conn.Laddr.IP == "::" {
-			ports = append(ports, fmt.Sprintf("%d", conn.Laddr.Port))
+		if isListenerAddr(conn.Laddr.Addr()) {
+			ports.Add(conn.Laddr.Port())
 		}
 	}
 	return ports, nil
 }
 
 // LocalListeningPorts returns the local listening ports.
-func LocalListeningPorts() ([]string, error) {
-	conns, err := ProcfsConnections()
+func LocalListeningPorts() (PortSet, error) {
+	return LocalListeningPortsAt("")
+}
+
+// LocalListeningPortsAt returns the listening ports in procfs under 'root', such as
+// a snapshot extracted by 'lstf snapshot'. It is the procfs of the host if empty.
+func LocalListeningPortsAt(root string) (PortSet, error) {
+	conns, err := ProcfsConnectionsAt(root)
 	if err != nil {
 		return nil, err
 	}
@@ -225,6 +275,9 @@ func parseProcStat(root string, pid int) (*procStat, error) {
 			break
 		}
 	}
+	if len(comm) < 2 || comm[0] != '(' || comm[len(comm)-1] != ')' {
+		return nil, xerrors.Errorf("comm should be enclosed in parentheses '%s'", stat)
+	}
 	comm = comm[1 : len(comm)-1] // remove '(' and ')'
 
 	// 3. state
@@ -262,11 +315,11 @@ func parseSocketInode(lnk string) (uint32, error) {
 		return 0, nil
 	}
 	open := ind + len(socketPrefix)
-	close := open + strings.Index(lnk[open:], "]")
-	if close == -1 {
-		return 0, xerrors.Errorf("'%s' should be the expected pattern '[socket:\\%d]'", lnk)
+	n := strings.Index(lnk[open:], "]")
+	if n == -1 {
+		return 0, xerrors.Errorf("'%s' should be the expected pattern 'socket:[<inode number>]'", lnk)
 	}
-	inode := lnk[open:close]
+	inode := lnk[open : open+n]
 	ino, err := strconv.ParseUint(inode, 10, 32)
 	if err != nil {
 		return 0, xerrors.Errorf("'%s' should be a number string", inode)
@@ -285,30 +338,73 @@ func binaryToString(s []int8) string {
 	return buff.String()
 }
 
-// BuildUserEntries scans under /proc/%pid/fd/.
-func BuildUserEntries() (UserEnts, error) {
+// procRoot returns the root of procfs, which can be overridden by PROC_ROOT.
+func procRoot() string {
 	root := os.Getenv("PROC_ROOT")
 	if root == "" {
 		root = "/proc"
 	}
+	return root
+}
 
+// readlink is replaceable for simulating races in tests.
+var readlink = os.Readlink
+
+// isVanished returns whether err means that a process or a fd has disappeared during the scan.
+func isVanished(err error) bool {
+	return xerrors.Is(err, syscall.ENOENT) || xerrors.Is(err, syscall.ESRCH)
+}
+
+// BuildUserEntries scans under /proc/%pid/fd/.
+// Processes that exit during the scan are skipped silently, and processes
+// that cannot be inspected are reported as warnings instead of failing the whole scan.
+// If the context is done during the scan, it returns the entries scanned so far
+// with the error of the context.
+func BuildUserEntries(ctx context.Context) (UserEnts, []*ScanWarning, error) {
+	return BuildUserEntriesAt(ctx, "")
+}
+
+// BuildUserEntriesAt is like BuildUserEntries, but scans under the procfs 'root'.
+// If 'root' has the fd manifest, such as an extracted snapshot, it reads the
+// manifest instead of the fd links. An empty root means the procfs of the host.
+func BuildUserEntriesAt(ctx context.Context, root string) (UserEnts, []*ScanWarning, error) {
+	if root == "" {
+		root = procRoot()
+	}
+	path := filepath.Join(root, FDManifestFilename)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return buildUserEntries(ctx, root)
+		}
+		return nil, nil, xerrors.Errorf("could not open %s: %w", path, err)
+	}
+	defer f.Close()
+	return buildUserEntriesFromManifest(ctx, root, f)
+}
+
+func buildUserEntries(ctx context.Context, root string) (UserEnts, []*ScanWarning, error) {
 	// Use dirent package instread of os.ReadDir for speeding up.
 	// see https://stackoverflow.com/questions/41419056/golang-os-file-readdir-using-lstat-on-all-files-can-it-be-optimised.
 	stream, err := dirent.Open(root)
 	if err != nil {
-		return nil, xerrors.Errorf("dirent.Open %s: %v", root, err)
+		return nil, nil, xerrors.Errorf("dirent.Open %s: %w", root, err)
 	}
 	defer stream.Close()
 
 	userEnts := make(UserEnts)
+	var warnings []*ScanWarning
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return userEnts, warnings, err
+		}
 		entry, err := stream.Read()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, xerrors.Errorf("stream.Read %s: %v", root, err)
+			return nil, nil, xerrors.Errorf("stream.Read %s: %w", root, err)
 		}
 		if entry.Type != unix.DT_DIR {
 			// find only "<pid>"" directory
@@ -326,84 +422,159 @@ func BuildUserEntries() (UserEnts, error) {
 			continue
 		}
 
-		pidDir := filepath.Join(root, dirName)
-		fdDir := filepath.Join(pidDir, "fd")
-
-		// exists fd?
-		fi, err := os.Stat(fdDir)
-		switch {
-		case err != nil:
-			// ignore ENOENT error
-			// ENOENT error occurs when the fd has already closed due to short-lived connection
-			continue
-		case !fi.IsDir():
-			continue
-		}
-
-		fdStream, err := dirent.Open(fdDir)
+		ents, err := scanProcessSockets(root, pid)
 		if err != nil {
-			pathErr := err.(*os.PathError)
-			errno := pathErr.Err.(syscall.Errno)
-			if errno == syscall.EACCES {
-				// ignore "open: <path> permission denied"
+			if isVanished(err) {
+				// the process has exited during the scan.
+				dlog.Debugf("skip pid %d: %v", pid, err)
 				continue
 			}
-			return nil, xerrors.Errorf("dirent.Open %s: %v", fdDir, err)
+			warnings = append(warnings, newScanWarning(pid, err))
+			continue
 		}
-		defer fdStream.Close()
+		for _, ent := range ents {
+			userEnts[ent.inode] = ent
+		}
+	}
+	return userEnts, warnings, nil
+}
 
-		var stat *procStat
+// scanProcessSockets returns the sockets opened by the process 'pid'.
+func scanProcessSockets(root string, pid int) ([]*UserEnt, error) {
+	fdDir := filepath.Join(root, strconv.Itoa(pid), "fd")
 
-		for {
-			fdEntry, err := fdStream.Read()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return nil, xerrors.Errorf("fdStream.Read %s: %v", fdEntry, err)
+	fdStream, err := dirent.Open(fdDir)
+	if err != nil {
+		return nil, err // *os.PathError
+	}
+	defer fdStream.Close()
+
+	var (
+		stat *procStat
+		ents []*UserEnt
+	)
+	for {
+		fdEntry, err := fdStream.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
-			fdName := binaryToString(fdEntry.Name[:])
+			return nil, xerrors.Errorf("fdStream.Read %s: %w", fdDir, err)
+		}
+		fdName := binaryToString(fdEntry.Name[:])
 
-			fd, err := strconv.Atoi(fdName)
-			if err != nil {
+		fd, err := strconv.Atoi(fdName)
+		if err != nil {
+			continue
+		}
+		fdpath := filepath.Join(fdDir, fdName)
+		lnk, err := readlink(fdpath)
+		if err != nil {
+			if isVanished(err) {
+				// ignore "readlink: no such file or directory"
+				// because fdpath is disappear depending on timing
 				continue
 			}
-			fdpath := filepath.Join(fdDir, fdName)
-			lnk, err := os.Readlink(fdpath)
-			if err != nil {
-				pathErr := err.(*os.PathError)
-				errno := pathErr.Err.(syscall.Errno)
-				if errno == syscall.ENOENT {
-					// ignore "readlink: no such file or directory"
-					// because fdpath is disappear depending on timing
-					continue
-				}
-				return nil, xerrors.Errorf("readlink %s: %v", fdpath, err)
-			}
-			ino, err := parseSocketInode(lnk)
+			return nil, err // *os.PathError
+		}
+		ino, err := parseSocketInode(lnk)
+		if err != nil {
+			return nil, err
+		}
+		if ino == 0 {
+			continue
+		}
+
+		if stat == nil {
+			stat, err = parseProcStat(root, pid)
 			if err != nil {
 				return nil, err
 			}
-			if ino == 0 {
-				continue
-			}
+		}
 
-			if stat == nil {
-				stat, err = parseProcStat(root, pid)
-				if err != nil {
-					return nil, err
-				}
-			}
+		ents = append(ents, &UserEnt{
+			inode: ino,
+			fd:    fd,
+			pid:   pid,
+			pname: stat.Pname,
+			ppid:  stat.Ppid,
+			pgrp:  stat.Pgrp,
+		})
+	}
+	return ents, nil
+}
+
+// LookupUserEnt returns the UserEnt of the process 'pid', which has no socket information.
+func LookupUserEnt(pid int) (*UserEnt, error) {
+	stat, err := parseProcStat(procRoot(), pid)
+	if err != nil {
+		return nil, err
+	}
+	return &UserEnt{
+		pid:   pid,
+		pname: stat.Pname,
+		ppid:  stat.Ppid,
+		pgrp:  stat.Pgrp,
+	}, nil
+}
+
+// FDManifestFilename is the name of the fd manifest under the procfs root of a snapshot.
+// Each line of the manifest is '<pid> <fd> <link>', which is the target of /proc/<pid>/fd/<fd>.
+const FDManifestFilename = "fd_manifest"
+
+// buildUserEntriesFromManifest builds UserEnts from the fd manifest and the stat files under 'root'.
+func buildUserEntriesFromManifest(ctx context.Context, root string, r io.Reader) (UserEnts, []*ScanWarning, error) {
+	userEnts := make(UserEnts)
+	var warnings []*ScanWarning
+	stats := map[int]*procStat{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if err := ctx.Err(); err != nil {
+			return userEnts, warnings, err
+		}
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, nil, xerrors.Errorf("%s:%d: should be '<pid> <fd> <link>'", FDManifestFilename, n)
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%s:%d: pid should be int: %w", FDManifestFilename, n, err)
+		}
+		fd, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%s:%d: fd should be int: %w", FDManifestFilename, n, err)
+		}
+		ino, err := parseSocketInode(fields[2])
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%s:%d: %w", FDManifestFilename, n, err)
+		}
+		if ino == 0 {
+			continue
+		}
 
-			userEnts[ino] = &UserEnt{
-				inode: ino,
-				fd:    fd,
-				pid:   pid,
-				pname: stat.Pname,
-				ppid:  stat.Ppid,
-				pgrp:  stat.Pgrp,
+		stat, ok := stats[pid]
+		if !ok {
+			stat, err = parseProcStat(root, pid)
+			if err != nil {
+				warnings = append(warnings, newScanWarning(pid, err))
 			}
+			stats[pid] = stat
 		}
+		if stat == nil {
+			continue
+		}
+		userEnts[ino] = &UserEnt{
+			inode: ino,
+			fd:    fd,
+			pid:   pid,
+			pname: stat.Pname,
+			ppid:  stat.Ppid,
+			pgrp:  stat.Pgrp,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, xerrors.Errorf("could not read %s: %w", FDManifestFilename, err)
 	}
-	return userEnts, nil
+	return userEnts, warnings, nil
 }
@@ -3,13 +3,16 @@
 package netutil
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 )
 
 func TestNetlinkConnections(t *testing.T) {
-	conns, err := NetlinkConnections()
+	conns, err := NetlinkConnections(context.Background())
 	if err != nil {
 		t.Fatalf("should not raise error: %v", err)
 	}
@@ -49,3 +52,196 @@ func TestParseSocketInode(t *testing.T) {
 		t.Errorf("inode should be 16408, but %v", ino)
 	}
 }
+
+func TestBuildUserEntries(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procscan")
+
+	ents, warnings, err := buildUserEntries(context.Background(), root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	for _, ino := range []uint32{1001, 1002, 4001} {
+		if _, ok := ents[ino]; !ok {
+			t.Errorf("inode %d should be found", ino)
+		}
+	}
+	if ent := ents[1001]; ent != nil && (ent.Pid() != 100 || ent.Pname() != "nginx" || ent.Fd() != 3) {
+		t.Errorf("inode 1001 should belong to nginx(100) fd 3, but %s(%d) fd %d", ent.Pname(), ent.Pid(), ent.Fd())
+	}
+	// pid 200 has exited before reading its stat.
+	if _, ok := ents[2001]; ok {
+		t.Error("inode 2001 of the exited process should be skipped")
+	}
+
+	// pid 500 has a broken stat.
+	if len(warnings) != 1 {
+		t.Fatalf("warnings should be len == 1, but %v", warnings)
+	}
+	if warnings[0].Pid != 500 {
+		t.Errorf("warning should be for pid 500, but %d", warnings[0].Pid)
+	}
+}
+
+func TestBuildUserEntries_races(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procscan")
+
+	readlink = func(name string) (string, error) {
+		switch name {
+		case filepath.Join(root, "100/fd/5"):
+			return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.ENOENT}
+		case filepath.Join(root, "400/fd/3"):
+			return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EACCES}
+		}
+		return os.Readlink(name)
+	}
+	defer func() { readlink = os.Readlink }()
+
+	ents, warnings, err := buildUserEntries(context.Background(), root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	if _, ok := ents[1001]; !ok {
+		t.Error("inode 1001 should be found")
+	}
+	if _, ok := ents[1002]; ok {
+		t.Error("inode 1002 of the closed fd should be skipped")
+	}
+	if _, ok := ents[4001]; ok {
+		t.Error("inode 4001 of the permission denied process should be skipped")
+	}
+
+	var denied *ScanWarning
+	for _, w := range warnings {
+		if w.Pid == 400 {
+			denied = w
+		}
+	}
+	if denied == nil {
+		t.Fatalf("warnings should contain pid 400, but %v", warnings)
+	}
+	if !denied.IsPermission() {
+		t.Errorf("warning should be permission error, but %v", denied.Err)
+	}
+	if denied.Path != filepath.Join(root, "400/fd/3") {
+		t.Errorf("warning path should be 400/fd/3, but %s", denied.Path)
+	}
+}
+
+func TestParseProcStat_broken(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procscan")
+
+	if _, err := parseProcStat(root, 500); err == nil {
+		t.Error("err should not be nil for the broken stat")
+	}
+	if _, err := parseProcStat(root, 300); err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+}
+
+func TestParseSocketInode_malformed(t *testing.T) {
+	if _, err := parseSocketInode("socket:[16408"); err == nil {
+		t.Error("err should not be nil for the unclosed link")
+	}
+}
+
+func TestDecodeAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		ip   string
+		port uint16
+	}{
+		{"0500000A:0016", "10.0.0.5", 22},
+		{"0085002452100113070057A13F025401:0035", "2400:8500:1301:1052:a157:7:154:23f", 53},
+	}
+	for _, tc := range tests {
+		addr, err := decodeAddress(tc.in)
+		if err != nil {
+			t.Fatalf("%s: should not raise error: %v", tc.in, err)
+		}
+		if addr.Addr().String() != tc.ip || addr.Port() != tc.port {
+			t.Errorf("%s: should be %s:%d, but %s", tc.in, tc.ip, tc.port, addr)
+		}
+	}
+}
+
+func TestProcfsConnectionsAt(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procsnapshot")
+
+	conns, err := ProcfsConnectionsAt(root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(conns) != 6 {
+		t.Fatalf("conns should be len == 6 including tcp6, but %d", len(conns))
+	}
+	if c := conns[2]; c.Laddr.Addr().String() != "10.0.0.5" || c.Raddr.String() != "10.0.0.20:5432" ||
+		c.UID != 1000 || c.Inode != 5003 {
+		t.Errorf("unexpected connection %+v", c)
+	}
+	if c := conns[2]; TimerName(c.Timer) != "retransmit" || c.TimerExpires != 450 || c.Retransmits != 2 {
+		t.Errorf("unexpected timer of connection %+v", c)
+	}
+	if c := conns[1]; c.Timer != 0 || c.TimerExpires != 0 {
+		t.Errorf("connection should have no timer, but %+v", c)
+	}
+	if c := conns[5]; c.Laddr.String() != "[2001:db8::1]:22" || c.Raddr.Addr().String() != "2001:db8::9" {
+		t.Errorf("unexpected ipv6 connection %+v", c)
+	}
+}
+
+func TestBuildUserEntriesAt_manifest(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procsnapshot")
+
+	ents, warnings, err := BuildUserEntriesAt(context.Background(), root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for _, ino := range []uint32{5001, 5002, 6001, 6002, 5003} {
+		if _, ok := ents[ino]; !ok {
+			t.Errorf("inode %d should be found", ino)
+		}
+	}
+	if ent := ents[5003]; ent != nil && (ent.Pid() != 200 || ent.Pname() != "app server" || ent.Fd() != 3) {
+		t.Errorf("inode 5003 should belong to app server(200) fd 3, but %s(%d) fd %d", ent.Pname(), ent.Pid(), ent.Fd())
+	}
+	// pid 300 has no stat file in the snapshot.
+	if len(warnings) != 1 || warnings[0].Pid != 300 {
+		t.Errorf("warnings should be for pid 300, but %v", warnings)
+	}
+}
+
+func TestBuildUserEntriesFromManifest_malformed(t *testing.T) {
+	if _, _, err := buildUserEntriesFromManifest(context.Background(), "", strings.NewReader("100 socket:[1]\n")); err == nil {
+		t.Error("err should not be nil for the malformed manifest")
+	}
+}
+
+func TestBuildUserEntriesAt_canceled(t *testing.T) {
+	cur, _ := os.Getwd()
+	root := filepath.Join(cur, "../testdata/procsnapshot")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ents, _, err := BuildUserEntriesAt(ctx, root)
+	if err != context.Canceled {
+		t.Fatalf("should raise context.Canceled, but %v", err)
+	}
+	if ents == nil {
+		t.Error("the partial entries should be returned")
+	}
+}
+
+func TestNetlinkConnections_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NetlinkConnections(ctx); err != context.Canceled {
+		t.Errorf("should raise context.Canceled, but %v", err)
+	}
+}
@@ -1,7 +1,8 @@
 package netutil
 
 import (
-	"net"
+	"net/netip"
+	"strings"
 	"testing"
 )
 
@@ -33,12 +34,139 @@ func TestIsPrivateIP(t *testing.T) {
 		{"192.168.10.111", true},
 		{"172.16.10.111", true},
 		{"10.1.10.111", true},
-		{"192.0.2.111", false},
+		{"8.8.8.8", false},
+		{"::ffff:10.1.10.111", true},
+		{"2001:4860:4860::8888", false},
+		// special-purpose blocks not globally reachable
+		{"127.0.0.1", true},
+		{"100.64.1.1", true},
+		{"169.254.169.254", true},
+		{"192.0.2.111", true},
+		{"198.18.0.1", true},
+		{"240.0.0.1", true},
+		{"2001:db8::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		// globally reachable exceptions
+		{"192.0.0.9", false},
+		{"2001:1::1", false},
+		{"2002:c000:204::1", false},
 	}
 	for _, tt := range tests {
-		in := net.ParseIP(tt.in)
+		in := netip.MustParseAddr(tt.in)
 		if IsPrivateIP(in) != tt.out {
-			t.Errorf("IsPrivateIP(%v) got: %v", in, tt.out)
+			t.Errorf("IsPrivateIP(%v) should be %v", in, tt.out)
+		}
+	}
+}
+
+func TestLookupSpecialPurpose(t *testing.T) {
+	tests := []struct {
+		in   string
+		name string
+	}{
+		{"100.64.1.1", "shared-address-space"},
+		{"192.0.0.9", "port-control-protocol-anycast"},
+		{"192.0.0.100", "ietf-protocol-assignments"},
+		{"::ffff:127.0.0.1", "loopback"},
+		{"2001:db8::1", "documentation"},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		var name string
+		if block := LookupSpecialPurpose(netip.MustParseAddr(tt.in)); block != nil {
+			name = block.Name
+		}
+		if name != tt.name {
+			t.Errorf("LookupSpecialPurpose(%v) should be %q, but %q", tt.in, tt.name, name)
+		}
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	c, err := LoadCatalog("../testdata/catalog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in    string
+		label string
+	}{
+		{"10.0.2.13", "web"},
+		{"10.0.2.200", "web canary"},
+		{"::ffff:10.0.1.10", "db"},
+		{"10.0.3.1", ""},
+	}
+	for _, tt := range tests {
+		if label := c.Label(netip.MustParseAddr(tt.in)); label != tt.label {
+			t.Errorf("Label(%v) should be %q, but %q", tt.in, tt.label, label)
+		}
+	}
+	if !c.HasLabel("web canary") || c.HasLabel("canary") {
+		t.Error("HasLabel should match the whole label")
+	}
+}
+
+func TestParseCatalog_error(t *testing.T) {
+	for _, in := range []string{"10.0.0.0/8", "10.0.0.0/33 db", "db 10.0.0.0/8"} {
+		if _, err := ParseCatalog(strings.NewReader("# comment\n" + in)); err == nil {
+			t.Errorf("ParseCatalog(%q) should raise error", in)
+		} else if !strings.HasPrefix(err.Error(), "2: ") {
+			t.Errorf("the error of ParseCatalog(%q) should start with the line number, but %q", in, err)
+		}
+	}
+}
+
+func TestLoadCloudRanges(t *testing.T) {
+	r, err := LoadCloudRanges(
+		"../testdata/cloud/aws-ip-ranges.json",
+		"../testdata/cloud/gcp-cloud.json",
+		"../testdata/cloud/azure-service-tags.json",
+		"../testdata/cloud/cloudflare-ips.json",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in    string
+		cloud string
+	}{
+		{"3.5.141.1", "aws/ap-northeast-2/S3"},
+		{"52.94.0.10", "aws/us-east-1/DYNAMODB"},
+		{"52.94.1.10", "aws/us-east-1"},
+		{"13.33.1.1", "aws/GLOBAL/CLOUDFRONT"},
+		{"2600:1f18::1", "aws/us-east-1/EC2"},
+		{"34.81.0.1", "gcp/asia-east1/Google Cloud"},
+		{"2600:1900:4000::1", "gcp/us-central1/Google Cloud"},
+		{"20.42.0.1", "azure/eastus/AzureStorage"},
+		{"40.64.0.1", "azure"},
+		{"2603:1030:210::1", "azure/eastus"},
+		{"::ffff:104.16.1.1", "cloudflare"},
+		{"2606:4700::1111", "cloudflare"},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if c := r.Lookup(netip.MustParseAddr(tt.in)); c != nil {
+			got = c.String()
+		}
+		if got != tt.cloud {
+			t.Errorf("Lookup(%v) should be %q, but %q", tt.in, tt.cloud, got)
+		}
+	}
+	if r.Len() != 13 {
+		t.Errorf("the duplicated prefixes should be merged into 13 ranges, but %d", r.Len())
+	}
+}
+
+func TestLoadCloudRanges_error(t *testing.T) {
+	for _, path := range []string{
+		"../testdata/cloud/notfound.json",
+		"../testdata/flows.json",
+		"../testdata/catalog.txt",
+	} {
+		if _, err := LoadCloudRanges(path); err == nil {
+			t.Errorf("LoadCloudRanges(%q) should raise error", path)
 		}
 	}
 }
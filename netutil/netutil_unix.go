@@ -3,7 +3,8 @@
 package netutil
 
 import (
-	"fmt"
+	"io"
+	"net/netip"
 
 	gnet "github.com/shirou/gopsutil/net"
 	"golang.org/x/xerrors"
@@ -25,24 +26,33 @@ import (
 // tcp        0      0 :::80                       :::*                        LISTEN
 // tcp        0      0 :::8081                     :::*                        LISTEN
 // tcp        0      0 :::22                       :::*                        LISTEN
-func FilterByLocalListeningPorts(conns []gnet.ConnectionStat) ([]string, error) {
-	ports := []string{}
+func FilterByLocalListeningPorts(conns []gnet.ConnectionStat) (PortSet, error) {
+	ports := PortSet{}
 	for _, conn := range conns {
 		if conn.Status != "LISTEN" {
 			continue
 		}
-		if conn.Laddr.IP == "0.0.0.0" || conn.Laddr.IP == "127.0.0.1" || conn.Laddr.IP == "::" {
-			ports = append(ports, fmt.Sprintf("%d", conn.Laddr.Port))
+		ip, err := netip.ParseAddr(conn.Laddr.IP)
+		if err != nil {
+			continue
+		}
+		if isListenerAddr(ip) {
+			ports.Add(uint16(conn.Laddr.Port))
 		}
 	}
 	return ports, nil
 }
 
 // LocalListeningPorts returns the local listening ports.
-func LocalListeningPorts() ([]string, error) {
+func LocalListeningPorts() (PortSet, error) {
 	conns, err := gnet.Connections("tcp")
 	if err != nil {
 		return nil, xerrors.Errorf("gopsutil/net.Connections() failed: %v", err)
 	}
 	return FilterByLocalListeningPorts(conns)
 }
+
+// WriteSnapshot is supported only on Linux.
+func WriteSnapshot(w io.Writer, dir string) ([]*ScanWarning, error) {
+	return nil, xerrors.New("snapshot is supported only on Linux")
+}
@@ -0,0 +1,148 @@
+// +build linux
+
+package netutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/dlog"
+)
+
+// WriteSnapshot writes the procfs files that lstf reads into w as a gzipped tarball,
+// whose entries are placed under the directory 'dir'. The extracted directory can be
+// analyzed later by ProcfsConnectionsAt and BuildUserEntriesAt.
+// The snapshot contains the TCP socket tables, the stat files of the processes
+// which open sockets and the fd manifest instead of the fd links.
+func WriteSnapshot(w io.Writer, dir string) ([]*ScanWarning, error) {
+	root := procRoot()
+	s := &snapshotWriter{
+		dir:     dir,
+		modTime: time.Now(),
+		gz:      gzip.NewWriter(w),
+	}
+	s.tw = tar.NewWriter(s.gz)
+
+	if err := s.writeDir(""); err != nil {
+		return nil, err
+	}
+	if err := s.writeDir("net"); err != nil {
+		return nil, err
+	}
+	for _, name := range tcpProcFilenames {
+		body, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			if name == "net/tcp6" && os.IsNotExist(err) {
+				// IPv6 is disabled.
+				continue
+			}
+			return nil, xerrors.Errorf("could not read socket table: %w", err)
+		}
+		if err := s.writeFile(name, body); err != nil {
+			return nil, err
+		}
+	}
+
+	userEnts, warnings, err := buildUserEntries(context.Background(), root)
+	if err != nil {
+		return nil, err
+	}
+	entsByPid := map[int][]*UserEnt{}
+	for _, ent := range userEnts {
+		entsByPid[ent.pid] = append(entsByPid[ent.pid], ent)
+	}
+	pids := make([]int, 0, len(entsByPid))
+	for pid := range entsByPid {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	var manifest bytes.Buffer
+	for _, pid := range pids {
+		name := path.Join(strconv.Itoa(pid), "stat")
+		stat, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			if isVanished(err) {
+				dlog.Debugf("skip pid %d: %v", pid, err)
+				continue
+			}
+			warnings = append(warnings, newScanWarning(pid, err))
+			continue
+		}
+		if err := s.writeDir(strconv.Itoa(pid)); err != nil {
+			return nil, err
+		}
+		if err := s.writeFile(name, stat); err != nil {
+			return nil, err
+		}
+
+		ents := entsByPid[pid]
+		sort.Slice(ents, func(i, j int) bool { return ents[i].fd < ents[j].fd })
+		for _, ent := range ents {
+			fmt.Fprintf(&manifest, "%d %d %s%d]\n", ent.pid, ent.fd, socketPrefix, ent.inode)
+		}
+	}
+	if err := s.writeFile(FDManifestFilename, manifest.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err := s.tw.Close(); err != nil {
+		return nil, xerrors.Errorf("could not write tarball: %w", err)
+	}
+	if err := s.gz.Close(); err != nil {
+		return nil, xerrors.Errorf("could not write tarball: %w", err)
+	}
+	return warnings, nil
+}
+
+type snapshotWriter struct {
+	dir     string
+	modTime time.Time
+	gz      *gzip.Writer
+	tw      *tar.Writer
+}
+
+func (s *snapshotWriter) writeDir(name string) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     path.Join(s.dir, name) + "/",
+		Mode:     0755,
+		ModTime:  s.modTime,
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return xerrors.Errorf("could not write tarball: %w", err)
+	}
+	return nil
+}
+
+// writeFile writes the file with the content read beforehand,
+// because the files in procfs report their size as zero.
+func (s *snapshotWriter) writeFile(name string, body []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(s.dir, name),
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  s.modTime,
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return xerrors.Errorf("could not write tarball: %w", err)
+	}
+	if _, err := s.tw.Write(body); err != nil {
+		return xerrors.Errorf("could not write tarball: %w", err)
+	}
+	return nil
+}
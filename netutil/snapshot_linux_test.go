@@ -0,0 +1,92 @@
+// +build linux
+
+package netutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	cur, _ := os.Getwd()
+	os.Setenv("PROC_ROOT", filepath.Join(cur, "../testdata/procscan"))
+	defer os.Unsetenv("PROC_ROOT")
+
+	var buf bytes.Buffer
+	warnings, err := WriteSnapshot(&buf, "snap")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	// pid 500 has a broken stat.
+	if len(warnings) != 1 || warnings[0].Pid != 500 {
+		t.Errorf("warnings should be for pid 500, but %v", warnings)
+	}
+
+	// extract the snapshot, and analyze it.
+	tmp, err := ioutil.TempDir("", "lstf-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(tmp, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, body, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.Join(tmp, "snap")
+	conns, err := ProcfsConnectionsAt(root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(conns) != 1 || conns[0].Inode != 1001 {
+		t.Errorf("conns should contain only the socket of inode 1001, but %v", conns)
+	}
+
+	ents, warnings, err := BuildUserEntriesAt(context.Background(), root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings should be empty, but %v", warnings)
+	}
+	for _, ino := range []uint32{1001, 1002, 4001} {
+		if _, ok := ents[ino]; !ok {
+			t.Errorf("inode %d should be found", ino)
+		}
+	}
+	if ent := ents[1002]; ent != nil && (ent.Pid() != 100 || ent.Pname() != "nginx" || ent.Fd() != 5) {
+		t.Errorf("inode 1002 should belong to nginx(100) fd 5, but %s(%d) fd %d", ent.Pname(), ent.Pid(), ent.Fd())
+	}
+}
@@ -0,0 +1,399 @@
+// +build linux
+
+package netutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/elastic/gosigar/sys/linux"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	traceGroup = "sock"
+	traceEvent = "inet_sock_set_state"
+
+	ipprotoTCP = 6
+)
+
+var tracefsRoots = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// ErrTracerClosed is returned by TCPTracer.Read after the tracer is closed.
+var ErrTracerClosed = xerrors.New("tcp tracer closed")
+
+// TCPEvent represents a state transition of a TCP socket.
+type TCPEvent struct {
+	Sock     uint64 // kernel address of the socket, which identifies the socket while it lives
+	Pid      int    // pid of the task running when the transition occurred
+	OldState linux.TCPState
+	NewState linux.TCPState
+	SrcIP    netip.Addr
+	SrcPort  uint16
+	DstIP    netip.Addr
+	DstPort  uint16
+}
+
+func (e *TCPEvent) String() string {
+	return fmt.Sprintf("%s -> %s %s:%d -> %s:%d",
+		e.OldState, e.NewState, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort)
+}
+
+// tracepointField is a field of a tracepoint record.
+type tracepointField struct {
+	offset int
+	size   int
+}
+
+// tracepointFormat is the layout of a tracepoint record described in
+// <tracefs>/events/<group>/<event>/format.
+type tracepointFormat struct {
+	fields map[string]tracepointField
+	size   int
+}
+
+func parseTracepointFormat(path string) (*tracepointFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	format := &tracepointFormat{fields: map[string]tracepointField{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eg. "	field:__u16 sport;	offset:24;	size:2;	signed:0;"
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "field:") {
+			continue
+		}
+		var (
+			name         string
+			offset, size int
+		)
+		for _, col := range strings.Split(line, ";") {
+			kv := strings.SplitN(strings.TrimSpace(col), ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "field":
+				decl := strings.Fields(kv[1])
+				name = decl[len(decl)-1]
+				if i := strings.Index(name, "["); i != -1 {
+					name = name[:i]
+				}
+			case "offset":
+				offset, err = strconv.Atoi(kv[1])
+			case "size":
+				size, err = strconv.Atoi(kv[1])
+			}
+			if err != nil {
+				return nil, xerrors.Errorf("invalid field '%s' in %s: %w", line, path, err)
+			}
+		}
+		format.fields[name] = tracepointField{offset: offset, size: size}
+		if offset+size > format.size {
+			format.size = offset + size
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", path, err)
+	}
+
+	for _, name := range []string{
+		"skaddr", "oldstate", "newstate", "sport", "dport",
+		"family", "protocol", "saddr", "daddr", "saddr_v6", "daddr_v6",
+	} {
+		if _, ok := format.fields[name]; !ok {
+			return nil, xerrors.Errorf("field '%s' not found in %s", name, path)
+		}
+	}
+	return format, nil
+}
+
+// uint reads the field 'name' as an unsigned integer.
+// Assumes this is little_endian
+func (f *tracepointFormat) uint(raw []byte, name string) uint64 {
+	field := f.fields[name]
+	b := raw[field.offset : field.offset+field.size]
+	switch field.size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	case 8:
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (f *tracepointFormat) bytes(raw []byte, name string) []byte {
+	field := f.fields[name]
+	b := make([]byte, field.size)
+	copy(b, raw[field.offset:field.offset+field.size])
+	return b
+}
+
+// parseEvent converts a raw tracepoint record into TCPEvent.
+// It returns nil if the record is not for TCP.
+func (f *tracepointFormat) parseEvent(raw []byte) (*TCPEvent, error) {
+	if len(raw) < f.size {
+		return nil, xerrors.Errorf("short record: %d bytes < %d bytes", len(raw), f.size)
+	}
+	if f.uint(raw, "protocol") != ipprotoTCP {
+		return nil, nil
+	}
+	ev := &TCPEvent{
+		Sock:     f.uint(raw, "skaddr"),
+		Pid:      int(binary.LittleEndian.Uint64(raw) >> 32), // tgid
+		OldState: linux.TCPState(f.uint(raw, "oldstate")),
+		NewState: linux.TCPState(f.uint(raw, "newstate")),
+		// sport and dport are stored in host byte order.
+		SrcPort: uint16(f.uint(raw, "sport")),
+		DstPort: uint16(f.uint(raw, "dport")),
+	}
+	switch linux.AddressFamily(f.uint(raw, "family")) {
+	case linux.AF_INET:
+		ev.SrcIP = AddrFromIP(f.bytes(raw, "saddr"))
+		ev.DstIP = AddrFromIP(f.bytes(raw, "daddr"))
+	case linux.AF_INET6:
+		ev.SrcIP = AddrFromIP(f.bytes(raw, "saddr_v6"))
+		ev.DstIP = AddrFromIP(f.bytes(raw, "daddr_v6"))
+	default:
+		return nil, nil
+	}
+	return ev, nil
+}
+
+// TCPTracer traces state transitions of TCP sockets by the eBPF program
+// attached to the sock:inet_sock_set_state tracepoint, which covers
+// tcp_connect, inet_csk_accept and tcp_close.
+type TCPTracer struct {
+	format *tracepointFormat
+	events *ebpf.Map
+	prog   *ebpf.Program
+	perfFD int
+	reader *perf.Reader
+
+	lost      uint64
+	closeOnce sync.Once
+}
+
+// NewTCPTracer loads the eBPF program and starts tracing.
+// It requires CAP_BPF and CAP_PERFMON (or CAP_SYS_ADMIN).
+func NewTCPTracer() (*TCPTracer, error) {
+	dir, err := findTracepoint(traceGroup, traceEvent)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseTracepointFormat(filepath.Join(dir, "format"))
+	if err != nil {
+		return nil, err
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, xerrors.Errorf("could not remove memlock rlimit: %w", err)
+	}
+
+	t := &TCPTracer{format: format, perfFD: -1}
+	t.events, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name: "lstf_events",
+		Type: ebpf.PerfEventArray,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("could not create perf event array: %w", err)
+	}
+	insns, err := relayProgram(format, t.events.FD())
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "lstf_set_state",
+		Type:         ebpf.TracePoint,
+		Instructions: insns,
+		License:      "GPL",
+	})
+	if err != nil {
+		t.Close()
+		return nil, xerrors.Errorf("could not load eBPF program: %w", err)
+	}
+	t.reader, err = perf.NewReader(t.events, os.Getpagesize()*64)
+	if err != nil {
+		t.Close()
+		return nil, xerrors.Errorf("could not create perf reader: %w", err)
+	}
+	t.perfFD, err = attachTracepoint(dir, t.prog)
+	if err != nil {
+		t.Close()
+		return nil, xerrors.Errorf("could not attach to tracepoint %s:%s: %w", traceGroup, traceEvent, err)
+	}
+	return t, nil
+}
+
+// findTracepoint returns the directory of the tracepoint in tracefs.
+func findTracepoint(group, event string) (string, error) {
+	for _, root := range tracefsRoots {
+		dir := filepath.Join(root, "events", group, event)
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", xerrors.Errorf("tracepoint %s:%s not found (is tracefs mounted on %s?)",
+		group, event, strings.Join(tracefsRoots, " or "))
+}
+
+// attachTracepoint attaches prog to the tracepoint in dir by perf_event_open(2).
+// The program runs on all CPUs although the perf event is opened on CPU 0.
+func attachTracepoint(dir string, prog *ebpf.Program) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "id"))
+	if err != nil {
+		return -1, xerrors.Errorf("could not read tracepoint id: %w", err)
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return -1, xerrors.Errorf("invalid tracepoint id '%s': %w", b, err)
+	}
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_TRACEPOINT,
+		Config:      id,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return -1, xerrors.Errorf("perf_event_open: %w", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog.FD()); err != nil {
+		unix.Close(fd)
+		return -1, xerrors.Errorf("ioctl PERF_EVENT_IOC_SET_BPF: %w", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		unix.Close(fd)
+		return -1, xerrors.Errorf("ioctl PERF_EVENT_IOC_ENABLE: %w", err)
+	}
+	return fd, nil
+}
+
+// relayProgram builds the eBPF program, which copies the tracepoint record
+// of TCP sockets onto the stack and relays it to the perf event array.
+// The record is parsed in userspace according to the tracepoint format, so
+// that the program does not depend on the kernel version.
+func relayProgram(format *tracepointFormat, mapFD int) (asm.Instructions, error) {
+	size := format.size
+	if size > 512 { // the limit of the eBPF stack
+		return nil, xerrors.Errorf("tracepoint record too large: %d bytes", size)
+	}
+	proto := format.fields["protocol"]
+	if proto.size != 2 {
+		return nil, xerrors.Errorf("unexpected size of protocol field: %d", proto.size)
+	}
+
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1), // save ctx
+		asm.LoadMem(asm.R0, asm.R6, int16(proto.offset), asm.Half),
+		asm.JNE.Imm(asm.R0, ipprotoTCP, "exit"),
+		// The common fields are not readable from eBPF programs,
+		// so that the first 8 bytes are replaced with the current pid_tgid.
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, int16(-size), asm.R0, asm.DWord),
+	}
+	for off := 8; off < size; {
+		var sz asm.Size
+		switch rest := size - off; {
+		case rest >= 8:
+			sz = asm.DWord
+		case rest >= 4:
+			sz = asm.Word
+		case rest >= 2:
+			sz = asm.Half
+		default:
+			sz = asm.Byte
+		}
+		insns = append(insns,
+			asm.LoadMem(asm.R0, asm.R6, int16(off), sz),
+			asm.StoreMem(asm.RFP, int16(off-size), asm.R0, sz),
+		)
+		off += sz.Sizeof()
+	}
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, mapFD),
+		asm.LoadImm(asm.R3, 0xffffffff, asm.DWord), // BPF_F_CURRENT_CPU
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, int32(-size)),
+		asm.Mov.Imm(asm.R5, int32(size)),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	)
+	return insns, nil
+}
+
+// Read blocks until a TCP event arrives.
+// It returns ErrTracerClosed after Close is called.
+func (t *TCPTracer) Read() (*TCPEvent, error) {
+	for {
+		rec, err := t.reader.Read()
+		if err != nil {
+			if xerrors.Is(err, perf.ErrClosed) {
+				return nil, ErrTracerClosed
+			}
+			return nil, xerrors.Errorf("could not read perf event: %w", err)
+		}
+		if rec.LostSamples > 0 {
+			t.lost += rec.LostSamples
+			continue
+		}
+		ev, err := t.format.parseEvent(rec.RawSample)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil {
+			return ev, nil
+		}
+	}
+}
+
+// Lost returns the number of events dropped because the perf buffer was full.
+func (t *TCPTracer) Lost() uint64 {
+	return t.lost
+}
+
+// Close detaches the eBPF program and releases the resources.
+// It is safe to call Close concurrently with Read.
+func (t *TCPTracer) Close() error {
+	t.closeOnce.Do(func() {
+		if t.perfFD != -1 {
+			unix.Close(t.perfFD)
+		}
+		if t.reader != nil {
+			t.reader.Close()
+		}
+		if t.prog != nil {
+			t.prog.Close()
+		}
+		if t.events != nil {
+			t.events.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,87 @@
+// +build linux
+
+package netutil
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elastic/gosigar/sys/linux"
+)
+
+func TestParseTracepointFormat(t *testing.T) {
+	cur, _ := os.Getwd()
+	format, err := parseTracepointFormat(filepath.Join(cur, "../testdata/tracepoint/inet_sock_set_state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format.size != 72 {
+		t.Errorf("size should be 72, but %d", format.size)
+	}
+	if f := format.fields["saddr_v6"]; f.offset != 40 || f.size != 16 {
+		t.Errorf("saddr_v6 should be offset:40 size:16, but %+v", f)
+	}
+
+	raw := make([]byte, format.size)
+	binary.LittleEndian.PutUint64(raw[0:], 1234<<32|1235) // pid_tgid
+	binary.LittleEndian.PutUint64(raw[8:], 0xffff888812345678)
+	binary.LittleEndian.PutUint32(raw[16:], uint32(linux.TCP_SYN_SENT))
+	binary.LittleEndian.PutUint32(raw[20:], uint32(linux.TCP_ESTABLISHED))
+	binary.LittleEndian.PutUint16(raw[24:], 48148)
+	binary.LittleEndian.PutUint16(raw[26:], 3306)
+	binary.LittleEndian.PutUint16(raw[28:], uint16(linux.AF_INET))
+	binary.LittleEndian.PutUint16(raw[30:], ipprotoTCP)
+	copy(raw[32:], []byte{10, 0, 1, 9})
+	copy(raw[36:], []byte{10, 0, 1, 10})
+
+	ev, err := format.parseEvent(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev == nil {
+		t.Fatal("event should not be nil")
+	}
+	if ev.Pid != 1234 {
+		t.Errorf("pid should be 1234, but %d", ev.Pid)
+	}
+	if ev.OldState != linux.TCP_SYN_SENT || ev.NewState != linux.TCP_ESTABLISHED {
+		t.Errorf("states should be SYN-SENT -> ESTAB, but %s -> %s", ev.OldState, ev.NewState)
+	}
+	if ev.SrcIP.String() != "10.0.1.9" || ev.SrcPort != 48148 {
+		t.Errorf("src should be 10.0.1.9:48148, but %s:%d", ev.SrcIP, ev.SrcPort)
+	}
+	if ev.DstIP.String() != "10.0.1.10" || ev.DstPort != 3306 {
+		t.Errorf("dst should be 10.0.1.10:3306, but %s:%d", ev.DstIP, ev.DstPort)
+	}
+
+	binary.LittleEndian.PutUint16(raw[30:], 132) // IPPROTO_SCTP
+	ev, err = format.parseEvent(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev != nil {
+		t.Errorf("event should be nil for SCTP, but %v", ev)
+	}
+
+	if _, err := format.parseEvent(raw[:10]); err == nil {
+		t.Error("err should not be nil for the short record")
+	}
+}
+
+func TestRelayProgram(t *testing.T) {
+	cur, _ := os.Getwd()
+	format, err := parseTracepointFormat(filepath.Join(cur, "../testdata/tracepoint/inet_sock_set_state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insns, err := relayProgram(format, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insns.SymbolOffsets(); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// link types.
+// see https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRawBSD   = 12 // DLT_RAW on OpenBSD
+	linkTypeLoop     = 108
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+// ether types.
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeQinQ2 = 0x9100
+)
+
+const protocolTCP = 6
+
+// decodePacket decodes the link layer packet into the TCP segment.
+// It returns false if the packet does not contain the header of a TCP segment.
+func decodePacket(data []byte, linkType uint32) (*Segment, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, payload := binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQ2 {
+			if len(payload) < 4 {
+				return nil, false
+			}
+			etherType, payload = binary.BigEndian.Uint16(payload[2:4]), payload[4:]
+		}
+		return decodeEtherType(etherType, payload)
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[14:16]), data[16:])
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[0:2]), data[20:])
+	case linkTypeNull, linkTypeLoop:
+		// The address family is in the host byte order of the captured host for NULL,
+		// and in the network byte order for LOOP. Both of them fit in the first byte
+		// or the last byte, and the values of IPv6 differ among BSDs.
+		if len(data) < 4 {
+			return nil, false
+		}
+		return decodeIP(data[4:])
+	case linkTypeRaw, linkTypeRawBSD, linkTypeIPv4, linkTypeIPv6:
+		return decodeIP(data)
+	}
+	return nil, false
+}
+
+func decodeEtherType(etherType uint16, payload []byte) (*Segment, bool) {
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		return decodeIP(payload)
+	}
+	return nil, false
+}
+
+// decodeIP decodes the IPv4 or IPv6 packet by its version.
+func decodeIP(data []byte) (*Segment, bool) {
+	if len(data) < 1 {
+		return nil, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	}
+	return nil, false
+}
+
+func decodeIPv4(data []byte) (*Segment, bool) {
+	if len(data) < 20 {
+		return nil, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return nil, false
+	}
+	if data[9] != protocolTCP {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+		// non-first fragment has no TCP header.
+		return nil, false
+	}
+	seg, ok := decodeTCP(data[ihl:])
+	if !ok {
+		return nil, false
+	}
+	seg.Src, _ = netip.AddrFromSlice(data[12:16])
+	seg.Dst, _ = netip.AddrFromSlice(data[16:20])
+	return seg, true
+}
+
+// IPv6 extension headers.
+const (
+	ipv6HopByHop     = 0
+	ipv6Routing      = 43
+	ipv6Fragment     = 44
+	ipv6DestinOption = 60
+)
+
+func decodeIPv6(data []byte) (*Segment, bool) {
+	if len(data) < 40 {
+		return nil, false
+	}
+	next, payload := data[6], data[40:]
+	for next != protocolTCP {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestinOption:
+			if len(payload) < 8 {
+				return nil, false
+			}
+			n := (int(payload[1]) + 1) * 8
+			if len(payload) < n {
+				return nil, false
+			}
+			next, payload = payload[0], payload[n:]
+		case ipv6Fragment:
+			if len(payload) < 8 || binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return nil, false
+			}
+			next, payload = payload[0], payload[8:]
+		default:
+			return nil, false
+		}
+	}
+	seg, ok := decodeTCP(payload)
+	if !ok {
+		return nil, false
+	}
+	seg.Src, _ = netip.AddrFromSlice(data[8:24])
+	seg.Dst, _ = netip.AddrFromSlice(data[24:40])
+	return seg, true
+}
+
+func decodeTCP(data []byte) (*Segment, bool) {
+	if len(data) < 14 {
+		return nil, false
+	}
+	return &Segment{
+		Sport: binary.BigEndian.Uint16(data[0:2]),
+		Dport: binary.BigEndian.Uint16(data[2:4]),
+		Flags: data[13],
+	}, true
+}
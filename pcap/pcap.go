@@ -0,0 +1,156 @@
+// Package pcap reads TCP segments from classic pcap and pcapng capture files.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// magic numbers of the file formats.
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+	magicPcapng       = 0x0a0d0d0a // section header block type
+)
+
+// Segment is a TCP segment captured in a packet.
+type Segment struct {
+	Time  time.Time
+	Src   netip.Addr
+	Dst   netip.Addr
+	Sport uint16
+	Dport uint16
+	Flags uint8
+}
+
+// TCP flags.
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagPSH = 0x08
+	FlagACK = 0x10
+)
+
+// Has returns whether the segment has all the flags.
+func (s *Segment) Has(flags uint8) bool {
+	return s.Flags&flags == flags
+}
+
+// ErrUnknownFormat is returned by NewReader if the file is neither pcap nor pcapng.
+var ErrUnknownFormat = xerrors.New("unknown capture file format (should be pcap or pcapng)")
+
+// packetReader reads the link layer packets from a capture file.
+type packetReader interface {
+	// next returns the next packet and its link type.
+	next() (data []byte, linkType uint32, ts time.Time, err error)
+}
+
+// Reader reads TCP segments from a capture file.
+type Reader struct {
+	r packetReader
+
+	// Skipped is the number of packets skipped because they are not TCP
+	// or their link type is unsupported.
+	Skipped int
+}
+
+// NewReader detects the format of the capture file, and returns the reader.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(4)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read capture file header: %w", err)
+	}
+	var pr packetReader
+	switch {
+	case binary.LittleEndian.Uint32(b) == magicPcapng:
+		pr, err = newPcapngReader(br)
+	case isPcapMagic(binary.LittleEndian.Uint32(b)) || isPcapMagic(binary.BigEndian.Uint32(b)):
+		pr, err = newPcapReader(br)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: pr}, nil
+}
+
+func isPcapMagic(magic uint32) bool {
+	return magic == magicMicroseconds || magic == magicNanoseconds
+}
+
+// Next returns the next TCP segment. It returns io.EOF at the end of the file.
+func (r *Reader) Next() (*Segment, error) {
+	for {
+		data, linkType, ts, err := r.r.next()
+		if err != nil {
+			return nil, err
+		}
+		seg, ok := decodePacket(data, linkType)
+		if !ok {
+			r.Skipped++
+			continue
+		}
+		seg.Time = ts
+		return seg, nil
+	}
+}
+
+// pcapReader reads classic pcap files.
+// see https://wiki.wireshark.org/Development/LibpcapFileFormat.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+	hdr      [16]byte
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, xerrors.Errorf("could not read pcap header: %w", err)
+	}
+	pr := &pcapReader{r: r, order: binary.LittleEndian}
+	magic := pr.order.Uint32(hdr[0:4])
+	if !isPcapMagic(magic) {
+		pr.order = binary.BigEndian
+		magic = pr.order.Uint32(hdr[0:4])
+	}
+	pr.nano = magic == magicNanoseconds
+	pr.linkType = pr.order.Uint32(hdr[20:24]) & 0x0fffffff // the upper bits are FCS information
+	return pr, nil
+}
+
+func (pr *pcapReader) next() ([]byte, uint32, time.Time, error) {
+	if _, err := io.ReadFull(pr.r, pr.hdr[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, time.Time{}, io.EOF
+		}
+		return nil, 0, time.Time{}, xerrors.Errorf("could not read pcap record header: %w", err)
+	}
+	sec := int64(pr.order.Uint32(pr.hdr[0:4]))
+	frac := int64(pr.order.Uint32(pr.hdr[4:8]))
+	if !pr.nano {
+		frac *= 1000
+	}
+	caplen := pr.order.Uint32(pr.hdr[8:12])
+	if caplen > maxPacketSize {
+		return nil, 0, time.Time{}, xerrors.Errorf("pcap record too large (%d bytes)", caplen)
+	}
+	data := make([]byte, caplen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, 0, time.Time{}, xerrors.Errorf("could not read pcap record: %w", err)
+	}
+	return data, pr.linkType, time.Unix(sec, frac), nil
+}
+
+// maxPacketSize limits the size of a packet for broken files.
+const maxPacketSize = 1 << 18
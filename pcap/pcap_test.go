@@ -0,0 +1,295 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+func ipPacket(src, dst string, sport, dport uint16, flags uint8) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], sport)
+	binary.BigEndian.PutUint16(tcp[2:4], dport)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		hdr := make([]byte, 20)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(len(hdr)+len(tcp)))
+		hdr[8] = 64
+		hdr[9] = protocolTCP
+		copy(hdr[12:16], srcIP.To4())
+		copy(hdr[16:20], dstIP.To4())
+		return append(hdr, tcp...)
+	}
+	// with a hop-by-hop options header.
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(8+len(tcp)))
+	hdr[6] = ipv6HopByHop
+	hdr[7] = 64
+	copy(hdr[8:24], srcIP)
+	copy(hdr[24:40], dstIP)
+	hopByHop := []byte{protocolTCP, 0, 1, 4, 0, 0, 0, 0}
+	return append(append(hdr, hopByHop...), tcp...)
+}
+
+func ethernetFrame(ip []byte, vlan bool) []byte {
+	frame := make([]byte, 12) // MAC addresses
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x0a)
+	}
+	etherType := []byte{0x08, 0x00}
+	if ip[0]>>4 == 6 {
+		etherType = []byte{0x86, 0xdd}
+	}
+	return append(append(frame, etherType...), ip...)
+}
+
+func sllFrame(ip []byte) []byte {
+	frame := make([]byte, 16)
+	binary.BigEndian.PutUint16(frame[14:16], etherTypeIPv6)
+	return append(frame, ip...)
+}
+
+func writePcap(order binary.ByteOrder, nano bool, linkType uint32, packets [][]byte) []byte {
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	magic := uint32(magicMicroseconds)
+	if nano {
+		magic = magicNanoseconds
+	}
+	order.PutUint32(hdr[0:4], magic)
+	order.PutUint16(hdr[4:6], 2)
+	order.PutUint16(hdr[6:8], 4)
+	order.PutUint32(hdr[16:20], 65535)
+	order.PutUint32(hdr[20:24], linkType)
+	buf.Write(hdr)
+	for i, p := range packets {
+		rec := make([]byte, 16)
+		order.PutUint32(rec[0:4], uint32(1600000000+i))
+		order.PutUint32(rec[4:8], 500)
+		order.PutUint32(rec[8:12], uint32(len(p)))
+		order.PutUint32(rec[12:16], uint32(len(p)))
+		buf.Write(rec)
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	order.PutUint32(block[0:4], typ)
+	order.PutUint32(block[4:8], uint32(12+len(body)))
+	block = append(block, body...)
+	trailer := make([]byte, 4)
+	order.PutUint32(trailer, uint32(12+len(body)))
+	return append(block, trailer...)
+}
+
+func writePcapng(order binary.ByteOrder, linkType uint16, packets [][]byte) []byte {
+	var buf bytes.Buffer
+
+	shb := make([]byte, 16)
+	order.PutUint32(shb[0:4], byteOrderMagic)
+	order.PutUint16(shb[4:6], 1)
+	order.PutUint64(shb[8:16], ^uint64(0)) // unspecified section length
+	buf.Write(pcapngBlock(order, blockSectionHeader, shb))
+
+	// an unknown block, which should be skipped.
+	buf.Write(pcapngBlock(order, 0x0bad, []byte{1, 2, 3, 4}))
+
+	// an interface with nanosecond timestamps.
+	idb := make([]byte, 8)
+	order.PutUint16(idb[0:2], linkType)
+	order.PutUint32(idb[4:8], 65535)
+	tsresol := make([]byte, 4)
+	order.PutUint16(tsresol[0:2], optionIfTsresol)
+	order.PutUint16(tsresol[2:4], 1)
+	idb = append(append(idb, tsresol...), 9, 0, 0, 0)
+	idb = append(idb, 0, 0, 0, 0) // opt_endofopt
+	buf.Write(pcapngBlock(order, blockInterface, idb))
+
+	for i, p := range packets {
+		if i == len(packets)-1 {
+			spb := make([]byte, 4)
+			order.PutUint32(spb[0:4], uint32(len(p)))
+			buf.Write(pcapngBlock(order, blockSimplePacket, append(spb, p...)))
+			continue
+		}
+		epb := make([]byte, 20)
+		ts := uint64(1600000000+i)*1e9 + 500
+		order.PutUint32(epb[4:8], uint32(ts>>32))
+		order.PutUint32(epb[8:12], uint32(ts))
+		order.PutUint32(epb[12:16], uint32(len(p)))
+		order.PutUint32(epb[16:20], uint32(len(p)))
+		buf.Write(pcapngBlock(order, blockEnhancedPacket, append(epb, p...)))
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, b []byte) ([]*Segment, *Reader) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	var segs []*Segment
+	for {
+		seg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, r
+}
+
+func TestReader(t *testing.T) {
+	v4 := [][]byte{
+		ipPacket("10.0.1.9", "10.0.1.10", 40001, 3306, FlagSYN),
+		ipPacket("10.0.1.10", "10.0.1.9", 3306, 40001, FlagSYN|FlagACK),
+		{0x45, 0x00}, // truncated
+		ipPacket("10.0.1.9", "10.0.1.10", 40001, 3306, FlagACK),
+	}
+	v6 := [][]byte{
+		ipPacket("2001:db8::9", "2001:db8::1", 50000, 22, FlagSYN),
+		ipPacket("2001:db8::1", "2001:db8::9", 22, 50000, FlagSYN|FlagACK),
+	}
+	frames := func(packets [][]byte, frame func([]byte) []byte) [][]byte {
+		ret := make([][]byte, 0, len(packets))
+		for _, p := range packets {
+			ret = append(ret, frame(p))
+		}
+		return ret
+	}
+
+	tests := []struct {
+		desc    string
+		file    []byte
+		want    [][]byte
+		skipped int
+	}{
+		{
+			desc:    "pcap ethernet little endian",
+			file:    writePcap(binary.LittleEndian, false, linkTypeEthernet, frames(v4, func(p []byte) []byte { return ethernetFrame(p, false) })),
+			want:    v4,
+			skipped: 1,
+		},
+		{
+			desc:    "pcap ethernet vlan big endian nanoseconds",
+			file:    writePcap(binary.BigEndian, true, linkTypeEthernet, frames(v4, func(p []byte) []byte { return ethernetFrame(p, true) })),
+			want:    v4,
+			skipped: 1,
+		},
+		{
+			desc: "pcap linux cooked ipv6",
+			file: writePcap(binary.LittleEndian, false, linkTypeLinuxSLL, frames(v6, sllFrame)),
+			want: v6,
+		},
+		{
+			desc:    "pcapng raw",
+			file:    writePcapng(binary.LittleEndian, linkTypeRaw, v4),
+			want:    v4,
+			skipped: 1,
+		},
+		{
+			desc: "pcapng ethernet big endian",
+			file: writePcapng(binary.BigEndian, linkTypeEthernet, frames(v6, func(p []byte) []byte { return ethernetFrame(p, false) })),
+			want: v6,
+		},
+	}
+	for _, tc := range tests {
+		segs, r := readAll(t, tc.file)
+		if r.Skipped != tc.skipped {
+			t.Errorf("desc: %q, skipped should be %d, but %d", tc.desc, tc.skipped, r.Skipped)
+		}
+		var want []*Segment
+		for _, p := range tc.want {
+			if seg, ok := decodeIP(p); ok {
+				want = append(want, seg)
+			}
+		}
+		if len(segs) != len(want) {
+			t.Fatalf("desc: %q, segments should be len == %d, but %d", tc.desc, len(want), len(segs))
+		}
+		for i, seg := range segs {
+			w := want[i]
+			if seg.Src != w.Src || seg.Dst != w.Dst || seg.Sport != w.Sport || seg.Dport != w.Dport || seg.Flags != w.Flags {
+				t.Errorf("desc: %q, segment %d should be %+v, but %+v", tc.desc, i, w, seg)
+			}
+		}
+	}
+}
+
+func TestReader_timestamp(t *testing.T) {
+	packets := [][]byte{ipPacket("10.0.1.9", "10.0.1.10", 40001, 3306, FlagSYN)}
+
+	segs, _ := readAll(t, writePcap(binary.LittleEndian, false, linkTypeRaw, packets))
+	if want := time.Unix(1600000000, 500*1000); !segs[0].Time.Equal(want) {
+		t.Errorf("pcap timestamp should be %v, but %v", want, segs[0].Time)
+	}
+
+	packets = append(packets, packets[0])
+	segs, _ = readAll(t, writePcapng(binary.LittleEndian, linkTypeRaw, packets))
+	if want := time.Unix(1600000000, 500); !segs[0].Time.Equal(want) {
+		t.Errorf("pcapng timestamp should be %v, but %v", want, segs[0].Time)
+	}
+}
+
+func TestPcapngReader_tsresol(t *testing.T) {
+	tests := []struct {
+		tsresol uint8
+		units   float64
+		err     bool
+	}{
+		{6, 1e6, false},
+		{9, 1e9, false},
+		{10, 0, true},
+		{0x80 | 20, 1 << 20, false},
+		{0x80 | 63, 1 << 63, false},
+		{0x80 | 64, 0, true},
+	}
+	for _, tc := range tests {
+		body := make([]byte, 8)
+		tsresol := make([]byte, 4)
+		binary.LittleEndian.PutUint16(tsresol[0:2], optionIfTsresol)
+		binary.LittleEndian.PutUint16(tsresol[2:4], 1)
+		body = append(append(body, tsresol...), tc.tsresol, 0, 0, 0)
+		pr := &pcapngReader{order: binary.LittleEndian}
+		err := pr.addInterface(body)
+		if tc.err {
+			if err == nil {
+				t.Errorf("tsresol 0x%02x should raise error", tc.tsresol)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tsresol 0x%02x should not raise error: %v", tc.tsresol, err)
+			continue
+		}
+		if units := pr.interfaces[0].tsUnits; units != tc.units {
+			t.Errorf("tsresol 0x%02x should be %g units per second, but %g", tc.tsresol, tc.units, units)
+		}
+	}
+}
+
+func TestNewReader_unknown(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("[{\"direction\":\"active\"}]")))
+	if !xerrors.Is(err, ErrUnknownFormat) {
+		t.Errorf("err should be ErrUnknownFormat, but %v", err)
+	}
+}
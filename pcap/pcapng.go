@@ -0,0 +1,205 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// pcapng block types.
+// see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html.
+const (
+	blockSectionHeader    = 0x0a0d0d0a
+	blockInterface        = 0x00000001
+	blockPacket           = 0x00000002 // obsolete
+	blockSimplePacket     = 0x00000003
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1a2b3c4d
+	optionEndOfOpt        = 0
+	optionIfTsresol       = 9
+	maxBlockSize          = 1 << 24
+	defaultTsresolDivisor = 1e6 // microseconds
+	maxTsresolPow10       = 9   // nanoseconds
+	maxTsresolPow2        = 63
+)
+
+// pcapngInterface is the interface described by an interface description block.
+type pcapngInterface struct {
+	linkType uint32
+	snaplen  uint32
+	// units per second of the timestamps
+	tsUnits float64
+}
+
+// pcapngReader reads pcapng files.
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []*pcapngInterface
+}
+
+func newPcapngReader(r io.Reader) (*pcapngReader, error) {
+	pr := &pcapngReader{r: r}
+	if err := pr.readSectionHeader(); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// readSectionHeader reads the section header block, which determines the byte order of the section.
+func (pr *pcapngReader) readSectionHeader() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return xerrors.Errorf("could not read pcapng section header: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[8:12]) == byteOrderMagic:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[8:12]) == byteOrderMagic:
+		pr.order = binary.BigEndian
+	default:
+		return xerrors.New("invalid byte-order magic in pcapng section header")
+	}
+	length := pr.order.Uint32(hdr[4:8])
+	if length < 28 || length > maxBlockSize || length%4 != 0 {
+		return xerrors.Errorf("invalid pcapng section header length %d", length)
+	}
+	// skip the rest of the block, such as the version and the options.
+	if _, err := io.CopyN(ioutil.Discard, pr.r, int64(length)-12); err != nil {
+		return xerrors.Errorf("could not read pcapng section header: %w", err)
+	}
+	pr.interfaces = nil
+	return nil
+}
+
+func (pr *pcapngReader) next() ([]byte, uint32, time.Time, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(pr.r, hdr[:4]); err != nil {
+			if err == io.EOF {
+				return nil, 0, time.Time{}, io.EOF
+			}
+			return nil, 0, time.Time{}, xerrors.Errorf("could not read pcapng block: %w", err)
+		}
+		// The section header block must be read before the byte order is known.
+		if binary.LittleEndian.Uint32(hdr[:4]) == blockSectionHeader {
+			if err := pr.readSectionHeader(); err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			continue
+		}
+		if _, err := io.ReadFull(pr.r, hdr[4:]); err != nil {
+			return nil, 0, time.Time{}, xerrors.Errorf("could not read pcapng block: %w", err)
+		}
+		typ, length := pr.order.Uint32(hdr[0:4]), pr.order.Uint32(hdr[4:8])
+		if length < 12 || length > maxBlockSize || length%4 != 0 {
+			return nil, 0, time.Time{}, xerrors.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return nil, 0, time.Time{}, xerrors.Errorf("could not read pcapng block: %w", err)
+		}
+		body = body[:len(body)-4] // trailing block total length
+
+		switch typ {
+		case blockInterface:
+			if err := pr.addInterface(body); err != nil {
+				return nil, 0, time.Time{}, err
+			}
+		case blockEnhancedPacket, blockPacket:
+			if len(body) < 20 {
+				return nil, 0, time.Time{}, xerrors.New("pcapng packet block too short")
+			}
+			var id uint32
+			if typ == blockEnhancedPacket {
+				id = pr.order.Uint32(body[0:4])
+			} else {
+				id = uint32(pr.order.Uint16(body[0:2]))
+			}
+			ifc, err := pr.iface(id)
+			if err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			caplen := pr.order.Uint32(body[12:16])
+			if int(caplen) > len(body)-20 {
+				return nil, 0, time.Time{}, xerrors.Errorf("pcapng packet length %d exceeds the block", caplen)
+			}
+			return body[20 : 20+caplen], ifc.linkType, ifc.time(ts), nil
+		case blockSimplePacket:
+			if len(body) < 4 {
+				return nil, 0, time.Time{}, xerrors.New("pcapng simple packet block too short")
+			}
+			ifc, err := pr.iface(0)
+			if err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			caplen := int(pr.order.Uint32(body[0:4]))
+			if ifc.snaplen != 0 && caplen > int(ifc.snaplen) {
+				caplen = int(ifc.snaplen)
+			}
+			if caplen > len(body)-4 {
+				caplen = len(body) - 4
+			}
+			// simple packet blocks have no timestamp.
+			return body[4 : 4+caplen], ifc.linkType, time.Time{}, nil
+		default:
+			// skip the other blocks such as statistics and name resolution.
+		}
+	}
+}
+
+func (pr *pcapngReader) iface(id uint32) (*pcapngInterface, error) {
+	if int(id) >= len(pr.interfaces) {
+		return nil, xerrors.Errorf("pcapng packet refers undefined interface %d", id)
+	}
+	return pr.interfaces[id], nil
+}
+
+func (pr *pcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return xerrors.New("pcapng interface description block too short")
+	}
+	ifc := &pcapngInterface{
+		linkType: uint32(pr.order.Uint16(body[0:2])),
+		snaplen:  pr.order.Uint32(body[4:8]),
+		tsUnits:  defaultTsresolDivisor,
+	}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code, length := pr.order.Uint16(opts[0:2]), int(pr.order.Uint16(opts[2:4]))
+		if code == optionEndOfOpt || 4+length > len(opts) {
+			break
+		}
+		if code == optionIfTsresol && length >= 1 {
+			// the resolutions finer than nanoseconds or 2^-63 overflow the timestamps.
+			v := opts[4]
+			switch {
+			case v&0x80 == 0 && v <= maxTsresolPow10:
+				ifc.tsUnits = math.Pow10(int(v))
+			case v&0x80 != 0 && v&0x7f <= maxTsresolPow2:
+				ifc.tsUnits = math.Pow(2, float64(v&0x7f))
+			default:
+				return xerrors.Errorf("pcapng interface has unsupported timestamp resolution 0x%02x", v)
+			}
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(opts) {
+			break
+		}
+		opts = opts[4+padded:]
+	}
+	pr.interfaces = append(pr.interfaces, ifc)
+	return nil
+}
+
+// time converts the timestamp in the units of the interface.
+func (ifc *pcapngInterface) time(ts uint64) time.Time {
+	sec := ts / uint64(ifc.tsUnits)
+	frac := float64(ts%uint64(ifc.tsUnits)) / ifc.tsUnits
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
@@ -0,0 +1,432 @@
+// Package rules checks host flows against the expectations declared in a YAML file,
+// such as the networks which a process may connect to.
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/yuuki/lstf/netutil"
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// Severities of Rule.
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Networks of Rule.Deny and Rule.Allow in addition to the addresses and the CIDRs.
+const (
+	NetworkPublic  = "public"
+	NetworkPrivate = "private"
+)
+
+// file is the rules file.
+type file struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule is an expectation of the flows selected by Match. It is violated by
+// the flows whose peers are in Deny or not in Allow, or by the total connections
+// of the flows not satisfying Connections.
+type Rule struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	// Severity is "warning" or "critical" (default: "critical").
+	Severity string `yaml:"severity,omitempty"`
+	// Match selects the flows which the rule applies to. It selects every flow if empty.
+	Match Selector `yaml:"match,omitempty"`
+	// Deny is the networks which the peers should not be in, such as "public" and "10.0.0.0/8".
+	Deny []string `yaml:"deny,omitempty"`
+	// Allow is the networks which the peers should be in.
+	Allow []string `yaml:"allow,omitempty"`
+	// Connections is the condition of the total connections of the flows such as "< 500",
+	// whose operator is one of "<", "<=", ">", ">=" and "==".
+	Connections string `yaml:"connections,omitempty"`
+
+	deny, allow []network
+	condition   *condition
+}
+
+// Selector selects flows. The empty fields select any flows.
+type Selector struct {
+	// Direction is "active", "passive" or "forwarded".
+	Direction string `yaml:"direction,omitempty"`
+	// Process is the name of the process, which requires collecting processes.
+	Process string `yaml:"process,omitempty"`
+	// Local and Peer are the address such as "10.0.1.10", the address and the port
+	// such as "10.0.1.10:3306", or the CIDR such as "10.0.0.0/8".
+	Local string `yaml:"local,omitempty"`
+	Peer  string `yaml:"peer,omitempty"`
+	// Port is the service port, which is the local port of passive flows and the
+	// peer port of active and forwarded flows.
+	Port uint16 `yaml:"port,omitempty"`
+
+	direction   tcpflow.FlowDirection
+	local, peer *endpoint
+}
+
+// Load loads the rules from the YAML file.
+func Load(path string) ([]*Rule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", path, err)
+	}
+	rules, err := Parse(b)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Parse parses the rules in YAML.
+func Parse(b []byte) ([]*Rule, error) {
+	var f file
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, xerrors.Errorf("could not parse rules: %w", err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, xerrors.New("no rules")
+	}
+	names := make(map[string]bool, len(f.Rules))
+	for i, r := range f.Rules {
+		if r.Name == "" {
+			return nil, xerrors.Errorf("rule #%d has no name", i+1)
+		}
+		if names[r.Name] {
+			return nil, xerrors.Errorf("rule %q is defined twice", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.compile(); err != nil {
+			return nil, xerrors.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return f.Rules, nil
+}
+
+func (r *Rule) compile() error {
+	switch r.Severity {
+	case "":
+		r.Severity = SeverityCritical
+	case SeverityWarning, SeverityCritical:
+	default:
+		return xerrors.Errorf("unknown severity %q (available: %s, %s)", r.Severity, SeverityWarning, SeverityCritical)
+	}
+	if len(r.Deny) == 0 && len(r.Allow) == 0 && r.Connections == "" {
+		return xerrors.New("either deny, allow or connections is required")
+	}
+	if err := r.Match.compile(); err != nil {
+		return err
+	}
+	var err error
+	if r.deny, err = parseNetworks(r.Deny); err != nil {
+		return xerrors.Errorf("deny: %w", err)
+	}
+	if r.allow, err = parseNetworks(r.Allow); err != nil {
+		return xerrors.Errorf("allow: %w", err)
+	}
+	if r.Connections != "" {
+		if r.condition, err = parseCondition(r.Connections); err != nil {
+			return xerrors.Errorf("connections: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Selector) compile() error {
+	switch s.Direction {
+	case "":
+	case "active":
+		s.direction = tcpflow.FlowActive
+	case "passive":
+		s.direction = tcpflow.FlowPassive
+	case "forwarded":
+		s.direction = tcpflow.FlowForwarded
+	default:
+		return xerrors.Errorf("unknown direction %q (available: active, passive, forwarded)", s.Direction)
+	}
+	var err error
+	if s.Local != "" {
+		if s.local, err = parseEndpoint(s.Local); err != nil {
+			return xerrors.Errorf("local: %w", err)
+		}
+	}
+	if s.Peer != "" {
+		if s.peer, err = parseEndpoint(s.Peer); err != nil {
+			return xerrors.Errorf("peer: %w", err)
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the selector selects the flow.
+func (s *Selector) Matches(flow *tcpflow.HostFlow) bool {
+	if s.direction != 0 && flow.Direction != s.direction {
+		return false
+	}
+	if s.Process != "" && (flow.Process == nil || flow.Process.Name != s.Process) {
+		return false
+	}
+	if s.local != nil && !s.local.matches(flow.Local) {
+		return false
+	}
+	if s.peer != nil && !s.peer.matches(flow.Peer) {
+		return false
+	}
+	if s.Port != 0 {
+		service := flow.Peer
+		if flow.Direction == tcpflow.FlowPassive {
+			service = flow.Local
+		}
+		if service.Wildcard || service.Port != s.Port {
+			return false
+		}
+	}
+	return true
+}
+
+// NeedsProcesses returns whether any rule selects the flows by the process.
+func NeedsProcesses(rules []*Rule) bool {
+	for _, r := range rules {
+		if r.Match.Process != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint matches the address and the port of either end of a flow.
+type endpoint struct {
+	prefix netip.Prefix
+	// port is any port if zero.
+	port uint16
+}
+
+func parseEndpoint(s string) (*endpoint, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid CIDR %q", s)
+		}
+		return &endpoint{prefix: prefix.Masked()}, nil
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return &endpoint{prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid address %q, which should be like '10.0.1.10', '10.0.1.10:3306' or '10.0.0.0/8'", s)
+	}
+	addr := ap.Addr().Unmap()
+	return &endpoint{prefix: netip.PrefixFrom(addr, addr.BitLen()), port: ap.Port()}, nil
+}
+
+func (e *endpoint) matches(ap *tcpflow.AddrPort) bool {
+	if !e.prefix.Contains(ap.Addr) {
+		return false
+	}
+	return e.port == 0 || (!ap.Wildcard && ap.Port == e.port)
+}
+
+// network is a network of Deny and Allow.
+type network struct {
+	name   string
+	prefix netip.Prefix
+}
+
+func parseNetworks(list []string) ([]network, error) {
+	networks := make([]network, 0, len(list))
+	for _, s := range list {
+		switch s {
+		case NetworkPublic, NetworkPrivate:
+			networks = append(networks, network{name: s})
+			continue
+		}
+		e, err := parseEndpoint(s)
+		if err != nil || e.port != 0 {
+			return nil, xerrors.Errorf("invalid network %q, which should be %q, %q, an address or a CIDR",
+				s, NetworkPublic, NetworkPrivate)
+		}
+		networks = append(networks, network{name: s, prefix: e.prefix})
+	}
+	return networks, nil
+}
+
+func (n network) contains(addr netip.Addr) bool {
+	switch n.name {
+	case NetworkPublic:
+		return !netutil.IsPrivateIP(addr)
+	case NetworkPrivate:
+		return netutil.IsPrivateIP(addr)
+	}
+	return n.prefix.Contains(addr)
+}
+
+// condition is the condition of the number of connections such as "< 500".
+type condition struct {
+	op    string
+	value int64
+}
+
+func parseCondition(s string) (*condition, error) {
+	s = strings.TrimSpace(s)
+	// the longer operators first not to take "<=" as "<".
+	for _, op := range []string{"<=", ">=", "==", "<", ">"} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(s[len(op):]), 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid number in %q", s)
+		}
+		return &condition{op: op, value: v}, nil
+	}
+	return nil, xerrors.Errorf("invalid condition %q, which should be like '< 500'", s)
+}
+
+func (c *condition) holds(n int64) bool {
+	switch c.op {
+	case "<":
+		return n < c.value
+	case "<=":
+		return n <= c.value
+	case ">":
+		return n > c.value
+	case ">=":
+		return n >= c.value
+	}
+	return n == c.value
+}
+
+func (c *condition) String() string {
+	return fmt.Sprintf("%s %d", c.op, c.value)
+}
+
+// Violation is a violation of a rule.
+type Violation struct {
+	Rule        string `json:"rule"`
+	Severity    string `json:"severity"`
+	Description string `json:"description,omitempty"`
+	Message     string `json:"message"`
+	// Flow is the flow violating the rule, which is nil for the violation of the connections.
+	Flow *tcpflow.HostFlow `json:"flow,omitempty"`
+}
+
+// String returns the string representation of Violation.
+func (v *Violation) String() string {
+	return fmt.Sprintf("[%s] %s: %s", v.Severity, v.Rule, v.Message)
+}
+
+// Check returns the violations of the rules by the flows, which are in the order
+// of the rules and then of the flows.
+func Check(rules []*Rule, flows tcpflow.HostFlows) []*Violation {
+	var violations []*Violation
+	sorted := flows.Sorted()
+	for _, r := range rules {
+		violations = append(violations, r.check(sorted)...)
+	}
+	return violations
+}
+
+func (r *Rule) check(flows []*tcpflow.HostFlow) []*Violation {
+	var (
+		violations  []*Violation
+		connections int64
+	)
+	newViolation := func(flow *tcpflow.HostFlow, format string, a ...interface{}) *Violation {
+		return &Violation{
+			Rule:        r.Name,
+			Severity:    r.Severity,
+			Description: r.Description,
+			Message:     fmt.Sprintf(format, a...),
+			Flow:        flow,
+		}
+	}
+	for _, flow := range flows {
+		if !r.Match.Matches(flow) {
+			continue
+		}
+		connections += flow.Connections
+		if n, ok := r.denies(flow.Peer.Addr); ok {
+			violations = append(violations, newViolation(flow, "%s reaches the denied network %q", describe(flow), n))
+		}
+		if !r.allows(flow.Peer.Addr) {
+			violations = append(violations, newViolation(flow, "%s reaches the network not allowed (allowed: %s)",
+				describe(flow), strings.Join(r.Allow, ", ")))
+		}
+	}
+	if r.condition != nil && !r.condition.holds(connections) {
+		violations = append(violations, newViolation(nil, "%d connections, which should be %s", connections, r.condition))
+	}
+	return violations
+}
+
+// denies returns the denied network containing the address.
+func (r *Rule) denies(addr netip.Addr) (string, bool) {
+	for _, n := range r.deny {
+		if n.contains(addr) {
+			return n.name, true
+		}
+	}
+	return "", false
+}
+
+// allows returns whether the address is in the allowed networks, or true if Allow is empty.
+func (r *Rule) allows(addr netip.Addr) bool {
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, n := range r.allow {
+		if n.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the description of the flow such as "10.0.1.9:many --> 8.8.8.8:443 (3 connections)".
+func describe(flow *tcpflow.HostFlow) string {
+	s := fmt.Sprintf("%s %s %s (%d connections)", flow.Local, flow.Direction.Arrow(), flow.Peer, flow.Connections)
+	if flow.Process != nil {
+		s += fmt.Sprintf(" of %s", flow.Process.Name)
+	}
+	return s
+}
+
+// Summary counts the violations by the severity.
+type Summary struct {
+	Warnings  int
+	Criticals int
+}
+
+// Summarize counts the violations by the severity.
+func Summarize(violations []*Violation) Summary {
+	var s Summary
+	for _, v := range violations {
+		if v.Severity == SeverityWarning {
+			s.Warnings++
+		} else {
+			s.Criticals++
+		}
+	}
+	return s
+}
+
+// Status returns "ok", "warning" or "critical" by the most severe violation.
+func (s Summary) Status() string {
+	switch {
+	case s.Criticals > 0:
+		return SeverityCritical
+	case s.Warnings > 0:
+		return SeverityWarning
+	}
+	return "ok"
+}
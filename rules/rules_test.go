@@ -0,0 +1,124 @@
+package rules
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func TestParse_error(t *testing.T) {
+	tests := []struct {
+		desc string
+		yaml string
+		want string
+	}{
+		{"empty", "rules: []", "no rules"},
+		{"unknown field", "rules:\n- name: a\n  deny: [public]\n  unknown: 1", "could not parse"},
+		{"no name", "rules:\n- deny: [public]", "rule #1 has no name"},
+		{"duplicated", "rules:\n- name: a\n  deny: [public]\n- name: a\n  deny: [public]", "defined twice"},
+		{"no expectation", "rules:\n- name: a\n  match: {port: 22}", "either deny, allow or connections is required"},
+		{"severity", "rules:\n- name: a\n  severity: fatal\n  deny: [public]", "unknown severity"},
+		{"direction", "rules:\n- name: a\n  match: {direction: in}\n  deny: [public]", "unknown direction"},
+		{"peer", "rules:\n- name: a\n  match: {peer: db01}\n  deny: [public]", "peer: invalid address"},
+		{"network", "rules:\n- name: a\n  deny: [10.0.0.1:80]", "deny: invalid network"},
+		{"condition", "rules:\n- name: a\n  connections: \"500\"", "invalid condition"},
+		{"condition number", "rules:\n- name: a\n  connections: \"< many\"", "invalid number"},
+	}
+	for _, tc := range tests {
+		_, err := Parse([]byte(tc.yaml))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("desc: %q, error should contain %q, got %v", tc.desc, tc.want, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rs, err := Parse([]byte(`
+rules:
+- name: app-no-public
+  match: {direction: active, process: app}
+  deny: [public]
+- name: mysql-connections
+  severity: warning
+  match: {peer: "10.0.1.10:3306"}
+  connections: "< 20"
+- name: ssh-internal
+  match: {direction: passive, port: 22}
+  allow: [10.0.0.0/8]
+- name: mysql-exists
+  match: {peer: 10.0.1.0/24, port: 3306}
+  connections: ">= 1"
+- name: nginx-no-public
+  match: {process: nginx}
+  deny: [public]
+`))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !NeedsProcesses(rs) {
+		t.Error("rules selecting processes should need processes")
+	}
+
+	local := netip.MustParseAddr("10.0.1.9")
+	flows := tcpflow.HostFlows{}
+	for _, f := range []*tcpflow.HostFlow{
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(local),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			Connections: 22,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+		},
+		{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(local),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr("8.8.8.8"), 443),
+			Connections: 3,
+			Process:     &tcpflow.Process{Name: "app", Pgid: 1200},
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(local, 22),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.2.13")),
+			Connections: 1,
+		},
+		{
+			Direction:   tcpflow.FlowPassive,
+			Local:       tcpflow.NewAddrPort(local, 22),
+			Peer:        tcpflow.NewWildcardAddrPort(netip.MustParseAddr("192.168.10.10")),
+			Connections: 2,
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+
+	violations := Check(rs, flows)
+	want := []struct {
+		rule     string
+		severity string
+		message  string
+	}{
+		{"app-no-public", SeverityCritical, "10.0.1.9:many --> 8.8.8.8:443 (3 connections) of app reaches the denied network \"public\""},
+		{"mysql-connections", SeverityWarning, "22 connections, which should be < 20"},
+		{"ssh-internal", SeverityCritical, "10.0.1.9:22 <-- 192.168.10.10:many (2 connections) reaches the network not allowed (allowed: 10.0.0.0/8)"},
+	}
+	if len(violations) != len(want) {
+		t.Fatalf("violations should be len == %d, got %d: %v", len(want), len(violations), violations)
+	}
+	for i, w := range want {
+		v := violations[i]
+		if v.Rule != w.rule || v.Severity != w.severity || v.Message != w.message {
+			t.Errorf("violation #%d should be [%s] %s: %s, got %s", i, w.severity, w.rule, w.message, v)
+		}
+	}
+
+	summary := Summarize(violations)
+	if summary.Warnings != 1 || summary.Criticals != 2 || summary.Status() != SeverityCritical {
+		t.Errorf("summary should be 1 warning and 2 criticals, got %+v", summary)
+	}
+	if status := Summarize(nil).Status(); status != "ok" {
+		t.Errorf("status without violations should be ok, got %q", status)
+	}
+}
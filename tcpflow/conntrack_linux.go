@@ -0,0 +1,106 @@
+// +build linux
+
+package tcpflow
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+// GetHostFlowsByConntrack gets host flows from the connections tracked by conntrack.
+// Unlike netlink, it also catches the flows traversing the host such as NAT gateways,
+// routers and Kubernetes nodes. The processes option is not supported.
+func GetHostFlowsByConntrack(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := netutil.ConntrackConnections()
+	if err != nil {
+		return nil, err
+	}
+	locals, err := localIPs()
+	if err != nil {
+		return nil, err
+	}
+	return hostFlowsFromConntrack(ctx, opt, entries, locals), nil
+}
+
+func hostFlowsFromConntrack(ctx context.Context, opt *GetHostFlowsOption, entries []*netutil.ConntrackEntry, locals map[netip.Addr]bool) HostFlows {
+	flows := HostFlows{}
+	for _, ent := range entries {
+		switch ent.State {
+		case "SYN_SENT", "SYN_SENT2", "SYN_RECV", "NONE":
+			continue
+		}
+
+		orig, reply := ent.Original, ent.Reply
+		var hf *HostFlow
+		switch {
+		case locals[orig.Src]:
+			// active open
+			hf = &HostFlow{
+				Direction: FlowActive,
+				Local:     NewWildcardAddrPort(orig.Src),
+				Peer:      NewAddrPort(orig.Dst, orig.Dport),
+			}
+		case locals[orig.Dst]:
+			// passive open
+			hf = &HostFlow{
+				Direction: FlowPassive,
+				Local:     NewAddrPort(orig.Dst, orig.Dport),
+				Peer:      NewWildcardAddrPort(orig.Src),
+			}
+		case locals[reply.Src]:
+			// passive open redirected to the local address by DNAT, whose local side
+			// is the translated address and port rather than the original destination.
+			hf = &HostFlow{
+				Direction: FlowPassive,
+				Local:     NewAddrPort(reply.Src, reply.Sport),
+				Peer:      NewWildcardAddrPort(orig.Src),
+			}
+		default:
+			hf = &HostFlow{
+				Direction: FlowForwarded,
+				Local:     NewWildcardAddrPort(orig.Src),
+				Peer:      NewAddrPort(orig.Dst, orig.Dport),
+			}
+		}
+
+		if opt.excludes(hf.Peer.Addr) {
+			continue
+		}
+
+		if ent.Translated() {
+			hf.NAT = &NAT{
+				ReplySrc: NewAddrPort(reply.Src, reply.Sport),
+				ReplyDst: NewWildcardAddrPort(reply.Dst),
+			}
+		}
+		flows.Insert(hf)
+	}
+
+	if !opt.Numeric {
+		flows.resolveNames(ctx)
+	}
+	return flows
+}
+
+// localIPs returns the set of IP addresses assigned to the host including loopback.
+func localIPs() (map[netip.Addr]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get local addresses: %v", err)
+	}
+	ips := make(map[netip.Addr]bool, len(addrs))
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			ips[netutil.AddrFromIP(ipnet.IP)] = true
+		}
+	}
+	return ips, nil
+}
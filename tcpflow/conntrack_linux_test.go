@@ -0,0 +1,63 @@
+// +build linux
+
+package tcpflow
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+func TestHostFlowsFromConntrack(t *testing.T) {
+	cur, _ := os.Getwd()
+	os.Setenv("PROC_ROOT", filepath.Join(cur, "../testdata/conntrack"))
+	defer os.Unsetenv("PROC_ROOT")
+
+	entries, err := netutil.ConntrackConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// redirected from 203.0.113.10:443 to the local port by DNAT
+	entries = append(entries, &netutil.ConntrackEntry{
+		State: "ESTABLISHED",
+		Original: netutil.ConntrackTuple{
+			Src: netip.MustParseAddr("198.51.100.7"), Dst: netip.MustParseAddr("203.0.113.10"),
+			Sport: 50100, Dport: 443,
+		},
+		Reply: netutil.ConntrackTuple{
+			Src: netip.MustParseAddr("10.0.1.9"), Dst: netip.MustParseAddr("198.51.100.7"),
+			Sport: 8443, Dport: 50100,
+		},
+	})
+	locals := map[netip.Addr]bool{netip.MustParseAddr("10.0.1.9"): true, netip.MustParseAddr("2001:db8::1"): true}
+	flows := hostFlowsFromConntrack(context.Background(), &GetHostFlowsOption{Numeric: true, Filter: FilterAll}, entries, locals)
+
+	tests := []struct {
+		key         string
+		connections int64
+	}{
+		{"2-10.0.1.9:many-10.0.1.10:3306", 1},
+		{"4-10.0.1.9:80-10.0.2.13:many", 1},
+		{"4-10.0.1.9:8443-198.51.100.7:many-10.0.1.9:8443 -> 198.51.100.7:many", 1},
+		{"8-10.244.1.5:many-10.96.0.10:53-10.244.2.7:53 -> 10.0.1.9:many", 1},
+		{"8-10.244.1.6:many-10.96.0.10:53-10.244.2.7:53 -> 10.0.1.9:many", 1},
+		{"2-[2001:db8::1]:many-[2001:db8::2]:22", 1},
+	}
+	if len(flows) != len(tests) {
+		t.Errorf("flows should be len == %d, but %d", len(tests), len(flows))
+	}
+	for _, tt := range tests {
+		flow, ok := flows[tt.key]
+		if !ok {
+			t.Errorf("flows should contain %q", tt.key)
+			continue
+		}
+		if flow.Connections != tt.connections {
+			t.Errorf("connections of %q should be %d, but %d", tt.key, tt.connections, flow.Connections)
+		}
+	}
+}
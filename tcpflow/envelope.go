@@ -0,0 +1,78 @@
+package tcpflow
+
+import (
+	"os"
+	"time"
+)
+
+//go:generate go run gen_schema.go -d ../schema
+
+// SchemaVersion is the version of the envelope format. It is incremented
+// when a field is removed or its meaning changes. Adding a field keeps the version.
+const SchemaVersion = 1
+
+// Envelope wraps host flows with the metadata of the collection for ingestion pipelines.
+type Envelope struct {
+	SchemaVersion int       `json:"schema_version"`
+	Hostname      string    `json:"hostname"`
+	LstfVersion   string    `json:"lstf_version"`
+	CollectedAt   time.Time `json:"collected_at"`
+	Source        string    `json:"source"`
+	Flows         HostFlows `json:"flows"`
+}
+
+// NewEnvelope wraps the flows collected by 'source' at 'collectedAt'.
+// If all the flows record the same source, such as "netlink" collected by "auto", it is used instead.
+func NewEnvelope(flows HostFlows, source, lstfVersion string, collectedAt time.Time) *Envelope {
+	hostname, _ := os.Hostname()
+	if s := flows.source(); s != "" {
+		source = s
+	}
+	if flows == nil {
+		flows = HostFlows{}
+	}
+	return &Envelope{
+		SchemaVersion: SchemaVersion,
+		Hostname:      hostname,
+		LstfVersion:   lstfVersion,
+		CollectedAt:   collectedAt.UTC(),
+		Source:        source,
+		Flows:         flows,
+	}
+}
+
+// FlowRecord is a host flow with the metadata of the collection, which is printed
+// as a line of the stream by '--ndjson'. It is self-describing unlike a flow in Envelope.
+type FlowRecord struct {
+	SchemaVersion int       `json:"schema_version"`
+	Hostname      string    `json:"hostname"`
+	CollectedAt   time.Time `json:"collected_at"`
+	*HostFlow
+}
+
+// NewFlowRecords returns the records of the flows collected at 'collectedAt'.
+func NewFlowRecords(flows HostFlows, collectedAt time.Time) []*FlowRecord {
+	hostname, _ := os.Hostname()
+	records := make([]*FlowRecord, 0, len(flows))
+	for _, flow := range flows {
+		records = append(records, &FlowRecord{
+			SchemaVersion: SchemaVersion,
+			Hostname:      hostname,
+			CollectedAt:   collectedAt.UTC(),
+			HostFlow:      flow,
+		})
+	}
+	return records
+}
+
+// source returns the source recorded in all the flows, or empty if they differ.
+func (hf HostFlows) source() string {
+	var source string
+	for _, f := range hf {
+		if source != "" && f.Source != source {
+			return ""
+		}
+		source = f.Source
+	}
+	return source
+}
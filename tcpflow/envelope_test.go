@@ -0,0 +1,275 @@
+package tcpflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validate validates the JSON value against the subset of JSON Schema generated by EnvelopeSchema.
+func validate(root, s *jsonSchema, v interface{}, path string) error {
+	if s.Ref != "" {
+		return validate(root, root.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")], v, path)
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be object, but %T", path, v)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s should have required property %q", path, name)
+			}
+		}
+		for name, pv := range obj {
+			ps, ok := s.Properties[name]
+			if !ok {
+				return fmt.Errorf("%s has unknown property %q", path, name)
+			}
+			if err := validate(root, ps, pv, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be array, but %T", path, v)
+		}
+		for i, item := range arr {
+			if err := validate(root, s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s should be integer, but %v", path, v)
+		}
+		if s.Const != nil && n != float64(s.Const.(int)) {
+			return fmt.Errorf("%s should be %v, but %v", path, s.Const, n)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s should be string, but %T", path, v)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s should be date-time, but %q", path, str)
+			}
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fmt.Errorf("%s should match %q, but %q", path, s.Pattern, str)
+		}
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				found = found || e == str
+			}
+			if !found {
+				return fmt.Errorf("%s should be one of %v, but %q", path, s.Enum, str)
+			}
+		}
+	default:
+		return fmt.Errorf("%s has unsupported type %q in schema", path, s.Type)
+	}
+	return nil
+}
+
+// validateJSON validates the JSON document against the schema generated by 'generate'.
+func validateJSON(t *testing.T, generate func() ([]byte, error), b []byte) {
+	t.Helper()
+	sb, err := generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(sb, &schema); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	// Const is decoded as float64.
+	schema.Properties["schema_version"].Const = SchemaVersion
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if err := validate(&schema, &schema, v, "$"); err != nil {
+		t.Errorf("%s should conform to the schema: %v", b, err)
+	}
+}
+
+func TestSchema_upToDate(t *testing.T) {
+	tests := []struct {
+		filename string
+		generate func() ([]byte, error)
+	}{
+		{"envelope.schema.json", EnvelopeSchema},
+		{"flow-record.schema.json", FlowRecordSchema},
+	}
+	cur, _ := os.Getwd()
+	for _, tc := range tests {
+		published, err := ioutil.ReadFile(filepath.Join(cur, "../schema", tc.filename))
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		generated, err := tc.generate()
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if !bytes.Equal(published, generated) {
+			t.Errorf("schema/%s is outdated; run 'go generate ./tcpflow'", tc.filename)
+		}
+	}
+}
+
+func TestNewEnvelope(t *testing.T) {
+	flows := HostFlows{}
+	flows.Insert(&HostFlow{
+		Direction: FlowActive,
+		Local:     NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+		Peer:      NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+		Process:   &Process{Name: "app", Pgid: 1200},
+	})
+	flows.Insert(&HostFlow{
+		Direction: FlowPassive,
+		Local:     NewAddrPort(netip.MustParseAddr("10.0.1.9"), 80),
+		Peer:      NewWildcardAddrPort(netip.MustParseAddr("2001:db8::1")),
+	})
+	flows.setSource("netlink")
+	collectedAt := time.Date(2020, 9, 13, 21, 26, 40, 0, time.FixedZone("JST", 9*60*60))
+
+	tests := []struct {
+		desc   string
+		flows  HostFlows
+		source string
+		want   string
+	}{
+		{desc: "uniform source", flows: flows, source: SourceAuto, want: "netlink"},
+		{desc: "no flows", flows: nil, source: SourceAuto, want: SourceAuto},
+	}
+	for _, tc := range tests {
+		env := NewEnvelope(tc.flows, tc.source, "0.7.2", collectedAt)
+		if env.Source != tc.want {
+			t.Errorf("desc: %q, source should be %q, but %q", tc.desc, tc.want, env.Source)
+		}
+		if !env.CollectedAt.Equal(collectedAt) || env.CollectedAt.Location() != time.UTC {
+			t.Errorf("desc: %q, collected_at should be %v in UTC, but %v", tc.desc, collectedAt, env.CollectedAt)
+		}
+		b, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("desc: %q, should not raise error: %v", tc.desc, err)
+		}
+		if tc.flows == nil && !bytes.Contains(b, []byte(`"flows":[]`)) {
+			t.Errorf("desc: %q, flows should be an empty array, but %s", tc.desc, b)
+		}
+		validateJSON(t, EnvelopeSchema, b)
+	}
+}
+
+// TestEnvelope_compat guards the format against breaking changes.
+// The fixture is written in the format of schema version 1, and should be kept as is.
+func TestEnvelope_compat(t *testing.T) {
+	cur, _ := os.Getwd()
+	b, err := ioutil.ReadFile(filepath.Join(cur, "../testdata/envelope/v1.json"))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	validateJSON(t, EnvelopeSchema, b)
+
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if env.SchemaVersion != 1 || env.Hostname != "web-01" || env.Source != "conntrack" {
+		t.Errorf("metadata should be decoded, but %+v", env)
+	}
+	if want := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC); !env.CollectedAt.Equal(want) {
+		t.Errorf("collected_at should be %v, but %v", want, env.CollectedAt)
+	}
+	if len(env.Flows) != 3 {
+		t.Fatalf("flows should be len == 3, but %d", len(env.Flows))
+	}
+	// re-encoding keeps each flow in the fixture. The order of flows is not kept.
+	var raw struct {
+		Flows []json.RawMessage `json:"flows"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for _, rf := range raw.Flows {
+		var flow HostFlow
+		if err := json.Unmarshal(rf, &flow); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		out, err := json.Marshal(env.Flows[flow.UniqKey()])
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if !jsonEqual(t, out, rf) {
+			t.Errorf("re-encoded flow should be %s, but %s", rf, out)
+		}
+	}
+}
+
+func TestNewFlowRecords(t *testing.T) {
+	flows := HostFlows{}
+	flows.Insert(&HostFlow{
+		Direction: FlowActive,
+		Local:     NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+		Peer:      NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+		Process:   &Process{Name: "app", Pgid: 1200},
+	})
+	flows.Insert(&HostFlow{
+		Direction: FlowPassive,
+		Local:     NewAddrPort(netip.MustParseAddr("10.0.1.9"), 80),
+		Peer:      NewWildcardAddrPort(netip.MustParseAddr("2001:db8::1")),
+	})
+	collectedAt := time.Date(2020, 9, 13, 21, 26, 40, 0, time.FixedZone("JST", 9*60*60))
+
+	records := NewFlowRecords(flows, collectedAt)
+	if len(records) != len(flows) {
+		t.Fatalf("records should be len == %d, but %d", len(flows), len(records))
+	}
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if bytes.ContainsRune(b, '\n') {
+			t.Errorf("record should be a line, but %s", b)
+		}
+		validateJSON(t, FlowRecordSchema, b)
+
+		var got FlowRecord
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if got.HostFlow == nil || got.UniqKey() != r.UniqKey() || !got.CollectedAt.Equal(collectedAt) {
+			t.Errorf("record should be decoded as %s, but %+v", b, got)
+		}
+	}
+}
+
+// jsonEqual returns whether the JSON documents are equal ignoring the formatting.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	return reflect.DeepEqual(av, bv)
+}
@@ -0,0 +1,35 @@
+// +build ignore
+
+// gen_schema writes the JSON Schemas of the JSON output of lstf.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func main() {
+	dir := flag.String("d", ".", "output directory")
+	flag.Parse()
+
+	schemas := []struct {
+		filename string
+		generate func() ([]byte, error)
+	}{
+		{"envelope.schema.json", tcpflow.EnvelopeSchema},
+		{"flow-record.schema.json", tcpflow.FlowRecordSchema},
+	}
+	for _, s := range schemas {
+		b, err := s.generate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(*dir, s.filename), b, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
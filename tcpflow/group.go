@@ -0,0 +1,182 @@
+package tcpflow
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+// Grouping kinds, which are the prefixes of the grouping specs parsed by ParseGrouping.
+const (
+	// GroupBySubnet groups the peers by their subnets, such as "subnet/24".
+	GroupBySubnet = "subnet"
+	// GroupByCIDR groups the peers by the networks of a catalog, such as "cidr:FILE".
+	GroupByCIDR = "cidr"
+	// GroupByDomain groups the peers by the domains of their host names.
+	GroupByDomain = "domain"
+	// GroupByProcess groups the flows by the processes.
+	GroupByProcess = "process"
+	// GroupByPort groups the flows by the service ports only.
+	GroupByPort = "port"
+
+	// defaultSubnetBits4 and defaultSubnetBits6 are the prefix lengths of "subnet".
+	defaultSubnetBits4 = 24
+	defaultSubnetBits6 = 64
+
+	// groupAny is the name of the collapsed addresses.
+	groupAny = "*"
+)
+
+// Grouping represents how HostFlows.GroupBy aggregates the flows.
+type Grouping struct {
+	Kind string
+	// Bits4 and Bits6 are the prefix lengths of IPv4 and IPv6 peers for GroupBySubnet.
+	Bits4, Bits6 int
+	// Catalog is the networks for GroupByCIDR.
+	Catalog *netutil.Catalog
+}
+
+// String returns the kind and the parameters of the grouping.
+func (g *Grouping) String() string {
+	switch g.Kind {
+	case GroupBySubnet:
+		return fmt.Sprintf("%s/%d,%d", g.Kind, g.Bits4, g.Bits6)
+	case GroupByCIDR:
+		return fmt.Sprintf("%s(%d prefixes)", g.Kind, g.Catalog.Len())
+	}
+	return g.Kind
+}
+
+// ParseGrouping parses the grouping spec below.
+//
+//	subnet[/BITS4[,BITS6]]	peer subnets (default: /24 for IPv4 and /64 for IPv6)
+//	cidr:FILE		peer networks of the catalog in FILE (see netutil.LoadCatalog)
+//	domain			peer host name domains
+//	process			processes
+//	port			service ports only
+func ParseGrouping(spec string) (*Grouping, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexAny(spec, "/:"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == GroupBySubnet && (spec == kind || strings.HasPrefix(spec, kind+"/")):
+		return parseSubnetGrouping(spec, arg)
+	case kind == GroupByCIDR && strings.HasPrefix(spec, kind+":"):
+		catalog, err := netutil.LoadCatalog(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &Grouping{Kind: GroupByCIDR, Catalog: catalog}, nil
+	case arg == "" && (kind == GroupByDomain || kind == GroupByProcess || kind == GroupByPort):
+		return &Grouping{Kind: kind}, nil
+	}
+	return nil, xerrors.Errorf("unknown grouping %q", spec)
+}
+
+func parseSubnetGrouping(spec, arg string) (*Grouping, error) {
+	g := &Grouping{Kind: GroupBySubnet, Bits4: defaultSubnetBits4, Bits6: defaultSubnetBits6}
+	if spec == GroupBySubnet {
+		return g, nil
+	}
+	bits := strings.SplitN(arg, ",", 2)
+	for i, max := range []int{32, 128}[:len(bits)] {
+		n, err := strconv.Atoi(bits[i])
+		if err != nil || n < 0 || n > max {
+			return nil, xerrors.Errorf("invalid prefix length %q in grouping %q", bits[i], spec)
+		}
+		if i == 0 {
+			g.Bits4 = n
+		} else {
+			g.Bits6 = n
+		}
+	}
+	return g, nil
+}
+
+// GroupBy aggregates the flows by the grouping, summing up their connections.
+// The local addresses are kept except for GroupByProcess and GroupByPort, which
+// collapse the addresses into the process names and "*". The grouped peers keep the ports of the flows,
+// and their names are the groups such as "10.0.2.0/24". The peers out of any
+// group, such as the peers out of the catalog, are kept as they are.
+// The NAT of the flows is dropped because it differs by connection.
+func (hf HostFlows) GroupBy(g *Grouping) HostFlows {
+	flows := make(HostFlows, len(hf))
+	for _, flow := range hf {
+		grouped := &HostFlow{
+			Direction:   flow.Direction,
+			Local:       flow.Local,
+			Peer:        g.peer(flow.Peer),
+			Connections: flow.Connections,
+			Process:     flow.Process,
+			Source:      flow.Source,
+			Sockets:     flow.Sockets,
+		}
+		switch g.Kind {
+		case GroupByProcess:
+			grouped.Local = &AddrPort{Name: groupAny, Wildcard: true}
+			if flow.Process != nil {
+				grouped.Local.Name = flow.Process.Name
+			}
+			grouped.Peer = &AddrPort{Name: groupAny, Wildcard: true}
+		case GroupByPort:
+			grouped.Local = &AddrPort{Name: groupAny, Port: flow.Local.Port, Wildcard: flow.Local.Wildcard}
+			grouped.Peer = &AddrPort{Name: groupAny, Port: flow.Peer.Port, Wildcard: flow.Peer.Wildcard}
+			grouped.Process = nil
+		}
+		key := grouped.UniqKey()
+		if f, ok := flows[key]; ok {
+			f.Connections += grouped.Connections
+			if f.Process == nil {
+				f.Process = grouped.Process
+			}
+			f.Sockets = append(f.Sockets[:len(f.Sockets):len(f.Sockets)], grouped.Sockets...)
+			continue
+		}
+		flows[key] = grouped
+	}
+	return flows
+}
+
+// peer returns the group of the peer, or the peer itself if it is out of any group.
+func (g *Grouping) peer(a *AddrPort) *AddrPort {
+	switch g.Kind {
+	case GroupBySubnet:
+		bits := g.Bits4
+		if a.Addr.Is6() {
+			bits = g.Bits6
+		}
+		prefix, err := a.Addr.Prefix(bits)
+		if err != nil {
+			return a
+		}
+		return &AddrPort{Name: prefix.String(), Addr: prefix.Addr(), Port: a.Port, Wildcard: a.Wildcard}
+	case GroupByCIDR:
+		if n := g.Catalog.Lookup(a.Addr); n != nil {
+			return &AddrPort{Name: n.Label, Port: a.Port, Wildcard: a.Wildcard}
+		}
+	case GroupByDomain:
+		if domain := hostDomain(a.Name); domain != "" {
+			return &AddrPort{Name: domain, Port: a.Port, Wildcard: a.Wildcard}
+		}
+	}
+	return a
+}
+
+// hostDomain returns the domain of the host name such as "example.com" for
+// "www.example.com". It is empty for an address or a name without domain.
+func hostDomain(name string) string {
+	if _, err := netip.ParseAddr(name); err == nil {
+		return ""
+	}
+	i := strings.IndexByte(name, '.')
+	if i < 0 || i == len(name)-1 {
+		return ""
+	}
+	return name[i+1:]
+}
@@ -0,0 +1,215 @@
+package tcpflow
+
+import (
+	"encoding/json"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+func TestParseGrouping(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+		err  bool
+	}{
+		{"subnet", "subnet/24,64", false},
+		{"subnet/16", "subnet/16,64", false},
+		{"subnet/16,48", "subnet/16,48", false},
+		{"cidr:../testdata/catalog.txt", "cidr(3 prefixes)", false},
+		{"domain", "domain", false},
+		{"process", "process", false},
+		{"port", "port", false},
+		{"subnet/33", "", true},
+		{"subnet/24,129", "", true},
+		{"subnet:24", "", true},
+		{"cidr", "", true},
+		{"cidr:../testdata/notfound.txt", "", true},
+		{"port/80", "", true},
+		{"unknown", "", true},
+	}
+	for _, tt := range tests {
+		g, err := ParseGrouping(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseGrouping(%q) should raise error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseGrouping(%q) should not raise error: %v", tt.spec, err)
+			continue
+		}
+		if g.String() != tt.want {
+			t.Errorf("ParseGrouping(%q) should be %q, but %q", tt.spec, tt.want, g)
+		}
+	}
+}
+
+func TestHostFlows_GroupBy(t *testing.T) {
+	flows := HostFlows{}
+	for _, f := range []*HostFlow{
+		{
+			Direction:   FlowPassive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Port: 80},
+			Peer:        &AddrPort{Name: "web01.prod.example.com", Addr: netip.MustParseAddr("10.0.2.13"), Wildcard: true},
+			Connections: 120,
+			Process:     &Process{Name: "nginx", Pgid: 1100},
+		},
+		{
+			Direction:   FlowPassive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Port: 80},
+			Peer:        &AddrPort{Name: "web02.prod.example.com", Addr: netip.MustParseAddr("10.0.2.200"), Wildcard: true},
+			Connections: 80,
+			Process:     &Process{Name: "nginx", Pgid: 1100},
+		},
+		{
+			Direction:   FlowPassive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Port: 443},
+			Peer:        &AddrPort{Name: "10.0.3.1", Addr: netip.MustParseAddr("10.0.3.1"), Wildcard: true},
+			Connections: 5,
+			Process:     &Process{Name: "nginx", Pgid: 1100},
+		},
+		{
+			Direction:   FlowActive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Wildcard: true},
+			Peer:        &AddrPort{Name: "db01.local", Addr: netip.MustParseAddr("10.0.1.10"), Port: 3306},
+			Connections: 22,
+			Process:     &Process{Name: "app", Pgid: 1200},
+		},
+		{
+			Direction:   FlowActive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Wildcard: true},
+			Peer:        &AddrPort{Name: "db02.local", Addr: netip.MustParseAddr("10.0.1.11"), Port: 3306},
+			Connections: 8,
+			Process:     &Process{Name: "app", Pgid: 1200},
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{
+			spec: "subnet",
+			want: []string{
+				"app01.local:443\t<--\t10.0.3.0/24:many\t5",
+				"app01.local:80\t<--\t10.0.2.0/24:many\t200",
+				"app01.local:many\t-->\t10.0.1.0/24:3306\t30",
+			},
+		},
+		{
+			spec: "subnet/25",
+			want: []string{
+				"app01.local:443\t<--\t10.0.3.0/25:many\t5",
+				"app01.local:80\t<--\t10.0.2.0/25:many\t120",
+				"app01.local:80\t<--\t10.0.2.128/25:many\t80",
+				"app01.local:many\t-->\t10.0.1.0/25:3306\t30",
+			},
+		},
+		{
+			spec: "cidr:../testdata/catalog.txt",
+			want: []string{
+				"app01.local:443\t<--\t10.0.3.1:many\t5",
+				"app01.local:80\t<--\tweb canary:many\t80",
+				"app01.local:80\t<--\tweb:many\t120",
+				"app01.local:many\t-->\tdb:3306\t30",
+			},
+		},
+		{
+			spec: "domain",
+			want: []string{
+				"app01.local:443\t<--\t10.0.3.1:many\t5",
+				"app01.local:80\t<--\tprod.example.com:many\t200",
+				"app01.local:many\t-->\tlocal:3306\t30",
+			},
+		},
+		{
+			spec: "process",
+			want: []string{
+				"app:many\t-->\t*:many\t30",
+				"nginx:many\t<--\t*:many\t205",
+			},
+		},
+		{
+			spec: "port",
+			want: []string{
+				"*:443\t<--\t*:many\t5",
+				"*:80\t<--\t*:many\t200",
+				"*:many\t-->\t*:3306\t30",
+			},
+		},
+	}
+	for _, tt := range tests {
+		g, err := ParseGrouping(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range flows.GroupBy(g) {
+			got = append(got, stripProcess(f))
+		}
+		sort.Strings(got)
+		if len(got) != len(tt.want) {
+			t.Errorf("GroupBy(%q) should be %q, but %q", tt.spec, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("GroupBy(%q) should be %q, but %q", tt.spec, tt.want, got)
+				break
+			}
+		}
+		if total := flows["2-10.0.1.9:many-10.0.1.10:3306"].Connections; total != 22 {
+			t.Errorf("GroupBy(%q) should not modify the flows, but connections = %d", tt.spec, total)
+		}
+	}
+}
+
+// stripProcess returns the string representation of the flow without the process.
+func stripProcess(f *HostFlow) string {
+	f2 := *f
+	f2.Process = nil
+	return f2.String()
+}
+
+func TestHostFlows_GroupBy_json(t *testing.T) {
+	g, err := ParseGrouping("cidr:../testdata/catalog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flows := HostFlows{}
+	for _, f := range []*HostFlow{
+		{
+			Direction:   FlowActive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Wildcard: true},
+			Peer:        &AddrPort{Name: "db01.local", Addr: netip.MustParseAddr("10.0.1.10"), Port: 3306},
+			Connections: 22,
+		},
+		{
+			Direction:   FlowActive,
+			Local:       &AddrPort{Name: "app01.local", Addr: netip.MustParseAddr("10.0.1.9"), Wildcard: true},
+			Peer:        &AddrPort{Name: "db02.local", Addr: netip.MustParseAddr("10.0.1.11"), Port: 3306},
+			Connections: 8,
+		},
+	} {
+		flows[f.UniqKey()] = f
+	}
+	b, err := json.Marshal(flows.GroupBy(g))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grouped HostFlows
+	if err := json.Unmarshal(b, &grouped); err != nil {
+		t.Fatalf("grouped flows should be parsed: %v", err)
+	}
+	flow, ok := grouped["2-10.0.1.9:many-db:3306"]
+	if !ok {
+		t.Fatalf("flows should contain the active flow to db:3306, but %v", grouped)
+	}
+	if flow.Peer.Addr.IsValid() || flow.Peer.Name != "db" || flow.Connections != 30 {
+		t.Errorf("peer should be labeled db without address, but %+v", flow.Peer)
+	}
+}
@@ -0,0 +1,160 @@
+package tcpflow
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// jsonSchema is the subset of JSON Schema (draft-07) describing the JSON representation of Go types.
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Ref         string                 `json:"$ref,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Pattern     string                 `json:"pattern,omitempty"`
+	Const       interface{}            `json:"const,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Definitions map[string]*jsonSchema `json:"definitions,omitempty"`
+}
+
+// schemaGenerator generates the schema of a Go type by reflection.
+// The named struct types are placed in the definitions.
+type schemaGenerator struct {
+	definitions map[string]*jsonSchema
+}
+
+// override returns the schema of the types whose JSON representation differs from their Go types.
+func (g *schemaGenerator) override(t reflect.Type) (*jsonSchema, bool) {
+	switch t {
+	case reflect.TypeOf(FlowDirection(0)):
+		s := &jsonSchema{Type: "string"}
+		for _, d := range []FlowDirection{FlowActive, FlowPassive, FlowForwarded, FlowUnknown} {
+			s.Enum = append(s.Enum, d.String())
+		}
+		return s, true
+	case reflect.TypeOf(AddrPort{}):
+		s := g.structSchema(reflect.TypeOf(addrPortJSON{}))
+		s.Properties["port"].Pattern = "^([0-9]+|" + portMany + ")$"
+		return g.define("AddrPort", s), true
+	case reflect.TypeOf(HostFlows(nil)):
+		return &jsonSchema{Type: "array", Items: g.schemaOf(reflect.TypeOf(HostFlow{}))}, true
+	case reflect.TypeOf(netip.AddrPort{}):
+		return &jsonSchema{Type: "string"}, true
+	case reflect.TypeOf(time.Time{}):
+		return &jsonSchema{Type: "string", Format: "date-time"}, true
+	}
+	return nil, false
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *jsonSchema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if s, ok := g.override(t); ok {
+		return s
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object"}
+	case reflect.Struct:
+		return g.define(t.Name(), g.structSchema(t))
+	}
+	panic("tcpflow: unsupported type in JSON schema: " + t.String())
+}
+
+// structSchema returns the schema of the struct fields. The fields without omitempty are required.
+func (g *schemaGenerator) structSchema(t reflect.Type) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			// the fields of an embedded struct are promoted.
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			es := g.structSchema(embedded)
+			for name, ps := range es.Properties {
+				s.Properties[name] = ps
+			}
+			s.Required = append(s.Required, es.Required...)
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schemaOf(f.Type)
+		omitempty := false
+		for _, opt := range opts[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// define places the schema in the definitions, and returns the reference to it.
+func (g *schemaGenerator) define(name string, s *jsonSchema) *jsonSchema {
+	if name == "" {
+		return s
+	}
+	g.definitions[name] = s
+	return &jsonSchema{Ref: "#/definitions/" + name}
+}
+
+// EnvelopeSchema returns the JSON Schema of Envelope, which is generated from the Go types.
+// The schema is published as schema/envelope.schema.json by 'go generate'.
+func EnvelopeSchema() ([]byte, error) {
+	return generateSchema(reflect.TypeOf(Envelope{}),
+		"lstf host flows", "Host flows printed by 'lstf --json-envelope'.")
+}
+
+// FlowRecordSchema returns the JSON Schema of FlowRecord, which is generated from the Go types.
+// The schema is published as schema/flow-record.schema.json by 'go generate'.
+func FlowRecordSchema() ([]byte, error) {
+	return generateSchema(reflect.TypeOf(FlowRecord{}),
+		"lstf host flow record", "A line of host flows printed by 'lstf --ndjson'.")
+}
+
+func generateSchema(t reflect.Type, title, description string) ([]byte, error) {
+	g := &schemaGenerator{definitions: map[string]*jsonSchema{}}
+	s := g.structSchema(t)
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = title
+	s.Description = description
+	s.Properties["schema_version"].Const = SchemaVersion
+	s.Definitions = g.definitions
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
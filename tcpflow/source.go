@@ -0,0 +1,206 @@
+package tcpflow
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/netutil"
+)
+
+// SourceAuto is the name of the flow source, which uses the best available source on the platform.
+const SourceAuto = "auto"
+
+// FlowSource is a backend to get host flows.
+type FlowSource interface {
+	// Name returns the name of the source, such as "netlink".
+	Name() string
+	// GetHostFlows gets host flows. Each flow records the name of the source actually used.
+	// It should return soon after the context is done, with the partial flows, such as
+	// the flows without processes or host names, and WarningPartial if the connections
+	// have been read, or with the error of the context otherwise.
+	GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error)
+}
+
+// ListenerSource is a FlowSource which also gets the listening ports of the host
+// whose sockets it reads. The other sources, such as the flows in a file or the
+// conntrack entries, do not tell the listening ports.
+type ListenerSource interface {
+	FlowSource
+	// GetListeningPorts gets the listening ports of the host.
+	GetListeningPorts(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error)
+}
+
+// FlowSourceFactory creates a flow source from the argument given as "<name>:<arg>".
+type FlowSourceFactory func(arg string) (FlowSource, error)
+
+var flowSources = map[string]FlowSourceFactory{}
+
+// RegisterFlowSource registers the flow source 'name'.
+// It panics if the name is already registered.
+func RegisterFlowSource(name string, factory FlowSourceFactory) {
+	if _, ok := flowSources[name]; ok {
+		panic("tcpflow: flow source registered twice: " + name)
+	}
+	flowSources[name] = factory
+}
+
+// FlowSourceNames returns the sorted names of the registered flow sources.
+func FlowSourceNames() []string {
+	names := make([]string, 0, len(flowSources))
+	for name := range flowSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFlowSource returns the flow source specified as "<name>" or "<name>:<arg>".
+func NewFlowSource(spec string) (FlowSource, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	factory, ok := flowSources[name]
+	if !ok {
+		return nil, xerrors.Errorf("unknown flow source '%s' (available: %s)",
+			name, strings.Join(FlowSourceNames(), ", "))
+	}
+	return factory(arg)
+}
+
+// GetHostFlows gets host flows from the best available source on the platform.
+func GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	return autoSource.GetHostFlows(ctx, opt)
+}
+
+// funcSource adapts a function to FlowSource.
+type funcSource struct {
+	name string
+	get  func(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error)
+}
+
+func (s *funcSource) Name() string {
+	return s.name
+}
+
+func (s *funcSource) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	flows, err := s.get(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	opt.warnPartial(ctx)
+	flows.setSource(s.name)
+	dlog.Debugf("got %d host flows from %s source", len(flows), s.name)
+	return flows, nil
+}
+
+// registerFuncSource registers the function as the flow source without argument.
+func registerFuncSource(name string, get func(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error)) *funcSource {
+	src := &funcSource{name: name, get: get}
+	registerSource(src)
+	return src
+}
+
+// listenerFuncSource adapts the functions to ListenerSource.
+type listenerFuncSource struct {
+	*funcSource
+	ports func(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error)
+}
+
+func (s *listenerFuncSource) GetListeningPorts(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ports(ctx, opt)
+}
+
+// registerListenerSource registers the functions as the listener source without argument.
+func registerListenerSource(name string,
+	get func(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error),
+	ports func(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error)) *listenerFuncSource {
+	src := &listenerFuncSource{funcSource: &funcSource{name: name, get: get}, ports: ports}
+	registerSource(src)
+	return src
+}
+
+// registerSource registers the flow source without argument.
+func registerSource(src FlowSource) {
+	name := src.Name()
+	RegisterFlowSource(name, func(arg string) (FlowSource, error) {
+		if arg != "" {
+			return nil, xerrors.Errorf("flow source '%s' takes no argument", name)
+		}
+		return src, nil
+	})
+}
+
+// fallbackSource tries the sources in order, and falls back to the next source
+// if a source fails except by the context. The failure is warned unless the
+// source is unavailable on the host.
+type fallbackSource struct {
+	name    string
+	sources []FlowSource
+}
+
+func (s *fallbackSource) Name() string {
+	return s.name
+}
+
+func (s *fallbackSource) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	var err error
+	for _, src := range s.sources {
+		var flows HostFlows
+		flows, err = src.GetHostFlows(ctx, opt)
+		if err == nil {
+			return flows, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		var netlinkErr *netutil.NetlinkError
+		if xerrors.As(err, &netlinkErr) {
+			dlog.Debugf("%s source is unavailable, fallback to the next source: %v", src.Name(), err)
+			continue
+		}
+		opt.warn(newFallbackWarning(src.Name(), err))
+	}
+	if err == nil {
+		err = xerrors.New("no flow source is available")
+	}
+	return nil, err
+}
+
+// GetListeningPorts gets the listening ports from the listener sources in order
+// like GetHostFlows.
+func (s *fallbackSource) GetListeningPorts(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error) {
+	err := xerrors.New("no listener source is available")
+	for _, src := range s.sources {
+		ls, ok := src.(ListenerSource)
+		if !ok {
+			continue
+		}
+		var ports netutil.PortSet
+		ports, err = ls.GetListeningPorts(ctx, opt)
+		if err == nil || ctx.Err() != nil {
+			return ports, err
+		}
+		dlog.Debugf("%s source could not get the listening ports, fallback to the next source: %v", src.Name(), err)
+	}
+	return nil, err
+}
+
+// autoSource is set up with the available sources on the platform by init().
+var autoSource = &fallbackSource{name: SourceAuto}
+
+func init() {
+	RegisterFlowSource(SourceAuto, func(arg string) (FlowSource, error) {
+		if arg != "" {
+			return nil, xerrors.Errorf("flow source '%s' takes no argument", SourceAuto)
+		}
+		return autoSource, nil
+	})
+}
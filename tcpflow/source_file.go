@@ -0,0 +1,78 @@
+package tcpflow
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/dlog"
+)
+
+// SourceFile is the name of FileSource.
+const SourceFile = "file"
+
+func init() {
+	RegisterFlowSource(SourceFile, func(arg string) (FlowSource, error) {
+		if arg == "" {
+			return nil, xerrors.Errorf("flow source '%s' requires a path such as '%s:flows.json'", SourceFile, SourceFile)
+		}
+		return NewFileSource(arg), nil
+	})
+}
+
+// FileSource reads host flows from a JSON file printed by `lstf --json`.
+// It is useful as a fixture for testing and for analyzing flows collected elsewhere.
+type FileSource struct {
+	path string
+}
+
+// NewFileSource creates FileSource reading the file 'path'.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+// Name returns the name of the source.
+func (s *FileSource) Name() string {
+	return SourceFile
+}
+
+// GetHostFlows reads host flows from the file, and applies the option to them.
+// The names of the addresses are kept as recorded unless the numeric option is set.
+func (s *FileSource) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", s.path, err)
+	}
+	var recorded HostFlows
+	if err := json.Unmarshal(b, &recorded); err != nil {
+		return nil, xerrors.Errorf("could not parse %s: %w", s.path, err)
+	}
+
+	flows := make(HostFlows, len(recorded))
+	for key, flow := range recorded {
+		if flow.Local == nil || flow.Peer == nil {
+			return nil, xerrors.Errorf("flow without local or peer address in %s", s.path)
+		}
+		if opt.excludes(flow.Peer.Addr) {
+			continue
+		}
+		if !opt.Processes {
+			flow.Process = nil
+		}
+		if !opt.Sockets {
+			flow.Sockets = nil
+		}
+		if opt.Numeric {
+			flow.Local.Name, flow.Peer.Name = "", ""
+		}
+		flows[key] = flow
+	}
+	flows.setSource(SourceFile)
+	dlog.Debugf("got %d host flows from %s source (%s)", len(flows), SourceFile, s.path)
+	return flows, nil
+}
@@ -0,0 +1,218 @@
+package tcpflow
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"os"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/dlog"
+	"github.com/yuuki/lstf/pcap"
+)
+
+// SourcePcap is the name of PcapSource.
+const SourcePcap = "pcap"
+
+// PcapSource reads host flows from a pcap or pcapng file captured on a host.
+// It reconstructs TCP connections from the SYN and SYN-ACK segments of the handshakes
+// to determine whether each connection is opened actively or passively by the host.
+type PcapSource struct {
+	path   string
+	locals []netip.Addr
+}
+
+// NewPcapSource creates PcapSource reading the file 'path'.
+// 'locals' are the addresses of the host where the file was captured.
+func NewPcapSource(path string, locals []netip.Addr) *PcapSource {
+	return &PcapSource{path: path, locals: locals}
+}
+
+// Name returns the name of the source.
+func (s *PcapSource) Name() string {
+	return SourcePcap
+}
+
+// GetHostFlows reads host flows from the file. The processes are unknown.
+// If the context is done while reading, it returns the flows of the packets read so far.
+func (s *PcapSource) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.locals) == 0 {
+		return nil, xerrors.Errorf("flow source '%s' requires the local addresses of the captured host", SourcePcap)
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, xerrors.Errorf("could not open %s: %w", s.path, err)
+	}
+	defer f.Close()
+
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", s.path, err)
+	}
+	flows, err := hostFlowsFromSegments(ctx, opt, r, s.locals)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read %s: %w", s.path, err)
+	}
+	dlog.Debugf("skipped %d packets other than TCP in %s", r.Skipped, s.path)
+	opt.warnPartial(ctx)
+	flows.setSource(SourcePcap)
+	dlog.Debugf("got %d host flows from %s source (%s)", len(flows), SourcePcap, s.path)
+	return flows, nil
+}
+
+// segmentReader is implemented by pcap.Reader.
+type segmentReader interface {
+	Next() (*pcap.Segment, error)
+}
+
+// pcapConn is a TCP connection reconstructed from the captured segments.
+type pcapConn struct {
+	local, peer netip.AddrPort
+	direction   FlowDirection
+	established bool
+	closed      bool
+}
+
+// hostFlowsFromSegments aggregates the TCP segments captured on the host whose addresses are 'locals'.
+// It stops reading the segments when the context is done.
+func hostFlowsFromSegments(ctx context.Context, opt *GetHostFlowsOption, r segmentReader, locals []netip.Addr) (HostFlows, error) {
+	isLocal := make(map[netip.Addr]bool, len(locals))
+	for _, local := range locals {
+		isLocal[local.Unmap()] = true
+	}
+
+	var (
+		// conns holds the current connection of each 4-tuple.
+		conns = map[[2]netip.AddrPort]*pcapConn{}
+		// all holds every connection including the ones reusing a 4-tuple.
+		all []*pcapConn
+		// listening holds the local ports accepting connections.
+		listening = map[netip.AddrPort]bool{}
+		// servers holds the peers accepting connections from the host.
+		servers = map[netip.AddrPort]bool{}
+	)
+	for ctx.Err() == nil {
+		seg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			src, dst    = netip.AddrPortFrom(seg.Src.Unmap(), seg.Sport), netip.AddrPortFrom(seg.Dst.Unmap(), seg.Dport)
+			fromLocal   = isLocal[src.Addr()]
+			local, peer netip.AddrPort
+		)
+		switch {
+		case fromLocal:
+			local, peer = src, dst
+		case isLocal[dst.Addr()]:
+			local, peer = dst, src
+		default:
+			continue // not for the host
+		}
+		key := [2]netip.AddrPort{local, peer}
+		conn := conns[key]
+
+		switch {
+		case seg.Has(pcap.FlagSYN) && !seg.Has(pcap.FlagACK):
+			if conn != nil && !conn.closed && !conn.established {
+				continue // retransmission
+			}
+			// the sender of SYN opens the connection actively.
+			conn = &pcapConn{local: local, peer: peer, direction: FlowPassive}
+			if fromLocal {
+				conn.direction = FlowActive
+			}
+			conns[key] = conn
+			all = append(all, conn)
+		case seg.Has(pcap.FlagSYN | pcap.FlagACK):
+			if conn == nil || conn.closed {
+				// SYN has not been captured.
+				conn = &pcapConn{local: local, peer: peer, direction: FlowActive}
+				if fromLocal {
+					conn.direction = FlowPassive
+				}
+				conns[key] = conn
+				all = append(all, conn)
+			}
+			conn.established = true
+		default:
+			if conn == nil {
+				// the connection has been opened before the capture.
+				conn = &pcapConn{local: local, peer: peer, direction: FlowUnknown, established: true}
+				conns[key] = conn
+				all = append(all, conn)
+			}
+			if seg.Has(pcap.FlagACK) && !seg.Has(pcap.FlagRST) {
+				// the final ACK of the handshake, even if SYN-ACK has not been captured.
+				conn.established = true
+			}
+			if seg.Has(pcap.FlagFIN) || seg.Has(pcap.FlagRST) {
+				conn.closed = true
+			}
+		}
+		if conn.established {
+			switch conn.direction {
+			case FlowPassive:
+				listening[local] = true
+			case FlowActive:
+				servers[peer] = true
+			}
+		}
+	}
+
+	flows := HostFlows{}
+	unclassified := 0
+	for _, conn := range all {
+		if !conn.established {
+			continue // refused or timed out
+		}
+		direction := conn.direction
+		if direction == FlowUnknown {
+			switch {
+			case listening[conn.local]:
+				direction = FlowPassive
+			case servers[conn.peer]:
+				direction = FlowActive
+			default:
+				unclassified++
+				continue
+			}
+		}
+
+		if opt.excludes(conn.peer.Addr()) {
+			continue
+		}
+
+		switch direction {
+		case FlowPassive:
+			flows.Insert(&HostFlow{
+				Direction: FlowPassive,
+				Local:     NewAddrPort(conn.local.Addr(), conn.local.Port()),
+				Peer:      NewWildcardAddrPort(conn.peer.Addr()),
+			})
+		case FlowActive:
+			flows.Insert(&HostFlow{
+				Direction: FlowActive,
+				Local:     NewWildcardAddrPort(conn.local.Addr()),
+				Peer:      NewAddrPort(conn.peer.Addr(), conn.peer.Port()),
+			})
+		}
+	}
+
+	if unclassified > 0 {
+		opt.warn(newUnclassifiedWarning(unclassified))
+	}
+
+	if !opt.Numeric {
+		flows.resolveNames(ctx)
+	}
+	return flows, nil
+}
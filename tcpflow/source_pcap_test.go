@@ -0,0 +1,96 @@
+package tcpflow
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/yuuki/lstf/pcap"
+)
+
+type segmentSlice []*pcap.Segment
+
+func (s *segmentSlice) Next() (*pcap.Segment, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	seg := (*s)[0]
+	*s = (*s)[1:]
+	return seg, nil
+}
+
+func newSegment(src string, sport uint16, dst string, dport uint16, flags uint8) *pcap.Segment {
+	return &pcap.Segment{Src: netip.MustParseAddr(src), Sport: sport, Dst: netip.MustParseAddr(dst), Dport: dport, Flags: flags}
+}
+
+func TestHostFlowsFromSegments(t *testing.T) {
+	const (
+		syn    = pcap.FlagSYN
+		synack = pcap.FlagSYN | pcap.FlagACK
+		ack    = pcap.FlagACK
+		fin    = pcap.FlagFIN | pcap.FlagACK
+		rst    = pcap.FlagRST | pcap.FlagACK
+	)
+	segs := segmentSlice{
+		// passive open with a retransmitted SYN
+		newSegment("10.0.2.13", 50001, "10.0.1.9", 80, syn),
+		newSegment("10.0.2.13", 50001, "10.0.1.9", 80, syn),
+		newSegment("10.0.1.9", 80, "10.0.2.13", 50001, synack),
+		newSegment("10.0.2.13", 50001, "10.0.1.9", 80, ack),
+		newSegment("10.0.2.13", 50001, "10.0.1.9", 80, fin),
+		// the same 4-tuple is reused after closed
+		newSegment("10.0.2.13", 50001, "10.0.1.9", 80, syn),
+		newSegment("10.0.1.9", 80, "10.0.2.13", 50001, synack),
+		// active open whose SYN has not been captured
+		newSegment("10.0.1.10", 3306, "10.0.1.9", 40001, synack),
+		// refused
+		newSegment("10.0.1.9", 40002, "10.0.1.10", 5432, syn),
+		newSegment("10.0.1.10", 5432, "10.0.1.9", 40002, rst),
+		// opened before the capture, classified by the listening port
+		newSegment("10.0.2.14", 50002, "10.0.1.9", 80, ack),
+		// opened before the capture, and unknown
+		newSegment("10.0.1.9", 43000, "10.0.3.1", 9000, ack),
+		// not for the host
+		newSegment("10.0.2.13", 50003, "10.0.1.10", 80, syn),
+	}
+
+	var warnings []*Warning
+	opt := &GetHostFlowsOption{
+		Numeric: true,
+		Filter:  FilterAll,
+		OnWarning: func(w *Warning) {
+			warnings = append(warnings, w)
+		},
+	}
+	flows, err := hostFlowsFromSegments(context.Background(), opt, &segs, []netip.Addr{netip.MustParseAddr("10.0.1.9")})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	tests := []struct {
+		key         string
+		connections int64
+	}{
+		{"4-10.0.1.9:80-10.0.2.13:many", 2},
+		{"4-10.0.1.9:80-10.0.2.14:many", 1},
+		{"2-10.0.1.9:many-10.0.1.10:3306", 1},
+	}
+	if len(flows) != len(tests) {
+		t.Errorf("flows should be len == %d, but %d: %v", len(tests), len(flows), flows)
+	}
+	for _, tt := range tests {
+		flow, ok := flows[tt.key]
+		if !ok {
+			t.Errorf("flow %s should be found in %v", tt.key, flows)
+			continue
+		}
+		if flow.Connections != tt.connections {
+			t.Errorf("flow %s should have %d connections, but %d", tt.key, tt.connections, flow.Connections)
+		}
+	}
+
+	if len(warnings) != 1 || warnings[0].Kind != WarningUnclassified || warnings[0].Count != 1 {
+		t.Errorf("warnings should contain 1 unclassified connection, but %v", warnings)
+	}
+}
@@ -0,0 +1,182 @@
+package tcpflow
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+func TestNewFlowSource(t *testing.T) {
+	tests := []struct {
+		spec string
+		name string
+		err  bool
+	}{
+		{"auto", SourceAuto, false},
+		{"file:../testdata/flows.json", SourceFile, false},
+		{"file", "", true},
+		{"auto:foo", "", true},
+		{"unknown", "", true},
+	}
+	for _, tt := range tests {
+		src, err := NewFlowSource(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("NewFlowSource(%q) should raise error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewFlowSource(%q) should not raise error: %v", tt.spec, err)
+			continue
+		}
+		if src.Name() != tt.name {
+			t.Errorf("NewFlowSource(%q).Name() should be %q, but %q", tt.spec, tt.name, src.Name())
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	src := NewFileSource("../testdata/flows.json")
+
+	flows, err := src.GetHostFlows(context.Background(), &GetHostFlowsOption{Filter: FilterPrivate, Numeric: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("flows should be len == 2 with private filter, but %d", len(flows))
+	}
+	flow, ok := flows["2-10.0.1.9:many-10.0.1.10:3306"]
+	if !ok {
+		t.Fatalf("flows should contain the active flow to 10.0.1.10:3306, but %v", flows)
+	}
+	if flow.Connections != 22 {
+		t.Errorf("connections should be 22, but %d", flow.Connections)
+	}
+	if flow.Process != nil {
+		t.Errorf("process should be nil without processes option, but %v", flow.Process)
+	}
+	if flow.Peer.Name != "" {
+		t.Errorf("peer name should be empty with numeric option, but %q", flow.Peer.Name)
+	}
+	if flow.Source != SourceFile {
+		t.Errorf("source should be %q, but %q", SourceFile, flow.Source)
+	}
+
+	flows, err = src.GetHostFlows(context.Background(), &GetHostFlowsOption{Filter: FilterPublic, Processes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 {
+		t.Fatalf("flows should be len == 1 with public filter, but %d", len(flows))
+	}
+	for _, flow := range flows {
+		if flow.Process == nil || flow.Process.Name != "app" {
+			t.Errorf("process should be app, but %v", flow.Process)
+		}
+	}
+}
+
+func TestFuncSource_partial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &funcSource{
+		name: "test",
+		get: func(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+			flows := HostFlows{}
+			flows.Insert(&HostFlow{
+				Direction: FlowActive,
+				Local:     NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+				Peer:      NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+			})
+			// interrupted after the connections have been read.
+			cancel()
+			return flows, nil
+		},
+	}
+	var warnings []*Warning
+	flows, err := src.GetHostFlows(ctx, &GetHostFlowsOption{
+		OnWarning: func(w *Warning) {
+			warnings = append(warnings, w)
+		},
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(flows) != 1 {
+		t.Errorf("partial flows should be len == 1, but %d", len(flows))
+	}
+	if len(warnings) != 1 || warnings[0].Kind != WarningPartial {
+		t.Errorf("warnings should contain a partial warning, but %v", warnings)
+	}
+}
+
+func TestFileSource_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := NewFileSource("../testdata/flows.json")
+	if _, err := src.GetHostFlows(ctx, &GetHostFlowsOption{Filter: FilterAll}); err != context.Canceled {
+		t.Errorf("should raise context.Canceled, but %v", err)
+	}
+}
+
+func TestFallbackSource(t *testing.T) {
+	failing := func(err error) FlowSource {
+		return &funcSource{name: "failing", get: func(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+			return nil, err
+		}}
+	}
+	file := NewFileSource("../testdata/flows.json")
+	tests := []struct {
+		desc     string
+		err      error
+		warnings int
+	}{
+		{"unavailable", xerrors.Errorf("NetlinkInetDiag: %w", &netutil.NetlinkError{}), 0},
+		{"other error", xerrors.New("could not parse"), 1},
+	}
+	for _, tc := range tests {
+		src := &fallbackSource{name: "test", sources: []FlowSource{failing(tc.err), file}}
+		var warnings []*Warning
+		flows, err := src.GetHostFlows(context.Background(), &GetHostFlowsOption{
+			Filter: FilterAll,
+			OnWarning: func(w *Warning) {
+				warnings = append(warnings, w)
+			},
+		})
+		if err != nil {
+			t.Errorf("desc: %q, should fall back without error: %v", tc.desc, err)
+			continue
+		}
+		if len(flows) != 3 {
+			t.Errorf("desc: %q, flows of the next source should be len == 3, but %d", tc.desc, len(flows))
+		}
+		if len(warnings) != tc.warnings || (tc.warnings > 0 && warnings[0].Kind != WarningFallback) {
+			t.Errorf("desc: %q, warnings should be %d fallback warnings, but %v", tc.desc, tc.warnings, warnings)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := &fallbackSource{name: "test", sources: []FlowSource{failing(context.Canceled), file}}
+	if _, err := src.GetHostFlows(ctx, &GetHostFlowsOption{Filter: FilterAll}); err != context.Canceled {
+		t.Errorf("should not fall back after the context is done, but %v", err)
+	}
+}
+
+func TestListenerSource(t *testing.T) {
+	var file FlowSource = NewFileSource("../testdata/flows.json")
+	if _, ok := file.(ListenerSource); ok {
+		t.Error("file source should not tell the listening ports")
+	}
+	src, err := NewFlowSource(SourceAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := src.(ListenerSource); !ok {
+		t.Error("auto source should tell the listening ports")
+	}
+}
@@ -1,10 +1,17 @@
 package tcpflow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/netip"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
 
 	"github.com/yuuki/lstf/netutil"
 )
@@ -19,10 +26,15 @@ const (
 	FlowActive
 	// FlowPassive are 'passive open'
 	FlowPassive
+	// FlowForwarded are flows forwarded by the host, such as a router or NAT gateway.
+	FlowForwarded
 
 	FilterAll     = "all"
 	FilterPublic  = "public"
 	FilterPrivate = "private"
+	// FilterCloud filters the peers in any cloud ranges. "cloud:PROVIDER[/REGION[/SERVICE]]"
+	// filters the peers in the specific clouds.
+	FilterCloud = "cloud"
 )
 
 // String returns string representation.
@@ -32,6 +44,8 @@ func (c FlowDirection) String() string {
 		return "active"
 	case FlowPassive:
 		return "passive"
+	case FlowForwarded:
+		return "forwarded"
 	case FlowUnknown:
 		return "unknown"
 	}
@@ -43,28 +57,169 @@ func (c FlowDirection) MarshalJSON() ([]byte, error) {
 	return json.Marshal(c.String())
 }
 
-// AddrPort are <addr>:<port>
+// UnmarshalJSON parses human readable `mode` format.
+func (c *FlowDirection) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "active":
+		*c = FlowActive
+	case "passive":
+		*c = FlowPassive
+	case "forwarded":
+		*c = FlowForwarded
+	case "unknown":
+		*c = FlowUnknown
+	default:
+		return fmt.Errorf("unknown direction %q", s)
+	}
+	return nil
+}
+
+// Arrow returns the arrow printed between the local and the peer addresses,
+// such as "-->" for active. It is empty for FlowUnknown.
+func (c FlowDirection) Arrow() string {
+	switch c {
+	case FlowActive:
+		return "-->"
+	case FlowPassive:
+		return "<--"
+	case FlowForwarded:
+		return "==>"
+	}
+	return ""
+}
+
+// portMany is the string representation of the wildcard port.
+const portMany = "many"
+
+// AddrPort are <addr>:<port>.
+// The port of the wildcard AddrPort is "many", which means that the flow
+// aggregates the connections from or to ephemeral ports.
 type AddrPort struct {
-	Name string `json:"name"`
-	Addr string `json:"addr"`
-	Port string `json:"port"`
+	Name     string
+	Addr     netip.Addr
+	Port     uint16
+	Wildcard bool
+	// Network is the label of the network containing the address in a catalog, such as "prod-db".
+	Network string
+	// Cloud is the cloud provider, the region and the service of the address.
+	Cloud *netutil.Cloud
+}
+
+// NewAddrPort returns the AddrPort of the address and the port.
+func NewAddrPort(addr netip.Addr, port uint16) *AddrPort {
+	return &AddrPort{Addr: addr.Unmap(), Port: port}
+}
+
+// NewWildcardAddrPort returns the AddrPort of the address and "many" ports.
+func NewWildcardAddrPort(addr netip.Addr) *AddrPort {
+	return &AddrPort{Addr: addr.Unmap(), Wildcard: true}
+}
+
+// PortString returns the port number or "many" for the wildcard.
+func (a *AddrPort) PortString() string {
+	if a.Wildcard {
+		return portMany
+	}
+	return strconv.Itoa(int(a.Port))
 }
 
 // String returns the string representation of the AddrPort.
 func (a *AddrPort) String() string {
 	if a.Name == "" {
-		return net.JoinHostPort(a.Addr, a.Port)
+		return a.key()
+	}
+	return net.JoinHostPort(a.Name, a.PortString())
+}
+
+// key returns the string representation of the address without name.
+// It is the name for the group without address, such as a CIDR label.
+func (a *AddrPort) key() string {
+	if !a.Addr.IsValid() {
+		return net.JoinHostPort(a.Name, a.PortString())
+	}
+	return net.JoinHostPort(a.Addr.String(), a.PortString())
+}
+
+// compare compares the addresses, the names for the groups without address,
+// and then the ports. The wildcard port is greater than any port.
+func (a *AddrPort) compare(b *AddrPort) int {
+	if c := a.Addr.Compare(b.Addr); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
 	}
-	return net.JoinHostPort(a.Name, a.Port)
+	switch {
+	case a.Wildcard != b.Wildcard:
+		if a.Wildcard {
+			return 1
+		}
+		return -1
+	case a.Port < b.Port:
+		return -1
+	case a.Port > b.Port:
+		return 1
+	}
+	return 0
 }
 
-// PortInt returnts integer representation.
+// PortInt returnts integer representation, which is 0 for the wildcard.
+//
+// Deprecated: use Port and Wildcard.
 func (a *AddrPort) PortInt() int {
-	if a.Port == "many" {
+	if a.Wildcard {
 		return 0
 	}
-	i, _ := strconv.Atoi(a.Port)
-	return i
+	return int(a.Port)
+}
+
+// addrPortJSON is the JSON representation of AddrPort, which keeps the port as string.
+// The address is empty for the group without address, such as a CIDR label.
+type addrPortJSON struct {
+	Name    string         `json:"name"`
+	Addr    string         `json:"addr"`
+	Port    string         `json:"port"`
+	Network string         `json:"network,omitempty"`
+	Cloud   *netutil.Cloud `json:"cloud,omitempty"`
+}
+
+// MarshalJSON returns the port as string such as "80" or "many".
+func (a *AddrPort) MarshalJSON() ([]byte, error) {
+	v := &addrPortJSON{Name: a.Name, Port: a.PortString(), Network: a.Network, Cloud: a.Cloud}
+	if a.Addr.IsValid() {
+		v.Addr = a.Addr.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON parses the port as string such as "80" or "many".
+func (a *AddrPort) UnmarshalJSON(b []byte) error {
+	var v addrPortJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = AddrPort{Name: v.Name, Network: v.Network, Cloud: v.Cloud}
+	if v.Addr != "" {
+		addr, err := netip.ParseAddr(v.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %v", v.Addr, err)
+		}
+		a.Addr = addr.Unmap()
+	}
+	if v.Port == portMany {
+		a.Wildcard = true
+		return nil
+	}
+	port, err := strconv.ParseUint(v.Port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %v", v.Port, err)
+	}
+	a.Port = uint16(port)
+	return nil
 }
 
 // Process represents a OS process.
@@ -73,6 +228,62 @@ type Process struct {
 	Pgid int    `json:"pgid"`
 }
 
+// Socket represents an individual TCP socket aggregated into a HostFlow.
+type Socket struct {
+	Local netip.AddrPort `json:"local"`
+	Peer  netip.AddrPort `json:"peer"`
+	// State is the TCP state such as "ESTAB" or "TIME-WAIT".
+	State string `json:"state"`
+	// Inode is the inode of the socket, which is 0 if no process owns it.
+	Inode uint32 `json:"inode"`
+	// UID is the owner of the socket.
+	UID uint32 `json:"uid"`
+	// Timer is the pending timer of the socket, or nil if no timer is pending.
+	Timer *SocketTimer `json:"timer,omitempty"`
+}
+
+// SocketTimer represents the pending timer of a socket like 'ss --options'.
+type SocketTimer struct {
+	// Kind is "retransmit", "keepalive", "timewait" or "probe" (zero window probe).
+	Kind string `json:"kind"`
+	// ExpiresMS is milliseconds until the timer expires.
+	ExpiresMS uint32 `json:"expires_ms"`
+	// Retransmits is the number of the retransmissions or the unanswered probes.
+	Retransmits uint8 `json:"retransmits"`
+}
+
+// newSocketTimer returns the timer of the kind, or nil if no timer is pending.
+func newSocketTimer(timer uint8, expiresMS uint32, retransmits uint8) *SocketTimer {
+	kind := netutil.TimerName(timer)
+	if kind == "" {
+		return nil
+	}
+	return &SocketTimer{Kind: kind, ExpiresMS: expiresMS, Retransmits: retransmits}
+}
+
+// String returns the string representation of Socket.
+func (s *Socket) String() string {
+	str := fmt.Sprintf("%s\t-\t%s\t%s uid=%d inode=%d", s.Local, s.Peer, s.State, s.UID, s.Inode)
+	if s.Timer != nil {
+		str += fmt.Sprintf(" timer=(%s,%s,%d)", s.Timer.Kind,
+			time.Duration(s.Timer.ExpiresMS)*time.Millisecond, s.Timer.Retransmits)
+	}
+	return str
+}
+
+// NAT represents the reply direction of a flow translated by NAT, which is tracked by conntrack.
+// Local and Peer of the HostFlow are the original direction, except the Local of a passive
+// flow redirected by DNAT, which is the translated local address.
+type NAT struct {
+	ReplySrc *AddrPort `json:"reply_src"`
+	ReplyDst *AddrPort `json:"reply_dst"`
+}
+
+// String returns the string representation of NAT.
+func (n *NAT) String() string {
+	return fmt.Sprintf("%s -> %s", n.ReplySrc, n.ReplyDst)
+}
+
 // HostFlow represents a `host flow`.
 type HostFlow struct {
 	Direction   FlowDirection `json:"direction"`
@@ -80,6 +291,11 @@ type HostFlow struct {
 	Peer        *AddrPort     `json:"peer"`
 	Connections int64         `json:"connections"`
 	Process     *Process      `json:"process,omitempty"`
+	NAT         *NAT          `json:"nat,omitempty"`
+	Source      string        `json:"source,omitempty"`
+	// Sockets are the sockets aggregated into the flow, which are collected
+	// only if GetHostFlowsOption.Sockets is set.
+	Sockets []*Socket `json:"sockets,omitempty"`
 }
 
 // String returns the string representation of HostFlow.
@@ -88,24 +304,36 @@ func (f *HostFlow) String() string {
 	if f.Process != nil {
 		entStr = fmt.Sprintf("\t(\"%s\",pgid=%d)", f.Process.Name, f.Process.Pgid)
 	}
-	switch f.Direction {
-	case FlowActive:
-		return fmt.Sprintf("%s\t-->\t%s\t%d%s", f.Local, f.Peer, f.Connections, entStr)
-	case FlowPassive:
-		return fmt.Sprintf("%s\t<--\t%s\t%d%s", f.Local, f.Peer, f.Connections, entStr)
+	if f.NAT != nil {
+		entStr += fmt.Sprintf("\t(reply %s)", f.NAT)
 	}
-	return ""
+	if f.Peer.Network != "" {
+		entStr += fmt.Sprintf("\t(network=%s)", f.Peer.Network)
+	}
+	if f.Peer.Cloud != nil {
+		entStr += fmt.Sprintf("\t(cloud=%s)", f.Peer.Cloud)
+	}
+	arrow := f.Direction.Arrow()
+	if arrow == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%d%s", f.Local, arrow, f.Peer, f.Connections, entStr)
 }
 
 // UniqKey returns the unique identifier key for connections flow.
 func (f *HostFlow) UniqKey() string {
-	return fmt.Sprintf("%d-%s-%s", f.Direction, f.Local, f.Peer)
+	if f.NAT != nil {
+		return fmt.Sprintf("%d-%s-%s-%s -> %s", f.Direction, f.Local.key(), f.Peer.key(),
+			f.NAT.ReplySrc.key(), f.NAT.ReplyDst.key())
+	}
+	return fmt.Sprintf("%d-%s-%s", f.Direction, f.Local.key(), f.Peer.key())
 }
 
-// setLookupedName replaces f.Addr into lookuped name.
-func (f *HostFlow) setLookupedName() {
-	f.Local.Name = netutil.ResolveAddr(f.Local.Addr)
-	f.Peer.Name = netutil.ResolveAddr(f.Peer.Addr)
+// ResolveNames replaces the names of the addresses into the names looked up
+// by the reverse DNS. The names are the addresses if the context is done.
+func (f *HostFlow) ResolveNames(ctx context.Context) {
+	f.Local.Name = netutil.ResolveAddr(ctx, f.Local.Addr)
+	f.Peer.Name = netutil.ResolveAddr(ctx, f.Peer.Addr)
 }
 
 // HostFlows represents a group of host flow by unique key.
@@ -120,7 +348,29 @@ func (hf HostFlows) MarshalJSON() ([]byte, error) {
 	return json.Marshal(list)
 }
 
-func (hf HostFlows) insert(flow *HostFlow) {
+// UnmarshalJSON converts list into map.
+func (hf *HostFlows) UnmarshalJSON(b []byte) error {
+	var list []*HostFlow
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*hf = make(HostFlows, len(list))
+	for _, f := range list {
+		(*hf)[f.UniqKey()] = f
+	}
+	return nil
+}
+
+// setSource records the name of the flow source into each flow.
+func (hf HostFlows) setSource(name string) {
+	for _, f := range hf {
+		f.Source = name
+	}
+}
+
+// Insert adds the flow as a connection. If the flow of the same key already
+// exists, the connection is counted into it.
+func (hf HostFlows) Insert(flow *HostFlow) {
 	key := flow.UniqKey()
 	if _, ok := hf[key]; !ok {
 		hf[key] = flow
@@ -128,17 +378,155 @@ func (hf HostFlows) insert(flow *HostFlow) {
 		if hf[key].Process == nil {
 			hf[key].Process = flow.Process
 		}
+		hf[key].Sockets = append(hf[key].Sockets, flow.Sockets...)
 	}
 	hf[key].Connections++
 }
 
-func contains(strs []string, s string) bool {
-	for _, str := range strs {
-		if str == s {
-			return true
+// resolveNames resolves the names of the flows until the context is done,
+// after which the names of the rest are kept numerical.
+func (hf HostFlows) resolveNames(ctx context.Context) {
+	for _, flow := range hf {
+		if ctx.Err() != nil {
+			return
+		}
+		flow.ResolveNames(ctx)
+	}
+}
+
+// Sorted returns the flows sorted by the direction, the local and the peer
+// addresses, whose addresses and ports are compared numerically.
+func (hf HostFlows) Sorted() []*HostFlow {
+	list := make([]*HostFlow, 0, len(hf))
+	for _, f := range hf {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if c := a.Local.compare(b.Local); c != 0 {
+			return c < 0
+		}
+		if c := a.Peer.compare(b.Peer); c != 0 {
+			return c < 0
+		}
+		return a.UniqKey() < b.UniqKey()
+	})
+	return list
+}
+
+// Annotate sets the labels of the networks containing the peers in the catalog.
+func (hf HostFlows) Annotate(catalog *netutil.Catalog) {
+	for _, flow := range hf {
+		if flow.Peer.Addr.IsValid() {
+			flow.Peer.Network = catalog.Label(flow.Peer.Addr)
 		}
 	}
-	return false
+}
+
+// AnnotateCloud sets the clouds of the ranges containing the peers.
+func (hf HostFlows) AnnotateCloud(ranges *netutil.CloudRanges) {
+	for _, flow := range hf {
+		if flow.Peer.Addr.IsValid() {
+			flow.Peer.Cloud = ranges.Lookup(flow.Peer.Addr)
+		}
+	}
+}
+
+// Filter returns the flows whose peer addresses pass the filter, such as FilterPublic.
+func (hf HostFlows) Filter(filter string) HostFlows {
+	opt := &GetHostFlowsOption{Filter: filter}
+	flows := make(HostFlows, len(hf))
+	for key, flow := range hf {
+		if !opt.excludes(flow.Peer.Addr) {
+			flows[key] = flow
+		}
+	}
+	return flows
+}
+
+// Warning kinds.
+const (
+	// WarningProcScan means that a process could not be inspected.
+	WarningProcScan = "proc_scan"
+	// WarningUnattributed means that some sockets could not be attributed to any process.
+	WarningUnattributed = "unattributed"
+	// WarningLostEvents means that some traced events have been dropped.
+	WarningLostEvents = "lost_events"
+	// WarningUnclassified means that some connections could not be classified into active or passive.
+	WarningUnclassified = "unclassified"
+	// WarningPartial means that the collection has been interrupted by the timeout,
+	// so that some flows lack the processes or the host names.
+	WarningPartial = "partial"
+	// WarningFallback means that a source has failed, so that the next source has been used.
+	WarningFallback = "fallback"
+)
+
+// Warning represents a non-fatal problem that occurred while getting host flows.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Pid     int    `json:"pid,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Count   int    `json:"count,omitempty"`
+	Message string `json:"message"`
+}
+
+// String returns the string representation of Warning.
+func (w *Warning) String() string {
+	return w.Message
+}
+
+func newProcScanWarning(sw *netutil.ScanWarning) *Warning {
+	return &Warning{
+		Kind:    WarningProcScan,
+		Pid:     sw.Pid,
+		Path:    sw.Path,
+		Message: sw.Error(),
+	}
+}
+
+func newUnattributedWarning(count int) *Warning {
+	return &Warning{
+		Kind:    WarningUnattributed,
+		Count:   count,
+		Message: fmt.Sprintf("%d sockets could not be attributed to any process", count),
+	}
+}
+
+func newLostEventsWarning(count uint64) *Warning {
+	return &Warning{
+		Kind:    WarningLostEvents,
+		Count:   int(count),
+		Message: fmt.Sprintf("%d events have been lost because the buffer was full", count),
+	}
+}
+
+func newUnclassifiedWarning(count int) *Warning {
+	return &Warning{
+		Kind:    WarningUnclassified,
+		Count:   count,
+		Message: fmt.Sprintf("%d connections could not be classified because their handshakes were not captured", count),
+	}
+}
+
+func newPartialWarning(err error) *Warning {
+	reason := "canceled"
+	if xerrors.Is(err, context.DeadlineExceeded) {
+		reason = "timed out"
+	}
+	return &Warning{
+		Kind:    WarningPartial,
+		Message: fmt.Sprintf("the collection has %s, so that the results are partial", reason),
+	}
+}
+
+func newFallbackWarning(source string, err error) *Warning {
+	return &Warning{
+		Kind:    WarningFallback,
+		Message: fmt.Sprintf("%s source has failed, so that the next source is used: %v", source, err),
+	}
 }
 
 // GetHostFlowsOption represens an option for func GetHostFlows().
@@ -146,4 +534,97 @@ type GetHostFlowsOption struct {
 	Numeric   bool
 	Processes bool
 	Filter    string
+
+	// Catalog classifies the peers into the named networks, whose labels
+	// can be the Filter in addition to FilterPublic and FilterPrivate.
+	Catalog *netutil.Catalog
+
+	// CloudRanges classifies the peers into the clouds, which can be the Filter
+	// as FilterCloud or "cloud:PROVIDER[/REGION[/SERVICE]]".
+	CloudRanges *netutil.CloudRanges
+
+	// Sockets keeps the individual sockets in HostFlow.Sockets.
+	// It is supported by netlink, procfs and gopsutil sources.
+	Sockets bool
+
+	// ProcRoot is the root of procfs read by the procfs source, such as
+	// a snapshot extracted by 'lstf snapshot'. It is the procfs of the host if empty.
+	ProcRoot string
+
+	// OnWarning is called for each non-fatal problem if it is not nil.
+	OnWarning func(*Warning)
+}
+
+func (opt *GetHostFlowsOption) warn(w *Warning) {
+	if opt.OnWarning != nil {
+		opt.OnWarning(w)
+	}
+}
+
+// warnPartial warns that the flows are partial if the context is done.
+func (opt *GetHostFlowsOption) warnPartial(ctx context.Context) {
+	if err := ctx.Err(); err != nil {
+		opt.warn(newPartialWarning(err))
+	}
+}
+
+// excludes returns whether the flow to the peer address is excluded by the filter.
+func (opt *GetHostFlowsOption) excludes(peer netip.Addr) bool {
+	switch opt.Filter {
+	case FilterPublic:
+		return netutil.IsPrivateIP(peer)
+	case FilterPrivate:
+		return !netutil.IsPrivateIP(peer)
+	case FilterAll, "":
+		return false
+	}
+	if query, ok := cloudQuery(opt.Filter); ok {
+		if opt.CloudRanges == nil {
+			return false
+		}
+		return !matchCloud(opt.CloudRanges.Lookup(peer), query)
+	}
+	if opt.Catalog == nil {
+		return false
+	}
+	return opt.Catalog.Label(peer) != opt.Filter
+}
+
+// ValidFilter returns whether the filter is FilterAll, FilterPublic, FilterPrivate,
+// a label of the networks in the catalog or a cloud filter with the cloud ranges.
+func (opt *GetHostFlowsOption) ValidFilter() bool {
+	switch opt.Filter {
+	case FilterAll, FilterPublic, FilterPrivate:
+		return true
+	}
+	if _, ok := cloudQuery(opt.Filter); ok {
+		return opt.CloudRanges != nil
+	}
+	return opt.Catalog.HasLabel(opt.Filter)
+}
+
+// cloudQuery returns the provider, the region and the service of the cloud filter.
+// An empty element or "*" matches any.
+func cloudQuery(filter string) ([]string, bool) {
+	if filter == FilterCloud {
+		return nil, true
+	}
+	if !strings.HasPrefix(filter, FilterCloud+":") {
+		return nil, false
+	}
+	return strings.SplitN(strings.TrimPrefix(filter, FilterCloud+":"), "/", 3), true
+}
+
+// matchCloud returns whether the cloud matches the provider, the region and the service
+// of the query case-insensitively. Any cloud matches the empty query.
+func matchCloud(c *netutil.Cloud, query []string) bool {
+	if c == nil {
+		return false
+	}
+	for i, v := range []string{c.Provider, c.Region, c.Service}[:len(query)] {
+		if q := query[i]; q != "" && q != "*" && !strings.EqualFold(q, v) {
+			return false
+		}
+	}
+	return true
 }
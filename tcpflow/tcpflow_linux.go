@@ -3,58 +3,89 @@
 package tcpflow
 
 import (
-	"fmt"
+	"context"
+	"net/netip"
 
 	"github.com/elastic/gosigar/sys/linux"
-	"golang.org/x/xerrors"
 
 	"github.com/yuuki/lstf/netutil"
 )
 
-// GetHostFlows gets host flows by netlink, and try to get by procfs if it fails.
-func GetHostFlows(opt *GetHostFlowsOption) (HostFlows, error) {
-	flows, err := GetHostFlowsByNetlink(opt)
+func init() {
+	netlink := registerListenerSource("netlink", GetHostFlowsByNetlink,
+		func(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error) {
+			return netutil.NetlinkLocalListeningPorts()
+		})
+	procfs := registerListenerSource("procfs", GetHostFlowsByProcfs,
+		func(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error) {
+			return netutil.LocalListeningPortsAt(opt.ProcRoot)
+		})
+	registerFuncSource("conntrack", GetHostFlowsByConntrack)
+	autoSource.sources = []FlowSource{netlink, procfs}
+}
+
+// GetHostFlowsByNetlink gets host flows by Linux netlink API.
+func GetHostFlowsByNetlink(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	conns, err := netutil.NetlinkConnections(ctx)
 	if err != nil {
-		var netlinkErr *netutil.NetlinkError
-		if xerrors.As(err, &netlinkErr) {
-			// fallback to procfs
-			return GetHostFlowsByProcfs()
-		}
 		return nil, err
 	}
-	return flows, nil
+	return hostFlowsFromDiag(ctx, opt, conns, nil)
 }
 
-// GetHostFlowsByNetlink gets host flows by Linux netlink API.
-func GetHostFlowsByNetlink(opt *GetHostFlowsOption) (HostFlows, error) {
+// hostFlowsFromDiag builds host flows from the sockets dumped by netlink and
+// the sockets that have been closed.
+func hostFlowsFromDiag(ctx context.Context, opt *GetHostFlowsOption, conns, closed []*linux.InetDiagMsg) (HostFlows, error) {
 	var userEnts netutil.UserEnts
 	if opt.Processes {
-		var err error
-		userEnts, err = netutil.BuildUserEntries()
-		if err != nil {
+		var (
+			warnings []*netutil.ScanWarning
+			err      error
+		)
+		userEnts, warnings, err = netutil.BuildUserEntries(ctx)
+		// the processes inspected until the context is done are kept.
+		if err != nil && ctx.Err() == nil {
 			return nil, err
 		}
-	}
-	conns, err := netutil.NetlinkConnections()
-	if err != nil {
-		return nil, err
+		for _, w := range warnings {
+			opt.warn(newProcScanWarning(w))
+		}
 	}
 	lconns, err := netutil.NetlinkFilterByLocalListeningPorts(conns)
 	if err != nil {
 		return nil, err
 	}
 
-	ports := make([]string, 0, len(lconns))
+	ports := make(netutil.PortSet, len(lconns))
 	lportEnt := make(netutil.UserEntByLport, len(lconns))
 	for _, lconn := range lconns {
-		sport := fmt.Sprintf("%d", lconn.SrcPort())
-		ports = append(ports, sport)
+		sport := uint16(lconn.SrcPort())
+		ports.Add(sport)
 		if userEnts != nil {
 			lportEnt[sport] = userEnts[lconn.Inode]
 		}
 	}
 
 	flows := HostFlows{}
+	unattributed := 0
+	if len(closed) > 0 {
+		// A closed socket may remain in TIME-WAIT state with the same cookie.
+		cookies := make(map[[2]uint32]bool, len(conns))
+		for _, conn := range conns {
+			cookies[conn.ID.Cookie] = true
+		}
+		for _, conn := range closed {
+			if conn.DstPort() == 0 {
+				// closed before connected, such as listening sockets
+				continue
+			}
+			if cookies[conn.ID.Cookie] {
+				continue
+			}
+			cookies[conn.ID.Cookie] = true
+			conns = append(conns, conn)
+		}
+	}
 	for _, conn := range conns {
 		switch linux.TCPState(conn.State) {
 		case linux.TCP_LISTEN:
@@ -65,16 +96,9 @@ func GetHostFlowsByNetlink(opt *GetHostFlowsOption) (HostFlows, error) {
 			continue
 		}
 
-		switch opt.Filter {
-		case FilterAll:
-		case FilterPublic:
-			if netutil.IsPrivateIP(conn.DstIP()) {
-				continue
-			}
-		case FilterPrivate:
-			if !netutil.IsPrivateIP(conn.DstIP()) {
-				continue
-			}
+		src, dst := netutil.AddrFromIP(conn.SrcIP()), netutil.AddrFromIP(conn.DstIP())
+		if opt.excludes(dst) {
+			continue
 		}
 
 		var ent *netutil.UserEnt
@@ -83,16 +107,19 @@ func GetHostFlowsByNetlink(opt *GetHostFlowsOption) (HostFlows, error) {
 			ent = userEnts[conn.Inode]
 		}
 
-		lport, rport := fmt.Sprintf("%d", conn.SrcPort()), fmt.Sprintf("%d", conn.DstPort())
-		if contains(ports, lport) {
+		lport, rport := uint16(conn.SrcPort()), uint16(conn.DstPort())
+		if ports.Has(lport) {
 			// passive open
 			if ent == nil {
 				ent = lportEnt[lport]
 			}
+			if userEnts != nil && ent == nil {
+				unattributed++
+			}
 			hf := &HostFlow{
 				Direction: FlowPassive,
-				Local:     &AddrPort{Addr: conn.SrcIP().String(), Port: lport},
-				Peer:      &AddrPort{Addr: conn.DstIP().String(), Port: "many"},
+				Local:     NewAddrPort(src, lport),
+				Peer:      NewWildcardAddrPort(dst),
 			}
 			if ent != nil {
 				hf.Process = &Process{
@@ -100,13 +127,19 @@ func GetHostFlowsByNetlink(opt *GetHostFlowsOption) (HostFlows, error) {
 					Pgid: ent.Pgrp(),
 				}
 			}
-			flows.insert(hf)
+			if opt.Sockets {
+				hf.Sockets = []*Socket{newSocketFromDiag(conn, src, dst)}
+			}
+			flows.Insert(hf)
 		} else {
 			// active open
 			hf := &HostFlow{
 				Direction: FlowActive,
-				Local:     &AddrPort{Addr: conn.SrcIP().String(), Port: "many"},
-				Peer:      &AddrPort{Addr: conn.DstIP().String(), Port: rport},
+				Local:     NewWildcardAddrPort(src),
+				Peer:      NewAddrPort(dst, rport),
+			}
+			if userEnts != nil && ent == nil {
+				unattributed++
 			}
 			if ent != nil {
 				hf.Process = &Process{
@@ -114,29 +147,74 @@ func GetHostFlowsByNetlink(opt *GetHostFlowsOption) (HostFlows, error) {
 					Pgid: ent.Pgrp(),
 				}
 			}
-			flows.insert(hf)
+			if opt.Sockets {
+				hf.Sockets = []*Socket{newSocketFromDiag(conn, src, dst)}
+			}
+			flows.Insert(hf)
 		}
 	}
 
+	if unattributed > 0 {
+		opt.warn(newUnattributedWarning(unattributed))
+	}
+
 	if !opt.Numeric {
-		for _, flow := range flows {
-			flow.setLookupedName()
-		}
+		flows.resolveNames(ctx)
 	}
 	return flows, nil
 }
 
-// GetHostFlowsByProcfs gets host flows from procfs.
-func GetHostFlowsByProcfs() (HostFlows, error) {
-	conns, err := netutil.ProcfsConnections()
+func newSocketFromDiag(conn *linux.InetDiagMsg, src, dst netip.Addr) *Socket {
+	return &Socket{
+		Local: netip.AddrPortFrom(src, uint16(conn.SrcPort())),
+		Peer:  netip.AddrPortFrom(dst, uint16(conn.DstPort())),
+		State: linux.TCPState(conn.State).String(),
+		Inode: conn.Inode,
+		UID:   conn.UID,
+		Timer: newSocketTimer(conn.Timer, conn.Expires, conn.Retrans),
+	}
+}
+
+// GetHostFlowsByProcfs gets host flows from procfs under opt.ProcRoot.
+func GetHostFlowsByProcfs(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conns, err := netutil.ProcfsConnectionsAt(opt.ProcRoot)
 	if err != nil {
 		return nil, err
 	}
+	var userEnts netutil.UserEnts
+	if opt.Processes {
+		var warnings []*netutil.ScanWarning
+		userEnts, warnings, err = netutil.BuildUserEntriesAt(ctx, opt.ProcRoot)
+		// the processes inspected until the context is done are kept.
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			opt.warn(newProcScanWarning(w))
+		}
+	}
 	ports, err := netutil.FilterByLocalListeningPorts(conns)
 	if err != nil {
 		return nil, err
 	}
+	lportEnt := make(netutil.UserEntByLport, len(ports))
+	if userEnts != nil {
+		for _, conn := range conns {
+			if conn.Status != linux.TCP_LISTEN {
+				continue
+			}
+			lport := conn.Laddr.Port()
+			if ent, ok := userEnts[conn.Inode]; ok && ports.Has(lport) {
+				lportEnt[lport] = ent
+			}
+		}
+	}
+
 	flows := HostFlows{}
+	unattributed := 0
 	for _, conn := range conns {
 		switch conn.Status {
 		case linux.TCP_LISTEN:
@@ -147,21 +225,62 @@ func GetHostFlowsByProcfs() (HostFlows, error) {
 			continue
 		}
 
-		lport := fmt.Sprintf("%d", conn.Laddr.Port)
-		rport := fmt.Sprintf("%d", conn.Raddr.Port)
-		if contains(ports, lport) {
-			flows.insert(&HostFlow{
+		if opt.excludes(conn.Raddr.Addr()) {
+			continue
+		}
+
+		var ent *netutil.UserEnt
+		// inode 0 means that it provides no process information
+		if userEnts != nil && conn.Inode != 0 {
+			ent = userEnts[conn.Inode]
+		}
+
+		lport := conn.Laddr.Port()
+		var hf *HostFlow
+		if ports.Has(lport) {
+			if ent == nil {
+				ent = lportEnt[lport]
+			}
+			hf = &HostFlow{
 				Direction: FlowPassive,
-				Local:     &AddrPort{Addr: conn.Laddr.IP, Port: lport},
-				Peer:      &AddrPort{Addr: conn.Raddr.IP, Port: "many"},
-			})
+				Local:     NewAddrPort(conn.Laddr.Addr(), lport),
+				Peer:      NewWildcardAddrPort(conn.Raddr.Addr()),
+			}
 		} else {
-			flows.insert(&HostFlow{
+			hf = &HostFlow{
 				Direction: FlowActive,
-				Local:     &AddrPort{Addr: conn.Laddr.IP, Port: "many"},
-				Peer:      &AddrPort{Addr: conn.Raddr.IP, Port: rport},
-			})
+				Local:     NewWildcardAddrPort(conn.Laddr.Addr()),
+				Peer:      NewAddrPort(conn.Raddr.Addr(), conn.Raddr.Port()),
+			}
+		}
+		if userEnts != nil && ent == nil {
+			unattributed++
 		}
+		if ent != nil {
+			hf.Process = &Process{
+				Name: ent.Pname(),
+				Pgid: ent.Pgrp(),
+			}
+		}
+		if opt.Sockets {
+			hf.Sockets = []*Socket{{
+				Local: conn.Laddr,
+				Peer:  conn.Raddr,
+				State: conn.Status.String(),
+				Inode: conn.Inode,
+				UID:   conn.UID,
+				Timer: newSocketTimer(conn.Timer, conn.TimerExpires, conn.Retransmits),
+			}}
+		}
+		flows.Insert(hf)
+	}
+
+	if unattributed > 0 {
+		opt.warn(newUnattributedWarning(unattributed))
+	}
+
+	if !opt.Numeric {
+		flows.resolveNames(ctx)
 	}
 	return flows, nil
 }
@@ -0,0 +1,168 @@
+// +build linux
+
+package tcpflow
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/elastic/gosigar/sys/linux"
+)
+
+func newDiagMsg(state linux.TCPState, src string, sport int, dst string, dport int, cookie uint32) *linux.InetDiagMsg {
+	msg := &linux.InetDiagMsg{
+		Family: uint8(linux.AF_INET),
+		State:  uint8(state),
+	}
+	binary.BigEndian.PutUint16(msg.ID.SPort[:], uint16(sport))
+	binary.BigEndian.PutUint16(msg.ID.DPort[:], uint16(dport))
+	copy(msg.ID.Src[:], net.ParseIP(src).To4())
+	copy(msg.ID.Dst[:], net.ParseIP(dst).To4())
+	msg.ID.Cookie[0] = cookie
+	return msg
+}
+
+func TestHostFlowsFromDiag_closed(t *testing.T) {
+	conns := []*linux.InetDiagMsg{
+		newDiagMsg(linux.TCP_LISTEN, "0.0.0.0", 80, "0.0.0.0", 0, 1),
+		newDiagMsg(linux.TCP_ESTABLISHED, "10.0.1.9", 80, "10.0.2.13", 50001, 2),
+		newDiagMsg(linux.TCP_TIME_WAIT, "10.0.1.9", 40001, "10.0.1.10", 3306, 3),
+	}
+	closed := []*linux.InetDiagMsg{
+		// closed and remaining in TIME-WAIT
+		newDiagMsg(linux.TCP_CLOSE, "10.0.1.9", 40001, "10.0.1.10", 3306, 3),
+		newDiagMsg(linux.TCP_CLOSE, "10.0.1.9", 80, "10.0.2.13", 50002, 4),
+		newDiagMsg(linux.TCP_CLOSE, "10.0.1.9", 40002, "10.0.1.10", 3306, 5),
+		// listening socket
+		newDiagMsg(linux.TCP_CLOSE, "0.0.0.0", 8080, "0.0.0.0", 0, 6),
+	}
+
+	flows, err := hostFlowsFromDiag(context.Background(), &GetHostFlowsOption{Numeric: true, Filter: FilterAll}, conns, closed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(flows) != 2 {
+		t.Fatalf("flows should be len == 2, but %v", flows)
+	}
+	tests := []struct {
+		key         string
+		connections int64
+	}{
+		{"4-10.0.1.9:80-10.0.2.13:many", 2},
+		{"2-10.0.1.9:many-10.0.1.10:3306", 2},
+	}
+	for _, tt := range tests {
+		flow, ok := flows[tt.key]
+		if !ok {
+			t.Errorf("flows should contain %q, but %v", tt.key, flows)
+			continue
+		}
+		if flow.Connections != tt.connections {
+			t.Errorf("connections of %q should be %d, but %d", tt.key, tt.connections, flow.Connections)
+		}
+	}
+}
+
+func TestUnseenClosed(t *testing.T) {
+	present := map[[2]uint32]bool{}
+	for _, conn := range []*linux.InetDiagMsg{
+		newDiagMsg(linux.TCP_ESTABLISHED, "10.0.1.9", 80, "10.0.2.13", 50001, 2),
+		newDiagMsg(linux.TCP_ESTABLISHED, "10.0.1.9", 40001, "10.0.1.10", 3306, 3),
+	} {
+		present[conn.ID.Cookie] = true
+	}
+	closed := []*linux.InetDiagMsg{
+		// present at the previous call, and closed in this interval
+		newDiagMsg(linux.TCP_CLOSE, "10.0.1.9", 80, "10.0.2.13", 50001, 2),
+		// opened and closed in this interval
+		newDiagMsg(linux.TCP_CLOSE, "10.0.1.9", 80, "10.0.2.13", 50002, 4),
+	}
+
+	unseen := unseenClosed(closed, present)
+	if len(unseen) != 1 || unseen[0].ID.Cookie[0] != 4 {
+		t.Errorf("only the connection opened in this interval should be unseen, but %v", unseen)
+	}
+}
+
+func TestGetHostFlowsByProcfs_procRoot(t *testing.T) {
+	cur, _ := os.Getwd()
+	var warnings []*Warning
+	flows, err := GetHostFlowsByProcfs(context.Background(), &GetHostFlowsOption{
+		Numeric:   true,
+		Processes: true,
+		Filter:    FilterAll,
+		ProcRoot:  filepath.Join(cur, "../testdata/procsnapshot"),
+		OnWarning: func(w *Warning) { warnings = append(warnings, w) },
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	tests := []struct {
+		key         string
+		connections int64
+		process     string
+	}{
+		{"4-10.0.0.5:80-10.0.0.9:many", 2, "nginx"},
+		{"2-10.0.0.5:many-10.0.0.20:5432", 1, "app server"},
+		{"4-[2001:db8::1]:22-[2001:db8::9]:many", 1, "nginx"},
+	}
+	if len(flows) != len(tests) {
+		t.Errorf("flows should be len == %d, but %d", len(tests), len(flows))
+	}
+	for _, tt := range tests {
+		flow, ok := flows[tt.key]
+		if !ok {
+			t.Errorf("flow %s should be found in %v", tt.key, flows)
+			continue
+		}
+		if flow.Connections != tt.connections {
+			t.Errorf("flow %s should have %d connections, but %d", tt.key, tt.connections, flow.Connections)
+		}
+		if flow.Process == nil || flow.Process.Name != tt.process {
+			t.Errorf("flow %s should belong to %s, but %v", tt.key, tt.process, flow.Process)
+		}
+	}
+
+	// pid 300 has no stat file in the snapshot.
+	if len(warnings) != 1 || warnings[0].Kind != WarningProcScan {
+		t.Errorf("warnings should contain only the proc scan warning, but %v", warnings)
+	}
+}
+
+func TestGetHostFlowsByProcfs_sockets(t *testing.T) {
+	cur, _ := os.Getwd()
+	flows, err := GetHostFlowsByProcfs(context.Background(), &GetHostFlowsOption{
+		Numeric:  true,
+		Filter:   FilterAll,
+		Sockets:  true,
+		ProcRoot: filepath.Join(cur, "../testdata/procsnapshot"),
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	flow, ok := flows["4-10.0.0.5:80-10.0.0.9:many"]
+	if !ok {
+		t.Fatalf("flow should be found in %v", flows)
+	}
+	var got []string
+	for _, s := range flow.Sockets {
+		got = append(got, s.String())
+	}
+	sort.Strings(got)
+	want := []string{
+		"10.0.0.5:80\t-\t10.0.0.9:51000\tESTAB uid=0 inode=5002",
+		"10.0.0.5:80\t-\t10.0.0.9:51001\tTIME-WAIT uid=0 inode=0 timer=(timewait,30s,0)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sockets should be %q, but %q", want, got)
+	}
+}
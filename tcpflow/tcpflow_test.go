@@ -0,0 +1,222 @@
+package tcpflow
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+func TestAddrPort_JSON(t *testing.T) {
+	tests := []struct {
+		addr *AddrPort
+		json string
+		str  string
+	}{
+		{
+			addr: NewAddrPort(netip.MustParseAddr("10.0.1.9"), 80),
+			json: `{"name":"","addr":"10.0.1.9","port":"80"}`,
+			str:  "10.0.1.9:80",
+		},
+		{
+			addr: NewWildcardAddrPort(netip.MustParseAddr("2001:db8::1")),
+			json: `{"name":"","addr":"2001:db8::1","port":"many"}`,
+			str:  "[2001:db8::1]:many",
+		},
+		{
+			addr: &AddrPort{Name: "db01", Addr: netip.MustParseAddr("10.0.1.10"), Port: 3306},
+			json: `{"name":"db01","addr":"10.0.1.10","port":"3306"}`,
+			str:  "db01:3306",
+		},
+		{
+			addr: &AddrPort{Addr: netip.MustParseAddr("10.0.1.10"), Port: 3306, Network: "prod-db"},
+			json: `{"name":"","addr":"10.0.1.10","port":"3306","network":"prod-db"}`,
+			str:  "10.0.1.10:3306",
+		},
+		{
+			addr: &AddrPort{Name: "web", Wildcard: true},
+			json: `{"name":"web","addr":"","port":"many"}`,
+			str:  "web:many",
+		},
+	}
+	for _, tc := range tests {
+		b, err := json.Marshal(tc.addr)
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if string(b) != tc.json {
+			t.Errorf("json should be %s, but %s", tc.json, b)
+		}
+		if tc.addr.String() != tc.str {
+			t.Errorf("string should be %s, but %s", tc.str, tc.addr)
+		}
+
+		var got AddrPort
+		if err := json.Unmarshal([]byte(tc.json), &got); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if got != *tc.addr {
+			t.Errorf("unmarshaled should be %+v, but %+v", *tc.addr, got)
+		}
+	}
+}
+
+func TestAddrPort_UnmarshalJSON_invalid(t *testing.T) {
+	for _, in := range []string{
+		`{"addr":"10.0.1.9","port":"http"}`,
+		`{"addr":"10.0.1.9","port":"65536"}`,
+		`{"addr":"db01","port":"80"}`,
+	} {
+		var a AddrPort
+		if err := json.Unmarshal([]byte(in), &a); err == nil {
+			t.Errorf("%s: err should not be nil", in)
+		}
+	}
+}
+
+func TestNewAddrPort_unmap(t *testing.T) {
+	a := NewAddrPort(netip.MustParseAddr("::ffff:10.0.1.9"), 80)
+	if a.String() != "10.0.1.9:80" {
+		t.Errorf("IPv4-mapped address should be unmapped, but %s", a)
+	}
+}
+
+func TestGetHostFlowsOption_excludes(t *testing.T) {
+	catalog := netutil.NewCatalog([]*netutil.Network{
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Label: "prod-db"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Label: "internal"},
+	})
+	tests := []struct {
+		filter   string
+		peer     string
+		excluded bool
+	}{
+		{FilterAll, "10.0.1.10", false},
+		{FilterPublic, "100.64.0.1", true},
+		{FilterPublic, "8.8.8.8", false},
+		{FilterPrivate, "169.254.169.254", false},
+		{"prod-db", "10.0.1.10", false},
+		{"prod-db", "10.0.2.10", true},
+		{"internal", "10.0.1.10", true},
+		{"internal", "10.0.2.10", false},
+	}
+	for _, tt := range tests {
+		opt := &GetHostFlowsOption{Filter: tt.filter, Catalog: catalog}
+		if got := opt.excludes(netip.MustParseAddr(tt.peer)); got != tt.excluded {
+			t.Errorf("filter %q should exclude %s: %v", tt.filter, tt.peer, tt.excluded)
+		}
+	}
+	for filter, valid := range map[string]bool{
+		"prod-db":    true,
+		FilterPublic: true,
+		"unknown":    false,
+		FilterCloud:  false,
+	} {
+		opt := &GetHostFlowsOption{Filter: filter, Catalog: catalog}
+		if opt.ValidFilter() != valid {
+			t.Errorf("ValidFilter() of %q should be %v", filter, valid)
+		}
+	}
+}
+
+func TestHostFlows_Annotate(t *testing.T) {
+	catalog := netutil.NewCatalog([]*netutil.Network{
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Label: "prod-db"},
+	})
+	flow := &HostFlow{
+		Direction: FlowActive,
+		Local:     NewWildcardAddrPort(netip.MustParseAddr("10.0.2.9")),
+		Peer:      NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306),
+	}
+	flows := HostFlows{flow.UniqKey(): flow}
+	flows.Annotate(catalog)
+	if flow.Peer.Network != "prod-db" || flow.Local.Network != "" {
+		t.Errorf("only the peer should be annotated, but local %q, peer %q", flow.Local.Network, flow.Peer.Network)
+	}
+	if want := "10.0.2.9:many\t-->\t10.0.1.10:3306\t0\t(network=prod-db)"; flow.String() != want {
+		t.Errorf("string should be %q, but %q", want, flow)
+	}
+}
+
+func TestGetHostFlowsOption_excludes_cloud(t *testing.T) {
+	ranges := netutil.NewCloudRanges()
+	ranges.Add(netip.MustParsePrefix("52.94.0.0/22"), &netutil.Cloud{Provider: "aws", Region: "us-east-1", Service: "DYNAMODB"})
+	ranges.Add(netip.MustParsePrefix("34.80.0.0/15"), &netutil.Cloud{Provider: "gcp", Region: "asia-east1", Service: "Google Cloud"})
+	tests := []struct {
+		filter   string
+		peer     string
+		excluded bool
+	}{
+		{FilterCloud, "52.94.0.1", false},
+		{FilterCloud, "8.8.8.8", true},
+		{"cloud:aws", "52.94.0.1", false},
+		{"cloud:aws", "34.80.0.1", true},
+		{"cloud:AWS/us-east-1", "52.94.0.1", false},
+		{"cloud:aws/us-west-2", "52.94.0.1", true},
+		{"cloud:*/*/dynamodb", "52.94.0.1", false},
+		{"cloud://Google Cloud", "34.80.0.1", false},
+		{"cloud://Google Cloud", "52.94.0.1", true},
+	}
+	for _, tt := range tests {
+		opt := &GetHostFlowsOption{Filter: tt.filter, CloudRanges: ranges}
+		if !opt.ValidFilter() {
+			t.Errorf("filter %q should be valid with the cloud ranges", tt.filter)
+		}
+		if got := opt.excludes(netip.MustParseAddr(tt.peer)); got != tt.excluded {
+			t.Errorf("filter %q should exclude %s: %v", tt.filter, tt.peer, tt.excluded)
+		}
+	}
+}
+
+func TestHostFlows_AnnotateCloud(t *testing.T) {
+	ranges := netutil.NewCloudRanges()
+	ranges.Add(netip.MustParsePrefix("52.94.0.0/22"), &netutil.Cloud{Provider: "aws", Region: "us-east-1", Service: "DYNAMODB"})
+	flow := &HostFlow{
+		Direction: FlowActive,
+		Local:     NewWildcardAddrPort(netip.MustParseAddr("10.0.2.9")),
+		Peer:      NewAddrPort(netip.MustParseAddr("52.94.0.10"), 443),
+	}
+	flows := HostFlows{flow.UniqKey(): flow}
+	flows.AnnotateCloud(ranges)
+	if want := "10.0.2.9:many\t-->\t52.94.0.10:443\t0\t(cloud=aws/us-east-1/DYNAMODB)"; flow.String() != want {
+		t.Errorf("string should be %q, but %q", want, flow)
+	}
+	b, err := json.Marshal(flow.Peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"","addr":"52.94.0.10","port":"443","cloud":{"provider":"aws","region":"us-east-1","service":"DYNAMODB"}}`; string(b) != want {
+		t.Errorf("json should be %s, but %s", want, b)
+	}
+}
+
+func TestHostFlows_Sorted(t *testing.T) {
+	local := netip.MustParseAddr("10.0.1.9")
+	flows := HostFlows{}
+	for _, f := range []*HostFlow{
+		{Direction: FlowPassive, Local: NewAddrPort(local, 443), Peer: NewWildcardAddrPort(netip.MustParseAddr("10.0.2.1"))},
+		{Direction: FlowPassive, Local: NewAddrPort(local, 80), Peer: NewWildcardAddrPort(netip.MustParseAddr("10.0.2.1"))},
+		{Direction: FlowActive, Local: NewWildcardAddrPort(local), Peer: NewAddrPort(netip.MustParseAddr("10.0.1.10"), 3306)},
+		{Direction: FlowActive, Local: NewWildcardAddrPort(local), Peer: NewAddrPort(netip.MustParseAddr("9.9.9.9"), 443)},
+		{Direction: FlowActive, Local: NewWildcardAddrPort(local), Peer: NewAddrPort(netip.MustParseAddr("9.9.9.9"), 80)},
+	} {
+		flows.Insert(f)
+	}
+	want := []string{
+		"10.0.1.9:many\t-->\t9.9.9.9:80\t1",
+		"10.0.1.9:many\t-->\t9.9.9.9:443\t1",
+		"10.0.1.9:many\t-->\t10.0.1.10:3306\t1",
+		"10.0.1.9:80\t<--\t10.0.2.1:many\t1",
+		"10.0.1.9:443\t<--\t10.0.2.1:many\t1",
+	}
+	got := flows.Sorted()
+	if len(got) != len(want) {
+		t.Fatalf("len should be %d, got %d", len(want), len(got))
+	}
+	for i, f := range got {
+		if f.String() != want[i] {
+			t.Errorf("flows[%d] should be %q, got %q", i, want[i], f.String())
+		}
+	}
+}
@@ -3,18 +3,27 @@
 package tcpflow
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"net/netip"
+	"syscall"
 
 	gnet "github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
 	"github.com/yuuki/lstf/netutil"
 	"golang.org/x/xerrors"
 )
 
-// GetHostFlows gets host flows.
-// TODO: implement processes option
-func GetHostFlows(opt *GetHostFlowsOption) (HostFlows, error) {
-	conns, err := gnet.Connections("tcp")
+func init() {
+	gopsutil := registerListenerSource("gopsutil", GetHostFlowsByGopsutil,
+		func(ctx context.Context, opt *GetHostFlowsOption) (netutil.PortSet, error) {
+			return netutil.LocalListeningPorts()
+		})
+	autoSource.sources = []FlowSource{gopsutil}
+}
+
+// GetHostFlowsByGopsutil gets host flows by gopsutil.
+func GetHostFlowsByGopsutil(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	conns, err := gnet.ConnectionsWithContext(ctx, "tcp")
 	if err != nil {
 		return nil, xerrors.Errorf("gopsutil/net.Connections(): %v", err)
 	}
@@ -23,43 +32,133 @@ func GetHostFlows(opt *GetHostFlowsOption) (HostFlows, error) {
 		return nil, err
 	}
 	flows := HostFlows{}
+	procs := map[int32]*Process{}
 	for _, conn := range conns {
 		if conn.Status == "LISTEN" {
 			continue
 		}
 
-		switch opt.Filter {
-		case FilterAll:
-		case FilterPublic:
-			if netutil.IsPrivateIP(net.ParseIP(conn.Raddr.IP)) {
-				continue
-			}
-		case FilterPrivate:
-			if !netutil.IsPrivateIP(net.ParseIP(conn.Raddr.IP)) {
-				continue
-			}
+		laddr, err := netip.ParseAddr(conn.Laddr.IP)
+		if err != nil {
+			continue
+		}
+		raddr, err := netip.ParseAddr(conn.Raddr.IP)
+		if err != nil {
+			continue
+		}
+		if opt.excludes(raddr) {
+			continue
 		}
 
-		lport := fmt.Sprintf("%d", conn.Laddr.Port)
-		rport := fmt.Sprintf("%d", conn.Raddr.Port)
-		if contains(ports, lport) {
-			flows.insert(&HostFlow{
+		lport, rport := uint16(conn.Laddr.Port), uint16(conn.Raddr.Port)
+		var hf *HostFlow
+		if ports.Has(lport) {
+			hf = &HostFlow{
 				Direction: FlowPassive,
-				Local:     &AddrPort{Addr: conn.Laddr.IP, Port: lport},
-				Peer:      &AddrPort{Addr: conn.Raddr.IP, Port: "many"},
-			})
+				Local:     NewAddrPort(laddr, lport),
+				Peer:      NewWildcardAddrPort(raddr),
+			}
 		} else {
-			flows.insert(&HostFlow{
+			hf = &HostFlow{
 				Direction: FlowActive,
-				Local:     &AddrPort{Addr: conn.Laddr.IP, Port: "many"},
-				Peer:      &AddrPort{Addr: conn.Raddr.IP, Port: rport},
-			})
+				Local:     NewWildcardAddrPort(laddr),
+				Peer:      NewAddrPort(raddr, rport),
+			}
+		}
+		if opt.Processes && conn.Pid > 0 {
+			proc, ok := procs[conn.Pid]
+			if !ok {
+				proc = gopsutilProcess(ctx, conn.Pid, opt)
+				procs[conn.Pid] = proc
+			}
+			hf.Process = proc
+		}
+		if opt.Sockets {
+			hf.Sockets = []*Socket{{
+				Local: netip.AddrPortFrom(laddr, lport),
+				Peer:  netip.AddrPortFrom(raddr, rport),
+				State: gopsutilState(conn.Status),
+			}}
+			if len(conn.Uids) > 0 {
+				hf.Sockets[0].UID = uint32(conn.Uids[0])
+			}
 		}
+		flows.Insert(hf)
 	}
 	if !opt.Numeric {
-		for _, flow := range flows {
-			flow.setLookupedName()
-		}
+		flows.resolveNames(ctx)
 	}
 	return flows, nil
 }
+
+// gopsutilProcess returns the process of the pid, or nil with a warning if it
+// could not be inspected, such as the process of another user.
+func gopsutilProcess(ctx context.Context, pid int32, opt *GetHostFlowsOption) *Process {
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		opt.warn(newProcScanWarning(&netutil.ScanWarning{Pid: int(pid), Err: err}))
+		return nil
+	}
+	name, err := proc.NameWithContext(ctx)
+	if err != nil {
+		opt.warn(newProcScanWarning(&netutil.ScanWarning{Pid: int(pid), Err: err}))
+		return nil
+	}
+	pgid, err := syscall.Getpgid(int(pid))
+	if err != nil {
+		pgid = int(pid)
+	}
+	return &Process{Name: name, Pgid: pgid}
+}
+
+// gopsutilStates maps the states of gopsutil into the names of the states on Linux.
+var gopsutilStates = map[string]string{
+	"ESTABLISHED": "ESTAB",
+	"SYN_SENT":    "SYN-SENT",
+	"SYN_RECV":    "SYN-RECV",
+	"FIN_WAIT1":   "FIN-WAIT-1",
+	"FIN_WAIT_1":  "FIN-WAIT-1",
+	"FIN_WAIT2":   "FIN-WAIT-2",
+	"FIN_WAIT_2":  "FIN-WAIT-2",
+	"TIME_WAIT":   "TIME-WAIT",
+	"CLOSE":       "UNCONN",
+	"CLOSE_WAIT":  "CLOSE-WAIT",
+	"LAST_ACK":    "LAST-ACK",
+	"LISTEN":      "LISTEN",
+	"CLOSING":     "CLOSING",
+}
+
+func gopsutilState(status string) string {
+	if state, ok := gopsutilStates[status]; ok {
+		return state
+	}
+	return status
+}
+
+// TraceHostFlows is not supported on this platform.
+func TraceHostFlows(opt *GetHostFlowsOption, done <-chan struct{}) (HostFlows, error) {
+	return nil, xerrors.New("tracing is supported only on Linux")
+}
+
+// Watcher is not supported on this platform.
+type Watcher struct{}
+
+// NewWatcher is not supported on this platform.
+func NewWatcher() (*Watcher, error) {
+	return nil, xerrors.New("socket destroy notifications are supported only on Linux")
+}
+
+// GetHostFlows is not supported on this platform.
+func (w *Watcher) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	return nil, xerrors.New("socket destroy notifications are supported only on Linux")
+}
+
+// Close is not supported on this platform.
+func (w *Watcher) Close() error {
+	return nil
+}
+
+// GetHostFlowsByConntrack is not supported on this platform.
+func GetHostFlowsByConntrack(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	return nil, xerrors.New("conntrack is supported only on Linux")
+}
@@ -0,0 +1,35 @@
+// +build darwin freebsd
+
+package tcpflow
+
+import (
+	"context"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestGopsutilProcess(t *testing.T) {
+	var warnings []*Warning
+	opt := &GetHostFlowsOption{
+		OnWarning: func(w *Warning) {
+			warnings = append(warnings, w)
+		},
+	}
+
+	proc := gopsutilProcess(context.Background(), int32(os.Getpid()), opt)
+	if proc == nil {
+		t.Fatalf("the process of the test should be inspected, got warnings %v", warnings)
+	}
+	if proc.Name == "" || proc.Pgid != syscall.Getpgrp() {
+		t.Errorf("the process should have the name and the pgid %d, got %+v", syscall.Getpgrp(), proc)
+	}
+
+	if proc := gopsutilProcess(context.Background(), math.MaxInt32, opt); proc != nil {
+		t.Errorf("the process of the nonexistent pid should be nil, got %+v", proc)
+	}
+	if len(warnings) != 1 || warnings[0].Kind != WarningProcScan {
+		t.Errorf("the nonexistent pid should be warned as %s, got %v", WarningProcScan, warnings)
+	}
+}
@@ -0,0 +1,178 @@
+// +build linux
+
+package tcpflow
+
+import (
+	"context"
+
+	"github.com/elastic/gosigar/sys/linux"
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+// traceAggregator aggregates TCP events into host flows.
+type traceAggregator struct {
+	opt   *GetHostFlowsOption
+	flows HostFlows
+	ports netutil.PortSet
+
+	// connecting holds the pid which called connect(2) for each socket.
+	connecting map[uint64]int
+	// opened holds the sockets whose open has been counted.
+	opened map[uint64]bool
+
+	lportEnt netutil.UserEntByLport
+	pidEnt   map[int]*netutil.UserEnt
+}
+
+// TraceHostFlows gets host flows from the TCP events traced by eBPF until done is closed.
+// Unlike GetHostFlows, it catches short-lived connections, which open and close
+// between snapshots. Connections that are opened or closed while tracing are counted.
+func TraceHostFlows(opt *GetHostFlowsOption, done <-chan struct{}) (HostFlows, error) {
+	// the snapshot before tracing and the name lookups after tracing are not interrupted by done.
+	ctx := context.Background()
+	conns, err := netutil.NetlinkConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lconns, err := netutil.NetlinkFilterByLocalListeningPorts(conns)
+	if err != nil {
+		return nil, err
+	}
+
+	agg := &traceAggregator{
+		opt:        opt,
+		flows:      HostFlows{},
+		ports:      make(netutil.PortSet, len(lconns)),
+		connecting: map[uint64]int{},
+		opened:     map[uint64]bool{},
+		lportEnt:   netutil.UserEntByLport{},
+		pidEnt:     map[int]*netutil.UserEnt{},
+	}
+	var userEnts netutil.UserEnts
+	if opt.Processes {
+		var warnings []*netutil.ScanWarning
+		userEnts, warnings, err = netutil.BuildUserEntries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			opt.warn(newProcScanWarning(w))
+		}
+	}
+	for _, lconn := range lconns {
+		sport := uint16(lconn.SrcPort())
+		agg.ports.Add(sport)
+		if userEnts != nil {
+			agg.lportEnt[sport] = userEnts[lconn.Inode]
+		}
+	}
+
+	tracer, err := netutil.NewTCPTracer()
+	if err != nil {
+		return nil, xerrors.Errorf("could not start tracing: %w", err)
+	}
+	defer tracer.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			tracer.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		ev, err := tracer.Read()
+		if err != nil {
+			if xerrors.Is(err, netutil.ErrTracerClosed) {
+				break
+			}
+			return nil, err
+		}
+		agg.add(ev)
+	}
+
+	if lost := tracer.Lost(); lost > 0 {
+		opt.warn(newLostEventsWarning(lost))
+	}
+
+	if !opt.Numeric {
+		agg.flows.resolveNames(ctx)
+	}
+	agg.flows.setSource("ebpf")
+	return agg.flows, nil
+}
+
+func (a *traceAggregator) add(ev *netutil.TCPEvent) {
+	switch {
+	case ev.OldState == linux.TCP_CLOSE && ev.NewState == linux.TCP_SYN_SENT:
+		// connect(2) runs in the context of the calling process.
+		a.connecting[ev.Sock] = ev.Pid
+	case ev.OldState == linux.TCP_SYN_SENT && ev.NewState == linux.TCP_ESTABLISHED:
+		a.opened[ev.Sock] = true
+		a.insert(ev, FlowActive, a.connectingEnt(ev.Sock))
+	case ev.OldState == linux.TCP_SYN_RECV && ev.NewState == linux.TCP_ESTABLISHED:
+		a.opened[ev.Sock] = true
+		a.insert(ev, FlowPassive, a.lportEnt[ev.SrcPort])
+	case ev.NewState == linux.TCP_CLOSE:
+		switch ev.OldState {
+		case linux.TCP_SYN_SENT, linux.TCP_SYN_RECV, linux.TCP_LISTEN:
+			// not established
+		default:
+			if !a.opened[ev.Sock] {
+				// the connection has been opened before tracing.
+				if a.ports.Has(ev.SrcPort) {
+					a.insert(ev, FlowPassive, a.lportEnt[ev.SrcPort])
+				} else {
+					a.insert(ev, FlowActive, nil)
+				}
+			}
+		}
+		delete(a.connecting, ev.Sock)
+		delete(a.opened, ev.Sock)
+	}
+}
+
+func (a *traceAggregator) connectingEnt(sock uint64) *netutil.UserEnt {
+	pid, ok := a.connecting[sock]
+	if !ok || !a.opt.Processes {
+		return nil
+	}
+	if ent, ok := a.pidEnt[pid]; ok {
+		return ent
+	}
+	ent, err := netutil.LookupUserEnt(pid)
+	if err != nil {
+		// the process may have already exited.
+		ent = nil
+	}
+	a.pidEnt[pid] = ent
+	return ent
+}
+
+func (a *traceAggregator) insert(ev *netutil.TCPEvent, direction FlowDirection, ent *netutil.UserEnt) {
+	if a.opt.excludes(ev.DstIP) {
+		return
+	}
+
+	hf := &HostFlow{Direction: direction}
+	switch direction {
+	case FlowPassive:
+		hf.Local = NewAddrPort(ev.SrcIP, ev.SrcPort)
+		hf.Peer = NewWildcardAddrPort(ev.DstIP)
+	case FlowActive:
+		hf.Local = NewWildcardAddrPort(ev.SrcIP)
+		hf.Peer = NewAddrPort(ev.DstIP, ev.DstPort)
+	}
+	if ent != nil {
+		hf.Process = &Process{
+			Name: ent.Pname(),
+			Pgid: ent.Pgrp(),
+		}
+	}
+	a.flows.Insert(hf)
+}
@@ -0,0 +1,121 @@
+// +build linux
+
+package tcpflow
+
+import (
+	"context"
+	"sync"
+
+	"github.com/elastic/gosigar/sys/linux"
+	"golang.org/x/xerrors"
+
+	"github.com/yuuki/lstf/netutil"
+)
+
+// Watcher gets host flows with the connections that have been closed since the
+// previous call, which it learns from socket destroy notifications. The number
+// of connections of each flow is the number of connections seen during the
+// interval rather than the number of connections present. Each connection is
+// counted once in the interval where it is seen first.
+type Watcher struct {
+	monitor *netutil.SockDestroyMonitor
+	// present is the cookies of the connections present at the previous call.
+	present map[[2]uint32]bool
+
+	mu     sync.Mutex
+	closed []*linux.InetDiagMsg
+	lost   int
+	err    error
+	done   chan struct{}
+}
+
+// NewWatcher starts receiving socket destroy notifications.
+// It requires CAP_NET_ADMIN.
+func NewWatcher() (*Watcher, error) {
+	monitor, err := netutil.NewSockDestroyMonitor()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		monitor: monitor,
+		done:    make(chan struct{}),
+	}
+	go w.receive()
+	return w, nil
+}
+
+func (w *Watcher) receive() {
+	defer close(w.done)
+	for {
+		msgs, err := w.monitor.Read()
+		w.mu.Lock()
+		switch {
+		case err == nil:
+			w.closed = append(w.closed, msgs...)
+		case xerrors.Is(err, netutil.ErrNotificationsLost):
+			w.lost++
+		case xerrors.Is(err, netutil.ErrMonitorClosed):
+			w.mu.Unlock()
+			return
+		default:
+			w.err = err
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+	}
+}
+
+// GetHostFlows gets the host flows present now and those closed since the previous call.
+func (w *Watcher) GetHostFlows(ctx context.Context, opt *GetHostFlowsOption) (HostFlows, error) {
+	conns, err := netutil.NetlinkConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	closed, lost, werr := w.closed, w.lost, w.err
+	w.closed, w.lost = nil, 0
+	w.mu.Unlock()
+
+	if werr != nil {
+		return nil, werr
+	}
+	if lost > 0 {
+		opt.warn(&Warning{
+			Kind:    WarningLostEvents,
+			Message: "some closed connections have been lost because the receive buffer overflowed",
+		})
+	}
+	closed = unseenClosed(closed, w.present)
+	w.present = make(map[[2]uint32]bool, len(conns))
+	for _, conn := range conns {
+		w.present[conn.ID.Cookie] = true
+	}
+	flows, err := hostFlowsFromDiag(ctx, opt, conns, closed)
+	if err != nil {
+		return nil, err
+	}
+	opt.warnPartial(ctx)
+	flows.setSource("netlink")
+	return flows, nil
+}
+
+// unseenClosed returns the closed connections except those present at the previous
+// call, which have been counted in the previous interval.
+func unseenClosed(closed []*linux.InetDiagMsg, present map[[2]uint32]bool) []*linux.InetDiagMsg {
+	unseen := make([]*linux.InetDiagMsg, 0, len(closed))
+	for _, conn := range closed {
+		if !present[conn.ID.Cookie] {
+			unseen = append(unseen, conn)
+		}
+	}
+	return unseen
+}
+
+// Close stops receiving the notifications.
+func (w *Watcher) Close() error {
+	err := w.monitor.Close()
+	<-w.done
+	return err
+}
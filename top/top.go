@@ -0,0 +1,506 @@
+// Package top implements the interactive terminal UI of 'lstf top'.
+// Model holds the state of the screen, and is rendered as ANSI escape sequences.
+package top
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+// Column is a column of the flow table.
+type Column int
+
+// Columns of the flow table in the order of display.
+const (
+	ColumnLocal Column = iota
+	ColumnPeer
+	ColumnConnections
+	ColumnProcess
+)
+
+var columnNames = []string{"local", "peer", "connections", "process"}
+
+func (c Column) String() string {
+	return columnNames[c]
+}
+
+// Action is what the caller should do after a key is handled.
+type Action int
+
+// Actions returned by Model.HandleKey.
+const (
+	// ActionRedraw redraws the screen.
+	ActionRedraw Action = iota
+	// ActionRefresh collects host flows again with the changed options, and redraws the screen.
+	ActionRefresh
+	// ActionQuit quits the UI.
+	ActionQuit
+)
+
+// ANSI escape sequences.
+const (
+	escReset   = "\x1b[0m"
+	escBold    = "\x1b[1m"
+	escReverse = "\x1b[7m"
+	escChanged = "\x1b[1;33m"
+	escHome    = "\x1b[H"
+	escClearEL = "\x1b[K"
+	escClearED = "\x1b[J"
+)
+
+// Model is the state of the UI.
+type Model struct {
+	// Numeric shows addresses instead of host names.
+	Numeric bool
+	// Processes shows the processes using the sockets.
+	Processes bool
+
+	sortBy  Column
+	reverse bool
+
+	filter  string
+	editing bool
+	input   string
+
+	flows     tcpflow.HostFlows
+	prev      map[string]int64
+	deltas    map[string]int64
+	added     map[string]bool
+	expanded  map[string]bool
+	updatedAt time.Time
+	err       error
+
+	rows   []*tcpflow.HostFlow // flows filtered and sorted
+	cursor int                 // index of rows
+	offset int                 // first line displayed
+}
+
+// NewModel creates Model sorted by the number of connections.
+func NewModel(numeric, processes bool) *Model {
+	return &Model{
+		Numeric:   numeric,
+		Processes: processes,
+		sortBy:    ColumnConnections,
+		reverse:   true,
+		expanded:  map[string]bool{},
+	}
+}
+
+// Update replaces the flows with the flows collected at 'at'. The flows whose numbers of
+// connections changed since the last update are highlighted. If err is not nil,
+// the last flows are kept and the error is shown.
+func (m *Model) Update(flows tcpflow.HostFlows, at time.Time, err error) {
+	m.err = err
+	if err != nil {
+		return
+	}
+	var selected string
+	if m.cursor < len(m.rows) {
+		selected = m.rows[m.cursor].UniqKey()
+	}
+
+	counts := make(map[string]int64, len(flows))
+	m.deltas = map[string]int64{}
+	m.added = map[string]bool{}
+	for key, flow := range flows {
+		counts[key] = flow.Connections
+		if m.prev == nil {
+			continue
+		}
+		prev, ok := m.prev[key]
+		switch {
+		case !ok:
+			m.added[key] = true
+		case prev != flow.Connections:
+			m.deltas[key] = flow.Connections - prev
+		}
+	}
+	m.prev = counts
+	m.flows = flows
+	m.updatedAt = at
+	m.layout()
+
+	// keep the cursor on the selected flow.
+	for i, flow := range m.rows {
+		if flow.UniqKey() == selected {
+			m.cursor = i
+		}
+	}
+}
+
+// layout filters and sorts the flows into rows.
+func (m *Model) layout() {
+	m.rows = m.rows[:0]
+	filter := strings.ToLower(m.filter)
+	for _, flow := range m.flows {
+		if filter != "" && !strings.Contains(strings.ToLower(m.rowText(flow)), filter) {
+			continue
+		}
+		m.rows = append(m.rows, flow)
+	}
+	sort.SliceStable(m.rows, func(i, j int) bool {
+		a, b := m.rows[i], m.rows[j]
+		if c := m.compare(a, b); c != 0 {
+			return (c < 0) != m.reverse
+		}
+		return a.UniqKey() < b.UniqKey()
+	})
+	if m.cursor >= len(m.rows) {
+		m.cursor = len(m.rows) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+}
+
+func (m *Model) compare(a, b *tcpflow.HostFlow) int {
+	switch m.sortBy {
+	case ColumnLocal:
+		return strings.Compare(m.addr(a.Local), m.addr(b.Local))
+	case ColumnPeer:
+		return strings.Compare(m.addr(a.Peer), m.addr(b.Peer))
+	case ColumnConnections:
+		switch {
+		case a.Connections < b.Connections:
+			return -1
+		case a.Connections > b.Connections:
+			return 1
+		}
+		return 0
+	case ColumnProcess:
+		return strings.Compare(processName(a), processName(b))
+	}
+	return 0
+}
+
+func (m *Model) addr(a *tcpflow.AddrPort) string {
+	if m.Numeric || a.Name == "" {
+		return a.Addr.String() + ":" + a.PortString()
+	}
+	return a.Name + ":" + a.PortString()
+}
+
+func processName(f *tcpflow.HostFlow) string {
+	if f.Process == nil {
+		return ""
+	}
+	return f.Process.Name
+}
+
+// rowText returns the text of the flow matched with the filter.
+func (m *Model) rowText(f *tcpflow.HostFlow) string {
+	text := m.addr(f.Local) + " " + m.addr(f.Peer)
+	if m.Processes {
+		text += " " + processName(f)
+	}
+	return text
+}
+
+// Key is a key pressed.
+type Key struct {
+	// Rune is the character, or 0 for the special keys.
+	Rune    rune
+	Special SpecialKey
+}
+
+// SpecialKey is a key without character.
+type SpecialKey int
+
+// Special keys.
+const (
+	KeyNone SpecialKey = iota
+	KeyUp
+	KeyDown
+	KeyPageUp
+	KeyPageDown
+	KeyEnter
+	KeyEscape
+	KeyBackspace
+	KeyCtrlC
+)
+
+// ParseKeys parses the bytes read from the terminal in raw mode into keys.
+func ParseKeys(b []byte) []Key {
+	var keys []Key
+	for len(b) > 0 {
+		switch {
+		case strings.HasPrefix(string(b), "\x1b[A"), strings.HasPrefix(string(b), "\x1bOA"):
+			keys, b = append(keys, Key{Special: KeyUp}), b[3:]
+		case strings.HasPrefix(string(b), "\x1b[B"), strings.HasPrefix(string(b), "\x1bOB"):
+			keys, b = append(keys, Key{Special: KeyDown}), b[3:]
+		case strings.HasPrefix(string(b), "\x1b[5~"):
+			keys, b = append(keys, Key{Special: KeyPageUp}), b[4:]
+		case strings.HasPrefix(string(b), "\x1b[6~"):
+			keys, b = append(keys, Key{Special: KeyPageDown}), b[4:]
+		case strings.HasPrefix(string(b), "\x1b["), strings.HasPrefix(string(b), "\x1bO"):
+			// skip an unknown sequence up to its final byte.
+			i := 2
+			for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+				i++
+			}
+			if i < len(b) {
+				i++
+			}
+			b = b[i:]
+		default:
+			r := rune(b[0])
+			b = b[1:]
+			switch r {
+			case '\r', '\n':
+				keys = append(keys, Key{Special: KeyEnter})
+			case 0x1b:
+				keys = append(keys, Key{Special: KeyEscape})
+			case 0x7f, 0x08:
+				keys = append(keys, Key{Special: KeyBackspace})
+			case 0x03:
+				keys = append(keys, Key{Special: KeyCtrlC})
+			default:
+				if r >= 0x20 && r < 0x7f {
+					keys = append(keys, Key{Rune: r})
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// HandleKey changes the state by the key.
+func (m *Model) HandleKey(k Key) Action {
+	if k.Special == KeyCtrlC {
+		return ActionQuit
+	}
+	if m.editing {
+		switch k.Special {
+		case KeyEnter:
+			m.editing = false
+			m.filter = m.input
+		case KeyEscape:
+			m.editing = false
+		case KeyBackspace:
+			if len(m.input) > 0 {
+				m.input = m.input[:len(m.input)-1]
+			}
+		case KeyNone:
+			m.input += string(k.Rune)
+		}
+		m.layout()
+		return ActionRedraw
+	}
+
+	switch k.Special {
+	case KeyUp:
+		m.move(-1)
+	case KeyDown:
+		m.move(1)
+	case KeyPageUp:
+		m.move(-10)
+	case KeyPageDown:
+		m.move(10)
+	case KeyEnter:
+		if m.cursor < len(m.rows) {
+			key := m.rows[m.cursor].UniqKey()
+			m.expanded[key] = !m.expanded[key]
+		}
+	case KeyEscape:
+		m.filter = ""
+		m.layout()
+	}
+
+	switch k.Rune {
+	case 'q':
+		return ActionQuit
+	case 'k':
+		m.move(-1)
+	case 'j':
+		m.move(1)
+	case ' ':
+		return m.HandleKey(Key{Special: KeyEnter})
+	case 's', '>':
+		m.sortBy = (m.sortBy + 1) % Column(len(columnNames))
+		m.layout()
+	case '<':
+		m.sortBy = (m.sortBy + Column(len(columnNames)) - 1) % Column(len(columnNames))
+		m.layout()
+	case '1', '2', '3', '4':
+		m.sortBy = Column(k.Rune - '1')
+		m.layout()
+	case 'r':
+		m.reverse = !m.reverse
+		m.layout()
+	case '/':
+		m.editing = true
+		m.input = m.filter
+	case 'n':
+		m.Numeric = !m.Numeric
+		m.layout()
+		if !m.Numeric {
+			return ActionRefresh // resolve the names
+		}
+	case 'p':
+		m.Processes = !m.Processes
+		m.layout()
+		if m.Processes {
+			return ActionRefresh // collect the processes
+		}
+	}
+	return ActionRedraw
+}
+
+func (m *Model) move(n int) {
+	m.cursor += n
+	if m.cursor >= len(m.rows) {
+		m.cursor = len(m.rows) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+}
+
+// line is a line of the table with its style.
+type line struct {
+	text  string
+	style string
+}
+
+// Render draws the screen of the size into w.
+func (m *Model) Render(w io.Writer, width, height int) {
+	var b strings.Builder
+	b.WriteString(escHome)
+	put := func(text, style string) {
+		if width > 0 && len(text) > width {
+			text = text[:width]
+		}
+		if style != "" {
+			text = style + text + escReset
+		}
+		b.WriteString(text + escClearEL + "\r\n")
+	}
+
+	order := "asc"
+	if m.reverse {
+		order = "desc"
+	}
+	updated := "-"
+	if !m.updatedAt.IsZero() {
+		updated = m.updatedAt.Format("15:04:05")
+	}
+	put(fmt.Sprintf("lstf top - %s  flows: %d/%d  sort: %s (%s)  numeric: %s  processes: %s",
+		updated, len(m.rows), len(m.flows), m.sortBy, order, onOff(m.Numeric), onOff(m.Processes)), escBold)
+	switch {
+	case m.editing:
+		put("filter: "+m.input+"_", "")
+	case m.err != nil:
+		put("error: "+m.err.Error(), escChanged)
+	case m.filter != "":
+		put("filter: "+m.filter+"  (esc to clear)", "")
+	default:
+		put("", "")
+	}
+
+	lines, cursorLine := m.tableLines()
+	// the header, the status, the table header and the help.
+	body := height - 4
+	if body < 1 {
+		body = 1
+	}
+	if cursorLine < m.offset {
+		m.offset = cursorLine
+	}
+	if cursorLine >= m.offset+body {
+		m.offset = cursorLine - body + 1
+	}
+	if m.offset > len(lines)-body {
+		m.offset = len(lines) - body
+	}
+	if m.offset < 0 {
+		m.offset = 0
+	}
+
+	put(m.tableHeader(), escReverse)
+	for i := m.offset; i < len(lines) && i < m.offset+body; i++ {
+		put(lines[i].text, lines[i].style)
+	}
+	for i := len(lines) - m.offset; i < body; i++ {
+		put("", "")
+	}
+	b.WriteString(escClearED)
+	b.WriteString("q:quit  up/down:move  enter:expand  s/1-4:sort  r:reverse  /:filter  n:numeric  p:processes")
+	io.WriteString(w, b.String())
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// widths of the columns except the last one.
+const (
+	widthAddr        = 30
+	widthArrow       = 5
+	widthConnections = 12
+)
+
+func (m *Model) tableHeader() string {
+	h := fmt.Sprintf("%-*s%-*s%-*s%*s", widthAddr, "Local Address:Port", widthArrow, "<-->",
+		widthAddr, "Peer Address:Port", widthConnections, "Connections")
+	if m.Processes {
+		h += "  Process"
+	}
+	return h
+}
+
+// tableLines returns the lines of the rows and the expanded sockets,
+// and the index of the line of the cursor.
+func (m *Model) tableLines() ([]line, int) {
+	var (
+		lines      []line
+		cursorLine int
+	)
+	for i, flow := range m.rows {
+		key := flow.UniqKey()
+		conns := fmt.Sprint(flow.Connections)
+		style := ""
+		switch {
+		case m.added[key]:
+			conns = "(new) " + conns
+			style = escChanged
+		case m.deltas[key] != 0:
+			conns = fmt.Sprintf("(%+d) %d", m.deltas[key], flow.Connections)
+			style = escChanged
+		}
+		text := fmt.Sprintf("%-*s%-*s%-*s%*s", widthAddr, m.addr(flow.Local), widthArrow, flow.Direction.Arrow(),
+			widthAddr, m.addr(flow.Peer), widthConnections, conns)
+		if m.Processes && flow.Process != nil {
+			text += fmt.Sprintf("  %s (pgid=%d)", flow.Process.Name, flow.Process.Pgid)
+		}
+		if i == m.cursor {
+			cursorLine = len(lines)
+			style += escReverse
+		}
+		lines = append(lines, line{text: text, style: style})
+
+		if !m.expanded[key] {
+			continue
+		}
+		if len(flow.Sockets) == 0 {
+			lines = append(lines, line{text: "  `- no sockets (not supported by the source)"})
+			continue
+		}
+		sockets := make([]string, 0, len(flow.Sockets))
+		for _, s := range flow.Sockets {
+			sockets = append(sockets, fmt.Sprintf("  `- %-*s %-*s %s", widthAddr-2, s.Local, widthAddr, s.Peer, s.State))
+		}
+		sort.Strings(sockets)
+		for _, s := range sockets {
+			lines = append(lines, line{text: s})
+		}
+	}
+	return lines, cursorLine
+}
@@ -0,0 +1,203 @@
+package top
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuuki/lstf/tcpflow"
+)
+
+func peers(m *Model) []string {
+	var ret []string
+	for _, f := range m.rows {
+		ret = append(ret, f.Peer.Addr.String())
+	}
+	return ret
+}
+
+func TestModel_sort(t *testing.T) {
+	flows := tcpflow.HostFlows{}
+	for peer, n := range map[string]int64{"10.0.0.1": 5, "10.0.0.2": 20, "10.0.0.3": 1} {
+		f := &tcpflow.HostFlow{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr(peer), 3306),
+			Connections: n,
+		}
+		flows[f.UniqKey()] = f
+	}
+	m := NewModel(true, false)
+	m.Update(flows, time.Now(), nil)
+
+	tests := []struct {
+		keys string
+		want []string
+	}{
+		{keys: "", want: []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"}},
+		{keys: "r", want: []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}},
+		{keys: "2", want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{keys: "r", want: []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}},
+	}
+	for _, tc := range tests {
+		for _, k := range ParseKeys([]byte(tc.keys)) {
+			m.HandleKey(k)
+		}
+		if got := peers(m); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("after %q, rows should be %v, but %v", tc.keys, tc.want, got)
+		}
+	}
+}
+
+func TestModel_filter(t *testing.T) {
+	flows := tcpflow.HostFlows{}
+	for peer, n := range map[string]int64{"10.0.0.1": 5, "10.0.0.2": 20} {
+		f := &tcpflow.HostFlow{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.MustParseAddr(peer), 3306),
+			Connections: n,
+		}
+		f.Peer.Name = "db-" + peer
+		flows[f.UniqKey()] = f
+	}
+	m := NewModel(false, false)
+	m.Update(flows, time.Now(), nil)
+
+	for _, k := range ParseKeys([]byte("/DB-10.0.0.1\r")) {
+		m.HandleKey(k)
+	}
+	if got := peers(m); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("rows should be filtered by the host name, but %v", got)
+	}
+
+	// numeric display matches the addresses only.
+	m.HandleKey(Key{Rune: 'n'})
+	if got := peers(m); len(got) != 0 {
+		t.Errorf("rows should be empty with numeric, but %v", got)
+	}
+
+	m.HandleKey(Key{Special: KeyEscape})
+	if got := peers(m); len(got) != 2 {
+		t.Errorf("filter should be cleared, but %v", got)
+	}
+}
+
+func TestModel_toggle(t *testing.T) {
+	m := NewModel(true, false)
+	if a := m.HandleKey(Key{Rune: 'p'}); a != ActionRefresh || !m.Processes {
+		t.Errorf("p should show processes and refresh, but %v", a)
+	}
+	if a := m.HandleKey(Key{Rune: 'p'}); a != ActionRedraw || m.Processes {
+		t.Errorf("p should hide processes and redraw, but %v", a)
+	}
+	if a := m.HandleKey(Key{Rune: 'n'}); a != ActionRefresh || m.Numeric {
+		t.Errorf("n should resolve names and refresh, but %v", a)
+	}
+	if a := m.HandleKey(Key{Rune: 'q'}); a != ActionQuit {
+		t.Errorf("q should quit, but %v", a)
+	}
+}
+
+func TestModel_render(t *testing.T) {
+	// the second update changes the connections to 10.0.0.1 and adds 10.0.0.3.
+	var updates []tcpflow.HostFlows
+	for _, counts := range []map[string]int64{
+		{"10.0.0.1": 5, "10.0.0.2": 20},
+		{"10.0.0.1": 8, "10.0.0.2": 20, "10.0.0.3": 1},
+	} {
+		flows := tcpflow.HostFlows{}
+		for peer, n := range counts {
+			f := &tcpflow.HostFlow{
+				Direction:   tcpflow.FlowActive,
+				Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+				Peer:        tcpflow.NewAddrPort(netip.MustParseAddr(peer), 3306),
+				Connections: n,
+				Process:     &tcpflow.Process{Name: "app-" + peer, Pgid: 100},
+			}
+			if peer == "10.0.0.2" {
+				f.Sockets = []*tcpflow.Socket{{
+					Local: netip.MustParseAddrPort("10.0.1.9:40001"),
+					Peer:  netip.MustParseAddrPort("10.0.0.2:3306"),
+					State: "ESTAB",
+				}}
+			}
+			flows[f.UniqKey()] = f
+		}
+		updates = append(updates, flows)
+	}
+	m := NewModel(true, true)
+	at := time.Date(2020, 9, 13, 12, 26, 40, 0, time.Local)
+	m.Update(updates[0], at, nil)
+	m.Update(updates[1], at.Add(time.Second), nil)
+	m.HandleKey(Key{Special: KeyEnter}) // expand the first row
+
+	var buf bytes.Buffer
+	m.Render(&buf, 200, 24)
+	out := buf.String()
+
+	for _, want := range []string{
+		"lstf top - 12:26:41  flows: 3/3  sort: connections (desc)",
+		escReverse + "10.0.1.9:many",
+		"`- 10.0.1.9:40001",
+		"ESTAB",
+		escChanged + fmt.Sprintf("%-*s-->  10.0.0.1:3306", widthAddr, "10.0.1.9:many"),
+		"(+3) 8",
+		"(new) 1",
+		"app-10.0.0.1 (pgid=100)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("screen should contain %q, but\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "\r\n") != 23 {
+		t.Errorf("screen should have 24 lines, but %d", strings.Count(out, "\r\n")+1)
+	}
+
+	// an error keeps the last flows.
+	m.Update(nil, at.Add(2*time.Second), errors.New("netlink failed"))
+	buf.Reset()
+	m.Render(&buf, 200, 24)
+	if out := buf.String(); !strings.Contains(out, "error: netlink failed") || !strings.Contains(out, "flows: 3/3") {
+		t.Errorf("screen should show the error and the last flows, but\n%s", out)
+	}
+}
+
+func TestModel_scroll(t *testing.T) {
+	flows := tcpflow.HostFlows{}
+	for i := 1; i <= 30; i++ {
+		f := &tcpflow.HostFlow{
+			Direction:   tcpflow.FlowActive,
+			Local:       tcpflow.NewWildcardAddrPort(netip.MustParseAddr("10.0.1.9")),
+			Peer:        tcpflow.NewAddrPort(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 3306),
+			Connections: int64(i),
+		}
+		flows[f.UniqKey()] = f
+	}
+	m := NewModel(true, false)
+	m.Update(flows, time.Now(), nil)
+	for i := 0; i < 29; i++ {
+		m.HandleKey(Key{Special: KeyDown})
+	}
+	var buf bytes.Buffer
+	m.Render(&buf, 200, 10)
+	if !strings.Contains(buf.String(), escReverse+"10.0.1.9:many") || !strings.Contains(buf.String(), "10.0.0.1:3306") {
+		t.Errorf("screen should scroll to the cursor at the last row, but\n%s", buf.String())
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := ParseKeys([]byte("j\x1b[A\x1b[B\x1b[5~\x1b[6~\x1b[1;5C\r\x1b\x7f\x03"))
+	want := []Key{
+		{Rune: 'j'}, {Special: KeyUp}, {Special: KeyDown}, {Special: KeyPageUp}, {Special: KeyPageDown},
+		{Special: KeyEnter}, {Special: KeyEscape}, {Special: KeyBackspace}, {Special: KeyCtrlC},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keys should be %v, but %v", want, got)
+	}
+}